@@ -0,0 +1,103 @@
+// Command electrum-timeline prints the merged timeline of one request ID,
+// order, transaction or user, as returned by the /timeline endpoint of a
+// running electrum with admin.token set.
+package main
+
+import (
+	"electrum/internal"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	server := flag.String("url", "http://127.0.0.1:5100", "electrum base URL")
+	token := flag.String("token", os.Getenv("ADMIN_TOKEN"), "admin token")
+	request := flag.String("request", "", "request ID")
+	order := flag.Int("order", 0, "order number")
+	transaction := flag.Int("transaction", 0, "transaction ID")
+	user := flag.String("user", "", "user ID")
+	level := flag.String("level", "", "lowest level: debug, info, warning or error")
+	from := flag.String("from", "", "start time, RFC 3339")
+	to := flag.String("to", "", "end time, RFC 3339")
+	offset := flag.Int("offset", 0, "events to skip")
+	limit := flag.Int("limit", 0, "events to return; the server default if zero")
+	raw := flag.Bool("json", false, "print the response as returned")
+	flag.Parse()
+
+	if *token == "" {
+		log.Fatal("admin token is required (-token or ADMIN_TOKEN)")
+	}
+
+	values := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	setInt := func(name string, value int) {
+		if value != 0 {
+			values.Set(name, strconv.Itoa(value))
+		}
+	}
+	set("request_id", *request)
+	setInt("order", *order)
+	setInt("transaction", *transaction)
+	set("user", *user)
+	set("level", *level)
+	set("from", *from)
+	set("to", *to)
+	setInt("offset", *offset)
+	setInt("limit", *limit)
+
+	req, err := http.NewRequest(http.MethodGet, *server+"/timeline?"+values.Encode(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%s: %s", resp.Status, body)
+	}
+
+	if *raw {
+		os.Stdout.Write(body)
+		return
+	}
+	var response struct {
+		Data internal.TimelinePage `json:"data"`
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		log.Fatal(err)
+	}
+	page := response.Data
+	for _, event := range page.Events {
+		order := "-"
+		if event.Order != 0 {
+			order = strconv.Itoa(event.Order)
+		}
+		fmt.Printf("%s %-7s %-7s %-10s %s\n", event.Time.Format(time.RFC3339Nano), event.Source, event.Level, order, event.Text)
+	}
+	shown := page.Query.Offset + len(page.Events)
+	fmt.Printf("events %d-%d of %d", min(page.Query.Offset+1, shown), shown, page.Total)
+	if page.Truncated {
+		fmt.Print("; the timeline is truncated")
+	}
+	fmt.Println()
+}
@@ -0,0 +1,38 @@
+// Command redsys-sandbox runs a local fake of the Redsys REST endpoint.
+// Point electrum's merchant.request_url to http://<listen>/sis/rest/trataPeticionREST,
+// merchant.query_url to http://<listen>/sis/rest/consultaOperacionREST,
+// and use the same merchant secret in both.
+package main
+
+import (
+	"electrum/internal/sandbox"
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:5200", "address to listen on")
+	secret := flag.String("secret", os.Getenv("MERCHANT_SECRET"), "Base64 merchant secret used to verify and sign messages")
+	notify := flag.String("notify", "http://127.0.0.1:5100/notify", "electrum notify URL; empty to disable notifications")
+	script := flag.String("script", "", "path to a JSON file with scripted outcomes")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("merchant secret is required (-secret or MERCHANT_SECRET)")
+	}
+
+	server := sandbox.NewServer(*secret)
+	server.SetLogger(log.New(os.Stderr, "sandbox: ", log.LstdFlags))
+	server.SetNotifyUrl(*notify)
+	if *script != "" {
+		if err := server.LoadScript(*script); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("redsys sandbox listening on %s%s, queries on %s", *listen, sandbox.RequestPath, sandbox.QueryPath)
+	if err := server.Listen(*listen); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/ilyakaznacheev/cleanenv"
 	"sync"
+	"time"
 )
 
 // Config holds all configuration for the Electrum payment service.
@@ -16,14 +17,30 @@ type Config struct {
 	DisablePayment bool   `yaml:"disable_payment" env:"DISABLE_PAYMENT" env-default:"false"`
 	LogRecords     int64  `yaml:"log_records" env:"LOG_RECORDS" env-default:"0"`
 	FirebaseKey    string `yaml:"firebase_key" env:"FIREBASE_KEY" env-default:""`
-	Listen         struct {
+	// ShutdownTimeout limits the time to drain requests and payment jobs on exit
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" env-default:"30s"`
+	Listen          struct {
 		Type     string `yaml:"type" env:"LISTEN_TYPE" env-default:"port"`
 		BindIP   string `yaml:"bind_ip" env:"BIND_IP" env-default:"0.0.0.0"`
 		Port     string `yaml:"port" env:"PORT" env-default:"5100"`
 		TLS      bool   `yaml:"tls_enabled" env:"TLS_ENABLED" env-default:"false"`
 		CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE" env-default:""`
 		KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE" env-default:""`
+		// RequestIdHeader carries the caller's request ID, which is echoed
+		// in the response; a missing or invalid one is replaced by a new ID
+		RequestIdHeader string `yaml:"request_id_header" env:"REQUEST_ID_HEADER" env-default:"X-Request-ID"`
 	} `yaml:"listen"`
+	Database struct {
+		// Type selects the storage: mongo, sqlite, postgres, or memory for local
+		// development and demos
+		Type string `yaml:"type" env:"DATABASE_TYPE" env-default:"mongo"`
+		// DSN locates the SQL database: the file path for sqlite, the connection
+		// URL for postgres
+		DSN string `yaml:"dsn" env:"DATABASE_DSN" env-default:""`
+		// Snapshot is the JSON file the memory database is loaded from and saved to
+		Snapshot         string        `yaml:"snapshot" env:"DATABASE_SNAPSHOT" env-default:""`
+		SnapshotInterval time.Duration `yaml:"snapshot_interval" env:"DATABASE_SNAPSHOT_INTERVAL" env-default:"1m"`
+	} `yaml:"database"`
 	Mongo struct {
 		Enabled  bool   `yaml:"enabled" env:"MONGO_ENABLED" env-default:"false"`
 		Host     string `yaml:"host" env:"MONGO_HOST" env-default:"127.0.0.1"`
@@ -31,13 +48,115 @@ type Config struct {
 		User     string `yaml:"user" env:"MONGO_USER" env-default:"admin"`
 		Password string `yaml:"password" env:"MONGO_PASSWORD" env-default:"pass"`
 		Database string `yaml:"database" env:"MONGO_DATABASE" env-default:""`
+		// ManageSchema creates the indexes electrum needs and applies data
+		// migrations at startup
+		ManageSchema bool `yaml:"manage_schema" env:"MONGO_MANAGE_SCHEMA" env-default:"true"`
 	} `yaml:"mongo"`
 	Merchant struct {
 		Secret     string `yaml:"secret" env:"MERCHANT_SECRET" env-default:""`
 		Code       string `yaml:"code" env:"MERCHANT_CODE" env-default:""`
 		Terminal   string `yaml:"terminal" env:"MERCHANT_TERMINAL" env-default:""`
 		RequestUrl string `yaml:"request_url" env:"MERCHANT_REQUEST_URL" env-default:"https://sis-t.redsys.es:25443/sis/rest/trataPeticionREST"`
+		QueryUrl   string `yaml:"query_url" env:"MERCHANT_QUERY_URL" env-default:""`
 	} `yaml:"merchant"`
+	Gateway struct {
+		Type string `yaml:"type" env:"GATEWAY_TYPE" env-default:"redsys"`
+		// a request times out after a multiple of the recent gateway latency,
+		// kept between the minimum and the maximum
+		TimeoutMin time.Duration `yaml:"timeout_min" env:"GATEWAY_TIMEOUT_MIN" env-default:"5s"`
+		TimeoutMax time.Duration `yaml:"timeout_max" env:"GATEWAY_TIMEOUT_MAX" env-default:"30s"`
+		// JobTimeout limits a background gateway job, including database updates
+		JobTimeout          time.Duration `yaml:"job_timeout" env:"GATEWAY_JOB_TIMEOUT" env-default:"60s"`
+		MaxIdleConns        int           `yaml:"max_idle_conns" env:"GATEWAY_MAX_IDLE_CONNS" env-default:"100"`
+		MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host" env:"GATEWAY_MAX_IDLE_CONNS_PER_HOST" env-default:"10"`
+		MaxConnsPerHost     int           `yaml:"max_conns_per_host" env:"GATEWAY_MAX_CONNS_PER_HOST" env-default:"20"`
+		IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout" env:"GATEWAY_IDLE_CONN_TIMEOUT" env-default:"90s"`
+		// RetryLimit is the number of times a request deferred while the gateway
+		// is unavailable, or lost in transport, is tried again
+		RetryLimit int `yaml:"retry_limit" env:"GATEWAY_RETRY_LIMIT" env-default:"3"`
+		// RetryBackoff is the delay before the first retry after a transport
+		// failure; it doubles with every further retry
+		RetryBackoff time.Duration `yaml:"retry_backoff" env:"GATEWAY_RETRY_BACKOFF" env-default:"2s"`
+		Breaker      struct {
+			Enabled          bool          `yaml:"enabled" env:"GATEWAY_BREAKER_ENABLED" env-default:"true"`
+			FailureThreshold int           `yaml:"failure_threshold" env:"GATEWAY_BREAKER_FAILURE_THRESHOLD" env-default:"5"`
+			OpenTimeout      time.Duration `yaml:"open_timeout" env:"GATEWAY_BREAKER_OPEN_TIMEOUT" env-default:"30s"`
+			HalfOpenRequests int           `yaml:"half_open_requests" env:"GATEWAY_BREAKER_HALF_OPEN_REQUESTS" env-default:"1"`
+		} `yaml:"breaker"`
+	} `yaml:"gateway"`
+	Sync struct {
+		// Wait is the longest a synchronous payment waits for the gateway outcome
+		Wait time.Duration `yaml:"wait" env:"SYNC_WAIT" env-default:"15s"`
+		// Clients are the addresses or CIDR networks of the callers paid
+		// synchronously without asking for it with ?wait=true
+		Clients []string `yaml:"clients" env:"SYNC_CLIENTS"`
+	} `yaml:"sync"`
+	Metrics struct {
+		// Enabled serves the Prometheus metrics on /metrics
+		Enabled bool `yaml:"enabled" env:"METRICS_ENABLED" env-default:"true"`
+	} `yaml:"metrics"`
+	Health struct {
+		// CheckTimeout limits the database ping of a readiness check
+		CheckTimeout time.Duration `yaml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT" env-default:"2s"`
+		// CertWarning is how long before expiry the TLS certificate is reported
+		CertWarning time.Duration `yaml:"cert_warning" env:"HEALTH_CERT_WARNING" env-default:"168h"`
+	} `yaml:"health"`
+	Tracing struct {
+		Enabled bool `yaml:"enabled" env:"TRACING_ENABLED" env-default:"false"`
+		// Exporter of the spans: otlp (OTLP/HTTP with protobuf), stdout or file
+		Exporter string `yaml:"exporter" env:"TRACING_EXPORTER" env-default:"otlp"`
+		// Endpoint receives the spans of the otlp exporter
+		Endpoint string `yaml:"endpoint" env:"TRACING_ENDPOINT" env-default:"http://127.0.0.1:4318/v1/traces"`
+		// File receives the spans of the file exporter, one JSON line per span
+		File        string `yaml:"file" env:"TRACING_FILE" env-default:""`
+		ServiceName string `yaml:"service_name" env:"TRACING_SERVICE_NAME" env-default:"electrum"`
+		// SampleRatio is the share of new traces exported; traces started by
+		// callers follow their sampling decision
+		SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" env-default:"1"`
+	} `yaml:"tracing"`
+	Admin struct {
+		// Token authorizes the admin endpoints as a bearer token; empty
+		// disables them
+		Token string `yaml:"token" env:"ADMIN_TOKEN" env-default:""`
+	} `yaml:"admin"`
+	Lock struct {
+		Type           string        `yaml:"type" env:"LOCK_TYPE" env-default:"memory"`
+		TTL            time.Duration `yaml:"ttl" env:"LOCK_TTL" env-default:"60s"`
+		Owner          string        `yaml:"owner" env:"LOCK_OWNER" env-default:""`
+		AcquireTimeout time.Duration `yaml:"acquire_timeout" env:"LOCK_ACQUIRE_TIMEOUT" env-default:"30s"`
+	} `yaml:"lock"`
+	Log struct {
+		// Format of the console output: console or json
+		Format string `yaml:"format" env:"LOG_FORMAT" env-default:"console"`
+		// Buffer holds log messages until they are written in batches
+		Buffer struct {
+			Size int `yaml:"size" env:"LOG_BUFFER_SIZE" env-default:"10000"`
+			// Policy when the buffer is full: drop the message, or block the caller
+			Policy        string        `yaml:"policy" env:"LOG_BUFFER_POLICY" env-default:"drop"`
+			BatchSize     int           `yaml:"batch_size" env:"LOG_BUFFER_BATCH_SIZE" env-default:"100"`
+			FlushInterval time.Duration `yaml:"flush_interval" env:"LOG_BUFFER_FLUSH_INTERVAL" env-default:"1s"`
+			WriteTimeout  time.Duration `yaml:"write_timeout" env:"LOG_BUFFER_WRITE_TIMEOUT" env-default:"5s"`
+		} `yaml:"buffer"`
+		Retention struct {
+			Enabled bool `yaml:"enabled" env:"LOG_RETENTION_ENABLED" env-default:"false"`
+			// Capped keeps at most log_records records; mongo creates the log
+			// as a capped collection of CappedSize bytes, by default 1 KB per record
+			Capped     bool  `yaml:"capped" env:"LOG_RETENTION_CAPPED" env-default:"false"`
+			CappedSize int64 `yaml:"capped_size" env:"LOG_RETENTION_CAPPED_SIZE" env-default:"0"`
+			// TTL by level deletes older records; zero keeps them
+			TTL struct {
+				Debug   time.Duration `yaml:"debug" env:"LOG_RETENTION_TTL_DEBUG" env-default:"168h"`
+				Info    time.Duration `yaml:"info" env:"LOG_RETENTION_TTL_INFO" env-default:"720h"`
+				Warning time.Duration `yaml:"warning" env:"LOG_RETENTION_TTL_WARNING" env-default:"2160h"`
+				Error   time.Duration `yaml:"error" env:"LOG_RETENTION_TTL_ERROR" env-default:"8760h"`
+			} `yaml:"ttl"`
+			Interval  time.Duration `yaml:"interval" env:"LOG_RETENTION_INTERVAL" env-default:"1h"`
+			BatchSize int           `yaml:"batch_size" env:"LOG_RETENTION_BATCH_SIZE" env-default:"1000"`
+			// ArchiveDir receives the deleted records as gzip compressed JSON
+			// lines files; empty deletes them without archiving
+			ArchiveDir string `yaml:"archive_dir" env:"LOG_RETENTION_ARCHIVE_DIR" env-default:""`
+		} `yaml:"retention"`
+	} `yaml:"log"`
 }
 
 var instance *Config
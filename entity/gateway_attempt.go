@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// Outcomes of a gateway attempt.
+const (
+	AttemptAnswered       = "answered"        // the gateway returned a result
+	AttemptRejected       = "rejected"        // the gateway rejected the request
+	AttemptTransportError = "transport_error" // no answer; the request may or may not have been processed
+	AttemptUnavailable    = "unavailable"     // not sent, the gateway is considered down
+	AttemptFound          = "query_found"     // a status query found the result
+	AttemptNoRecord       = "query_no_record" // a status query found no record, the request is resent
+	AttemptQueryFailed    = "query_failed"    // the status of the request remains unknown
+)
+
+// GatewayAttempt records one call to the gateway made for an operation of the order.
+type GatewayAttempt struct {
+	Operation string    `json:"operation" bson:"operation"`
+	Attempt   int       `json:"attempt" bson:"attempt"`
+	Outcome   string    `json:"outcome" bson:"outcome"`
+	Code      string    `json:"code,omitempty" bson:"code,omitempty"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+	Time      time.Time `json:"time" bson:"time"`
+}
@@ -27,4 +27,6 @@ type MerchantParameters struct {
 	CofType string `json:"DS_MERCHANT_COF_TYPE"`
 	// CofTid: Network transaction ID from initial authorization (links MIT to original CIT)
 	CofTid string `json:"DS_MERCHANT_COF_TXNID"`
+	// MerchantData: free data returned in the response and notification as Ds_MerchantData
+	MerchantData string `json:"DS_MERCHANT_MERCHANTDATA,omitempty"`
 }
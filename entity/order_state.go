@@ -0,0 +1,96 @@
+package entity
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OrderState is the lifecycle state of a payment order.
+type OrderState string
+
+const (
+	OrderCreated           OrderState = "created"
+	OrderSent              OrderState = "sent"
+	OrderDeferred          OrderState = "deferred"
+	OrderAuthorized        OrderState = "authorized"
+	OrderDeclined          OrderState = "declined"
+	OrderErrored           OrderState = "errored"
+	OrderTimedOut          OrderState = "timed_out"
+	OrderHeld              OrderState = "held"
+	OrderCaptured          OrderState = "captured"
+	OrderVoided            OrderState = "voided"
+	OrderPartiallyRefunded OrderState = "partially_refunded"
+	OrderRefunded          OrderState = "refunded"
+)
+
+// orderTransitions lists the states reachable from each state.
+// A timed out order may still receive a late gateway result. A deferred order
+// was not sent because the gateway was unavailable, and is sent again later.
+var orderTransitions = map[OrderState][]OrderState{
+	OrderCreated:           {OrderSent, OrderErrored, OrderTimedOut, OrderDeferred},
+	OrderSent:              {OrderAuthorized, OrderDeclined, OrderErrored, OrderTimedOut, OrderHeld, OrderDeferred},
+	OrderDeferred:          {OrderSent, OrderErrored, OrderTimedOut},
+	OrderTimedOut:          {OrderAuthorized, OrderDeclined, OrderHeld},
+	OrderHeld:              {OrderCaptured, OrderVoided, OrderTimedOut},
+	OrderAuthorized:        {OrderPartiallyRefunded, OrderRefunded},
+	OrderCaptured:          {OrderPartiallyRefunded, OrderRefunded},
+	OrderPartiallyRefunded: {OrderPartiallyRefunded, OrderRefunded},
+}
+
+// CanTransition reports whether an order in state s may move to the given state.
+func (s OrderState) CanTransition(to OrderState) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOpen reports whether the order still waits for a gateway result.
+func (s OrderState) IsOpen() bool {
+	return s == OrderCreated || s == OrderSent || s == OrderDeferred || s == OrderHeld
+}
+
+// OrderStateChange is an entry of the order state history.
+type OrderStateChange struct {
+	From OrderState `json:"from" bson:"from"`
+	To   OrderState `json:"to" bson:"to"`
+	Note string     `json:"note" bson:"note"`
+	Time time.Time  `json:"time" bson:"time"`
+}
+
+// TransitionError is returned for a state change not allowed by the state machine.
+type TransitionError struct {
+	Order int
+	From  OrderState
+	To    OrderState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %d: illegal state transition %s -> %s", e.Order, e.From, e.To)
+}
+
+// legacyState derives the state of an order saved before states were recorded,
+// from the completion flag and the free-text result.
+func legacyState(o *PaymentOrder) OrderState {
+	switch {
+	case !o.IsCompleted:
+		return OrderSent
+	case o.Result == "closed without response":
+		return OrderTimedOut
+	case o.Result == "0000 by electrum":
+		if o.RefundAmount > 0 && o.RefundAmount >= o.Amount {
+			return OrderRefunded
+		}
+		if o.RefundAmount > 0 {
+			return OrderPartiallyRefunded
+		}
+		return OrderAuthorized
+	case strings.HasSuffix(o.Result, " by electrum"):
+		return OrderDeclined
+	default:
+		return OrderErrored
+	}
+}
@@ -0,0 +1,130 @@
+package entity
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderTransition(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      []OrderState
+		to        OrderState
+		allowed   bool
+		completed bool
+	}{
+		{"send a created order", nil, OrderSent, true, false},
+		{"defer a created order", nil, OrderDeferred, true, false},
+		{"authorize a sent order", []OrderState{OrderSent}, OrderAuthorized, true, true},
+		{"decline a sent order", []OrderState{OrderSent}, OrderDeclined, true, true},
+		{"hold a sent order", []OrderState{OrderSent}, OrderHeld, true, false},
+		{"capture a held order", []OrderState{OrderSent, OrderHeld}, OrderCaptured, true, true},
+		{"void a held order", []OrderState{OrderSent, OrderHeld}, OrderVoided, true, true},
+		{"resend a deferred order", []OrderState{OrderDeferred}, OrderSent, true, false},
+		{"late result of a timed out order", []OrderState{OrderSent, OrderTimedOut}, OrderAuthorized, true, true},
+		{"refund in parts", []OrderState{OrderSent, OrderAuthorized, OrderPartiallyRefunded}, OrderPartiallyRefunded, true, true},
+		{"refund the rest", []OrderState{OrderSent, OrderAuthorized, OrderPartiallyRefunded}, OrderRefunded, true, true},
+		{"authorize a created order", nil, OrderAuthorized, false, false},
+		{"refund a declined order", []OrderState{OrderSent, OrderDeclined}, OrderRefunded, false, true},
+		{"reopen an authorized order", []OrderState{OrderSent, OrderAuthorized}, OrderSent, false, true},
+		{"refund a refunded order", []OrderState{OrderSent, OrderAuthorized, OrderRefunded}, OrderPartiallyRefunded, false, true},
+		{"time out an errored order", []OrderState{OrderErrored}, OrderTimedOut, false, true},
+		{"void a captured order", []OrderState{OrderSent, OrderHeld, OrderCaptured}, OrderVoided, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order := PaymentOrder{Order: 1}
+			order.Create("test")
+			for _, state := range test.path {
+				if err := order.Transition(state, "setup"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			from := order.CurrentState()
+			history := len(order.StateHistory)
+
+			err := order.Transition(test.to, "test")
+			if !test.allowed {
+				var transitionError *TransitionError
+				if !errors.As(err, &transitionError) || transitionError.From != from || transitionError.To != test.to {
+					t.Fatalf("error = %v, want transition error %s -> %s", err, from, test.to)
+				}
+				if order.CurrentState() != from || len(order.StateHistory) != history {
+					t.Errorf("refused transition changed the order to %s", order.CurrentState())
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				last := order.StateHistory[len(order.StateHistory)-1]
+				if order.CurrentState() != test.to || last.From != from || last.To != test.to {
+					t.Errorf("state %s, last change %s -> %s", order.CurrentState(), last.From, last.To)
+				}
+			}
+			if order.IsCompleted != test.completed {
+				t.Errorf("completed = %v, want %v", order.IsCompleted, test.completed)
+			}
+		})
+	}
+}
+
+func TestLegacyState(t *testing.T) {
+	tests := []struct {
+		name  string
+		order PaymentOrder
+		state OrderState
+	}{
+		{"open", PaymentOrder{}, OrderSent},
+		{"closed without response", PaymentOrder{IsCompleted: true, Result: "closed without response"}, OrderTimedOut},
+		{"authorized", PaymentOrder{IsCompleted: true, Amount: 500, Result: "0000 by electrum"}, OrderAuthorized},
+		{"partially refunded", PaymentOrder{IsCompleted: true, Amount: 500, RefundAmount: 200, Result: "0000 by electrum"}, OrderPartiallyRefunded},
+		{"refunded", PaymentOrder{IsCompleted: true, Amount: 500, RefundAmount: 500, Result: "0000 by electrum"}, OrderRefunded},
+		{"declined", PaymentOrder{IsCompleted: true, Result: "0190 by electrum"}, OrderDeclined},
+		{"errored", PaymentOrder{IsCompleted: true, Result: "SIS0054"}, OrderErrored},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if state := test.order.CurrentState(); state != test.state {
+				t.Errorf("state = %s, want %s", state, test.state)
+			}
+		})
+	}
+}
+
+func TestOrderRefunds(t *testing.T) {
+	order := PaymentOrder{Amount: 1000, IsCompleted: true, Result: "0000 by electrum", RefundAmount: 100}
+
+	order.AddRefund(Refund{Amount: 300})
+	order.AddRefund(Refund{Amount: 300})
+	if len(order.Refunds) != 3 || order.Refunds[0].Status != RefundCompleted {
+		t.Fatalf("legacy refund not kept as the first entry: %+v", order.Refunds)
+	}
+	if refundable := order.Refundable(); refundable != 300 {
+		t.Errorf("refundable = %d, want 300", refundable)
+	}
+
+	if !order.CloseRefund(300, RefundCompleted, "0000", "A1") {
+		t.Fatal("pending refund not closed")
+	}
+	if order.Refunds[1].Status != RefundCompleted || order.Refunds[2].Status != RefundPending {
+		t.Errorf("closed refund is not the oldest pending one: %+v", order.Refunds)
+	}
+	if order.RefundAmount != 400 {
+		t.Errorf("refund amount = %d, want 400", order.RefundAmount)
+	}
+
+	if !order.CloseRefund(300, RefundFailed, "0950", "") {
+		t.Fatal("second refund not closed")
+	}
+	if order.CloseRefund(300, RefundCompleted, "0000", "") {
+		t.Error("closed a refund that is not pending")
+	}
+	if order.RefundAmount != 400 || order.Refundable() != 600 {
+		t.Errorf("after a failed refund: refund amount %d, refundable %d", order.RefundAmount, order.Refundable())
+	}
+	if !order.HasCompletedRefund(300, "A1") || order.HasCompletedRefund(300, "B2") || order.HasPendingRefund(300) {
+		t.Error("refund lookups do not match the recorded refunds")
+	}
+}
@@ -3,19 +3,172 @@ package entity
 import "time"
 
 type PaymentOrder struct {
-	TransactionId int       `json:"transaction_id" bson:"transaction_id"`
-	Order         int       `json:"order" bson:"order"`
-	UserId        string    `json:"user_id" bson:"user_id"`
-	UserName      string    `json:"user_name" bson:"user_name"`
-	Amount        int       `json:"amount" bson:"amount"`
-	Currency      string    `json:"currency" bson:"currency"`
-	Description   string    `json:"description" bson:"description"`
-	Identifier    string    `json:"identifier" bson:"identifier"`
-	IsCompleted   bool      `json:"is_completed" bson:"is_completed"`
-	Result        string    `json:"result" bson:"result"`
-	Date          string    `json:"date" bson:"date"`
-	TimeOpened    time.Time `json:"time_opened" bson:"time_opened"`
-	TimeClosed    time.Time `json:"time_closed" bson:"time_closed"`
-	RefundAmount  int       `json:"refund_amount" bson:"refund_amount"`
-	RefundTime    time.Time `json:"refund_time" bson:"refund_time"`
+	TransactionId int                `json:"transaction_id" bson:"transaction_id"`
+	Order         int                `json:"order" bson:"order"`
+	UserId        string             `json:"user_id" bson:"user_id"`
+	UserName      string             `json:"user_name" bson:"user_name"`
+	Amount        int                `json:"amount" bson:"amount"`
+	Captured      int                `json:"captured" bson:"captured"`
+	Currency      string             `json:"currency" bson:"currency"`
+	Description   string             `json:"description" bson:"description"`
+	Identifier    string             `json:"identifier" bson:"identifier"`
+	IsCompleted   bool               `json:"is_completed" bson:"is_completed"`
+	State         OrderState         `json:"state" bson:"state"`
+	StateHistory  []OrderStateChange `json:"state_history" bson:"state_history"`
+	Result        string             `json:"result" bson:"result"`
+	Date          string             `json:"date" bson:"date"`
+	TimeOpened    time.Time          `json:"time_opened" bson:"time_opened"`
+	TimeClosed    time.Time          `json:"time_closed" bson:"time_closed"`
+	RefundAmount  int                `json:"refund_amount" bson:"refund_amount"`
+	RefundTime    time.Time          `json:"refund_time" bson:"refund_time"`
+	Refunds       []Refund           `json:"refunds" bson:"refunds"`
+	Attempts      []GatewayAttempt   `json:"attempts" bson:"attempts"`
+	// RequestId is the request that opened the order; it is sent to the
+	// gateway as merchant data and comes back in the notification.
+	RequestId string `json:"request_id" bson:"request_id"`
+	// Version is incremented by every save; a save made with an outdated
+	// version is rejected. Documents without it are at version 0.
+	Version int64 `json:"version" bson:"version"`
+}
+
+// CapturedAmount returns the amount charged by the order. For orders saved before
+// the captured amount was recorded, it is the amount of an authorized order.
+func (o *PaymentOrder) CapturedAmount() int {
+	if o.Captured > 0 {
+		return o.Captured
+	}
+	switch o.CurrentState() {
+	case OrderAuthorized, OrderCaptured, OrderPartiallyRefunded, OrderRefunded:
+		return o.Amount
+	}
+	return 0
+}
+
+// CurrentState returns the order state, deriving it for orders saved before
+// states were recorded.
+func (o *PaymentOrder) CurrentState() OrderState {
+	if o.State == "" {
+		return legacyState(o)
+	}
+	return o.State
+}
+
+// Create puts a new order in the created state.
+func (o *PaymentOrder) Create(note string) {
+	o.State = OrderCreated
+	o.IsCompleted = false
+	o.StateHistory = []OrderStateChange{{To: OrderCreated, Note: note, Time: time.Now()}}
+}
+
+// Transition moves the order to another state and records the change in the
+// history. IsCompleted is kept in sync for queries on open orders.
+// Returns a *TransitionError if the change is not allowed.
+func (o *PaymentOrder) Transition(to OrderState, note string) error {
+	from := o.CurrentState()
+	if !from.CanTransition(to) {
+		return &TransitionError{Order: o.Order, From: from, To: to}
+	}
+	o.State = to
+	o.IsCompleted = !to.IsOpen()
+	o.StateHistory = append(o.StateHistory, OrderStateChange{
+		From: from,
+		To:   to,
+		Note: note,
+		Time: time.Now(),
+	})
+	return nil
+}
+
+// RefundedTotal returns the amount of refunds that are completed or still in flight.
+// Refunds made before refunds were listed are represented by RefundAmount.
+func (o *PaymentOrder) RefundedTotal() int {
+	if len(o.Refunds) == 0 {
+		return o.RefundAmount
+	}
+	total := 0
+	for _, refund := range o.Refunds {
+		if refund.Status != RefundFailed {
+			total += refund.Amount
+		}
+	}
+	return total
+}
+
+// Refundable returns the captured amount that is not refunded or being refunded.
+func (o *PaymentOrder) Refundable() int {
+	return o.CapturedAmount() - o.RefundedTotal()
+}
+
+// AddRefund appends a pending refund, keeping a refund recorded only in
+// RefundAmount as the first completed entry.
+func (o *PaymentOrder) AddRefund(refund Refund) {
+	if len(o.Refunds) == 0 && o.RefundAmount > 0 {
+		o.Refunds = append(o.Refunds, Refund{
+			Amount:     o.RefundAmount,
+			Status:     RefundCompleted,
+			Time:       o.RefundTime,
+			TimeClosed: o.RefundTime,
+		})
+	}
+	refund.Status = RefundPending
+	o.Refunds = append(o.Refunds, refund)
+}
+
+// CloseRefund sets the result of the oldest pending refund with the amount and
+// updates RefundAmount to the completed total. Returns false if there is no such refund.
+func (o *PaymentOrder) CloseRefund(amount int, status, result, authorisationCode string) bool {
+	for i := range o.Refunds {
+		refund := &o.Refunds[i]
+		if refund.Amount != amount || refund.Status != RefundPending {
+			continue
+		}
+		refund.Status = status
+		refund.Result = result
+		refund.AuthorisationCode = authorisationCode
+		refund.TimeClosed = time.Now()
+
+		completed := 0
+		for _, r := range o.Refunds {
+			if r.Status == RefundCompleted {
+				completed += r.Amount
+			}
+		}
+		o.RefundAmount = completed
+		if status == RefundCompleted {
+			o.RefundTime = refund.TimeClosed
+		}
+		return true
+	}
+	return false
+}
+
+// HasPendingRefund reports whether a pending refund with the amount exists.
+func (o *PaymentOrder) HasPendingRefund(amount int) bool {
+	for _, refund := range o.Refunds {
+		if refund.Status == RefundPending && refund.Amount == amount {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCompletedRefund reports whether a completed refund with the amount exists.
+// When the authorisation code is known, it must match as well.
+func (o *PaymentOrder) HasCompletedRefund(amount int, authorisationCode string) bool {
+	for _, refund := range o.Refunds {
+		if refund.Status != RefundCompleted || refund.Amount != amount {
+			continue
+		}
+		if authorisationCode == "" || refund.AuthorisationCode == authorisationCode {
+			return true
+		}
+	}
+	return false
+}
+
+// AddAttempt appends a gateway attempt, numbered in the order of the attempts.
+func (o *PaymentOrder) AddAttempt(attempt GatewayAttempt) {
+	attempt.Attempt = len(o.Attempts) + 1
+	attempt.Time = time.Now()
+	o.Attempts = append(o.Attempts, attempt)
 }
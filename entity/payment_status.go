@@ -0,0 +1,66 @@
+package entity
+
+import "strings"
+
+// Categories of the outcome of a payment order.
+const (
+	PaymentApproved = "approved" // charged, or refunded after the charge
+	PaymentHeld     = "held"     // funds reserved, not charged yet
+	PaymentDeclined = "declined" // declined by the issuer, or a hold was released
+	PaymentFailed   = "failed"   // rejected by the gateway, abandoned or closed without a result
+	PaymentPending  = "pending"  // waiting for the gateway
+)
+
+// PaymentStatus is the outcome of a payment order as reported to callers.
+type PaymentStatus struct {
+	Order         int        `json:"order"`
+	TransactionId int        `json:"transaction_id"`
+	State         OrderState `json:"state"`
+	Category      string     `json:"category"`
+	Code          string     `json:"code,omitempty"` // gateway response code
+	Amount        int        `json:"amount"`
+	Billed        int        `json:"billed"`
+}
+
+// Status returns the outcome of the order.
+func (o *PaymentOrder) Status() *PaymentStatus {
+	state := o.CurrentState()
+	return &PaymentStatus{
+		Order:         o.Order,
+		TransactionId: o.TransactionId,
+		State:         state,
+		Category:      stateCategory(state),
+		Code:          o.ResponseCode(),
+		Amount:        o.Amount,
+		Billed:        o.CapturedAmount(),
+	}
+}
+
+// ResponseCode returns the code of the applied gateway result, from a
+// response or a notification, or else of the last gateway answer, such as
+// the error code of a rejected request.
+func (o *PaymentOrder) ResponseCode() string {
+	if code, ok := strings.CutSuffix(o.Result, " by electrum"); ok {
+		return code
+	}
+	for i := len(o.Attempts) - 1; i >= 0; i-- {
+		if code := o.Attempts[i].Code; code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+func stateCategory(state OrderState) string {
+	switch state {
+	case OrderAuthorized, OrderCaptured, OrderPartiallyRefunded, OrderRefunded:
+		return PaymentApproved
+	case OrderHeld:
+		return PaymentHeld
+	case OrderDeclined, OrderVoided:
+		return PaymentDeclined
+	case OrderErrored, OrderTimedOut:
+		return PaymentFailed
+	}
+	return PaymentPending
+}
@@ -0,0 +1,29 @@
+package entity
+
+import "time"
+
+const (
+	RefundPending   = "pending"
+	RefundCompleted = "completed"
+	RefundFailed    = "failed"
+)
+
+// Refund is a refund requested against a payment order.
+type Refund struct {
+	Amount            int       `json:"amount" bson:"amount"`
+	Status            string    `json:"status" bson:"status"`
+	Reason            string    `json:"reason" bson:"reason"`
+	Operator          string    `json:"operator" bson:"operator"`
+	AuthorisationCode string    `json:"authorisation_code" bson:"authorisation_code"`
+	RequestId         string    `json:"request_id" bson:"request_id"`
+	Result            string    `json:"result" bson:"result"`
+	Time              time.Time `json:"time" bson:"time"`
+	TimeClosed        time.Time `json:"time_closed" bson:"time_closed"`
+}
+
+// RefundRequest is the body of a refund request for an order.
+type RefundRequest struct {
+	Amount   int    `json:"amount"`
+	Reason   string `json:"reason"`
+	Operator string `json:"operator"`
+}
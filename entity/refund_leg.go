@@ -0,0 +1,13 @@
+package entity
+
+import "time"
+
+// RefundLeg is the part of a transaction refund sent against one payment order.
+type RefundLeg struct {
+	Order      int       `json:"order" bson:"order"`
+	Amount     int       `json:"amount" bson:"amount"`
+	Status     string    `json:"status" bson:"status"`
+	Result     string    `json:"result" bson:"result"`
+	TimeOpened time.Time `json:"time_opened" bson:"time_opened"`
+	TimeClosed time.Time `json:"time_closed" bson:"time_closed"`
+}
@@ -31,7 +31,11 @@ type Transaction struct {
 	MeterValues   []TransactionMeter `json:"meter_values" bson:"meter_values"`
 	PaymentMethod *PaymentMethod     `json:"payment_method,omitempty" bson:"payment_method"`
 	PaymentOrders []PaymentOrder     `json:"payment_orders" bson:"payment_orders"`
+	RefundLegs    []RefundLeg        `json:"refund_legs" bson:"refund_legs"`
 	UserTag       *UserTag           `json:"user_tag,omitempty" bson:"user_tag"`
+	// Version is incremented by every payment update; updates made with an
+	// outdated version are rejected. Documents without it are at version 0.
+	Version int64 `json:"version" bson:"version"`
 
 	// mutex provides thread-safe access to transaction data.
 	// Changed from *sync.Mutex to sync.Mutex to ensure it's always initialized.
@@ -60,3 +64,18 @@ func (t *Transaction) AddOrder(order PaymentOrder) {
 	}
 	t.PaymentOrders = append(t.PaymentOrders, order)
 }
+
+// CloseRefundLeg sets the result of the oldest pending leg for the order and amount.
+// Returns false if there is no such leg.
+func (t *Transaction) CloseRefundLeg(order, amount int, status, result string) bool {
+	for i := range t.RefundLegs {
+		leg := &t.RefundLegs[i]
+		if leg.Order == order && leg.Amount == amount && leg.Status == RefundPending {
+			leg.Status = status
+			leg.Result = result
+			leg.TimeClosed = time.Now()
+			return true
+		}
+	}
+	return false
+}
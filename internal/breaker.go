@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerStats is a snapshot of a CircuitBreaker.
+type BreakerStats struct {
+	State      BreakerState `json:"state"`
+	Failures   int          `json:"failures"` // consecutive failures
+	Opened     int64        `json:"opened"`   // times the breaker opened
+	Rejected   int64        `json:"rejected"` // calls refused while open
+	LastError  string       `json:"last_error,omitempty"`
+	LastChange time.Time    `json:"last_change"`
+}
+
+// CircuitBreaker stops calls to a dependency after consecutive failures:
+//   - closed: calls pass; threshold consecutive failures open the breaker;
+//   - open: calls are refused until openTimeout has passed;
+//   - half open: up to halfOpenMax trial calls pass; a success closes the
+//     breaker, a failure opens it again.
+type CircuitBreaker struct {
+	mutex       sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	halfOpenMax int
+	state       BreakerState
+	failures    int
+	trials      int // trial calls in flight while half open
+	openedAt    time.Time
+	stats       BreakerStats
+	onChange    func(from, to BreakerState)
+}
+
+func NewCircuitBreaker(threshold int, openTimeout time.Duration, halfOpenMax int) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if openTimeout <= 0 {
+		openTimeout = 30 * time.Second
+	}
+	if halfOpenMax <= 0 {
+		halfOpenMax = 1
+	}
+	return &CircuitBreaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		halfOpenMax: halfOpenMax,
+		state:       BreakerClosed,
+		stats:       BreakerStats{State: BreakerClosed, LastChange: time.Now()},
+	}
+}
+
+// OnChange sets a function called on every state change, with the breaker locked.
+func (b *CircuitBreaker) OnChange(fn func(from, to BreakerState)) {
+	b.onChange = fn
+}
+
+// Allow reports whether a call may proceed. If it may, the returned call must
+// be finished with Done or Abandon; otherwise retryAfter tells when to try again.
+func (b *CircuitBreaker) Allow() (call *BreakerCall, retryAfter time.Duration, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen {
+		elapsed := time.Since(b.openedAt)
+		if elapsed < b.openTimeout {
+			b.stats.Rejected++
+			return nil, b.openTimeout - elapsed, false
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	trial := b.state == BreakerHalfOpen
+	if trial {
+		if b.trials >= b.halfOpenMax {
+			b.stats.Rejected++
+			return nil, b.openTimeout, false
+		}
+		b.trials++
+	}
+	return &BreakerCall{breaker: b, trial: trial}, 0, true
+}
+
+// BreakerCall is a call let through by a CircuitBreaker. Only the first of
+// Done and Abandon has an effect.
+type BreakerCall struct {
+	breaker *CircuitBreaker
+	trial   bool // a trial call while half open
+	once    sync.Once
+}
+
+// Done records the outcome of the call; a nil failure is a success.
+func (c *BreakerCall) Done(failure error) {
+	c.once.Do(func() { c.breaker.record(c.trial, failure) })
+}
+
+// Abandon ends a call that says nothing about the dependency, such as one
+// cancelled by the caller: a trial slot is freed, nothing is recorded.
+func (c *BreakerCall) Abandon() {
+	c.once.Do(func() { c.breaker.abandon(c.trial) })
+}
+
+func (b *CircuitBreaker) record(trial bool, failure error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if trial {
+		b.trials--
+	}
+	if failure == nil {
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	b.stats.LastError = failure.Error()
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.stats.Opened++
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) abandon(trial bool) {
+	if !trial {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trials--
+}
+
+// setState changes the state; b.mutex must be held.
+func (b *CircuitBreaker) setState(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.stats.LastChange = time.Now()
+	if b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+// Stats returns a snapshot of the breaker state and counters.
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats := b.stats
+	stats.State = b.state
+	stats.Failures = b.failures
+	return stats
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testOpenTimeout = 20 * time.Millisecond
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	type step struct {
+		action  string // success, failure, abandon, hold (leave the call open) or wait
+		allowed bool
+		state   BreakerState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens at the threshold", []step{
+			{"failure", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+			{"success", false, BreakerOpen},
+		}},
+		{"success resets the failures", []step{
+			{"failure", true, BreakerClosed},
+			{"success", true, BreakerClosed},
+			{"failure", true, BreakerClosed},
+		}},
+		{"abandoned calls do not count", []step{
+			{"failure", true, BreakerClosed},
+			{"abandon", true, BreakerClosed},
+			{"abandon", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+		}},
+		{"trial success closes", []step{
+			{"failure", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+			{"wait", false, BreakerOpen},
+			{"success", true, BreakerClosed},
+		}},
+		{"trial failure opens again", []step{
+			{"failure", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+			{"wait", false, BreakerOpen},
+			{"failure", true, BreakerOpen},
+			{"success", false, BreakerOpen},
+		}},
+		{"abandoned trial frees its slot", []step{
+			{"failure", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+			{"wait", false, BreakerOpen},
+			{"abandon", true, BreakerHalfOpen},
+			{"success", true, BreakerClosed},
+		}},
+		{"trials are limited", []step{
+			{"failure", true, BreakerClosed},
+			{"failure", true, BreakerOpen},
+			{"wait", false, BreakerOpen},
+			{"hold", true, BreakerHalfOpen},
+			{"success", false, BreakerHalfOpen},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewCircuitBreaker(2, testOpenTimeout, 1)
+			for i, step := range test.steps {
+				if step.action == "wait" {
+					time.Sleep(testOpenTimeout + 5*time.Millisecond)
+					continue
+				}
+				call, _, ok := b.Allow()
+				if ok != step.allowed {
+					t.Fatalf("step %d %s: allowed %v", i, step.action, ok)
+				}
+				if ok {
+					switch step.action {
+					case "success":
+						call.Done(nil)
+					case "failure":
+						call.Done(errors.New("connection refused"))
+					case "abandon":
+						call.Abandon()
+					}
+				}
+				if state := b.Stats().State; state != step.state {
+					t.Fatalf("step %d %s: state %s, want %s", i, step.action, state, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerCallEndsOnce(t *testing.T) {
+	b := NewCircuitBreaker(1, testOpenTimeout, 1)
+	call, _, _ := b.Allow()
+	call.Done(nil)
+	call.Done(errors.New("late failure"))
+	call.Abandon()
+	if stats := b.Stats(); stats.State != BreakerClosed || stats.Failures != 0 {
+		t.Errorf("stats after a repeated end: %+v", stats)
+	}
+}
+
+// stallingGateway fails in transport until it is told to answer, and waits for
+// the caller to give up while stalled.
+type stallingGateway struct {
+	*MemoryGateway
+	mode string // fail, stall or answer
+}
+
+func (g *stallingGateway) Authorize(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	switch g.mode {
+	case "fail":
+		return nil, errors.New("connection refused")
+	case "stall":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return g.MemoryGateway.Authorize(ctx, request)
+}
+
+func TestGuardedGatewayCancelledTrial(t *testing.T) {
+	conf := &config.Config{}
+	conf.Gateway.TimeoutMin = time.Second
+	conf.Gateway.TimeoutMax = time.Second
+	conf.Gateway.Breaker.Enabled = true
+	conf.Gateway.Breaker.FailureThreshold = 1
+	conf.Gateway.Breaker.OpenTimeout = testOpenTimeout
+	conf.Gateway.Breaker.HalfOpenRequests = 1
+	gateway := &stallingGateway{MemoryGateway: NewMemoryGateway(), mode: "fail"}
+	guarded := NewGuardedGateway(gateway, conf)
+
+	if _, err := guarded.Authorize(context.Background(), &services.GatewayRequest{Order: 1}); err == nil {
+		t.Fatal("transport failure not returned")
+	}
+	if state := guarded.Status().Breaker.State; state != BreakerOpen {
+		t.Fatalf("state %s after a failure", state)
+	}
+	if _, err := guarded.Authorize(context.Background(), &services.GatewayRequest{Order: 2}); !errors.Is(err, services.ErrGatewayUnavailable) {
+		t.Fatalf("open breaker let a request through: %v", err)
+	}
+
+	// the trial is cancelled by the caller: it neither closes nor opens the breaker
+	time.Sleep(testOpenTimeout + 5*time.Millisecond)
+	gateway.mode = "stall"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := guarded.Authorize(ctx, &services.GatewayRequest{Order: 3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled trial: %v", err)
+	}
+	if state := guarded.Status().Breaker.State; state != BreakerHalfOpen {
+		t.Fatalf("state %s after a cancelled trial, want half open", state)
+	}
+
+	// the slot of the cancelled trial is free for the next one
+	gateway.mode = "answer"
+	if _, err := guarded.Authorize(context.Background(), &services.GatewayRequest{Order: 4, Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if state := guarded.Status().Breaker.State; state != BreakerClosed {
+		t.Errorf("state %s after a successful trial", state)
+	}
+}
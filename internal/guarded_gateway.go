@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWeight is the weight of a new sample in the moving average
+	latencyWeight = 0.2
+	// timeoutFactor is the request timeout as a multiple of the average latency
+	timeoutFactor = 4
+)
+
+// GatewayStatus reports the health of a guarded gateway.
+type GatewayStatus struct {
+	Gateway string        `json:"gateway"`
+	Breaker BreakerStats  `json:"breaker"` // always closed when the breaker is disabled
+	Latency time.Duration `json:"latency"` // moving average of response times
+	Timeout time.Duration `json:"timeout"` // timeout of the next request
+}
+
+// GuardedGateway wraps a services.Gateway with a circuit breaker and an
+// adaptive request timeout. The breaker can be disabled in the configuration.
+//
+// Transport failures and timeouts count against the breaker; answers of the
+// gateway, including declines and rejected requests, count as successes. While
+// the breaker is open, requests are refused with a *services.UnavailableError
+// without reaching the gateway. The timeout of a request is a multiple of the
+// moving average of response times, kept between the configured bounds, so
+// that callers give up early on a slowing gateway without cutting off a
+// gateway that is slow but working.
+type GuardedGateway struct {
+	gateway    services.Gateway
+	breaker    *CircuitBreaker
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	mutex      sync.Mutex
+	latency    time.Duration
+	logger     services.LogHandler
+	metrics    *Metrics
+}
+
+func NewGuardedGateway(gateway services.Gateway, conf *config.Config) *GuardedGateway {
+	g := &GuardedGateway{
+		gateway:    gateway,
+		minTimeout: conf.Gateway.TimeoutMin,
+		maxTimeout: max(conf.Gateway.TimeoutMax, conf.Gateway.TimeoutMin),
+	}
+	if breaker := conf.Gateway.Breaker; breaker.Enabled {
+		g.breaker = NewCircuitBreaker(breaker.FailureThreshold, breaker.OpenTimeout, breaker.HalfOpenRequests)
+		g.breaker.OnChange(func(from, to BreakerState) {
+			if g.logger != nil {
+				g.logger.Warn(fmt.Sprintf("%s circuit breaker %s -> %s", gateway.Name(), from, to))
+			}
+		})
+	}
+	return g
+}
+
+func (g *GuardedGateway) SetLogger(logger services.LogHandler) {
+	g.logger = logger
+}
+
+// SetMetrics enables the request duration metrics.
+func (g *GuardedGateway) SetMetrics(metrics *Metrics) {
+	g.metrics = metrics
+}
+
+// Status returns the breaker state and the current timeout, for health checks and metrics.
+func (g *GuardedGateway) Status() GatewayStatus {
+	g.mutex.Lock()
+	latency := g.latency
+	g.mutex.Unlock()
+	status := GatewayStatus{
+		Gateway: g.gateway.Name(),
+		Breaker: BreakerStats{State: BreakerClosed},
+		Latency: latency,
+		Timeout: g.timeout(),
+	}
+	if g.breaker != nil {
+		status.Breaker = g.breaker.Stats()
+	}
+	return status
+}
+
+func (g *GuardedGateway) Name() string {
+	return g.gateway.Name()
+}
+
+func (g *GuardedGateway) Validate() error {
+	return g.gateway.Validate()
+}
+
+func (g *GuardedGateway) Authorize(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(ctx, services.OperationAuthorize, request, g.gateway.Authorize)
+}
+
+func (g *GuardedGateway) Capture(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(ctx, services.OperationCapture, request, g.gateway.Capture)
+}
+
+func (g *GuardedGateway) Refund(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(ctx, services.OperationRefund, request, g.gateway.Refund)
+}
+
+func (g *GuardedGateway) Void(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(ctx, services.OperationVoid, request, g.gateway.Void)
+}
+
+func (g *GuardedGateway) Query(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(ctx, services.OperationQuery, request, g.gateway.Query)
+}
+
+// VerifyNotification is not guarded: notifications come from the gateway.
+func (g *GuardedGateway) VerifyNotification(ctx context.Context, data []byte) (*services.GatewayResult, error) {
+	return g.gateway.VerifyNotification(ctx, data)
+}
+
+type gatewayCall func(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error)
+
+func (g *GuardedGateway) call(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, send gatewayCall) (*services.GatewayResult, error) {
+	var breakerCall *BreakerCall
+	if g.breaker != nil {
+		var retryAfter time.Duration
+		var ok bool
+		breakerCall, retryAfter, ok = g.breaker.Allow()
+		if !ok {
+			return nil, &services.UnavailableError{Gateway: g.gateway.Name(), RetryAfter: retryAfter}
+		}
+	}
+	done := func(failure error) {
+		if breakerCall != nil {
+			breakerCall.Done(failure)
+		}
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, g.timeout())
+	defer cancel()
+	start := time.Now()
+	result, err := send(callCtx, request)
+	elapsed := time.Since(start)
+
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, e.g. on shutdown; this says nothing about the gateway
+		if breakerCall != nil {
+			breakerCall.Abandon()
+		}
+		return nil, err
+	}
+	g.observe(elapsed)
+	outcome := "answered"
+	switch {
+	case isTransportFailure(err):
+		outcome = "failed"
+		done(err)
+	case err != nil:
+		outcome = "rejected"
+		done(nil)
+	default:
+		done(nil)
+	}
+	g.metrics.GatewayRequest(g.gateway.Name(), operation, outcome, elapsed)
+	return result, err
+}
+
+// isTransportFailure reports whether an error means the gateway did not answer.
+func isTransportFailure(err error) bool {
+	if err == nil || errors.Is(err, services.ErrGatewayNoRecord) || errors.Is(err, services.ErrGatewayQueryUnsupported) {
+		return false
+	}
+	var gatewayError *services.GatewayError
+	return !errors.As(err, &gatewayError)
+}
+
+func (g *GuardedGateway) observe(elapsed time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.latency == 0 {
+		g.latency = elapsed
+		return
+	}
+	g.latency = time.Duration(latencyWeight*float64(elapsed) + (1-latencyWeight)*float64(g.latency))
+}
+
+// timeout returns the timeout of the next request; it is the maximum until
+// the first response is observed.
+func (g *GuardedGateway) timeout() time.Duration {
+	g.mutex.Lock()
+	latency := g.latency
+	g.mutex.Unlock()
+	if latency == 0 {
+		return g.maxTimeout
+	}
+	return min(max(latency*timeoutFactor, g.minTimeout), g.maxTimeout)
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"context"
+	"crypto/x509"
+	"electrum/config"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	CheckOk   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+const (
+	// the log backlog is reported as a share of the buffer size
+	logBacklogWarn = 0.5
+	logBacklogFail = 0.9
+
+	redacted = "[redacted]"
+)
+
+// dsnPassword matches the password of a key=value connection string.
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// Pinger is implemented by the databases that can check their connection.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthCheck is the result of one readiness check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Readiness is the result of all readiness checks: it fails if any check
+// fails, and warns if any check warns.
+type Readiness struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+// DebugStatus is the diagnostic state of the process.
+type DebugStatus struct {
+	Build     BuildInfo         `json:"build"`
+	Started   time.Time         `json:"started"`
+	Uptime    string            `json:"uptime"`
+	InFlight  int64             `json:"in_flight"`
+	Locks     []string          `json:"locks"`
+	Gateway   *GatewayStatus    `json:"gateway,omitempty"`
+	Logs      *LogPipelineStats `json:"logs,omitempty"`
+	Retention *RetentionStatus  `json:"retention,omitempty"`
+	Config    config.Config     `json:"config"` // with secrets redacted
+}
+
+// Health runs the readiness checks and reports the diagnostic status. The
+// checks of components that are not set are skipped.
+type Health struct {
+	conf      *config.Config
+	started   time.Time
+	database  Pinger
+	gateway   *GuardedGateway
+	logs      *LogPipeline
+	payments  *Payments
+	retention *LogRetention
+}
+
+func NewHealth(conf *config.Config) *Health {
+	return &Health{
+		conf:    conf,
+		started: time.Now(),
+	}
+}
+
+func (h *Health) SetDatabase(database Pinger) {
+	h.database = database
+}
+
+func (h *Health) SetGateway(gateway *GuardedGateway) {
+	h.gateway = gateway
+}
+
+func (h *Health) SetLogPipeline(logs *LogPipeline) {
+	h.logs = logs
+}
+
+func (h *Health) SetPayments(payments *Payments) {
+	h.payments = payments
+}
+
+func (h *Health) SetRetention(retention *LogRetention) {
+	h.retention = retention
+}
+
+// Ready runs the readiness checks.
+func (h *Health) Ready(ctx context.Context) Readiness {
+	checks := make([]HealthCheck, 0, 5)
+	if h.database != nil {
+		checks = append(checks, h.checkDatabase(ctx))
+	}
+	if h.gateway != nil {
+		checks = append(checks, h.checkMerchant(), h.checkBreaker())
+	}
+	if h.conf.Listen.TLS {
+		checks = append(checks, h.checkCertificate(time.Now()))
+	}
+	if h.logs != nil {
+		checks = append(checks, h.checkLogBacklog())
+	}
+
+	readiness := Readiness{Status: CheckOk, Checks: checks}
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			readiness.Status = CheckFail
+			break
+		}
+		if check.Status == CheckWarn {
+			readiness.Status = CheckWarn
+		}
+	}
+	return readiness
+}
+
+func (h *Health) checkDatabase(ctx context.Context) HealthCheck {
+	check := HealthCheck{Name: "database", Status: CheckOk, Message: h.conf.Database.Type}
+	ctx, cancel := context.WithTimeout(ctx, h.conf.Health.CheckTimeout)
+	defer cancel()
+	if err := h.database.Ping(ctx); err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s: %v", h.conf.Database.Type, err)
+	}
+	return check
+}
+
+func (h *Health) checkMerchant() HealthCheck {
+	check := HealthCheck{Name: "merchant", Status: CheckOk, Message: h.gateway.Name()}
+	if err := h.gateway.Validate(); err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s: %v", h.gateway.Name(), err)
+	}
+	return check
+}
+
+// checkBreaker fails while the breaker is open, as payments are refused, and
+// warns while it probes the gateway.
+func (h *Health) checkBreaker() HealthCheck {
+	status := h.gateway.Status()
+	check := HealthCheck{Name: "gateway", Status: CheckOk, Message: fmt.Sprintf("circuit %s", status.Breaker.State)}
+	switch status.Breaker.State {
+	case BreakerOpen:
+		check.Status = CheckFail
+	case BreakerHalfOpen:
+		check.Status = CheckWarn
+	}
+	return check
+}
+
+// checkCertificate reads the certificate file on every check, so a renewed
+// certificate is reported before the server is restarted to load it.
+func (h *Health) checkCertificate(now time.Time) HealthCheck {
+	check := HealthCheck{Name: "certificate", Status: CheckOk}
+	expires, err := certificateExpiry(h.conf.Listen.CertFile)
+	switch {
+	case err != nil:
+		check.Status = CheckFail
+		check.Message = err.Error()
+	case !now.Before(expires):
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("expired at %s", expires.Format(time.RFC3339))
+	case expires.Sub(now) < h.conf.Health.CertWarning:
+		check.Status = CheckWarn
+		check.Message = fmt.Sprintf("expires at %s", expires.Format(time.RFC3339))
+	default:
+		check.Message = fmt.Sprintf("expires at %s", expires.Format(time.RFC3339))
+	}
+	return check
+}
+
+// certificateExpiry returns the expiry of the first certificate of a PEM file.
+func certificateExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read certificate: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, fmt.Errorf("no certificate in %s", path)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parse certificate: %w", err)
+		}
+		return certificate.NotAfter, nil
+	}
+}
+
+func (h *Health) checkLogBacklog() HealthCheck {
+	stats := h.logs.Stats()
+	size := h.conf.Log.Buffer.Size
+	check := HealthCheck{Name: "log", Status: CheckOk, Message: fmt.Sprintf("%d of %d queued", stats.Queued, size)}
+	if size <= 0 {
+		return check
+	}
+	switch backlog := float64(stats.Queued) / float64(size); {
+	case backlog >= logBacklogFail:
+		check.Status = CheckFail
+	case backlog >= logBacklogWarn:
+		check.Status = CheckWarn
+	}
+	return check
+}
+
+// Status returns the diagnostic status of the process.
+func (h *Health) Status() DebugStatus {
+	uptime := time.Since(h.started)
+	status := DebugStatus{
+		Build:   buildInfo(),
+		Started: h.started,
+		Uptime:  uptime.Truncate(time.Second).String(),
+		Locks:   []string{},
+		Config:  redactConfig(h.conf),
+	}
+	if h.payments != nil {
+		status.InFlight = h.payments.InFlight()
+		for _, key := range h.payments.HeldLocks() {
+			status.Locks = append(status.Locks, key.String())
+		}
+	}
+	if h.gateway != nil {
+		gateway := h.gateway.Status()
+		status.Gateway = &gateway
+	}
+	if h.logs != nil {
+		logs := h.logs.Stats()
+		status.Logs = &logs
+	}
+	if h.retention != nil {
+		retention := h.retention.Status()
+		status.Retention = &retention
+	}
+	return status
+}
+
+func buildInfo() BuildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{}
+	}
+	build := BuildInfo{
+		GoVersion: info.GoVersion,
+		Module:    info.Main.Path,
+		Version:   info.Main.Version,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.Time = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// redactConfig returns a copy of the configuration without secrets; a secret
+// that is set is replaced, so that a missing one can still be told apart.
+func redactConfig(conf *config.Config) config.Config {
+	copied := *conf
+	for _, secret := range []*string{
+		&copied.Merchant.Secret,
+		&copied.Mongo.Password,
+		&copied.Admin.Token,
+		&copied.FirebaseKey,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	copied.Database.DSN = redactDSN(copied.Database.DSN)
+	return copied
+}
+
+// redactDSN removes the password of a connection URL or key=value string.
+func redactDSN(dsn string) string {
+	if parsed, err := url.Parse(dsn); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "password="+redacted)
+}
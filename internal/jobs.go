@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobGroup tracks background goroutines so that shutdown can wait for them.
+// Jobs run with contexts derived from the group context, which is cancelled
+// when draining runs out of time. Jobs that only wait, such as deferred
+// requests, should give up when stopping is closed.
+type jobGroup struct {
+	wg       sync.WaitGroup
+	running  atomic.Int64
+	draining atomic.Bool
+	stopping chan struct{} // closed when draining starts
+	stopOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newJobGroup() *jobGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobGroup{ctx: ctx, cancel: cancel, stopping: make(chan struct{})}
+}
+
+// goJob runs fn in a tracked goroutine. Jobs may start other jobs while draining.
+func (g *jobGroup) goJob(fn func()) {
+	g.wg.Add(1)
+	g.running.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.running.Add(-1)
+		fn()
+	}()
+}
+
+// drain marks the group as draining and waits for the jobs until the context
+// is done; then it cancels the remaining jobs and gives them a moment to return.
+func (g *jobGroup) drain(ctx context.Context) error {
+	g.draining.Store(true)
+	g.stopOnce.Do(func() { close(g.stopping) })
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	left := g.running.Load()
+	g.cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	return fmt.Errorf("%d jobs cancelled at shutdown deadline", left)
+}
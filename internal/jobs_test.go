@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForJobs(t *testing.T) {
+	g := newJobGroup()
+	release := make(chan struct{})
+	var finished atomic.Int32
+	g.goJob(func() {
+		<-release
+		// a job may start another one while draining
+		g.goJob(func() {
+			time.Sleep(20 * time.Millisecond)
+			finished.Add(1)
+		})
+		finished.Add(1)
+	})
+
+	drained := make(chan error, 1)
+	go func() { drained <- g.drain(context.Background()) }()
+	select {
+	case <-g.stopping:
+	case <-time.After(time.Second):
+		t.Fatal("stopping not closed when draining started")
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drained with a job running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return after the jobs finished")
+	}
+	if finished.Load() != 2 || g.running.Load() != 0 {
+		t.Errorf("%d jobs finished, %d running; want both finished", finished.Load(), g.running.Load())
+	}
+	if g.ctx.Err() != nil {
+		t.Error("jobs cancelled although they finished in time")
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	g := newJobGroup()
+	cancelled := make(chan struct{})
+	g.goJob(func() {
+		<-g.ctx.Done()
+		close(cancelled)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := g.drain(ctx)
+	if err == nil || err.Error() != "1 jobs cancelled at shutdown deadline" {
+		t.Errorf("drain: %v, want the job cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("drained in %v, want the deadline", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the job was not cancelled at the deadline")
+	}
+}
+
+func TestPaymentsRefuseWhileDraining(t *testing.T) {
+	p := NewPayments(&config.Config{})
+	p.SetLogger(NewLogger("payments", false, nil))
+	release := make(chan struct{})
+	p.jobs.goJob(func() { <-release })
+
+	drained := make(chan error, 1)
+	go func() { drained <- p.Drain(context.Background()) }()
+	<-p.jobs.stopping
+
+	ctx := context.Background()
+	operations := map[string]func() error{
+		"pay":             func() error { return p.PayTransaction(ctx, 10) },
+		"return payment":  func() error { return p.ReturnPayment(ctx, 10, 500) },
+		"return by order": func() error { return p.ReturnByOrder(ctx, "1200", &entity.RefundRequest{Amount: 500}) },
+		"notify":          func() error { return p.Notify(ctx, []byte("{}")) },
+	}
+	for name, operation := range operations {
+		var refusal *services.PaymentError
+		if err := operation(); !errors.As(err, &refusal) || refusal.Code != services.ErrorShuttingDown {
+			t.Errorf("%s while draining: %v, want shutting_down", name, err)
+		}
+	}
+	if p.InFlight() != 1 {
+		t.Errorf("%d jobs in flight, want the running one", p.InFlight())
+	}
+
+	close(release)
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"fmt"
+	"time"
+)
+
+// stopHook is one shutdown step.
+type stopHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Lifecycle stops the service components in reverse order of registration,
+// like deferred calls, all within one shutdown deadline. A failed or late step
+// is logged and the next one still runs, so that the database is disconnected
+// in any case.
+type Lifecycle struct {
+	timeout time.Duration
+	hooks   []stopHook
+	logger  services.LogHandler
+}
+
+func NewLifecycle(timeout time.Duration) *Lifecycle {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &Lifecycle{timeout: timeout}
+}
+
+func (l *Lifecycle) SetLogger(logger services.LogHandler) {
+	l.logger = logger
+}
+
+// OnStop registers a shutdown step of a started component; the steps of
+// components started later run first.
+func (l *Lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, stopHook{name: name, stop: stop})
+}
+
+// Stop runs the shutdown steps. Each step gets the remaining time, but at least
+// a short grace period, so the last steps are not skipped after a slow one.
+func (l *Lifecycle) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	for i := len(l.hooks) - 1; i >= 0; i-- {
+		hook := l.hooks[i]
+		start := time.Now()
+		stepCtx := ctx
+		if ctx.Err() != nil {
+			var stepCancel context.CancelFunc
+			stepCtx, stepCancel = context.WithTimeout(context.Background(), time.Second)
+			defer stepCancel()
+		}
+		if err := hook.stop(stepCtx); err != nil {
+			l.logger.Error(fmt.Sprintf("stop %s", hook.name), err)
+			continue
+		}
+		l.logger.Info(fmt.Sprintf("stopped %s in %v", hook.name, time.Since(start).Round(time.Millisecond)))
+	}
+}
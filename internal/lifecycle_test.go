@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLifecycleStopOrder(t *testing.T) {
+	l := NewLifecycle(time.Second)
+	l.SetLogger(NewLogger("lifecycle", false, nil))
+	var stopped []string
+	for _, name := range []string{"database", "payments", "server"} {
+		name := name
+		l.OnStop(name, func(context.Context) error {
+			stopped = append(stopped, name)
+			if name == "payments" {
+				return errors.New("drain failed")
+			}
+			return nil
+		})
+	}
+
+	l.Stop()
+	// a failed step does not stop the next ones
+	if want := []string{"server", "payments", "database"}; !slices.Equal(stopped, want) {
+		t.Errorf("stopped %v, want %v", stopped, want)
+	}
+}
+
+func TestLifecycleDeadline(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	l := NewLifecycle(timeout)
+	l.SetLogger(NewLogger("lifecycle", false, nil))
+	var lastErr error
+	var lastLeft time.Duration
+	l.OnStop("database", func(ctx context.Context) error {
+		lastErr = ctx.Err()
+		deadline, _ := ctx.Deadline()
+		lastLeft = time.Until(deadline)
+		return nil
+	})
+	var slowLeft time.Duration
+	l.OnStop("payments", func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		slowLeft = time.Until(deadline)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	l.Stop()
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+500*time.Millisecond {
+		t.Errorf("stopped in %v, want the deadline of %v", elapsed, timeout)
+	}
+	if slowLeft <= 0 || slowLeft > timeout {
+		t.Errorf("the slow step had %v, want at most %v", slowLeft, timeout)
+	}
+	// the step after the deadline still runs, with a grace period
+	if lastErr != nil || lastLeft <= timeout {
+		t.Errorf("the last step ran with %v and %v left, want a grace period", lastErr, lastLeft)
+	}
+}
+
+func TestLifecycleDefaultTimeout(t *testing.T) {
+	if l := NewLifecycle(0); l.timeout != 30*time.Second {
+		t.Errorf("timeout %v, want 30s", l.timeout)
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockStats reports contention of one lock namespace.
+type LockStats struct {
+	Namespace services.LockNamespace `json:"namespace"`
+	Held      int                    `json:"held"`      // leases held now
+	Waiting   int                    `json:"waiting"`   // callers waiting now
+	Acquired  int64                  `json:"acquired"`  // leases granted
+	Contended int64                  `json:"contended"` // grants that had to wait
+	TimedOut  int64                  `json:"timed_out"` // acquires abandoned on context deadline or cancel
+	WaitTotal time.Duration          `json:"wait_total"`
+	WaitMax   time.Duration          `json:"wait_max"`
+}
+
+// lockEntry is a reference-counted mutex for one key. refs counts the holder
+// and all waiters, so the entry stays in the map until nobody uses it.
+type lockEntry struct {
+	semaphore chan struct{}
+	refs      int
+}
+
+// LockManager is a process-local services.Locker with keys separated by
+// namespace. Entries are reference counted: a key is removed from the map only
+// when its holder released it and no other caller waits on it, so every caller
+// of a key always contends on the same mutex. It is enough for a single electrum
+// instance; replicas need a shared locker such as MongoLocker.
+type LockManager struct {
+	mutex   sync.Mutex
+	entries map[services.LockKey]*lockEntry
+	stats   map[services.LockNamespace]*LockStats
+	token   int64
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		entries: make(map[services.LockKey]*lockEntry),
+		stats:   make(map[services.LockNamespace]*LockStats),
+	}
+}
+
+// Acquire waits until the key is free or the context is done; callers set the
+// acquire timeout with the context deadline.
+func (m *LockManager) Acquire(ctx context.Context, key services.LockKey) (services.Lease, error) {
+	m.mutex.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &lockEntry{semaphore: make(chan struct{}, 1)}
+		m.entries[key] = entry
+	}
+	entry.refs++
+	stats := m.namespaceStats(key.Namespace)
+	stats.Waiting++
+	m.mutex.Unlock()
+
+	start := time.Now()
+	contended := false
+	select {
+	case entry.semaphore <- struct{}{}:
+	default:
+		contended = true
+		select {
+		case entry.semaphore <- struct{}{}:
+		case <-ctx.Done():
+			m.mutex.Lock()
+			stats.Waiting--
+			stats.TimedOut++
+			m.unref(key, entry)
+			m.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	wait := time.Since(start)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats.Waiting--
+	stats.Held++
+	stats.Acquired++
+	if contended {
+		stats.Contended++
+	}
+	stats.WaitTotal += wait
+	stats.WaitMax = max(stats.WaitMax, wait)
+	m.token++
+	return &managedLease{manager: m, key: key, entry: entry, token: m.token}, nil
+}
+
+func (m *LockManager) release(lease *managedLease) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if lease.released {
+		return services.ErrLeaseLost
+	}
+	lease.released = true
+	<-lease.entry.semaphore
+	m.namespaceStats(lease.key.Namespace).Held--
+	m.unref(lease.key, lease.entry)
+	return nil
+}
+
+// unref drops a reference and removes the entry when unused; m.mutex must be held.
+func (m *LockManager) unref(key services.LockKey, entry *lockEntry) {
+	entry.refs--
+	if entry.refs == 0 {
+		delete(m.entries, key)
+	}
+}
+
+// namespaceStats returns the stats of a namespace; m.mutex must be held.
+func (m *LockManager) namespaceStats(namespace services.LockNamespace) *LockStats {
+	stats, ok := m.stats[namespace]
+	if !ok {
+		stats = &LockStats{Namespace: namespace}
+		m.stats[namespace] = stats
+	}
+	return stats
+}
+
+// Stats returns a snapshot of contention counters per namespace.
+func (m *LockManager) Stats() []LockStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := make([]LockStats, 0, len(m.stats))
+	for _, stats := range m.stats {
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Namespace < result[j].Namespace })
+	return result
+}
+
+// HeldKeys returns the keys that are held or waited on.
+func (m *LockManager) HeldKeys() []services.LockKey {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]services.LockKey, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
+
+type managedLease struct {
+	manager  *LockManager
+	key      services.LockKey
+	entry    *lockEntry
+	token    int64
+	released bool // guarded by manager.mutex
+}
+
+func (l *managedLease) Key() services.LockKey {
+	return l.key
+}
+
+func (l *managedLease) Token() int64 {
+	return l.token
+}
+
+// Renew only checks the lease is still held; local leases do not expire.
+func (l *managedLease) Renew(_ context.Context) error {
+	l.manager.mutex.Lock()
+	defer l.manager.mutex.Unlock()
+	if l.released {
+		return services.ErrLeaseLost
+	}
+	return nil
+}
+
+// Lost returns nil: a local lease is held until it is released.
+func (l *managedLease) Lost() <-chan struct{} {
+	return nil
+}
+
+func (l *managedLease) Release(_ context.Context) error {
+	return l.manager.release(l)
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"errors"
+	"testing"
+	"time"
+)
+
+func orderKey(id string) services.LockKey {
+	return services.LockKey{Namespace: services.LockOrder, Id: id}
+}
+
+func TestLockManagerRemovesUnusedEntries(t *testing.T) {
+	m := NewLockManager()
+	lease, err := m.Acquire(context.Background(), orderKey("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := m.HeldKeys(); len(keys) != 1 {
+		t.Fatalf("held keys %v", keys)
+	}
+	if err = lease.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := m.HeldKeys(); len(keys) != 0 {
+		t.Errorf("entry kept after release: %v", keys)
+	}
+	if err = lease.Release(context.Background()); !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("second release: %v, want lease lost", err)
+	}
+	if err = lease.Renew(context.Background()); !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("renew after release: %v, want lease lost", err)
+	}
+}
+
+func TestLockManagerKeepsEntryForWaiters(t *testing.T) {
+	m := NewLockManager()
+	key := orderKey("1")
+	holder, err := m.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan services.Lease)
+	go func() {
+		lease, err := m.Acquire(context.Background(), key)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lease
+	}()
+	// the waiter holds a reference to the entry
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		m.mutex.Lock()
+		refs := m.entries[key].refs
+		m.mutex.Unlock()
+		if refs == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry refs %d, want 2", refs)
+		}
+	}
+
+	// the key passes to the waiter, and a third caller waits on it
+	if err = holder.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waiter := <-acquired
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = m.Acquire(ctx, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquired a key held by the waiter: %v", err)
+	}
+	if err = waiter.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := m.HeldKeys(); len(keys) != 0 {
+		t.Errorf("entry kept after the last release: %v", keys)
+	}
+}
+
+func TestLockManagerStats(t *testing.T) {
+	m := NewLockManager()
+	holder, err := m.Acquire(context.Background(), orderKey("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another key and namespace do not wait
+	other, err := m.Acquire(context.Background(), services.LockKey{Namespace: services.LockTransaction, Id: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = m.Acquire(ctx, orderKey("1")); err == nil {
+		t.Fatal("acquired a held key")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = holder.Release(context.Background())
+	}()
+	waiter, err := m.Acquire(context.Background(), orderKey("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = waiter.Release(context.Background())
+	_ = other.Release(context.Background())
+
+	stats := m.Stats()
+	if len(stats) != 2 || stats[0].Namespace != services.LockOrder || stats[1].Namespace != services.LockTransaction {
+		t.Fatalf("stats %+v", stats)
+	}
+	order := stats[0]
+	if order.Held != 0 || order.Waiting != 0 || order.Acquired != 2 || order.Contended != 1 || order.TimedOut != 1 {
+		t.Errorf("order stats %+v", order)
+	}
+	if order.WaitMax <= 0 || order.WaitTotal < order.WaitMax {
+		t.Errorf("order wait total %v, max %v", order.WaitTotal, order.WaitMax)
+	}
+	if stats[1].Acquired != 1 || stats[1].Contended != 0 {
+		t.Errorf("transaction stats %+v", stats[1])
+	}
+	if keys := m.HeldKeys(); len(keys) != 0 {
+		t.Errorf("entries kept: %v", keys)
+	}
+}
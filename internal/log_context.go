@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"math"
+	"strconv"
+)
+
+const logFieldsKey contextKey = "logFields"
+
+// Keys of the fields stored at the top level of log messages, so that the
+// records of a request, order, transaction or user can be queried.
+const (
+	FieldRequestId     = "request_id"
+	FieldOrder         = "order"
+	FieldTransactionId = "transaction_id"
+	FieldUserId        = "user_id"
+)
+
+// WithLogFields returns a context whose log records carry the key/value pairs
+// in addition to those of ctx; a later value of a key replaces an earlier one.
+func WithLogFields(ctx context.Context, fields ...any) context.Context {
+	existing, _ := ctx.Value(logFieldsKey).([]any)
+	merged := make([]any, 0, len(existing)+len(fields))
+	merged = append(append(merged, existing...), fields...)
+	return context.WithValue(ctx, logFieldsKey, merged)
+}
+
+// detachContext returns ctx with the request ID and the log fields of parent,
+// and a link to its span, for work that outlives the request of parent.
+func detachContext(ctx, parent context.Context) context.Context {
+	ctx = linkSpans(ctx, parent)
+	if reqID := GetRequestID(parent); reqID != "" {
+		ctx = context.WithValue(ctx, requestIDKey, reqID)
+	}
+	if fields, ok := parent.Value(logFieldsKey).([]any); ok {
+		ctx = context.WithValue(ctx, logFieldsKey, fields)
+	}
+	return ctx
+}
+
+// applyLogFields sets the fields of the context and the key/value pairs on a
+// message: the known keys at the top level, the others in Fields. An order or
+// transaction that is not an integer is kept in Fields, as it cannot be
+// queried by number. A key without a value is stored with an empty one.
+func applyLogFields(ctx context.Context, message *services.LogMessage, fields []any) {
+	if ctx != nil {
+		message.RequestId = GetRequestID(ctx)
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			message.TraceId = span.TraceID().String()
+			message.SpanId = span.SpanID().String()
+		}
+		contextFields, _ := ctx.Value(logFieldsKey).([]any)
+		fields = append(contextFields[:len(contextFields):len(contextFields)], fields...)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		var value any
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		switch key {
+		case FieldRequestId:
+			message.RequestId = fmt.Sprint(value)
+			continue
+		case FieldUserId:
+			message.UserId = fmt.Sprint(value)
+			continue
+		case FieldOrder:
+			if number, ok := intField(value); ok {
+				message.Order = number
+				continue
+			}
+		case FieldTransactionId:
+			if number, ok := intField(value); ok {
+				message.TransactionId = number
+				continue
+			}
+		}
+		if message.Fields == nil {
+			message.Fields = make(map[string]any)
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		message.Fields[key] = value
+	}
+}
+
+// intField converts an order or transaction number given as an integer, a
+// float without a fraction, as decoded from JSON, or a string. It reports
+// false for other values and numbers out of range.
+func intField(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), v >= math.MinInt && v <= math.MaxInt
+	case uint:
+		return int(v), v <= math.MaxInt
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), uint64(v) <= math.MaxInt
+	case uint64:
+		return int(v), v <= math.MaxInt
+	case float32:
+		return floatField(float64(v))
+	case float64:
+		return floatField(v)
+	case string:
+		number, err := strconv.Atoi(v)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// floatField converts a float without a fraction to an integer.
+func floatField(v float64) (int, bool) {
+	if v != math.Trunc(v) || v < math.MinInt || v >= math.MaxInt {
+		return 0, false
+	}
+	return int(v), true
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testSpanContext returns ctx with a remote span.
+func testSpanContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+func TestApplyLogFields(t *testing.T) {
+	ctx := testSpanContext(WithRequestIDValue(context.Background(), "csms-42"))
+	ctx = WithLogFields(ctx, FieldTransactionId, 10, FieldOrder, 1200)
+	// a later value of a key replaces an earlier one
+	ctx = WithLogFields(ctx, FieldOrder, "1201", "gateway", "redsys")
+
+	var message services.LogMessage
+	applyLogFields(ctx, &message, []any{FieldUserId, "user-1", "attempt", 2, "error", errors.New("connection reset"), "pending"})
+	if message.RequestId != "csms-42" || message.TransactionId != 10 || message.Order != 1201 || message.UserId != "user-1" {
+		t.Errorf("request %q, transaction %d, order %d, user %q; want csms-42, 10, 1201, user-1",
+			message.RequestId, message.TransactionId, message.Order, message.UserId)
+	}
+	if message.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || message.SpanId != "00f067aa0ba902b7" {
+		t.Errorf("trace %q, span %q; want those of the context", message.TraceId, message.SpanId)
+	}
+	fields := map[string]any{"gateway": "redsys", "attempt": 2, "error": "connection reset", "pending": nil}
+	if !reflect.DeepEqual(message.Fields, fields) {
+		t.Errorf("fields %v, want %v", message.Fields, fields)
+	}
+
+	// the fields of the context are not changed by those of a call
+	var other services.LogMessage
+	applyLogFields(ctx, &other, nil)
+	if other.UserId != "" || len(other.Fields) != 1 {
+		t.Errorf("user %q, fields %v; want only the fields of the context", other.UserId, other.Fields)
+	}
+}
+
+func TestIntField(t *testing.T) {
+	tests := []struct {
+		value  any
+		number int
+		ok     bool
+	}{
+		{1200, 1200, true},
+		{int32(1200), 1200, true},
+		{int64(1200), 1200, true},
+		{uint(1200), 1200, true},
+		{uint64(1200), 1200, true},
+		{uint64(math.MaxUint64), 0, false},
+		{float64(1200), 1200, true}, // as decoded from JSON
+		{1200.5, 0, false},
+		{math.NaN(), 0, false},
+		{math.Inf(1), 0, false},
+		{"1200", 1200, true},
+		{"order 1200", 0, false},
+		{nil, 0, false},
+		{true, 0, false},
+	}
+	for _, tt := range tests {
+		number, ok := intField(tt.value)
+		if ok != tt.ok || ok && number != tt.number {
+			t.Errorf("intField(%#v) = %d, %v; want %d, %v", tt.value, number, ok, tt.number, tt.ok)
+		}
+	}
+
+	// a number that is not an integer is kept in the fields
+	var message services.LogMessage
+	applyLogFields(nil, &message, []any{FieldOrder, 1200.5, FieldTransactionId, uint(10)})
+	if message.Order != 0 || message.Fields[FieldOrder] != 1200.5 || message.TransactionId != 10 {
+		t.Errorf("order %d, transaction %d, fields %v; want the order in the fields", message.Order, message.TransactionId, message.Fields)
+	}
+}
+
+func TestDetachContext(t *testing.T) {
+	parent, cancel := context.WithCancel(testSpanContext(WithRequestIDValue(context.Background(), "csms-42")))
+	parent = WithLogFields(parent, FieldOrder, 1200)
+	ctx := detachContext(context.Background(), parent)
+	cancel()
+
+	if ctx.Err() != nil {
+		t.Error("the detached context was canceled with its parent")
+	}
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("the detached context continues the span of its parent")
+	}
+	links, _ := ctx.Value(spanLinksKey).([]trace.Link)
+	if len(links) != 1 || links[0].SpanContext.SpanID() != trace.SpanContextFromContext(parent).SpanID() {
+		t.Errorf("links %v, want a link to the span of the parent", links)
+	}
+
+	var message services.LogMessage
+	applyLogFields(ctx, &message, nil)
+	if message.RequestId != "csms-42" || message.Order != 1200 || message.TraceId != "" {
+		t.Errorf("request %q, order %d, trace %q; want the request and fields of the parent without its trace",
+			message.RequestId, message.Order, message.TraceId)
+	}
+
+	// without request and fields, there is nothing to carry
+	plain := detachContext(context.Background(), context.Background())
+	if GetRequestID(plain) != "" || plain.Value(logFieldsKey) != nil || plain.Value(spanLinksKey) != nil {
+		t.Error("values detached from an empty parent")
+	}
+}
+
+func TestPrintJSON(t *testing.T) {
+	var output bytes.Buffer
+	saved := jsonLog
+	jsonLog = log.New(&output, "", 0)
+	defer func() { jsonLog = saved }()
+
+	message := &services.LogMessage{Level: string(Warning), Category: "payments", Text: "authorize order 1200: connection reset"}
+	applyLogFields(WithRequestIDValue(context.Background(), "csms-42"), message,
+		[]any{FieldOrder, 1200, FieldTransactionId, 10, "attempt", 2})
+	printJSON(message)
+
+	var record map[string]any
+	if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+		t.Fatalf("output %q: %v", output.String(), err)
+	}
+	want := map[string]any{
+		"level": "warning", "category": "payments", "text": "authorize order 1200: connection reset",
+		"request_id": "csms-42", "order": 1200.0, "transaction_id": 10.0, "fields": map[string]any{"attempt": 2.0},
+	}
+	for key, value := range want {
+		if !reflect.DeepEqual(record[key], value) {
+			t.Errorf("%s: %v, want %v", key, record[key], value)
+		}
+	}
+	if _, ok := record["user_id"]; ok {
+		t.Error("an empty user id is printed")
+	}
+	if message.Level != string(Warning) {
+		t.Error("the level of the message was changed")
+	}
+
+	if fields := consoleFields(message); fields != " request_id=csms-42 transaction_id=10 order=1200 attempt=2" {
+		t.Errorf("console fields %q", fields)
+	}
+}
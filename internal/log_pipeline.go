@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Policies of a full log buffer.
+const (
+	LogPolicyDrop  = "drop"  // the message is dropped and counted
+	LogPolicyBlock = "block" // the caller waits for room in the buffer
+)
+
+// logEntry is a queued log message with the message service of its logger.
+type logEntry struct {
+	message        *services.LogMessage
+	messageService services.MessageService
+}
+
+// LogPipelineStats reports the counters of a log pipeline.
+type LogPipelineStats struct {
+	Queued  int   `json:"queued"`
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Failed  int64 `json:"failed"`
+}
+
+// LogPipeline writes the messages of all loggers from a bounded buffer, in
+// batches, with one background worker. A batch is written when it is full,
+// every flush interval, and on Flush. Messages are sent to the message
+// service of their logger after they are written.
+type LogPipeline struct {
+	database      services.Database
+	queue         chan logEntry
+	block         bool
+	batchSize     int
+	flushInterval time.Duration
+	writeTimeout  time.Duration
+	flushes       chan chan struct{}
+	reported      int64 // drops reported on the console, by the worker
+
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+func NewLogPipeline(conf *config.Config, database services.Database) *LogPipeline {
+	buffer := conf.Log.Buffer
+	p := &LogPipeline{
+		database:      database,
+		block:         buffer.Policy == LogPolicyBlock,
+		batchSize:     buffer.BatchSize,
+		flushInterval: buffer.FlushInterval,
+		writeTimeout:  buffer.WriteTimeout,
+		flushes:       make(chan chan struct{}),
+	}
+	size := buffer.Size
+	if size <= 0 {
+		size = 10000
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = 100
+	}
+	if p.flushInterval <= 0 {
+		p.flushInterval = time.Second
+	}
+	if p.writeTimeout <= 0 {
+		p.writeTimeout = 5 * time.Second
+	}
+	p.queue = make(chan logEntry, size)
+	return p
+}
+
+// Start runs the worker; it lives as long as the process, so that messages
+// logged after Flush are still written.
+func (p *LogPipeline) Start() {
+	go p.run()
+}
+
+// Flush writes the buffered messages and waits for them until the context is done.
+func (p *LogPipeline) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case p.flushes <- done:
+	case <-ctx.Done():
+		return fmt.Errorf("flush logs: %w", ctx.Err())
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flush logs: %w", ctx.Err())
+	}
+}
+
+// Stats returns the current counters.
+func (p *LogPipeline) Stats() LogPipelineStats {
+	return LogPipelineStats{
+		Queued:  len(p.queue),
+		Written: p.written.Load(),
+		Dropped: p.dropped.Load(),
+		Failed:  p.failed.Load(),
+	}
+}
+
+// stores reports whether messages are written to a database.
+func (p *LogPipeline) stores() bool {
+	return p.database != nil
+}
+
+// enqueue adds a message to the buffer; when the buffer is full, it waits or
+// drops the message, as the policy says.
+func (p *LogPipeline) enqueue(entry logEntry) {
+	if p.block {
+		p.queue <- entry
+		return
+	}
+	select {
+	case p.queue <- entry:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *LogPipeline) run() {
+	batch := make([]logEntry, 0, p.batchSize)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry := <-p.queue:
+			batch = append(batch, entry)
+			if len(batch) < p.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-p.flushes:
+			batch = p.drain(batch)
+			p.write(batch)
+			batch = batch[:0]
+			close(done)
+			continue
+		}
+		p.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain writes the buffered messages in full batches and returns the rest.
+func (p *LogPipeline) drain(batch []logEntry) []logEntry {
+	for {
+		select {
+		case entry := <-p.queue:
+			batch = append(batch, entry)
+			if len(batch) == p.batchSize {
+				p.write(batch)
+				batch = batch[:0]
+			}
+		default:
+			return batch
+		}
+	}
+}
+
+func (p *LogPipeline) write(batch []logEntry) {
+	// report drops on the console, as they cannot be logged
+	if dropped := p.dropped.Load(); dropped != p.reported {
+		log.Printf("%s log buffer full: %d messages dropped", Warning, dropped-p.reported)
+		p.reported = dropped
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if p.database != nil {
+		data := make([]services.Data, len(batch))
+		for i, entry := range batch {
+			data[i] = entry.message
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.writeTimeout)
+		err := p.database.WriteLogMessages(ctx, data)
+		cancel()
+		if err != nil {
+			p.failed.Add(int64(len(batch)))
+			log.Printf("%s log pipeline: write %d messages: %s", Error, len(batch), err)
+		} else {
+			p.written.Add(int64(len(batch)))
+		}
+	}
+	for _, entry := range batch {
+		if entry.messageService == nil {
+			continue
+		}
+		if err := entry.messageService.Send(entry.message); err != nil {
+			p.failed.Add(1)
+			log.Printf("%s %s logger: sending message: %s", Error, entry.message.Category, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchDatabase records the batches of log messages written to it.
+type batchDatabase struct {
+	*MemoryDatabase
+	mutex   sync.Mutex
+	batches [][]string
+	fail    error
+}
+
+func (d *batchDatabase) WriteLogMessages(_ context.Context, data []services.Data) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.fail != nil {
+		return d.fail
+	}
+	batch := make([]string, len(data))
+	for i, message := range data {
+		batch[i] = message.(*services.LogMessage).Text
+	}
+	d.batches = append(d.batches, batch)
+	return nil
+}
+
+// sentMessages records the messages sent to a message service.
+type sentMessages struct {
+	mutex sync.Mutex
+	texts []string
+}
+
+func (s *sentMessages) Send(message services.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.texts = append(s.texts, message.(*services.LogMessage).Text)
+	return nil
+}
+
+func newTestPipeline(t *testing.T, size int, policy string) (*LogPipeline, *batchDatabase) {
+	t.Helper()
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &batchDatabase{MemoryDatabase: memory}
+	conf := &config.Config{}
+	conf.Log.Buffer.Size = size
+	conf.Log.Buffer.Policy = policy
+	conf.Log.Buffer.BatchSize = 3
+	// batches are written when full and on Flush only
+	conf.Log.Buffer.FlushInterval = time.Hour
+	return NewLogPipeline(conf, database), database
+}
+
+// enqueueTexts queues messages with the texts from..to-1.
+func enqueueTexts(p *LogPipeline, from, to int, messageService services.MessageService) {
+	for i := from; i < to; i++ {
+		p.enqueue(logEntry{message: &services.LogMessage{Text: strconv.Itoa(i)}, messageService: messageService})
+	}
+}
+
+func flushPipeline(t *testing.T, p *LogPipeline) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogPipelineWritesBatches(t *testing.T) {
+	p, database := newTestPipeline(t, 100, LogPolicyDrop)
+	sent := &sentMessages{}
+	p.Start()
+	enqueueTexts(p, 0, 7, sent)
+	flushPipeline(t, p)
+
+	var written []string
+	for _, batch := range database.batches {
+		if len(batch) == 0 || len(batch) > 3 {
+			t.Errorf("batch of %d messages", len(batch))
+		}
+		written = append(written, batch...)
+	}
+	for i, text := range written {
+		if text != strconv.Itoa(i) {
+			t.Fatalf("written %v, want 0..6 in order", written)
+		}
+	}
+	if len(written) != 7 || len(sent.texts) != 7 {
+		t.Errorf("%d written, %d sent, want 7", len(written), len(sent.texts))
+	}
+	if stats := p.Stats(); stats != (LogPipelineStats{Written: 7}) {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLogPipelineDropsWhenFull(t *testing.T) {
+	p, database := newTestPipeline(t, 2, LogPolicyDrop)
+	// the worker is not running yet, so the buffer fills up
+	enqueueTexts(p, 0, 5, nil)
+	if stats := p.Stats(); stats != (LogPipelineStats{Queued: 2, Dropped: 3}) {
+		t.Fatalf("stats of a full buffer %+v", stats)
+	}
+
+	p.Start()
+	flushPipeline(t, p)
+	if stats := p.Stats(); stats != (LogPipelineStats{Written: 2, Dropped: 3}) {
+		t.Errorf("stats after flush %+v", stats)
+	}
+	if len(database.batches) != 1 || database.batches[0][0] != "0" || database.batches[0][1] != "1" {
+		t.Errorf("batches %v, want the first two messages", database.batches)
+	}
+}
+
+func TestLogPipelineBlocksWhenFull(t *testing.T) {
+	p, _ := newTestPipeline(t, 1, LogPolicyBlock)
+	enqueueTexts(p, 0, 1, nil)
+	queued := make(chan struct{})
+	go func() {
+		enqueueTexts(p, 1, 2, nil)
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("message queued in a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.Start()
+	<-queued
+	flushPipeline(t, p)
+	if stats := p.Stats(); stats != (LogPipelineStats{Written: 2}) {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLogPipelineCountsFailures(t *testing.T) {
+	p, database := newTestPipeline(t, 100, LogPolicyDrop)
+	database.fail = errors.New("database down")
+	sent := &sentMessages{}
+	p.Start()
+	enqueueTexts(p, 0, 4, sent)
+	flushPipeline(t, p)
+
+	if stats := p.Stats(); stats != (LogPipelineStats{Failed: 4}) {
+		t.Errorf("stats %+v", stats)
+	}
+	// messages not stored are still sent
+	if len(sent.texts) != 4 {
+		t.Errorf("%d messages sent, want 4", len(sent.texts))
+	}
+}
@@ -0,0 +1,391 @@
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogFilter selects stored log records. Records without a level, such as
+// feature messages, count as info. With correlation fields set, a record
+// matches if it has any of them.
+type LogFilter struct {
+	Level  string    // Importance of the records, any if empty
+	Levels []string  // records of any of these importances, any if empty
+	Before time.Time // records written before, any time if zero
+	After  time.Time // records written at or after, any time if zero
+
+	RequestId     string
+	Orders        []int
+	TransactionId int
+	UserId        string
+}
+
+// StoredLog is a log record as stored, with the id the store deletes it by.
+type StoredLog struct {
+	Id   string
+	Data json.RawMessage
+}
+
+// LogStore is implemented by the databases whose log records the retention
+// task can expire.
+type LogStore interface {
+	CountLogs(ctx context.Context) (int64, error)
+	// ReadLogs returns up to limit records matching the filter, oldest first.
+	ReadLogs(ctx context.Context, filter LogFilter, limit int) ([]StoredLog, error)
+	DeleteLogs(ctx context.Context, ids []string) (int64, error)
+}
+
+// logCapper is implemented by the databases that can cap the log themselves.
+type logCapper interface {
+	// EnsureCappedLogs makes the log keep at most records entries and reports
+	// whether it does; a log created before without a cap is left as is.
+	EnsureCappedLogs(ctx context.Context, records, size int64) (bool, error)
+}
+
+// retentionLevels maps the configured level names to the logged levels.
+var retentionLevels = []struct {
+	name  string
+	level Importance
+}{
+	{"debug", Raw},
+	{"info", Info},
+	{"warning", Warning},
+	{"error", Error},
+}
+
+// cappedLogRecordSize is the record size the capped log is sized by, when no
+// size is configured.
+const cappedLogRecordSize = 1024
+
+// RetentionStatus reports the state of the log retention task.
+type RetentionStatus struct {
+	Running      bool             `json:"running"`
+	Capped       bool             `json:"capped"` // the database caps the log itself
+	LastRun      time.Time        `json:"last_run,omitempty"`
+	LastDuration string           `json:"last_duration,omitempty"`
+	LastError    string           `json:"last_error,omitempty"`
+	NextRun      time.Time        `json:"next_run,omitempty"`
+	Deleted      map[string]int64 `json:"deleted"` // since start, by level, and "capped" for trimmed records
+	Archived     int64            `json:"archived"`
+	LastArchive  string           `json:"last_archive,omitempty"`
+}
+
+// LogRetention deletes old log records in the background: records older than
+// the TTL of their level and, in capped mode, the oldest records beyond
+// log_records, unless the database caps the log itself. With an archive
+// directory set, the records are written to a compressed JSON lines file
+// before they are deleted; records that could not be archived are kept.
+type LogRetention struct {
+	store      LogStore
+	records    int64
+	capped     bool
+	cappedSize int64
+	ttl        map[Importance]time.Duration
+	interval   time.Duration
+	batchSize  int
+	archiveDir string
+	logger     services.LogHandler
+
+	mutex  sync.Mutex
+	status RetentionStatus
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewLogRetention(conf *config.Config, store LogStore) *LogRetention {
+	retention := conf.Log.Retention
+	r := &LogRetention{
+		store:      store,
+		records:    conf.LogRecords,
+		capped:     retention.Capped && conf.LogRecords > 0,
+		cappedSize: retention.CappedSize,
+		ttl: map[Importance]time.Duration{
+			Raw:     retention.TTL.Debug,
+			Info:    retention.TTL.Info,
+			Warning: retention.TTL.Warning,
+			Error:   retention.TTL.Error,
+		},
+		interval:   retention.Interval,
+		batchSize:  retention.BatchSize,
+		archiveDir: retention.ArchiveDir,
+		status:     RetentionStatus{Deleted: make(map[string]int64)},
+	}
+	if r.interval <= 0 {
+		r.interval = time.Hour
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = 1000
+	}
+	if r.cappedSize <= 0 {
+		r.cappedSize = r.records * cappedLogRecordSize
+	}
+	return r
+}
+
+func (r *LogRetention) SetLogger(logger services.LogHandler) {
+	r.logger = logger
+}
+
+// Start caps the log in the database if capped mode is on and the database
+// supports it, then runs the retention at once and every interval until Stop.
+func (r *LogRetention) Start(ctx context.Context) {
+	if capper, ok := r.store.(logCapper); ok && r.capped {
+		capped, err := capper.EnsureCappedLogs(ctx, r.records, r.cappedSize)
+		switch {
+		case err != nil:
+			r.logger.Error("cap log", err)
+		case capped:
+			r.logger.Info(fmt.Sprintf("log is capped at %d records by the database", r.records))
+		default:
+			r.logger.Warn("log was created without a cap: the oldest records are deleted by the retention task")
+		}
+		r.mutex.Lock()
+		r.status.Capped = capped
+		r.mutex.Unlock()
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	r.mutex.Lock()
+	r.status.Running = true
+	r.mutex.Unlock()
+
+	go func() {
+		defer close(r.done)
+		runCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-r.stop:
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-timer.C:
+			}
+			if err := r.Run(runCtx); err != nil && runCtx.Err() == nil {
+				r.logger.Error("log retention", err)
+			}
+			r.mutex.Lock()
+			r.status.NextRun = time.Now().Add(r.interval)
+			r.mutex.Unlock()
+			timer.Reset(r.interval)
+		}
+	}()
+}
+
+// Stop interrupts a run in progress and waits for the task until the context is done.
+func (r *LogRetention) Stop(ctx context.Context) error {
+	if r.stop == nil {
+		return nil
+	}
+	close(r.stop)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r.mutex.Lock()
+	r.status.Running = false
+	r.status.NextRun = time.Time{}
+	r.mutex.Unlock()
+	return nil
+}
+
+// Status returns a copy of the retention status.
+func (r *LogRetention) Status() RetentionStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status
+	status.Deleted = make(map[string]int64, len(r.status.Deleted))
+	for name, count := range r.status.Deleted {
+		status.Deleted[name] = count
+	}
+	return status
+}
+
+// Run expires the log records once. A failure at one level does not stop the
+// others; the error joins the failures.
+func (r *LogRetention) Run(ctx context.Context) error {
+	start := time.Now()
+	archive := &logArchive{dir: r.archiveDir, time: start}
+	deleted := make(map[string]int64)
+	var failures []error
+
+	for _, level := range retentionLevels {
+		ttl := r.ttl[level.level]
+		if ttl <= 0 {
+			continue
+		}
+		filter := LogFilter{Level: string(level.level), Before: start.Add(-ttl)}
+		count, err := r.expire(ctx, filter, -1, archive)
+		deleted[level.name] += count
+		if err != nil {
+			failures = append(failures, fmt.Errorf("expire %s records: %w", level.name, err))
+		}
+	}
+
+	r.mutex.Lock()
+	trim := r.capped && !r.status.Capped
+	r.mutex.Unlock()
+	if trim {
+		count, err := r.trim(ctx, archive)
+		deleted["capped"] += count
+		if err != nil {
+			failures = append(failures, fmt.Errorf("trim log: %w", err))
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		failures = append(failures, err)
+	}
+	err := errors.Join(failures...)
+
+	var total int64
+	r.mutex.Lock()
+	for name, count := range deleted {
+		r.status.Deleted[name] += count
+		total += count
+	}
+	r.status.Archived += archive.written
+	if archive.written > 0 {
+		r.status.LastArchive = archive.path
+	}
+	r.status.LastRun = start
+	r.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	r.mutex.Unlock()
+
+	if total > 0 {
+		r.logger.Debug(fmt.Sprintf("log retention deleted %d records, archived %d", total, archive.written))
+	}
+	return err
+}
+
+// trim deletes the oldest records beyond the records limit.
+func (r *LogRetention) trim(ctx context.Context, archive *logArchive) (int64, error) {
+	count, err := r.store.CountLogs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if count <= r.records {
+		return 0, nil
+	}
+	return r.expire(ctx, LogFilter{}, count-r.records, archive)
+}
+
+// expire archives and deletes the records matching the filter in batches,
+// oldest first, up to limit records, or all of them if limit is negative.
+func (r *LogRetention) expire(ctx context.Context, filter LogFilter, limit int64, archive *logArchive) (int64, error) {
+	var deleted int64
+	for limit < 0 || deleted < limit {
+		size := r.batchSize
+		if limit >= 0 && limit-deleted < int64(size) {
+			size = int(limit - deleted)
+		}
+		records, err := r.store.ReadLogs(ctx, filter, size)
+		if err != nil {
+			return deleted, err
+		}
+		if len(records) == 0 {
+			return deleted, nil
+		}
+		if err = archive.Write(records); err != nil {
+			return deleted, err
+		}
+		ids := make([]string, len(records))
+		for i, record := range records {
+			ids[i] = record.Id
+		}
+		count, err := r.store.DeleteLogs(ctx, ids)
+		deleted += count
+		if err != nil {
+			return deleted, err
+		}
+		if len(records) < size {
+			return deleted, nil
+		}
+	}
+	return deleted, nil
+}
+
+// logArchive writes the records of a retention run to one gzip compressed
+// JSON lines file, created with the first records. Without a directory it
+// writes nothing.
+type logArchive struct {
+	dir     string
+	time    time.Time
+	path    string
+	file    *os.File
+	gzip    *gzip.Writer
+	written int64
+}
+
+// Write appends the records and flushes them to disk, so that they are
+// archived before they are deleted.
+func (a *logArchive) Write(records []StoredLog) error {
+	if a.dir == "" {
+		return nil
+	}
+	if a.file == nil {
+		if err := os.MkdirAll(a.dir, 0o750); err != nil {
+			return fmt.Errorf("create archive directory: %w", err)
+		}
+		a.path = filepath.Join(a.dir, fmt.Sprintf("%s-%s.jsonl.gz", collectionLog, a.time.UTC().Format("20060102-150405")))
+		file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("create archive: %w", err)
+		}
+		a.file = file
+		a.gzip = gzip.NewWriter(file)
+	}
+	for _, record := range records {
+		if _, err := a.gzip.Write(record.Data); err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+		if _, err := a.gzip.Write([]byte{'\n'}); err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+	}
+	if err := a.gzip.Flush(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	a.written += int64(len(records))
+	return nil
+}
+
+func (a *logArchive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.gzip.Close()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("close archive: %w", err)
+	}
+	return nil
+}
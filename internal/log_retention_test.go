@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testLog is a record written to the store some time ago.
+type testLog struct {
+	text  string
+	level Importance // a feature message without a level if empty
+	age   time.Duration
+}
+
+// newLogStore creates an SQLite store with the records, oldest first.
+func newLogStore(t *testing.T, logs []testLog) *SQLDatabase {
+	t.Helper()
+	conf := &config.Config{}
+	conf.Database.Type = dialectSQLite
+	conf.Database.DSN = ":memory:"
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close(context.Background()) })
+
+	ctx := context.Background()
+	for _, log := range logs {
+		var data services.Data = &services.LogMessage{Level: string(log.level), Text: log.text}
+		if log.level == "" {
+			data = &services.FeatureMessage{Feature: "test", Text: log.text}
+		}
+		if err = store.WriteLogMessage(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.exec(ctx, "UPDATE payment_log SET timestamp = ? WHERE id = (SELECT MAX(id) FROM payment_log)", time.Now().Add(-log.age))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// storedTexts returns the texts of the stored records, oldest first.
+func storedTexts(t *testing.T, records []StoredLog) []string {
+	t.Helper()
+	var texts []string
+	for _, record := range records {
+		var message struct{ Text string }
+		if err := json.Unmarshal(record.Data, &message); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, message.Text)
+	}
+	return texts
+}
+
+func TestLogRetentionRun(t *testing.T) {
+	const day = 24 * time.Hour
+	logs := []testLog{
+		{"old error", Error, 400 * day},
+		{"old warning", Warning, 400 * day},
+		{"old info", Info, 40 * day},
+		{"old feature", "", 40 * day},
+		{"old debug", Raw, 10 * day},
+		{"error", Error, 40 * day},
+		{"info", Info, 10 * day},
+		{"feature", "", 10 * day},
+		{"debug", Raw, time.Hour},
+	}
+	tests := []struct {
+		name    string
+		ttl     bool  // the default TTL by level: debug 7, info 30, warning 90, error 365 days
+		records int64 // capped at the records if set
+		deleted map[string]int64
+		kept    []string
+	}{
+		{
+			name:    "ttl by level",
+			ttl:     true,
+			deleted: map[string]int64{"debug": 1, "info": 2, "warning": 1, "error": 1},
+			kept:    []string{"error", "info", "feature", "debug"},
+		},
+		{
+			name:    "capped",
+			records: 3,
+			deleted: map[string]int64{"capped": 6},
+			kept:    []string{"info", "feature", "debug"},
+		},
+		{
+			name:    "ttl, then the cap",
+			ttl:     true,
+			records: 3,
+			deleted: map[string]int64{"debug": 1, "info": 2, "warning": 1, "error": 1, "capped": 1},
+			kept:    []string{"info", "feature", "debug"},
+		},
+		{
+			name:    "under the cap",
+			records: 20,
+			deleted: map[string]int64{},
+			kept:    []string{"old error", "old warning", "old info", "old feature", "old debug", "error", "info", "feature", "debug"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newLogStore(t, logs)
+			conf := &config.Config{LogRecords: test.records}
+			retention := &conf.Log.Retention
+			retention.Capped = test.records > 0
+			retention.BatchSize = 2
+			retention.ArchiveDir = t.TempDir()
+			if test.ttl {
+				retention.TTL.Debug = 7 * day
+				retention.TTL.Info = 30 * day
+				retention.TTL.Warning = 90 * day
+				retention.TTL.Error = 365 * day
+			}
+			r := NewLogRetention(conf, store)
+			r.SetLogger(NewLogger("retention", false, nil))
+
+			if err := r.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			status := r.Status()
+			for name, count := range status.Deleted {
+				if count == 0 {
+					delete(status.Deleted, name)
+				}
+			}
+			if !reflect.DeepEqual(status.Deleted, test.deleted) {
+				t.Errorf("deleted %v, want %v", status.Deleted, test.deleted)
+			}
+
+			records, err := store.ReadLogs(context.Background(), LogFilter{}, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if texts := storedTexts(t, records); !reflect.DeepEqual(texts, test.kept) {
+				t.Errorf("kept %v, want %v", texts, test.kept)
+			}
+
+			// every deleted record is archived
+			var total int64
+			for _, count := range test.deleted {
+				total += count
+			}
+			if status.Archived != total {
+				t.Errorf("archived %d, want %d", status.Archived, total)
+			}
+			if total > 0 && archivedLines(t, status.LastArchive) != total {
+				t.Errorf("archive %s does not hold %d records", status.LastArchive, total)
+			}
+		})
+	}
+}
+
+func TestLogRetentionCappedSize(t *testing.T) {
+	tests := []struct {
+		records    int64
+		capped     bool
+		size       int64
+		wantCapped bool
+		wantSize   int64
+	}{
+		{records: 1000, capped: true, wantCapped: true, wantSize: 1000 * cappedLogRecordSize},
+		{records: 1000, capped: true, size: 4096, wantCapped: true, wantSize: 4096},
+		{records: 0, capped: true, wantCapped: false, wantSize: 0},
+		{records: 1000, capped: false, wantCapped: false, wantSize: 1000 * cappedLogRecordSize},
+	}
+	for _, test := range tests {
+		conf := &config.Config{LogRecords: test.records}
+		conf.Log.Retention.Capped = test.capped
+		conf.Log.Retention.CappedSize = test.size
+		r := NewLogRetention(conf, nil)
+		if r.capped != test.wantCapped || r.cappedSize != test.wantSize {
+			t.Errorf("%d records, capped %v, size %d: capped %v, size %d", test.records, test.capped, test.size, r.capped, r.cappedSize)
+		}
+	}
+}
+
+// archivedLines counts the records in an archive file.
+func archivedLines(t *testing.T, path string) int64 {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int64
+	for scanner := bufio.NewScanner(reader); scanner.Scan(); {
+		lines++
+	}
+	return lines
+}
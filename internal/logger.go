@@ -3,8 +3,13 @@ package internal
 import (
 	"context"
 	"electrum/services"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +22,54 @@ const (
 	Raw     Importance = "-"
 )
 
+// Console output formats.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// levelNames name the levels in JSON output.
+var levelNames = map[string]string{
+	string(Raw):     "debug",
+	string(Info):    "info",
+	string(Warning): "warning",
+	string(Error):   "error",
+}
+
+// jsonOutput switches the console output of all loggers to JSON lines.
+var jsonOutput atomic.Bool
+
+// jsonLog prints JSON lines without the time prefix of the standard logger;
+// the records have their own.
+var jsonLog = log.New(os.Stderr, "", 0)
+
+// SetLogFormat selects the console output format of all loggers.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatConsole, "":
+		jsonOutput.Store(false)
+	case LogFormatJSON:
+		jsonOutput.Store(true)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
 type Logger struct {
 	messageService services.MessageService
-	database       services.Database
+	pipeline       *LogPipeline
 	debugMode      bool
 	category       string
 }
 
-func NewLogger(category string, debug bool, db services.Database) *Logger {
+// NewLogger creates a logger writing through the pipeline; with a nil
+// pipeline, it only prints to the console.
+func NewLogger(category string, debug bool, pipeline *LogPipeline) *Logger {
 	return &Logger{
 		debugMode: debug,
 		category:  category,
-		database:  db,
+		pipeline:  pipeline,
 	}
 }
 
@@ -40,8 +81,8 @@ func (l *Logger) SetMessageService(messageService services.MessageService) {
 	l.messageService = messageService
 }
 
-func (l *Logger) SetDatabase(database services.Database) {
-	l.database = database
+func (l *Logger) SetPipeline(pipeline *LogPipeline) {
+	l.pipeline = pipeline
 }
 
 func logTime(t time.Time) string {
@@ -49,70 +90,111 @@ func logTime(t time.Time) string {
 	return timeString
 }
 func (l *Logger) Info(text string) {
-	l.logEvent(Info, text)
+	l.logEvent(nil, Info, text, nil)
 }
 
 func (l *Logger) Debug(text string) {
-	l.logEvent(Raw, text)
+	l.logEvent(nil, Raw, text, nil)
 }
 
 func (l *Logger) Warn(text string) {
-	l.logEvent(Warning, text)
+	l.logEvent(nil, Warning, text, nil)
 }
 
 func (l *Logger) Error(event string, err error) {
 	text := fmt.Sprintf("%s: %s", event, err.Error())
-	l.logEvent(Error, text)
+	l.logEvent(nil, Error, text, nil)
+}
+
+func (l *Logger) InfoContext(ctx context.Context, text string, fields ...any) {
+	l.logEvent(ctx, Info, text, fields)
+}
+
+func (l *Logger) DebugContext(ctx context.Context, text string, fields ...any) {
+	l.logEvent(ctx, Raw, text, fields)
+}
+
+func (l *Logger) WarnContext(ctx context.Context, text string, fields ...any) {
+	l.logEvent(ctx, Warning, text, fields)
 }
 
-func (l *Logger) internalError(event string, err error) {
-	text := fmt.Sprintf("  %s logger: %s: %s", l.category, event, err.Error())
-	l.logLine(string(Error), text)
+func (l *Logger) ErrorContext(ctx context.Context, event string, err error, fields ...any) {
+	text := fmt.Sprintf("%s: %s", event, err.Error())
+	l.logEvent(ctx, Error, text, fields)
 }
 
-func (l *Logger) logEvent(level Importance, text string) {
+func (l *Logger) logEvent(ctx context.Context, level Importance, text string, fields []any) {
 
 	if level == Raw && !l.debugMode {
 		return
 	}
 
+	now := time.Now()
 	message := &services.LogMessage{
-		Time:      logTime(time.Now()),
-		Timestamp: time.Now(),
+		Time:      logTime(now),
+		Timestamp: now,
 		Text:      text,
 		Category:  l.category,
 		Level:     string(level),
 	}
+	applyLogFields(ctx, message, fields)
 
-	messageText := fmt.Sprintf("%s: %s", message.Category, message.Text)
-	l.logLine(message.Level, messageText)
+	l.logLine(message)
 
-	go l.sendToMessageService(message)
-
-	go l.writeToDatabase(message)
+	if l.pipeline != nil {
+		l.pipeline.enqueue(logEntry{message: message, messageService: l.messageService})
+	}
 }
 
-func (l *Logger) sendToMessageService(message *services.LogMessage) {
-	if l.messageService != nil {
-		if err := l.messageService.Send(message); err != nil {
-			l.internalError("sending message", err)
-		}
+func (l *Logger) logLine(message *services.LogMessage) {
+	if message.Level == string(Info) && !l.debugMode && l.pipeline != nil && l.pipeline.stores() {
+		return
+	}
+	if jsonOutput.Load() {
+		printJSON(message)
+		return
 	}
+	log.Printf("%s %s: %s%s", message.Level, message.Category, message.Text, consoleFields(message))
 }
 
-func (l *Logger) writeToDatabase(message *services.LogMessage) {
-	if l.database != nil {
-		// Use background context for async log writes
-		ctx := context.Background()
-		if err := l.database.WriteLogMessage(ctx, message); err != nil {
-			l.internalError("write to database", err)
-		}
+// consoleFields formats the fields of a message as " key=value" pairs: the
+// known fields first, then the others in order of key.
+func consoleFields(message *services.LogMessage) string {
+	var b strings.Builder
+	if message.RequestId != "" {
+		fmt.Fprintf(&b, " %s=%s", FieldRequestId, message.RequestId)
+	}
+	if message.TransactionId != 0 {
+		fmt.Fprintf(&b, " %s=%d", FieldTransactionId, message.TransactionId)
+	}
+	if message.Order != 0 {
+		fmt.Fprintf(&b, " %s=%d", FieldOrder, message.Order)
+	}
+	if message.UserId != "" {
+		fmt.Fprintf(&b, " %s=%s", FieldUserId, message.UserId)
+	}
+	if message.TraceId != "" {
+		fmt.Fprintf(&b, " trace_id=%s", message.TraceId)
+	}
+	keys := make([]string, 0, len(message.Fields))
+	for key := range message.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, message.Fields[key])
 	}
+	return b.String()
 }
 
-func (l *Logger) logLine(importance, text string) {
-	if importance == string(Info) && !l.debugMode && l.database != nil {
+// printJSON prints a message as a JSON line, with the level by name.
+func printJSON(message *services.LogMessage) {
+	record := *message
+	record.Level = levelNames[message.Level]
+	line, err := json.Marshal(&record)
+	if err != nil {
+		log.Printf("%s %s: %s", message.Level, message.Category, message.Text)
 		return
 	}
-	log.Printf("%s %s", importance, text)
+	jsonLog.Println(string(line))
 }
@@ -0,0 +1,680 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMemoryLogRecords limits the log messages kept by the memory database
+// when log_records is not set.
+const defaultMemoryLogRecords = 10000
+
+// errNoRecord is returned by the lookups that find nothing
+var errNoRecord = services.ErrNotFound
+
+// memoryUnitKey marks the context of a unit of work of the memory database.
+type memoryUnitKey struct{}
+
+// memoryUnit collects the changes of a unit of work to undo them on failure.
+type memoryUnit struct {
+	undo []func()
+}
+
+// memoryState holds the collections; it is also the layout of the snapshot file.
+type memoryState struct {
+	UserTags       []*entity.UserTag           `json:"user_tags"`
+	Transactions   []*entity.Transaction       `json:"transactions"`
+	PaymentMethods []*entity.PaymentMethod     `json:"payment_methods"`
+	PaymentOrders  []*entity.PaymentOrder      `json:"payment_orders"`
+	PaymentResults []*entity.PaymentParameters `json:"payment_results"`
+	Logs           []json.RawMessage           `json:"logs"`
+}
+
+// MemoryDatabase is a services.Database kept in memory, for local development,
+// demos and running Payments without MongoDB. It follows the semantics of the
+// Mongo implementation: documents are stored as copies, payment orders and
+// transactions are versioned, and collections keep insertion order where Mongo
+// would return documents in natural order.
+//
+// Units of work run one at a time and are undone on failure; single writes
+// outside a unit are not blocked by them and may see their intermediate state.
+// The state can be loaded from and saved to a JSON snapshot file.
+type MemoryDatabase struct {
+	mutex      sync.RWMutex
+	units      sync.Mutex // serializes units of work
+	state      memoryState
+	snapshot   string
+	logRecords int
+	logger     services.LogHandler
+	fences     map[services.LockKey]int64 // recorded by Fence, not part of the snapshot
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewMemoryDatabase creates an empty memory database. With a snapshot path, the
+// state is loaded from the file if it exists, and written to it by Save.
+func NewMemoryDatabase(snapshot string, logRecords int64) (*MemoryDatabase, error) {
+	m := &MemoryDatabase{
+		snapshot:   snapshot,
+		logRecords: int(logRecords),
+	}
+	if m.logRecords <= 0 {
+		m.logRecords = defaultMemoryLogRecords
+	}
+	if snapshot == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	if err = json.Unmarshal(data, &m.state); err != nil {
+		return nil, fmt.Errorf("decode snapshot %s: %w", snapshot, err)
+	}
+	return m, nil
+}
+
+func (m *MemoryDatabase) SetLogger(logger services.LogHandler) {
+	m.logger = logger
+}
+
+// StartSnapshots saves the snapshot at the interval until Close.
+func (m *MemoryDatabase) StartSnapshots(interval time.Duration) {
+	if m.snapshot == "" || interval <= 0 || m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Save(); err != nil && m.logger != nil {
+					m.logger.Error("save memory snapshot", err)
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Save writes the state to the snapshot file, replacing it atomically.
+func (m *MemoryDatabase) Save() error {
+	if m.snapshot == "" {
+		return nil
+	}
+	m.mutex.RLock()
+	state := m.state
+	state.Logs = m.recentLogs()
+	data, err := json.MarshalIndent(&state, "", "  ")
+	m.mutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(m.snapshot), filepath.Base(m.snapshot)+".*")
+	if err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err = temp.Close(); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err = os.Rename(temp.Name(), m.snapshot); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Close stops periodic snapshots and saves the final state.
+func (m *MemoryDatabase) Close(ctx context.Context) error {
+	if m.stop != nil {
+		close(m.stop)
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return m.Save()
+}
+
+// WithTransaction runs fn as a unit of work. Nested calls join the outer unit.
+// When fn fails, the writes it made are undone in reverse order.
+func (m *MemoryDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(memoryUnitKey{}).(*memoryUnit); ok {
+		return fn(ctx)
+	}
+
+	m.units.Lock()
+	defer m.units.Unlock()
+
+	unit := &memoryUnit{}
+	if err := fn(context.WithValue(ctx, memoryUnitKey{}, unit)); err != nil {
+		m.mutex.Lock()
+		for i := len(unit.undo) - 1; i >= 0; i-- {
+			unit.undo[i]()
+		}
+		m.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// remember registers the undo of a write in the unit of work of the context,
+// if any; m.mutex must be held.
+func (m *MemoryDatabase) remember(ctx context.Context, undo func()) {
+	if unit, ok := ctx.Value(memoryUnitKey{}).(*memoryUnit); ok {
+		unit.undo = append(unit.undo, undo)
+	}
+}
+
+// Fence records the fencing token of a lock key unless a greater one is recorded.
+func (m *MemoryDatabase) Fence(ctx context.Context, key services.LockKey, token int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous, ok := m.fences[key]
+	if previous > token {
+		return &services.FencedError{Key: key, Token: token}
+	}
+	if m.fences == nil {
+		m.fences = map[services.LockKey]int64{}
+	}
+	m.fences[key] = token
+	m.remember(ctx, func() {
+		if ok {
+			m.fences[key] = previous
+		} else {
+			delete(m.fences, key)
+		}
+	})
+	return nil
+}
+
+// SaveUserTag stores a user tag, replacing one with the same id tag. It is not
+// part of services.Database: user tags are written by the central system, here
+// it seeds the database for development.
+func (m *MemoryDatabase) SaveUserTag(tag *entity.UserTag) error {
+	stored, err := clone(tag)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, t := range m.state.UserTags {
+		if t.IdTag == tag.IdTag {
+			m.state.UserTags[i] = stored
+			return nil
+		}
+	}
+	m.state.UserTags = append(m.state.UserTags, stored)
+	return nil
+}
+
+// SaveTransaction stores a transaction, replacing one with the same id. Like
+// SaveUserTag, it seeds the database for development.
+func (m *MemoryDatabase) SaveTransaction(transaction *entity.Transaction) error {
+	stored, err := clone(transaction)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if i := m.transactionIndex(transaction.Id); i >= 0 {
+		m.state.Transactions[i] = stored
+		return nil
+	}
+	m.state.Transactions = append(m.state.Transactions, stored)
+	return nil
+}
+
+// WriteLogMessage stores a log message. The oldest messages beyond the limit
+// are dropped in chunks of a quarter of the limit, so that a write does not
+// copy the whole log; until then recentLogs leaves them out.
+func (m *MemoryDatabase) WriteLogMessage(_ context.Context, data services.Data) error {
+	message, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("write log message: %w", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state.Logs = append(m.state.Logs, message)
+	if len(m.state.Logs)-m.logRecords >= max(m.logRecords/4, 1) {
+		m.state.Logs = append(m.state.Logs[:0:0], m.recentLogs()...)
+	}
+	return nil
+}
+
+// recentLogs returns the newest log messages up to the limit.
+func (m *MemoryDatabase) recentLogs() []json.RawMessage {
+	if excess := len(m.state.Logs) - m.logRecords; excess > 0 {
+		return m.state.Logs[excess:]
+	}
+	return m.state.Logs
+}
+
+// WriteLogMessages stores log messages, dropping the oldest beyond the limit.
+func (m *MemoryDatabase) WriteLogMessages(ctx context.Context, data []services.Data) error {
+	for _, message := range data {
+		if err := m.WriteLogMessage(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUserTag retrieves a user tag (RFID card) by its identifier.
+func (m *MemoryDatabase) GetUserTag(_ context.Context, idTag string) (*entity.UserTag, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, tag := range m.state.UserTags {
+		if tag.IdTag == idTag {
+			return clone(tag)
+		}
+	}
+	return nil, fmt.Errorf("get user tag %s: %w", idTag, errNoRecord)
+}
+
+// GetTransaction retrieves a transaction by ID.
+func (m *MemoryDatabase) GetTransaction(_ context.Context, id int) (*entity.Transaction, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if i := m.transactionIndex(id); i >= 0 {
+		return clone(m.state.Transactions[i])
+	}
+	return nil, fmt.Errorf("get transaction %d: %w", id, errNoRecord)
+}
+
+// UpdateTransaction updates transaction payment billing data at the expected version.
+func (m *MemoryDatabase) UpdateTransaction(ctx context.Context, transaction *entity.Transaction) error {
+	update, err := clone(transaction)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expected := transaction.Version
+	i := m.transactionIndex(transaction.Id)
+	if i < 0 || m.state.Transactions[i].Version != expected {
+		return &services.ConflictError{Entity: "transaction", Id: transaction.Id, Version: expected}
+	}
+	stored := m.state.Transactions[i]
+	previous, err := clone(stored)
+	if err != nil {
+		return err
+	}
+	m.remember(ctx, func() { m.state.Transactions[i] = previous })
+
+	// only the payment fields are written, as by the Mongo update
+	updated, err := clone(stored)
+	if err != nil {
+		return err
+	}
+	updated.PaymentOrder = update.PaymentOrder
+	updated.PaymentError = update.PaymentError
+	updated.PaymentBilled = update.PaymentBilled
+	updated.PaymentOrders = update.PaymentOrders
+	updated.RefundLegs = update.RefundLegs
+	updated.Version = expected + 1
+	m.state.Transactions[i] = updated
+	transaction.Version = expected + 1
+	return nil
+}
+
+// GetPaymentMethod retrieves the best available payment method for a user:
+// the default one, or the one with the lowest fail count if there is no
+// default or the default has failures.
+func (m *MemoryDatabase) GetPaymentMethod(_ context.Context, userId string) (*entity.PaymentMethod, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var best *entity.PaymentMethod
+	for _, pm := range m.state.PaymentMethods {
+		if pm.UserId == userId && pm.IsDefault {
+			best = pm
+			break
+		}
+	}
+	if best == nil || best.FailCount > 0 {
+		best = nil
+		for _, pm := range m.state.PaymentMethods {
+			if pm.UserId == userId && (best == nil || pm.FailCount < best.FailCount) {
+				best = pm
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("get payment method for user %s: %w", userId, errNoRecord)
+	}
+	return clone(best)
+}
+
+// GetPaymentMethodByIdentifier retrieves a payment method by its unique identifier.
+func (m *MemoryDatabase) GetPaymentMethodByIdentifier(_ context.Context, identifier string) (*entity.PaymentMethod, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, pm := range m.state.PaymentMethods {
+		if pm.Identifier == identifier {
+			return clone(pm)
+		}
+	}
+	return nil, fmt.Errorf("get payment method by identifier: %w", errNoRecord)
+}
+
+// SavePaymentMethod saves a new payment method.
+// Returns an error if a payment method with the same identifier already exists for the user.
+func (m *MemoryDatabase) SavePaymentMethod(ctx context.Context, paymentMethod *entity.PaymentMethod) error {
+	stored, err := clone(paymentMethod)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, pm := range m.state.PaymentMethods {
+		if pm.Identifier == paymentMethod.Identifier && pm.UserId == paymentMethod.UserId {
+			return fmt.Errorf("payment method with identifier %s already exists", secret(paymentMethod.Identifier))
+		}
+	}
+	m.state.PaymentMethods = append(m.state.PaymentMethods, stored)
+	m.remember(ctx, func() { m.removePaymentMethod(stored) })
+	return nil
+}
+
+// UpdatePaymentMethodFailCount updates the fail counter of the first payment
+// method with the identifier.
+func (m *MemoryDatabase) UpdatePaymentMethodFailCount(ctx context.Context, identifier string, count int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, pm := range m.state.PaymentMethods {
+		if pm.Identifier == identifier {
+			previous := pm.FailCount
+			pm.FailCount = count
+			m.remember(ctx, func() { pm.FailCount = previous })
+			return nil
+		}
+	}
+	return nil
+}
+
+// GetPaymentOrderByTransaction retrieves an incomplete payment order for a transaction.
+func (m *MemoryDatabase) GetPaymentOrderByTransaction(_ context.Context, transactionId int) (*entity.PaymentOrder, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, order := range m.state.PaymentOrders {
+		if order.TransactionId == transactionId && !order.IsCompleted {
+			return clone(order)
+		}
+	}
+	return nil, fmt.Errorf("get payment order by transaction %d: %w", transactionId, errNoRecord)
+}
+
+// CreatePaymentOrder inserts a new payment order unless its number is taken.
+func (m *MemoryDatabase) CreatePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
+	expected := order.Version
+	order.Version = expected + 1
+	stored, err := clone(order)
+	order.Version = expected
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.orderIndex(order.Order) >= 0 {
+		return &services.ConflictError{Entity: "payment order", Id: order.Order, Version: expected}
+	}
+	m.state.PaymentOrders = append(m.state.PaymentOrders, stored)
+	m.remember(ctx, func() { m.removePaymentOrder(stored) })
+	order.Version = expected + 1
+	return nil
+}
+
+// SavePaymentOrder updates a payment order at its expected version.
+func (m *MemoryDatabase) SavePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
+	expected := order.Version
+	order.Version = expected + 1
+	stored, err := clone(order)
+	order.Version = expected
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.orderIndex(order.Order)
+	if i < 0 || m.state.PaymentOrders[i].Version != expected {
+		return &services.ConflictError{Entity: "payment order", Id: order.Order, Version: expected}
+	}
+	previous := m.state.PaymentOrders[i]
+	m.state.PaymentOrders[i] = stored
+	m.remember(ctx, func() {
+		if j := m.orderIndex(previous.Order); j >= 0 {
+			m.state.PaymentOrders[j] = previous
+		}
+	})
+	order.Version = expected + 1
+	return nil
+}
+
+// GetPaymentOrder retrieves a payment order by its order number.
+func (m *MemoryDatabase) GetPaymentOrder(_ context.Context, id int) (*entity.PaymentOrder, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if i := m.orderIndex(id); i >= 0 {
+		return clone(m.state.PaymentOrders[i])
+	}
+	return nil, fmt.Errorf("get payment order %d: %w", id, errNoRecord)
+}
+
+// GetLastOrder retrieves the most recently opened payment order.
+func (m *MemoryDatabase) GetLastOrder(_ context.Context) (*entity.PaymentOrder, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if len(m.state.PaymentOrders) == 0 {
+		return nil, fmt.Errorf("get last order: %w", errNoRecord)
+	}
+	orders := make([]*entity.PaymentOrder, len(m.state.PaymentOrders))
+	copy(orders, m.state.PaymentOrders)
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].TimeOpened.After(orders[j].TimeOpened)
+	})
+	return clone(orders[0])
+}
+
+// OpenOrderTimes returns the opening times of the orders not completed.
+func (m *MemoryDatabase) OpenOrderTimes(_ context.Context) ([]time.Time, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var times []time.Time
+	for _, order := range m.state.PaymentOrders {
+		if !order.IsCompleted {
+			times = append(times, order.TimeOpened)
+		}
+	}
+	return times, nil
+}
+
+// SavePaymentResult stores a payment response for audit purposes.
+func (m *MemoryDatabase) SavePaymentResult(_ context.Context, paymentParameters *entity.PaymentParameters) error {
+	stored, err := clone(paymentParameters)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state.PaymentResults = append(m.state.PaymentResults, stored)
+	return nil
+}
+
+// FindLogMessages returns the latest limit log messages matching the filter,
+// newest first.
+func (m *MemoryDatabase) FindLogMessages(_ context.Context, filter LogFilter, limit int) ([]*services.LogMessage, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var messages []*services.LogMessage
+	logs := m.recentLogs()
+	for i := len(logs) - 1; i >= 0 && len(messages) < limit; i-- {
+		var message services.LogMessage
+		if err := json.Unmarshal(logs[i], &message); err != nil {
+			return nil, fmt.Errorf("find logs: %w", err)
+		}
+		if matchLogFilter(filter, &message) {
+			messages = append(messages, &message)
+		}
+	}
+	return messages, nil
+}
+
+// matchLogFilter reports whether a log message matches the filter.
+func matchLogFilter(filter LogFilter, message *services.LogMessage) bool {
+	switch {
+	case filter.Level == string(Info) && message.Level != "" && message.Level != filter.Level:
+		return false
+	case filter.Level != "" && filter.Level != string(Info) && message.Level != filter.Level:
+		return false
+	case !filter.Before.IsZero() && !message.Timestamp.Before(filter.Before):
+		return false
+	case !filter.After.IsZero() && message.Timestamp.Before(filter.After):
+		return false
+	case len(filter.Levels) > 0 && message.Level != "" && !slices.Contains(filter.Levels, message.Level):
+		return false
+	case len(filter.Levels) > 0 && message.Level == "" && !slices.Contains(filter.Levels, string(Info)):
+		return false
+	}
+	if filter.RequestId == "" && len(filter.Orders) == 0 && filter.TransactionId == 0 && filter.UserId == "" {
+		return true
+	}
+	return filter.RequestId != "" && message.RequestId == filter.RequestId ||
+		message.Order != 0 && slices.Contains(filter.Orders, message.Order) ||
+		filter.TransactionId != 0 && message.TransactionId == filter.TransactionId ||
+		filter.UserId != "" && message.UserId == filter.UserId
+}
+
+// FindPaymentOrders returns up to limit orders matching any of the query
+// fields, newest first.
+func (m *MemoryDatabase) FindPaymentOrders(_ context.Context, query OrderQuery, limit int) ([]*entity.PaymentOrder, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var orders []*entity.PaymentOrder
+	for _, order := range m.state.PaymentOrders {
+		if slices.Contains(query.Orders, order.Order) ||
+			query.TransactionId != 0 && order.TransactionId == query.TransactionId ||
+			query.UserId != "" && order.UserId == query.UserId {
+			orders = append(orders, order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].TimeOpened.After(orders[j].TimeOpened)
+	})
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+	found := make([]*entity.PaymentOrder, len(orders))
+	for i, order := range orders {
+		var err error
+		if found[i], err = clone(order); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// FindPaymentResults returns the raw gateway results of the orders. The time
+// of a result is the date and hour the gateway reported, as no receive time is
+// kept.
+func (m *MemoryDatabase) FindPaymentResults(_ context.Context, orders []int) ([]ReceivedResult, error) {
+	numbers := make([]string, len(orders))
+	for i, order := range orders {
+		numbers[i] = strconv.Itoa(order)
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var results []ReceivedResult
+	for _, result := range m.state.PaymentResults {
+		if !slices.Contains(numbers, result.Order) {
+			continue
+		}
+		parameters, err := clone(result)
+		if err != nil {
+			return nil, err
+		}
+		received, _ := time.ParseInLocation("02/01/2006 15:04", result.Date+" "+result.Hour, time.Local)
+		results = append(results, ReceivedResult{Time: received, Parameters: parameters})
+	}
+	return results, nil
+}
+
+// transactionIndex returns the position of a transaction or -1; m.mutex must be held.
+func (m *MemoryDatabase) transactionIndex(id int) int {
+	for i, transaction := range m.state.Transactions {
+		if transaction.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// orderIndex returns the position of a payment order or -1; m.mutex must be held.
+func (m *MemoryDatabase) orderIndex(id int) int {
+	for i, order := range m.state.PaymentOrders {
+		if order.Order == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryDatabase) removePaymentOrder(order *entity.PaymentOrder) {
+	for i, o := range m.state.PaymentOrders {
+		if o == order {
+			m.state.PaymentOrders = append(m.state.PaymentOrders[:i], m.state.PaymentOrders[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *MemoryDatabase) removePaymentMethod(pm *entity.PaymentMethod) {
+	for i, p := range m.state.PaymentMethods {
+		if p == pm {
+			m.state.PaymentMethods = append(m.state.PaymentMethods[:i], m.state.PaymentMethods[i+1:]...)
+			return
+		}
+	}
+}
+
+// clone returns a deep copy through JSON, the format of the snapshot, so that
+// callers never share documents with the database.
+func clone[T any](value *T) (*T, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("copy %T: %w", value, err)
+	}
+	var copied T
+	if err = json.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("copy %T: %w", value, err)
+	}
+	return &copied, nil
+}
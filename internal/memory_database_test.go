@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMemoryLogLimit(t *testing.T) {
+	const limit = 8
+	snapshot := filepath.Join(t.TempDir(), "state.json")
+	m, err := NewMemoryDatabase(snapshot, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for written := 1; written <= 3*limit; written++ {
+		if err = m.WriteLogMessage(context.Background(), &services.LogMessage{Text: strconv.Itoa(written)}); err != nil {
+			t.Fatal(err)
+		}
+		if stored := len(m.state.Logs); stored > limit+limit/4 {
+			t.Fatalf("%d messages stored after %d writes", stored, written)
+		}
+
+		messages, err := m.FindLogMessages(context.Background(), LogFilter{}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := min(written, limit)
+		if len(messages) != kept {
+			t.Fatalf("%d messages found after %d writes, want %d", len(messages), written, kept)
+		}
+		// the newest messages, newest first
+		if first, last := messages[0].Text, messages[kept-1].Text; first != strconv.Itoa(written) || last != strconv.Itoa(written-kept+1) {
+			t.Fatalf("messages %s to %s after %d writes", first, last, written)
+		}
+	}
+
+	if err = m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state memoryState
+	if err = json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Logs) != limit {
+		t.Errorf("%d messages in the snapshot, want %d", len(state.Logs), limit)
+	}
+}
+
+func TestMemoryGetPaymentMethod(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []entity.PaymentMethod
+		want    string
+	}{
+		{"default", []entity.PaymentMethod{
+			{Identifier: "tok-1", FailCount: 0},
+			{Identifier: "tok-2", IsDefault: true, FailCount: 0},
+		}, "tok-2"},
+		{"default with failures", []entity.PaymentMethod{
+			{Identifier: "tok-1", IsDefault: true, FailCount: 2},
+			{Identifier: "tok-2", FailCount: 3},
+			{Identifier: "tok-3", FailCount: 1},
+		}, "tok-3"},
+		{"no default", []entity.PaymentMethod{
+			{Identifier: "tok-1", FailCount: 1},
+			{Identifier: "tok-2", FailCount: 0},
+		}, "tok-2"},
+		{"no method", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMemoryDatabase("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			// a default method of another user is never chosen
+			if err = m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-2", Identifier: "tok-9", IsDefault: true}); err != nil {
+				t.Fatal(err)
+			}
+			for _, pm := range tt.methods {
+				pm.UserId = "user-1"
+				if err = m.SavePaymentMethod(ctx, &pm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pm, err := m.GetPaymentMethod(ctx, "user-1")
+			if tt.want == "" {
+				if !errors.Is(err, services.ErrNotFound) {
+					t.Errorf("method %v, error %v; want not found", pm, err)
+				}
+				return
+			}
+			if err != nil || pm.Identifier != tt.want {
+				t.Errorf("method %v, error %v; want %s", pm, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemorySavePaymentMethodDuplicate(t *testing.T) {
+	m, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-1"}); err == nil {
+		t.Error("the same card was saved twice for a user")
+	}
+	// another user may register the same card
+	if err = m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-2", Identifier: "tok-1"}); err != nil {
+		t.Errorf("the card of another user: %v", err)
+	}
+	if n := len(m.state.PaymentMethods); n != 2 {
+		t.Errorf("%d payment methods stored, want 2", n)
+	}
+}
+
+func TestMemoryPaymentOrderWrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   int64 // version of the stored order 1200, none if negative
+		create   bool  // CreatePaymentOrder, or SavePaymentOrder
+		version  int64 // version of the written order
+		conflict bool
+	}{
+		{"create", -1, true, 0, false},
+		{"create a taken number", 1, true, 0, true},
+		{"save", 1, false, 1, false},
+		{"save a stale version", 2, false, 1, true},
+		{"save a newer version", 1, false, 2, true},
+		{"save a missing order", -1, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMemoryDatabase("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.stored >= 0 {
+				m.state.PaymentOrders = append(m.state.PaymentOrders, &entity.PaymentOrder{Order: 1200, Amount: 100, Version: tt.stored})
+			}
+
+			order := &entity.PaymentOrder{Order: 1200, Amount: 500, Version: tt.version}
+			if tt.create {
+				err = m.CreatePaymentOrder(ctx, order)
+			} else {
+				err = m.SavePaymentOrder(ctx, order)
+			}
+			stored, _ := m.GetPaymentOrder(ctx, 1200)
+			if tt.conflict {
+				if !errors.Is(err, services.ErrConflict) {
+					t.Fatalf("error %v, want conflict", err)
+				}
+				if order.Version != tt.version || stored != nil && stored.Amount != 100 {
+					t.Errorf("version %d, stored %+v; want the write refused", order.Version, stored)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Version != tt.version+1 || stored == nil || stored.Version != tt.version+1 || stored.Amount != 500 {
+				t.Errorf("version %d, stored %+v; want the order at version %d", order.Version, stored, tt.version+1)
+			}
+		})
+	}
+}
+
+func TestMemoryWithTransactionUndo(t *testing.T) {
+	m, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = m.SaveTransaction(&entity.Transaction{Id: 10, PaymentAmount: 1500}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-1", FailCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.CreatePaymentOrder(ctx, &entity.PaymentOrder{Order: 1200, TransactionId: 10, Amount: 500}); err != nil {
+		t.Fatal(err)
+	}
+	key := services.LockKey{Namespace: services.LockOrder, Id: "1200"}
+	if err = m.Fence(ctx, key, 3); err != nil {
+		t.Fatal(err)
+	}
+	before, err := json.Marshal(m.state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("gateway down")
+	err = m.WithTransaction(ctx, func(ctx context.Context) error {
+		order, err := m.GetPaymentOrder(ctx, 1200)
+		if err != nil {
+			return err
+		}
+		order.Amount = 900
+		if err = m.SavePaymentOrder(ctx, order); err != nil {
+			return err
+		}
+		if err = m.CreatePaymentOrder(ctx, &entity.PaymentOrder{Order: 1201, TransactionId: 10}); err != nil {
+			return err
+		}
+		transaction, err := m.GetTransaction(ctx, 10)
+		if err != nil {
+			return err
+		}
+		transaction.PaymentBilled = 900
+		if err = m.UpdateTransaction(ctx, transaction); err != nil {
+			return err
+		}
+		if err = m.Fence(ctx, key, 4); err != nil {
+			return err
+		}
+		// a nested unit joins the outer one and is undone with it
+		return m.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := m.UpdatePaymentMethodFailCount(ctx, "tok-1", 2); err != nil {
+				return err
+			}
+			if err := m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-2"}); err != nil {
+				return err
+			}
+			return failure
+		})
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("error %v, want the failure of the unit", err)
+	}
+	after, err := json.Marshal(m.state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("state after the failed unit:\n%s\nwant:\n%s", after, before)
+	}
+	if m.fences[key] != 3 {
+		t.Errorf("fence %d, want 3", m.fences[key])
+	}
+}
+
+func TestMemoryConcurrentUse(t *testing.T) {
+	m, err := NewMemoryDatabase("", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = m.CreatePaymentOrder(ctx, &entity.PaymentOrder{Order: 1200}); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				// a versioned read-modify-write, retried on conflict
+				for {
+					order, err := m.GetPaymentOrder(ctx, 1200)
+					if err != nil {
+						errs <- err
+						return
+					}
+					order.Amount++
+					err = m.SavePaymentOrder(ctx, order)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, services.ErrConflict) {
+						errs <- err
+						return
+					}
+				}
+				message := &services.LogMessage{Text: "increment", Order: 1200}
+				if err := m.WriteLogMessage(ctx, message); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := m.FindLogMessages(ctx, LogFilter{Orders: []int{1200}}, 10); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	order, err := m.GetPaymentOrder(ctx, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Amount != workers*increments || order.Version != workers*increments+1 {
+		t.Errorf("amount %d, version %d; want %d increments", order.Amount, order.Version, workers*increments)
+	}
+}
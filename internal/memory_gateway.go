@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	memoryGatewayName = "memory"
+
+	memoryCodeApproved = "approved"
+	memoryCodeDeclined = "declined"
+	memoryCodeNotFound = "not_found"
+	memoryCodeRejected = "not_allowed"
+)
+
+// memoryOrder is the ledger entry of an order settled by MemoryGateway.
+type memoryOrder struct {
+	last       *services.GatewayResult
+	authorized int
+	captured   int
+	refunded   int
+	held       bool
+	voided     bool
+}
+
+// MemoryGateway is an in-process services.Gateway that settles every operation
+// immediately. It keeps a ledger of orders, so refunds, captures and voids are
+// checked like an acquirer would, and card tokens can be scripted to decline.
+// It is meant for demos and for running Payments without an acquirer.
+type MemoryGateway struct {
+	mutex    sync.Mutex
+	orders   map[int]*memoryOrder
+	declines map[string]string
+}
+
+func NewMemoryGateway() *MemoryGateway {
+	return &MemoryGateway{
+		orders:   make(map[int]*memoryOrder),
+		declines: make(map[string]string),
+	}
+}
+
+// Decline makes authorizations with the given card token fail with the code.
+func (g *MemoryGateway) Decline(identifier, code string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.declines[identifier] = code
+}
+
+func (g *MemoryGateway) Name() string {
+	return memoryGatewayName
+}
+
+func (g *MemoryGateway) Validate() error {
+	return nil
+}
+
+func (g *MemoryGateway) Authorize(_ context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.orders[request.Order]; ok {
+		return nil, &services.GatewayError{Gateway: memoryGatewayName, Code: "duplicate_order", Duplicate: true}
+	}
+
+	result := g.newResult(services.OperationAuthorize, request)
+	result.Held = request.Hold
+	if code, ok := g.declines[request.Identifier]; ok {
+		result.Code = code
+	} else {
+		result.Approved = true
+		result.Code = memoryCodeApproved
+		result.AuthorisationCode = fmt.Sprintf("%06d", request.Order%1000000)
+	}
+
+	entry := &memoryOrder{last: result}
+	if result.Approved {
+		entry.authorized = request.Amount
+		entry.held = request.Hold
+		if !request.Hold {
+			entry.captured = request.Amount
+		}
+	}
+	g.orders[request.Order] = entry
+	return g.finish(result), nil
+}
+
+func (g *MemoryGateway) Capture(_ context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.settle(services.OperationCapture, request, func(entry *memoryOrder) bool {
+		if !entry.held || entry.voided || entry.captured+request.Amount > entry.authorized {
+			return false
+		}
+		entry.captured += request.Amount
+		entry.held = false
+		return true
+	})
+}
+
+func (g *MemoryGateway) Refund(_ context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.settle(services.OperationRefund, request, func(entry *memoryOrder) bool {
+		if entry.captured-entry.refunded < request.Amount {
+			return false
+		}
+		entry.refunded += request.Amount
+		return true
+	})
+}
+
+func (g *MemoryGateway) Void(_ context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.settle(services.OperationVoid, request, func(entry *memoryOrder) bool {
+		if !entry.held || entry.voided {
+			return false
+		}
+		entry.voided = true
+		entry.held = false
+		return true
+	})
+}
+
+func (g *MemoryGateway) Query(_ context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	entry, ok := g.orders[request.Order]
+	if !ok {
+		return nil, services.ErrGatewayNoRecord
+	}
+	result := *entry.last
+	return &result, nil
+}
+
+// VerifyNotification decodes a JSON-encoded GatewayResult. The memory gateway
+// does not sign notifications, so only the order is checked against the ledger.
+func (g *MemoryGateway) VerifyNotification(_ context.Context, data []byte) (*services.GatewayResult, error) {
+	var result services.GatewayResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode notification: %v", err)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.orders[result.Order]; !ok {
+		return nil, fmt.Errorf("unknown order %d", result.Order)
+	}
+	return g.finish(&result), nil
+}
+
+// settle applies an operation on an existing order; apply reports whether it is allowed.
+func (g *MemoryGateway) settle(operation services.GatewayOperation, request *services.GatewayRequest, apply func(entry *memoryOrder) bool) (*services.GatewayResult, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	entry, ok := g.orders[request.Order]
+	if !ok {
+		return nil, &services.GatewayError{Gateway: memoryGatewayName, Code: memoryCodeNotFound}
+	}
+
+	result := g.newResult(operation, request)
+	if apply(entry) {
+		result.Approved = true
+		result.Code = memoryCodeApproved
+	} else {
+		result.Code = memoryCodeRejected
+	}
+	entry.last = result
+	return g.finish(result), nil
+}
+
+func (g *MemoryGateway) newResult(operation services.GatewayOperation, request *services.GatewayRequest) *services.GatewayResult {
+	return &services.GatewayResult{
+		Operation:    operation,
+		Order:        request.Order,
+		Amount:       request.Amount,
+		Currency:     request.Currency,
+		Code:         memoryCodeDeclined,
+		Identifier:   request.Identifier,
+		CofTid:       request.CofTid,
+		Date:         time.Now().Format("02/01/2006 15:04"),
+		MerchantData: request.MerchantData,
+	}
+}
+
+// finish attaches the audit record to the result.
+func (g *MemoryGateway) finish(result *services.GatewayResult) *services.GatewayResult {
+	result.Raw = &entity.PaymentParameters{
+		Order:              fmt.Sprintf("%d", result.Order),
+		Amount:             fmt.Sprintf("%d", result.Amount),
+		Currency:           result.Currency,
+		Date:               result.Date,
+		MerchantIdentifier: result.Identifier,
+		Response:           result.Code,
+		MerchantData:       result.MerchantData,
+		TransactionType:    string(result.Operation),
+		AuthorisationCode:  result.AuthorisationCode,
+		MerchantCofTxnid:   result.CofTid,
+	}
+	return result
+}
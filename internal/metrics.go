@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of payments and refunds.
+const (
+	OutcomeApproved    = "approved"
+	OutcomeHeld        = "held"
+	OutcomeDeclined    = "declined"
+	OutcomeRejected    = "rejected"    // the gateway refused the request
+	OutcomeUnavailable = "unavailable" // abandoned while the gateway was unavailable
+)
+
+// Results of verified notifications.
+const (
+	NotificationValid     = "valid"
+	NotificationInvalid   = "invalid"
+	NotificationDuplicate = "duplicate" // valid, for an order or refund already closed
+)
+
+// collectTimeout limits the database queries of a scrape.
+const collectTimeout = 5 * time.Second
+
+var (
+	gatewayBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	lockBuckets    = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30}
+	mongoBuckets   = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1, 5}
+)
+
+// orderAgeBuckets are the upper bounds of the open order age buckets, with
+// the label of each.
+var orderAgeBuckets = []struct {
+	age   time.Duration
+	label string
+}{
+	{time.Minute, "0-1m"},
+	{5 * time.Minute, "1m-5m"},
+	{15 * time.Minute, "5m-15m"},
+	{time.Hour, "15m-1h"},
+	{24 * time.Hour, "1h-24h"},
+	{math.MaxInt64, "24h+"},
+}
+
+// OpenOrderStore is implemented by the databases that can list open orders
+// for the metrics.
+type OpenOrderStore interface {
+	// OpenOrderTimes returns the opening times of the orders not completed.
+	OpenOrderTimes(ctx context.Context) ([]time.Time, error)
+}
+
+// Metrics collects the service metrics in a Prometheus registry of its own.
+// Every series has the merchant and terminal labels of the configuration.
+// Counters and histograms are updated as events happen; the running jobs, the
+// circuit breaker, the locks, the log pipeline counters and the open orders
+// are read on each scrape. A nil *Metrics records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	paymentResults *prometheus.CounterVec
+	refundResults  *prometheus.CounterVec
+	notifications  *prometheus.CounterVec
+	gatewayLatency *prometheus.HistogramVec
+	lockWait       *prometheus.HistogramVec
+	mongoLatency   *prometheus.HistogramVec
+	mongoErrors    *prometheus.CounterVec
+
+	payments *Payments
+	gateway  *GuardedGateway
+	logs     *LogPipeline
+	orders   OpenOrderStore
+	logger   services.LogHandler
+}
+
+func NewMetrics(conf *config.Config) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		paymentResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "electrum_payments_total",
+			Help: "Payment operations completed, by operation, outcome and gateway response code.",
+		}, []string{"operation", "outcome", "code"}),
+		refundResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "electrum_refunds_total",
+			Help: "Refunds completed, by outcome and gateway response code.",
+		}, []string{"outcome", "code"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "electrum_notifications_total",
+			Help: "Gateway notifications received, by result.",
+		}, []string{"result"}),
+		gatewayLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "electrum_gateway_request_duration_seconds",
+			Help:    "Duration of gateway requests, by gateway, operation and result.",
+			Buckets: gatewayBuckets,
+		}, []string{"gateway", "operation", "result"}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "electrum_lock_wait_seconds",
+			Help:    "Time spent waiting for transaction and order locks.",
+			Buckets: lockBuckets,
+		}, []string{"namespace"}),
+		mongoLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "electrum_mongo_command_duration_seconds",
+			Help:    "Duration of MongoDB commands, by command.",
+			Buckets: mongoBuckets,
+		}, []string{"command"}),
+		mongoErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "electrum_mongo_command_errors_total",
+			Help: "Failed MongoDB commands, by command.",
+		}, []string{"command"}),
+	}
+
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{
+		"merchant": conf.Merchant.Code,
+		"terminal": conf.Merchant.Terminal,
+	}, m.registry)
+	registerer.MustRegister(
+		m.paymentResults, m.refundResults, m.notifications,
+		m.gatewayLatency, m.lockWait, m.mongoLatency, m.mongoErrors,
+		&stateCollector{metrics: m},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// SetPayments enables the in-flight job gauge and the lock metrics.
+func (m *Metrics) SetPayments(payments *Payments) {
+	m.payments = payments
+}
+
+// SetGateway enables the circuit breaker metrics.
+func (m *Metrics) SetGateway(gateway *GuardedGateway) {
+	m.gateway = gateway
+}
+
+// SetLogPipeline enables the log pipeline counters.
+func (m *Metrics) SetLogPipeline(logs *LogPipeline) {
+	m.logs = logs
+}
+
+// SetOrderStore enables the open order gauge.
+func (m *Metrics) SetOrderStore(orders OpenOrderStore) {
+	m.orders = orders
+}
+
+func (m *Metrics) SetLogger(logger services.LogHandler) {
+	m.logger = logger
+}
+
+// Handler serves the metrics in the Prometheus exposition formats.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog: log.Default(),
+	})
+}
+
+// Result counts a completed payment operation or refund.
+func (m *Metrics) Result(operation services.GatewayOperation, outcome, code string) {
+	if m == nil {
+		return
+	}
+	if operation == services.OperationRefund {
+		m.refundResults.WithLabelValues(outcome, code).Inc()
+		return
+	}
+	m.paymentResults.WithLabelValues(string(operation), outcome, code).Inc()
+}
+
+// Notification counts a gateway notification.
+func (m *Metrics) Notification(result string) {
+	if m == nil {
+		return
+	}
+	m.notifications.WithLabelValues(result).Inc()
+}
+
+// GatewayRequest records the duration of a gateway request; result is
+// answered, rejected or failed.
+func (m *Metrics) GatewayRequest(gateway string, operation services.GatewayOperation, result string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.gatewayLatency.WithLabelValues(gateway, string(operation), result).Observe(elapsed.Seconds())
+}
+
+// LockWait records the time spent acquiring a lock.
+func (m *Metrics) LockWait(namespace services.LockNamespace, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lockWait.WithLabelValues(string(namespace)).Observe(elapsed.Seconds())
+}
+
+// MongoCommand records the duration of a MongoDB command and counts it if it failed.
+func (m *Metrics) MongoCommand(command string, elapsed time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.mongoLatency.WithLabelValues(command).Observe(elapsed.Seconds())
+	if failed {
+		m.mongoErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// breakerStates are the values of the breaker state gauge.
+var breakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+var (
+	jobsInFlightDesc = prometheus.NewDesc("electrum_jobs_in_flight",
+		"Background payment jobs running.", nil, nil)
+
+	breakerStateDesc = prometheus.NewDesc("electrum_gateway_breaker_state",
+		"Circuit breaker state of the gateway, 1 for the current state.", []string{"gateway", "state"}, nil)
+	breakerOpenedDesc = prometheus.NewDesc("electrum_gateway_breaker_opened_total",
+		"Times the gateway circuit breaker opened.", []string{"gateway"}, nil)
+	breakerRejectedDesc = prometheus.NewDesc("electrum_gateway_breaker_rejected_total",
+		"Gateway requests refused by the open circuit breaker.", []string{"gateway"}, nil)
+
+	locksHeldDesc = prometheus.NewDesc("electrum_locks_held",
+		"Transaction and order locks held.", []string{"namespace"}, nil)
+	locksWaitingDesc = prometheus.NewDesc("electrum_locks_waiting",
+		"Callers waiting for a transaction or order lock.", []string{"namespace"}, nil)
+	locksAcquiredDesc = prometheus.NewDesc("electrum_locks_acquired_total",
+		"Transaction and order locks granted.", []string{"namespace"}, nil)
+	locksContendedDesc = prometheus.NewDesc("electrum_locks_contended_total",
+		"Locks granted after waiting for another holder.", []string{"namespace"}, nil)
+	locksTimedOutDesc = prometheus.NewDesc("electrum_locks_timed_out_total",
+		"Lock acquisitions abandoned on timeout or cancellation.", []string{"namespace"}, nil)
+	locksWaitDesc = prometheus.NewDesc("electrum_locks_wait_seconds_total",
+		"Total time callers waited for locks.", []string{"namespace"}, nil)
+
+	logQueuedDesc = prometheus.NewDesc("electrum_log_queued",
+		"Log messages waiting in the buffer.", nil, nil)
+	logWrittenDesc = prometheus.NewDesc("electrum_log_written_total",
+		"Log messages written to the database.", nil, nil)
+	logDroppedDesc = prometheus.NewDesc("electrum_log_dropped_total",
+		"Log messages dropped because the buffer was full.", nil, nil)
+	logFailedDesc = prometheus.NewDesc("electrum_log_failed_total",
+		"Log messages that could not be written or sent.", nil, nil)
+
+	openOrdersDesc = prometheus.NewDesc("electrum_open_orders",
+		"Payment orders not completed, by age.", []string{"age"}, nil)
+)
+
+// stateCollector reads the metrics of the service state on each scrape; the
+// parts that are not set are left out.
+type stateCollector struct {
+	metrics *Metrics
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		jobsInFlightDesc,
+		breakerStateDesc, breakerOpenedDesc, breakerRejectedDesc,
+		locksHeldDesc, locksWaitingDesc, locksAcquiredDesc, locksContendedDesc, locksTimedOutDesc, locksWaitDesc,
+		logQueuedDesc, logWrittenDesc, logDroppedDesc, logFailedDesc,
+		openOrdersDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.metrics
+	if m.payments != nil {
+		ch <- prometheus.MustNewConstMetric(jobsInFlightDesc, prometheus.GaugeValue, float64(m.payments.InFlight()))
+		collectLocks(ch, m.payments.LockStats())
+	}
+	if m.gateway != nil {
+		collectBreaker(ch, m.gateway.Status())
+	}
+	if m.logs != nil {
+		stats := m.logs.Stats()
+		ch <- prometheus.MustNewConstMetric(logQueuedDesc, prometheus.GaugeValue, float64(stats.Queued))
+		ch <- prometheus.MustNewConstMetric(logWrittenDesc, prometheus.CounterValue, float64(stats.Written))
+		ch <- prometheus.MustNewConstMetric(logDroppedDesc, prometheus.CounterValue, float64(stats.Dropped))
+		ch <- prometheus.MustNewConstMetric(logFailedDesc, prometheus.CounterValue, float64(stats.Failed))
+	}
+	if m.orders != nil {
+		m.collectOpenOrders(ch)
+	}
+}
+
+// collectBreaker sends the state of the gateway circuit breaker, one series
+// per state with 1 for the current one, and its counters.
+func collectBreaker(ch chan<- prometheus.Metric, status GatewayStatus) {
+	for _, state := range breakerStates {
+		value := 0.0
+		if status.Breaker.State == state {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, value, status.Gateway, string(state))
+	}
+	ch <- prometheus.MustNewConstMetric(breakerOpenedDesc, prometheus.CounterValue, float64(status.Breaker.Opened), status.Gateway)
+	ch <- prometheus.MustNewConstMetric(breakerRejectedDesc, prometheus.CounterValue, float64(status.Breaker.Rejected), status.Gateway)
+}
+
+// collectLocks sends the lock counters by namespace.
+func collectLocks(ch chan<- prometheus.Metric, stats []LockStats) {
+	for _, s := range stats {
+		namespace := string(s.Namespace)
+		ch <- prometheus.MustNewConstMetric(locksHeldDesc, prometheus.GaugeValue, float64(s.Held), namespace)
+		ch <- prometheus.MustNewConstMetric(locksWaitingDesc, prometheus.GaugeValue, float64(s.Waiting), namespace)
+		ch <- prometheus.MustNewConstMetric(locksAcquiredDesc, prometheus.CounterValue, float64(s.Acquired), namespace)
+		ch <- prometheus.MustNewConstMetric(locksContendedDesc, prometheus.CounterValue, float64(s.Contended), namespace)
+		ch <- prometheus.MustNewConstMetric(locksTimedOutDesc, prometheus.CounterValue, float64(s.TimedOut), namespace)
+		ch <- prometheus.MustNewConstMetric(locksWaitDesc, prometheus.CounterValue, s.WaitTotal.Seconds(), namespace)
+	}
+}
+
+// collectOpenOrders sends the number of open orders by age bucket; the gauge
+// is left out when the orders cannot be read.
+func (m *Metrics) collectOpenOrders(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	opened, err := m.orders.OpenOrderTimes(ctx)
+	if err != nil {
+		if m.logger != nil {
+			m.logger.Error("metrics: read open orders", err)
+		}
+		return
+	}
+	counts := make([]int, len(orderAgeBuckets))
+	now := time.Now()
+	for _, t := range opened {
+		age := now.Sub(t)
+		for i, bucket := range orderAgeBuckets {
+			if age < bucket.age {
+				counts[i]++
+				break
+			}
+		}
+	}
+	for i, bucket := range orderAgeBuckets {
+		ch <- prometheus.MustNewConstMetric(openOrdersDesc, prometheus.GaugeValue, float64(counts[i]), bucket.label)
+	}
+}
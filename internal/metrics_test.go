@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	conf := &config.Config{}
+	conf.Merchant.Code = "999008881"
+	conf.Merchant.Terminal = "1"
+	conf.Gateway.Breaker.Enabled = true
+	conf.Gateway.Breaker.FailureThreshold = 1
+	conf.Gateway.Breaker.OpenTimeout = time.Minute
+	conf.Gateway.Breaker.HalfOpenRequests = 1
+
+	p := NewPayments(conf)
+	p.SetLogger(NewLogger("payments", false, nil))
+	gateway := &stallingGateway{MemoryGateway: NewMemoryGateway(), mode: "fail"}
+	guarded := NewGuardedGateway(gateway, conf)
+	metrics := NewMetrics(conf)
+	metrics.SetPayments(p)
+	metrics.SetGateway(guarded)
+	p.SetMetrics(metrics)
+	guarded.SetMetrics(metrics)
+
+	// a failure opens the breaker
+	if _, err := guarded.Authorize(context.Background(), &services.GatewayRequest{Order: 1}); err == nil {
+		t.Fatal("transport failure not returned")
+	}
+	metrics.Result(services.OperationAuthorize, OutcomeApproved, "0000")
+	// the second lock of the order waits for the first
+	_, first, err := p.lockOrder(context.Background(), 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.unlock(first)
+	}()
+	_, second, err := p.lockOrder(context.Background(), 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.unlock(second)
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const labels = `merchant="999008881",`
+	for _, series := range []string{
+		`electrum_payments_total{code="0000",` + labels + `operation="authorize",outcome="approved",terminal="1"} 1`,
+		`electrum_gateway_breaker_state{gateway="memory",` + labels + `state="open",terminal="1"} 1`,
+		`electrum_gateway_breaker_state{gateway="memory",` + labels + `state="closed",terminal="1"} 0`,
+		`electrum_gateway_breaker_opened_total{gateway="memory",` + labels + `terminal="1"} 1`,
+		`electrum_locks_acquired_total{` + labels + `namespace="order",terminal="1"} 2`,
+		`electrum_locks_contended_total{` + labels + `namespace="order",terminal="1"} 1`,
+		`electrum_locks_held{` + labels + `namespace="order",terminal="1"} 0`,
+		`electrum_lock_wait_seconds_count{` + labels + `namespace="order",terminal="1"} 2`,
+		`electrum_jobs_in_flight{` + labels + `terminal="1"} 0`,
+	} {
+		if !strings.Contains(string(body), series+"\n") {
+			t.Errorf("missing %s", series)
+		}
+	}
+	if t.Failed() {
+		t.Logf("scraped:\n%s", body)
+	}
+}
@@ -0,0 +1,154 @@
+-- Payment data of electrum. Transactions and user tags are written by the
+-- central system; payment methods, orders, refunds and results by electrum.
+
+CREATE TABLE user_tags (
+    id_tag          TEXT PRIMARY KEY,
+    user_id         TEXT NOT NULL DEFAULT '',
+    username        TEXT NOT NULL DEFAULT '',
+    source          TEXT NOT NULL DEFAULT '',
+    is_enabled      BOOLEAN NOT NULL DEFAULT FALSE,
+    local           BOOLEAN NOT NULL DEFAULT FALSE,
+    note            TEXT NOT NULL DEFAULT '',
+    date_registered TIMESTAMPTZ,
+    last_seen       TIMESTAMPTZ
+);
+
+CREATE TABLE payment_methods (
+    id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id      TEXT NOT NULL,
+    identifier   TEXT NOT NULL,
+    description  TEXT NOT NULL DEFAULT '',
+    card_number  TEXT NOT NULL DEFAULT '',
+    card_type    TEXT NOT NULL DEFAULT '',
+    card_brand   TEXT NOT NULL DEFAULT '',
+    card_country TEXT NOT NULL DEFAULT '',
+    expiry_date  TEXT NOT NULL DEFAULT '',
+    is_default   BOOLEAN NOT NULL DEFAULT FALSE,
+    user_name    TEXT NOT NULL DEFAULT '',
+    fail_count   INTEGER NOT NULL DEFAULT 0,
+    cof_tid      TEXT NOT NULL DEFAULT '',
+    UNIQUE (user_id, identifier)
+);
+CREATE INDEX payment_methods_identifier ON payment_methods (identifier);
+
+CREATE TABLE transactions (
+    transaction_id    INTEGER PRIMARY KEY,
+    session_id        TEXT NOT NULL DEFAULT '',
+    is_finished       BOOLEAN NOT NULL DEFAULT FALSE,
+    connector_id      INTEGER NOT NULL DEFAULT 0,
+    charge_point_id   TEXT NOT NULL DEFAULT '',
+    id_tag            TEXT NOT NULL DEFAULT '',
+    reservation_id    INTEGER,
+    meter_start       INTEGER NOT NULL DEFAULT 0,
+    meter_stop        INTEGER NOT NULL DEFAULT 0,
+    time_start        TIMESTAMPTZ,
+    time_stop         TIMESTAMPTZ,
+    reason            TEXT NOT NULL DEFAULT '',
+    id_tag_note       TEXT NOT NULL DEFAULT '',
+    username          TEXT NOT NULL DEFAULT '',
+    payment_amount    INTEGER NOT NULL DEFAULT 0,
+    payment_billed    INTEGER NOT NULL DEFAULT 0,
+    payment_order     INTEGER NOT NULL DEFAULT 0,
+    payment_error     TEXT NOT NULL DEFAULT '',
+    payment_plan      JSONB NOT NULL DEFAULT '{}',
+    meter_values      JSONB NOT NULL DEFAULT '[]',
+    payment_method_id BIGINT REFERENCES payment_methods (id) ON DELETE SET NULL,
+    version           BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE payment_orders (
+    order_number      INTEGER PRIMARY KEY,
+    transaction_id    INTEGER REFERENCES transactions (transaction_id),
+    payment_method_id BIGINT REFERENCES payment_methods (id) ON DELETE SET NULL,
+    user_id           TEXT NOT NULL DEFAULT '',
+    user_name         TEXT NOT NULL DEFAULT '',
+    amount            INTEGER NOT NULL DEFAULT 0,
+    captured          INTEGER NOT NULL DEFAULT 0,
+    currency          TEXT NOT NULL DEFAULT '',
+    description       TEXT NOT NULL DEFAULT '',
+    identifier        TEXT NOT NULL DEFAULT '',
+    is_completed      BOOLEAN NOT NULL DEFAULT FALSE,
+    state             TEXT NOT NULL DEFAULT '',
+    state_history     JSONB NOT NULL DEFAULT '[]',
+    attempts          JSONB NOT NULL DEFAULT '[]',
+    result            TEXT NOT NULL DEFAULT '',
+    date              TEXT NOT NULL DEFAULT '',
+    time_opened       TIMESTAMPTZ,
+    time_closed       TIMESTAMPTZ,
+    refund_amount     INTEGER NOT NULL DEFAULT 0,
+    refund_time       TIMESTAMPTZ,
+    version           BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX payment_orders_transaction ON payment_orders (transaction_id, is_completed);
+CREATE INDEX payment_orders_time_opened ON payment_orders (time_opened);
+
+-- orders billed to a transaction, in billing order
+CREATE TABLE transaction_orders (
+    transaction_id INTEGER NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    order_number   INTEGER NOT NULL REFERENCES payment_orders (order_number),
+    position       INTEGER NOT NULL,
+    PRIMARY KEY (transaction_id, order_number)
+);
+
+CREATE TABLE refunds (
+    id                 BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_number       INTEGER NOT NULL REFERENCES payment_orders (order_number) ON DELETE CASCADE,
+    position           INTEGER NOT NULL,
+    amount             INTEGER NOT NULL,
+    status             TEXT NOT NULL,
+    reason             TEXT NOT NULL DEFAULT '',
+    operator           TEXT NOT NULL DEFAULT '',
+    authorisation_code TEXT NOT NULL DEFAULT '',
+    request_id         TEXT NOT NULL DEFAULT '',
+    result             TEXT NOT NULL DEFAULT '',
+    time               TIMESTAMPTZ,
+    time_closed        TIMESTAMPTZ,
+    UNIQUE (order_number, position)
+);
+
+CREATE TABLE refund_legs (
+    id             BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    order_number   INTEGER NOT NULL REFERENCES payment_orders (order_number),
+    position       INTEGER NOT NULL,
+    amount         INTEGER NOT NULL,
+    status         TEXT NOT NULL,
+    result         TEXT NOT NULL DEFAULT '',
+    time_opened    TIMESTAMPTZ,
+    time_closed    TIMESTAMPTZ,
+    UNIQUE (transaction_id, position)
+);
+
+-- raw gateway results, for audit
+CREATE TABLE payment_results (
+    id                   BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_number         TEXT NOT NULL DEFAULT '',
+    merchant_code        TEXT NOT NULL DEFAULT '',
+    terminal             TEXT NOT NULL DEFAULT '',
+    amount               TEXT NOT NULL DEFAULT '',
+    currency             TEXT NOT NULL DEFAULT '',
+    date                 TEXT NOT NULL DEFAULT '',
+    hour                 TEXT NOT NULL DEFAULT '',
+    secure_payment       TEXT NOT NULL DEFAULT '',
+    expiry_date          TEXT NOT NULL DEFAULT '',
+    merchant_identifier  TEXT NOT NULL DEFAULT '',
+    card_country         TEXT NOT NULL DEFAULT '',
+    response             TEXT NOT NULL DEFAULT '',
+    merchant_data        TEXT NOT NULL DEFAULT '',
+    transaction_type     TEXT NOT NULL DEFAULT '',
+    consumer_language    TEXT NOT NULL DEFAULT '',
+    authorisation_code   TEXT NOT NULL DEFAULT '',
+    card_brand           TEXT NOT NULL DEFAULT '',
+    merchant_cof_txnid   TEXT NOT NULL DEFAULT '',
+    processed_pay_method TEXT NOT NULL DEFAULT '',
+    time_received        TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX payment_results_order ON payment_results (order_number);
+
+CREATE TABLE payment_log (
+    id        BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    data_type TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    data      JSONB NOT NULL
+);
+CREATE INDEX payment_log_timestamp ON payment_log (timestamp);
@@ -0,0 +1,5 @@
+-- fencing token last recorded per lock key
+CREATE TABLE lock_fences (
+    lock_key TEXT PRIMARY KEY,
+    token    BIGINT NOT NULL
+);
@@ -0,0 +1,4 @@
+-- level of log messages, for the retention by level
+ALTER TABLE payment_log ADD COLUMN level TEXT;
+UPDATE payment_log SET level = json_extract(data, '$.level');
+CREATE INDEX payment_log_level_timestamp ON payment_log (level, timestamp);
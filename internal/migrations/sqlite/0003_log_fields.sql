@@ -0,0 +1,16 @@
+-- correlation fields of log messages, for the timeline of a request, order,
+-- transaction or user
+ALTER TABLE payment_log ADD COLUMN request_id TEXT;
+ALTER TABLE payment_log ADD COLUMN order_number INTEGER;
+ALTER TABLE payment_log ADD COLUMN transaction_id INTEGER;
+ALTER TABLE payment_log ADD COLUMN user_id TEXT;
+UPDATE payment_log SET
+    request_id = json_extract(data, '$.request_id'),
+    order_number = json_extract(data, '$.order'),
+    transaction_id = json_extract(data, '$.transaction_id'),
+    user_id = json_extract(data, '$.user_id');
+CREATE INDEX payment_log_request_id ON payment_log (request_id);
+CREATE INDEX payment_log_order_number ON payment_log (order_number);
+CREATE INDEX payment_log_transaction_id ON payment_log (transaction_id);
+CREATE INDEX payment_log_user_id ON payment_log (user_id);
+CREATE INDEX payment_orders_user_id ON payment_orders (user_id);
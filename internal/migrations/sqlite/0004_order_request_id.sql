@@ -0,0 +1,2 @@
+-- request ID of the call that opened an order
+ALTER TABLE payment_orders ADD COLUMN request_id TEXT NOT NULL DEFAULT '';
@@ -8,8 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -19,6 +27,7 @@ const (
 	collectionPaymentMethods = "payment_methods"
 	collectionPaymentOrders  = "payment_orders"
 	collectionPayment        = "payment"
+	collectionFences         = "lock_fences"
 )
 
 // MongoDB provides database operations for the Electrum payment service.
@@ -27,6 +36,9 @@ type MongoDB struct {
 	client           *mongo.Client
 	database         string
 	logRecordsNumber int64
+	transactions     bool // server supports multi-document transactions
+	metrics          atomic.Pointer[Metrics]
+	spans            sync.Map // spans of the commands in progress, by request id
 }
 
 // GetTransaction retrieves a transaction by ID from the database.
@@ -36,7 +48,7 @@ func (m *MongoDB) GetTransaction(ctx context.Context, id int) (*entity.Transacti
 	collection := m.client.Database(m.database).Collection(collectionTransactions)
 	err := collection.FindOne(ctx, filter).Decode(&transaction)
 	if err != nil {
-		return nil, fmt.Errorf("get transaction %d: %w", id, err)
+		return nil, fmt.Errorf("get transaction %d: %w", id, mongoNotFound(err))
 	}
 	return &transaction, nil
 }
@@ -72,7 +84,7 @@ func (m *MongoDB) GetPaymentMethodByIdentifier(ctx context.Context, identifier s
 	var paymentMethod *entity.PaymentMethod
 	err := collection.FindOne(ctx, filter).Decode(&paymentMethod)
 	if err != nil {
-		return nil, fmt.Errorf("get payment method by identifier: %w", err)
+		return nil, fmt.Errorf("get payment method by identifier: %w", mongoNotFound(err))
 	}
 	return paymentMethod, nil
 }
@@ -86,9 +98,17 @@ func (m *MongoDB) UpdatePaymentMethodFailCount(ctx context.Context, identifier s
 			{Key: "fail_count", Value: count},
 		}},
 	}
-	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+	written, err := m.remember(ctx, collectionPaymentMethods, filter)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
 		return fmt.Errorf("update payment method fail count: %w", err)
 	}
+	if result.MatchedCount > 0 {
+		written(bson.D{{Key: "fail_count", Value: count}})
+	}
 	return nil
 }
 
@@ -98,21 +118,70 @@ func (m *MongoDB) GetPaymentOrderByTransaction(ctx context.Context, transactionI
 	filter := bson.D{{Key: "transaction_id", Value: transactionId}, {Key: "is_completed", Value: false}}
 	var order entity.PaymentOrder
 	if err := collection.FindOne(ctx, filter).Decode(&order); err != nil {
-		return nil, fmt.Errorf("get payment order by transaction %d: %w", transactionId, err)
+		return nil, fmt.Errorf("get payment order by transaction %d: %w", transactionId, mongoNotFound(err))
 	}
 	return &order, nil
 }
 
-// SavePaymentOrder saves or updates a payment order using upsert.
+// versionFilter extends a filter to match only a document at the expected
+// version; documents written before versioning have no version and count as 0.
+func versionFilter(filter bson.D, expected int64) bson.D {
+	versioned := make(bson.D, len(filter), len(filter)+1)
+	copy(versioned, filter)
+	if expected == 0 {
+		return append(versioned, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "version", Value: int64(0)}},
+			bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}},
+		}})
+	}
+	return append(versioned, bson.E{Key: "version", Value: expected})
+}
+
+// CreatePaymentOrder inserts a new payment order; the unique index on the
+// order number turns a taken number into a conflict.
+func (m *MongoDB) CreatePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
+	filter := bson.D{{Key: "order", Value: order.Order}}
+	written, err := m.remember(ctx, collectionPaymentOrders, filter)
+	if err != nil {
+		return err
+	}
+	collection := m.client.Database(m.database).Collection(collectionPaymentOrders)
+
+	expected := order.Version
+	order.Version = expected + 1
+	if _, err = collection.InsertOne(ctx, order); err != nil {
+		order.Version = expected
+		if mongo.IsDuplicateKeyError(err) {
+			return &services.ConflictError{Entity: "payment order", Id: order.Order, Version: expected}
+		}
+		return fmt.Errorf("create payment order %d: %w", order.Order, err)
+	}
+	written(bson.D{{Key: "version", Value: order.Version}})
+	return nil
+}
+
+// SavePaymentOrder updates a payment order at its expected version.
 func (m *MongoDB) SavePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
 	filter := bson.D{{Key: "order", Value: order.Order}}
-	set := bson.M{"$set": order}
+	written, err := m.remember(ctx, collectionPaymentOrders, filter)
+	if err != nil {
+		return err
+	}
 	collection := m.client.Database(m.database).Collection(collectionPaymentOrders)
-	_, err := collection.UpdateOne(ctx, filter, set, options.Update().SetUpsert(true))
+
+	expected := order.Version
+	order.Version = expected + 1
+	result, err := collection.UpdateOne(ctx, versionFilter(filter, expected), bson.M{"$set": order})
 	if err != nil {
+		order.Version = expected
 		return fmt.Errorf("save payment order %d: %w", order.Order, err)
 	}
-	return nil
+	if result.MatchedCount > 0 {
+		written(bson.D{{Key: "version", Value: order.Version}})
+		return nil
+	}
+	order.Version = expected
+	return &services.ConflictError{Entity: "payment order", Id: order.Order, Version: expected}
 }
 
 // GetLastOrder retrieves the most recently opened payment order.
@@ -121,14 +190,14 @@ func (m *MongoDB) GetLastOrder(ctx context.Context) (*entity.PaymentOrder, error
 	filter := bson.D{}
 	var order entity.PaymentOrder
 	if err := collection.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "time_opened", Value: -1}})).Decode(&order); err != nil {
-		return nil, fmt.Errorf("get last order: %w", err)
+		return nil, fmt.Errorf("get last order: %w", mongoNotFound(err))
 	}
 	return &order, nil
 }
 
 // NewMongoClient creates a new MongoDB client with a persistent connection pool.
 // The client maintains an active connection to MongoDB and should be reused throughout
-// the application lifecycle. Call Disconnect() when the application shuts down.
+// the application lifecycle. Call Disconnect when the application shuts down.
 func NewMongoClient(conf *config.Config) (*MongoDB, error) {
 	if !conf.Mongo.Enabled {
 		return nil, nil
@@ -146,6 +215,40 @@ func NewMongoClient(conf *config.Config) (*MongoDB, error) {
 		})
 	}
 
+	m := &MongoDB{
+		database:         conf.Mongo.Database,
+		logRecordsNumber: conf.LogRecords,
+	}
+	// command durations and failures go to the metrics, once they are set;
+	// commands run for a traced operation get a span
+	clientOptions.SetMonitor(&event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				return
+			}
+			collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+			_, span := StartSpan(ctx, "mongo "+e.CommandName, trace.SpanKindClient,
+				attribute.String("db.system", "mongodb"),
+				attribute.String("db.name", e.DatabaseName),
+				attribute.String("db.operation", e.CommandName),
+				attribute.String("db.mongodb.collection", collection))
+			m.spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			m.metrics.Load().MongoCommand(e.CommandName, e.Duration, false)
+			if span, ok := m.spans.LoadAndDelete(e.RequestID); ok {
+				span.(trace.Span).End()
+			}
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			m.metrics.Load().MongoCommand(e.CommandName, e.Duration, true)
+			if span, ok := m.spans.LoadAndDelete(e.RequestID); ok {
+				spanError(span.(trace.Span), errors.New(e.Failure))
+				span.(trace.Span).End()
+			}
+		},
+	})
+
 	// Establish connection once at startup
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -158,23 +261,77 @@ func NewMongoClient(conf *config.Config) (*MongoDB, error) {
 		return nil, fmt.Errorf("ping mongodb: %w", err)
 	}
 
-	return &MongoDB{
-		client:           client,
-		database:         conf.Mongo.Database,
-		logRecordsNumber: conf.LogRecords,
-	}, nil
+	m.client = client
+	m.transactions = supportsTransactions(ctx, client)
+	return m, nil
+}
+
+// SetMetrics enables the command metrics.
+func (m *MongoDB) SetMetrics(metrics *Metrics) {
+	m.metrics.Store(metrics)
+}
+
+// OpenOrderTimes returns the opening times of the orders not completed.
+func (m *MongoDB) OpenOrderTimes(ctx context.Context) ([]time.Time, error) {
+	collection := m.client.Database(m.database).Collection(collectionPaymentOrders)
+	opts := options.Find().SetProjection(bson.D{{Key: "time_opened", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "is_completed", Value: false}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("find open orders: %w", err)
+	}
+	var orders []struct {
+		TimeOpened time.Time `bson:"time_opened"`
+	}
+	if err = cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("find open orders: %w", err)
+	}
+	times := make([]time.Time, len(orders))
+	for i, order := range orders {
+		times[i] = order.TimeOpened
+	}
+	return times, nil
 }
 
-// Disconnect closes the MongoDB connection gracefully.
+// SupportsTransactions reports whether units of work run in session transactions
+// rather than with compensation.
+func (m *MongoDB) SupportsTransactions() bool {
+	return m.transactions
+}
+
+// Disconnect closes the MongoDB connection gracefully, waiting for operations
+// in progress until the context is done.
 // This should be called when the application shuts down.
-func (m *MongoDB) Disconnect() error {
+func (m *MongoDB) Disconnect(ctx context.Context) error {
 	if m.client == nil {
 		return nil
 	}
-	ctx := context.Background()
 	return m.client.Disconnect(ctx)
 }
 
+// Ping checks that the primary answers, for readiness checks.
+func (m *MongoDB) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
+// Fence records the fencing token of a lock key in a document keyed by the
+// key. The filter only matches a smaller or equal token, so with a greater one
+// the upsert inserts a duplicate key and the unit of work is fenced. On a
+// standalone server the record is not compensated, and it does not stop a
+// stale holder that passed it before from writing.
+func (m *MongoDB) Fence(ctx context.Context, key services.LockKey, token int64) error {
+	collection := m.client.Database(m.database).Collection(collectionFences)
+	filter := bson.D{{Key: "_id", Value: key.String()}, {Key: "token", Value: bson.D{{Key: "$lte", Value: token}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: token}}}}
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return &services.FencedError{Key: key, Token: token}
+	}
+	if err != nil {
+		return fmt.Errorf("fence %s: %w", key, err)
+	}
+	return nil
+}
+
 // WriteLogMessage writes a log message to the database.
 func (m *MongoDB) WriteLogMessage(ctx context.Context, data services.Data) error {
 	collection := m.client.Database(m.database).Collection(collectionLog)
@@ -185,6 +342,24 @@ func (m *MongoDB) WriteLogMessage(ctx context.Context, data services.Data) error
 	return nil
 }
 
+// WriteLogMessages writes log messages with one unordered insert, so that a
+// failed message does not stop the others.
+func (m *MongoDB) WriteLogMessages(ctx context.Context, data []services.Data) error {
+	if len(data) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(data))
+	for i, message := range data {
+		documents[i] = message
+	}
+	collection := m.client.Database(m.database).Collection(collectionLog)
+	_, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("write log messages: %w", err)
+	}
+	return nil
+}
+
 // GetUserTag retrieves a user tag (RFID card) by its identifier.
 func (m *MongoDB) GetUserTag(ctx context.Context, id string) (*entity.UserTag, error) {
 	filter := bson.D{{Key: "id_tag", Value: id}}
@@ -192,7 +367,7 @@ func (m *MongoDB) GetUserTag(ctx context.Context, id string) (*entity.UserTag, e
 	var userTag entity.UserTag
 	err := collection.FindOne(ctx, filter).Decode(&userTag)
 	if err != nil {
-		return nil, fmt.Errorf("get user tag %s: %w", id, err)
+		return nil, fmt.Errorf("get user tag %s: %w", id, mongoNotFound(err))
 	}
 	return &userTag, nil
 }
@@ -213,26 +388,55 @@ func (m *MongoDB) GetPaymentOrder(ctx context.Context, id int) (*entity.PaymentO
 	filter := bson.D{{Key: "order", Value: id}}
 	var order entity.PaymentOrder
 	if err := collection.FindOne(ctx, filter).Decode(&order); err != nil {
-		return nil, fmt.Errorf("get payment order %d: %w", id, err)
+		return nil, fmt.Errorf("get payment order %d: %w", id, mongoNotFound(err))
 	}
 	return &order, nil
 }
 
-// UpdateTransaction updates transaction payment billing data.
+// mongoUnavailable reports whether a command failed because no server could
+// be reached, rather than on the command itself.
+func mongoUnavailable(err error) bool {
+	var selection topology.ServerSelectionError
+	return mongo.IsNetworkError(err) || errors.As(err, &selection) || errors.Is(err, mongo.ErrClientDisconnected)
+}
+
+// mongoNotFound converts the error of a lookup that found no document to
+// services.ErrNotFound.
+func mongoNotFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return services.ErrNotFound
+	}
+	return err
+}
+
+// UpdateTransaction updates transaction payment billing data at the expected version.
 func (m *MongoDB) UpdateTransaction(ctx context.Context, transaction *entity.Transaction) error {
 	collection := m.client.Database(m.database).Collection(collectionTransactions)
 	filter := bson.D{{Key: "transaction_id", Value: transaction.Id}}
+	expected := transaction.Version
 	update := bson.D{
 		{Key: "$set", Value: bson.D{
 			{Key: "payment_order", Value: transaction.PaymentOrder},
 			{Key: "payment_error", Value: transaction.PaymentError},
 			{Key: "payment_billed", Value: transaction.PaymentBilled},
 			{Key: "payment_orders", Value: transaction.PaymentOrders},
+			{Key: "refund_legs", Value: transaction.RefundLegs},
+			{Key: "version", Value: expected + 1},
 		}},
 	}
-	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+	written, err := m.remember(ctx, collectionTransactions, filter)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, versionFilter(filter, expected), update)
+	if err != nil {
 		return fmt.Errorf("update transaction %d: %w", transaction.Id, err)
 	}
+	if result.MatchedCount == 0 {
+		return &services.ConflictError{Entity: "transaction", Id: transaction.Id, Version: expected}
+	}
+	written(bson.D{{Key: "version", Value: expected + 1}})
+	transaction.Version = expected + 1
 	return nil
 }
 
@@ -255,10 +459,16 @@ func (m *MongoDB) SavePaymentMethod(ctx context.Context, paymentMethod *entity.P
 		return fmt.Errorf("payment method with identifier %s... already exists", paymentMethod.Identifier[0:10])
 	}
 
+	filter := bson.D{{Key: "identifier", Value: paymentMethod.Identifier}, {Key: "user_id", Value: paymentMethod.UserId}}
+	written, err := m.remember(ctx, collectionPaymentMethods, filter)
+	if err != nil {
+		return err
+	}
 	collection := m.client.Database(m.database).Collection(collectionPaymentMethods)
-	_, err := collection.InsertOne(ctx, paymentMethod)
+	result, err := collection.InsertOne(ctx, paymentMethod)
 	if err != nil {
 		return fmt.Errorf("save payment method: %w", err)
 	}
+	written(bson.D{{Key: "_id", Value: result.InsertedID}})
 	return nil
 }
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	collectionLocks    = "locks"
+	collectionCounters = "counters"
+	fencingCounterId   = "lock_fencing_token"
+)
+
+// MongoLocker is a services.Locker shared by all electrum instances using the
+// same database. A lease is a document in the locks collection keyed by the
+// lock key, with the owner and an expiry time:
+//   - a lease is granted when no document exists or the existing one expired;
+//   - the holder renews it in the background every third of the TTL, so a
+//     crashed instance releases its keys after at most one TTL;
+//   - a lease taken over by another holder, or not renewed in time to be sure
+//     it is still held, is reported lost through Lease.Lost;
+//   - fencing tokens come from a counter document and never decrease, even if
+//     lease documents are deleted by the TTL index.
+type MongoLocker struct {
+	db           *MongoDB
+	owner        string
+	ttl          time.Duration
+	pollInterval time.Duration
+	logger       services.LogHandler
+	mutex        sync.Mutex
+	held         map[string]services.LockKey // leases of this instance by holder
+}
+
+// NewMongoLocker creates a locker with the given lease TTL and ensures the TTL
+// index that removes expired leases. An empty owner defaults to host name and process id.
+func NewMongoLocker(db *MongoDB, owner string, ttl time.Duration) (*MongoLocker, error) {
+	if owner == "" {
+		host, _ := os.Hostname()
+		owner = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	locker := &MongoLocker{
+		db:           db,
+		owner:        owner,
+		ttl:          ttl,
+		pollInterval: 100 * time.Millisecond,
+		held:         make(map[string]services.LockKey),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	if _, err := locker.collection().Indexes().CreateOne(ctx, index); err != nil {
+		return nil, fmt.Errorf("create locks ttl index: %w", err)
+	}
+	return locker, nil
+}
+
+func (m *MongoLocker) SetLogger(logger services.LogHandler) {
+	m.logger = logger
+}
+
+func (m *MongoLocker) collection() *mongo.Collection {
+	return m.db.client.Database(m.db.database).Collection(collectionLocks)
+}
+
+// Acquire polls until the key is free or the context is done.
+func (m *MongoLocker) Acquire(ctx context.Context, lockKey services.LockKey) (services.Lease, error) {
+	key := lockKey.String()
+	holder := fmt.Sprintf("%s/%s", m.owner, GenerateRequestID())
+	for {
+		ok, err := m.tryAcquire(ctx, key, holder)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			token, err := m.nextToken(ctx)
+			if err != nil {
+				_, _ = m.collection().DeleteOne(context.Background(), bson.D{{Key: "_id", Value: key}, {Key: "owner", Value: holder}})
+				return nil, err
+			}
+			filter := bson.D{{Key: "_id", Value: key}, {Key: "owner", Value: holder}}
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: token}}}}
+			if _, err = m.collection().UpdateOne(ctx, filter, update); err != nil {
+				_, _ = m.collection().DeleteOne(context.Background(), filter)
+				return nil, fmt.Errorf("set fencing token: %w", err)
+			}
+			lease := &mongoLease{
+				locker:  m,
+				lockKey: lockKey,
+				key:     key,
+				holder:  holder,
+				token:   token,
+				expires: time.Now().Add(m.ttl),
+				stop:    make(chan struct{}),
+				lost:    make(chan struct{}),
+			}
+			m.hold(holder, lockKey)
+			go lease.keepAlive()
+			return lease, nil
+		}
+
+		select {
+		case <-time.After(m.pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *MongoLocker) hold(holder string, key services.LockKey) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.held[holder] = key
+}
+
+func (m *MongoLocker) forget(holder string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.held, holder)
+}
+
+// HeldKeys returns the keys leased by this instance; leases of other
+// instances are not listed.
+func (m *MongoLocker) HeldKeys() []services.LockKey {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]services.LockKey, 0, len(m.held))
+	for _, key := range m.held {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
+
+// tryAcquire takes the lease document if it is missing or expired.
+func (m *MongoLocker) tryAcquire(ctx context.Context, key, holder string) (bool, error) {
+	now := time.Now()
+	filter := bson.D{{Key: "_id", Value: key}, {Key: "expires_at", Value: bson.D{{Key: "$lt", Value: now}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "owner", Value: holder},
+		{Key: "acquired_at", Value: now},
+		{Key: "expires_at", Value: now.Add(m.ttl)},
+	}}}
+	_, err := m.collection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err == nil {
+		return true, nil
+	}
+	// the upsert collides with a live lease document
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("acquire lock %s: %w", key, err)
+}
+
+func (m *MongoLocker) nextToken(ctx context.Context) (int64, error) {
+	var counter struct {
+		Value int64 `bson:"value"`
+	}
+	filter := bson.D{{Key: "_id", Value: fencingCounterId}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "value", Value: int64(1)}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := m.db.client.Database(m.db.database).Collection(collectionCounters).FindOneAndUpdate(ctx, filter, update, opts).Decode(&counter)
+	if err != nil {
+		return 0, fmt.Errorf("next fencing token: %w", err)
+	}
+	return counter.Value, nil
+}
+
+type mongoLease struct {
+	locker  *MongoLocker
+	lockKey services.LockKey
+	key     string // lease document id
+	holder  string
+	token   int64
+	expires time.Time // local bound of the expiry, set by keepAlive only
+	stop    chan struct{}
+	once    sync.Once
+	lost    chan struct{} // closed by keepAlive
+}
+
+func (l *mongoLease) Key() services.LockKey {
+	return l.lockKey
+}
+
+func (l *mongoLease) Token() int64 {
+	return l.token
+}
+
+func (l *mongoLease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *mongoLease) Renew(ctx context.Context) error {
+	filter := bson.D{{Key: "_id", Value: l.key}, {Key: "owner", Value: l.holder}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: time.Now().Add(l.locker.ttl)}}}}
+	result, err := l.locker.collection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("renew lock %s: %w", l.key, err)
+	}
+	if result.MatchedCount == 0 {
+		return services.ErrLeaseLost
+	}
+	return nil
+}
+
+func (l *mongoLease) Release(ctx context.Context) error {
+	l.once.Do(func() { close(l.stop) })
+	l.locker.forget(l.holder)
+	filter := bson.D{{Key: "_id", Value: l.key}, {Key: "owner", Value: l.holder}}
+	result, err := l.locker.collection().DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("release lock %s: %w", l.key, err)
+	}
+	if result.DeletedCount == 0 {
+		return services.ErrLeaseLost
+	}
+	return nil
+}
+
+// keepAlive renews the lease until it is released or lost. When renewals fail
+// and less than a renewal interval is left before the lease may expire, the
+// lease is given up as lost: another instance could take it by then.
+func (l *mongoLease) keepAlive() {
+	interval := l.locker.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := l.Renew(ctx)
+			cancel()
+			if err == nil {
+				l.expires = start.Add(l.locker.ttl)
+				continue
+			}
+			if !errors.Is(err, services.ErrLeaseLost) {
+				if l.locker.logger != nil {
+					l.locker.logger.Error("renew lock", err)
+				}
+				if time.Until(l.expires) > interval {
+					continue
+				}
+			}
+			l.markLost()
+			return
+		}
+	}
+}
+
+// markLost reports the lease as lost to its holder, unless it was released
+// while being renewed.
+func (l *mongoLease) markLost() {
+	select {
+	case <-l.stop:
+		return
+	default:
+	}
+	close(l.lost)
+	l.locker.forget(l.holder)
+	if l.locker.logger != nil {
+		l.locker.logger.Warn(fmt.Sprintf("lock %s lost (token %d)", l.key, l.token))
+	}
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"slices"
+	"strconv"
+)
+
+// CountLogs returns the number of log records, as estimated from the
+// collection metadata.
+func (m *MongoDB) CountLogs(ctx context.Context) (int64, error) {
+	count, err := m.client.Database(m.database).Collection(collectionLog).EstimatedDocumentCount(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("count logs: %w", err)
+	}
+	return count, nil
+}
+
+// ReadLogs returns up to limit log records matching the filter, oldest first,
+// as relaxed extended JSON.
+func (m *MongoDB) ReadLogs(ctx context.Context, filter LogFilter, limit int) ([]StoredLog, error) {
+	collection := m.client.Database(m.database).Collection(collectionLog)
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, mongoLogFilter(filter), opts)
+	if err != nil {
+		return nil, fmt.Errorf("read logs: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []StoredLog
+	for cursor.Next(ctx) {
+		id, _ := cursor.Current.Lookup("_id").ObjectIDOK()
+		data, err := bson.MarshalExtJSON(cursor.Current, false, false)
+		if err != nil {
+			return nil, fmt.Errorf("read logs: %w", err)
+		}
+		records = append(records, StoredLog{Id: id.Hex(), Data: data})
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, fmt.Errorf("read logs: %w", err)
+	}
+	return records, nil
+}
+
+// mongoLogFilter builds the query of a log filter; records without a level
+// match info.
+func mongoLogFilter(filter LogFilter) bson.D {
+	query := bson.D{}
+	switch filter.Level {
+	case "":
+	case string(Info):
+		query = append(query, bson.E{Key: "level", Value: bson.D{{Key: "$in", Value: bson.A{filter.Level, nil}}}})
+	default:
+		query = append(query, bson.E{Key: "level", Value: filter.Level})
+	}
+	if len(filter.Levels) > 0 {
+		levels := bson.A{}
+		for _, level := range filter.Levels {
+			levels = append(levels, level)
+		}
+		if slices.Contains(filter.Levels, string(Info)) {
+			levels = append(levels, nil)
+		}
+		query = append(query, bson.E{Key: "level", Value: bson.D{{Key: "$in", Value: levels}}})
+	}
+	timestamp := bson.D{}
+	if !filter.Before.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$lt", Value: filter.Before})
+	}
+	if !filter.After.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$gte", Value: filter.After})
+	}
+	if len(timestamp) > 0 {
+		query = append(query, bson.E{Key: "timestamp", Value: timestamp})
+	}
+
+	var correlation bson.A
+	if filter.RequestId != "" {
+		correlation = append(correlation, bson.D{{Key: "request_id", Value: filter.RequestId}})
+	}
+	if len(filter.Orders) > 0 {
+		correlation = append(correlation, bson.D{{Key: "order", Value: bson.D{{Key: "$in", Value: filter.Orders}}}})
+	}
+	if filter.TransactionId != 0 {
+		correlation = append(correlation, bson.D{{Key: "transaction_id", Value: filter.TransactionId}})
+	}
+	if filter.UserId != "" {
+		correlation = append(correlation, bson.D{{Key: "user_id", Value: filter.UserId}})
+	}
+	if len(correlation) > 0 {
+		query = append(query, bson.E{Key: "$or", Value: correlation})
+	}
+	return query
+}
+
+// FindLogMessages returns the latest limit log messages matching the filter,
+// newest first.
+func (m *MongoDB) FindLogMessages(ctx context.Context, filter LogFilter, limit int) ([]*services.LogMessage, error) {
+	collection := m.client.Database(m.database).Collection(collectionLog)
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, mongoLogFilter(filter), opts)
+	if err != nil {
+		return nil, fmt.Errorf("find logs: %w", err)
+	}
+	var messages []*services.LogMessage
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, fmt.Errorf("find logs: %w", err)
+	}
+	return messages, nil
+}
+
+// FindPaymentOrders returns up to limit orders matching any of the query
+// fields, newest first.
+func (m *MongoDB) FindPaymentOrders(ctx context.Context, query OrderQuery, limit int) ([]*entity.PaymentOrder, error) {
+	var filters bson.A
+	if len(query.Orders) > 0 {
+		filters = append(filters, bson.D{{Key: "order", Value: bson.D{{Key: "$in", Value: query.Orders}}}})
+	}
+	if query.TransactionId != 0 {
+		filters = append(filters, bson.D{{Key: "transaction_id", Value: query.TransactionId}})
+	}
+	if query.UserId != "" {
+		filters = append(filters, bson.D{{Key: "user_id", Value: query.UserId}})
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	collection := m.client.Database(m.database).Collection(collectionPaymentOrders)
+	opts := options.Find().SetSort(bson.D{{Key: "time_opened", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.D{{Key: "$or", Value: filters}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("find payment orders: %w", err)
+	}
+	var orders []*entity.PaymentOrder
+	if err = cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("find payment orders: %w", err)
+	}
+	return orders, nil
+}
+
+// FindPaymentResults returns the raw gateway results of the orders, with the
+// time they were stored as recorded in their object id.
+func (m *MongoDB) FindPaymentResults(ctx context.Context, orders []int) ([]ReceivedResult, error) {
+	numbers := make(bson.A, 0, len(orders))
+	for _, order := range orders {
+		numbers = append(numbers, strconv.Itoa(order))
+	}
+	collection := m.client.Database(m.database).Collection(collectionPayment)
+	cursor, err := collection.Find(ctx, bson.D{{Key: "order", Value: bson.D{{Key: "$in", Value: numbers}}}})
+	if err != nil {
+		return nil, fmt.Errorf("find payment results: %w", err)
+	}
+	defer cursor.Close(ctx)
+	var results []ReceivedResult
+	for cursor.Next(ctx) {
+		var parameters entity.PaymentParameters
+		if err = cursor.Decode(&parameters); err != nil {
+			return nil, fmt.Errorf("find payment results: %w", err)
+		}
+		id, _ := cursor.Current.Lookup("_id").ObjectIDOK()
+		results = append(results, ReceivedResult{Time: id.Timestamp(), Parameters: &parameters})
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, fmt.Errorf("find payment results: %w", err)
+	}
+	return results, nil
+}
+
+// DeleteLogs deletes log records by id. Deleting from a capped collection
+// requires MongoDB 5.0 or later.
+func (m *MongoDB) DeleteLogs(ctx context.Context, ids []string) (int64, error) {
+	objectIds := make(bson.A, 0, len(ids))
+	for _, id := range ids {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return 0, fmt.Errorf("delete logs: %w", err)
+		}
+		objectIds = append(objectIds, objectId)
+	}
+	collection := m.client.Database(m.database).Collection(collectionLog)
+	result, err := collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: objectIds}}}})
+	if err != nil {
+		return 0, fmt.Errorf("delete logs: %w", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// EnsureCappedLogs creates the log collection as a capped collection of at
+// most records documents and size bytes, if it does not exist yet, and reports
+// whether the collection is capped. An existing collection is not converted:
+// convertToCapped cannot limit the number of documents and blocks the database
+// while it copies them.
+func (m *MongoDB) EnsureCappedLogs(ctx context.Context, records, size int64) (bool, error) {
+	db := m.client.Database(m.database)
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collectionLog}})
+	if err != nil {
+		return false, fmt.Errorf("read log collection: %w", err)
+	}
+	if len(specs) > 0 {
+		capped, _ := specs[0].Options.Lookup("capped").BooleanOK()
+		return capped, nil
+	}
+
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(size).SetMaxDocuments(records)
+	err = db.CreateCollection(ctx, collectionLog, opts)
+	var commandError mongo.CommandError
+	if err != nil && !(errors.As(err, &commandError) && commandError.Code == 48) {
+		return false, fmt.Errorf("create capped log collection: %w", err)
+	}
+	if err != nil {
+		// created meanwhile by a log write or another instance
+		return m.EnsureCappedLogs(ctx, records, size)
+	}
+	return true, nil
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+const collectionMigrations = "migrations"
+
+const (
+	migrationRunning = "running"
+	migrationDone    = "done"
+	// migrationTakeover is the age after which a running claim is considered
+	// left by a failed or interrupted run
+	migrationTakeover = 10 * time.Minute
+)
+
+// mongoMigration is a data migration. apply must be idempotent: it selects
+// only the documents that still need the change, so that running it again, or
+// after a partial run, is safe. In a dry run it counts those documents.
+type mongoMigration struct {
+	version int
+	name    string
+	apply   func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error)
+}
+
+// migrationRecord is the record of a migration in the migrations collection.
+type migrationRecord struct {
+	Version  int       `bson:"_id"`
+	Name     string    `bson:"name"`
+	Status   string    `bson:"status"`
+	Owner    string    `bson:"owner"`
+	Affected int64     `bson:"affected"`
+	Started  time.Time `bson:"started"`
+	Finished time.Time `bson:"finished,omitempty"`
+}
+
+// mongoMigrations lists the migrations in order. Applied migrations must not
+// change; data changes are added as new migrations.
+var mongoMigrations = []mongoMigration{
+	{1, "version_fields", migrateVersionFields},
+	{2, "payment_method_fail_count", migrateFailCount},
+	{3, "order_state", migrateOrderState},
+}
+
+// Migrate applies the migrations not recorded as done in the migrations
+// collection, in order of version; in a dry run, it reports them with the
+// number of documents they would change. A migration is claimed with an insert
+// of its record, so that with several instances only one runs it; a claim left
+// by a failed or interrupted run is taken over once it is older than
+// migrationTakeover.
+func (m *MongoDB) Migrate(ctx context.Context, owner string, dryRun bool) ([]SchemaStep, error) {
+	db := m.client.Database(m.database)
+	records := db.Collection(collectionMigrations)
+
+	var steps []SchemaStep
+	for _, migration := range mongoMigrations {
+		target := fmt.Sprintf("migration %d_%s", migration.version, migration.name)
+
+		var record migrationRecord
+		err := records.FindOne(ctx, bson.D{{Key: "_id", Value: migration.version}}).Decode(&record)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return steps, fmt.Errorf("read %s: %w", target, err)
+		}
+		if err == nil && record.Status == migrationDone {
+			steps = append(steps, SchemaStep{Target: target, Action: SchemaExists})
+			continue
+		}
+
+		if dryRun {
+			affected, err := migration.apply(ctx, db, true)
+			if err != nil {
+				return steps, fmt.Errorf("check %s: %w", target, err)
+			}
+			steps = append(steps, SchemaStep{target, SchemaPending, fmt.Sprintf("%d documents", affected)})
+			continue
+		}
+
+		claimed, err := m.claimMigration(ctx, migration, owner, err == nil)
+		if err != nil {
+			return steps, fmt.Errorf("claim %s: %w", target, err)
+		}
+		if !claimed {
+			steps = append(steps, SchemaStep{Target: target, Action: SchemaSkipped})
+			continue
+		}
+
+		affected, err := migration.apply(ctx, db, false)
+		if err != nil {
+			// leave the claim for the next start to take over
+			return steps, fmt.Errorf("apply %s: %w", target, err)
+		}
+		_, err = records.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: migration.version}, {Key: "owner", Value: owner}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: migrationDone},
+				{Key: "affected", Value: affected},
+				{Key: "finished", Value: time.Now()},
+			}}})
+		if err != nil {
+			return steps, fmt.Errorf("record %s: %w", target, err)
+		}
+		steps = append(steps, SchemaStep{target, SchemaApplied, fmt.Sprintf("%d documents", affected)})
+	}
+	return steps, nil
+}
+
+// claimMigration records the migration as running by owner. A stale record
+// left running by an earlier run is taken over. Returns false if another
+// instance claimed it or is still running it.
+func (m *MongoDB) claimMigration(ctx context.Context, migration mongoMigration, owner string, recorded bool) (bool, error) {
+	records := m.client.Database(m.database).Collection(collectionMigrations)
+	record := migrationRecord{
+		Version: migration.version,
+		Name:    migration.name,
+		Status:  migrationRunning,
+		Owner:   owner,
+		Started: time.Now(),
+	}
+	if !recorded {
+		_, err := records.InsertOne(ctx, record)
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	result, err := records.ReplaceOne(ctx,
+		bson.D{
+			{Key: "_id", Value: migration.version},
+			{Key: "status", Value: migrationRunning},
+			{Key: "started", Value: bson.D{{Key: "$lt", Value: time.Now().Add(-migrationTakeover)}}},
+		}, record)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// updateMissing sets a default on the documents of a collection that lack a field.
+func updateMissing(ctx context.Context, collection *mongo.Collection, field string, value any, dryRun bool) (int64, error) {
+	filter := bson.D{{Key: field, Value: bson.D{{Key: "$exists", Value: false}}}}
+	if dryRun {
+		return collection.CountDocuments(ctx, filter)
+	}
+	result, err := collection.UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: value}}}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// migrateVersionFields sets version 0 on orders and transactions saved before
+// versioning, so that they can be queried by version.
+func migrateVersionFields(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	orders, err := updateMissing(ctx, db.Collection(collectionPaymentOrders), "version", int64(0), dryRun)
+	if err != nil {
+		return orders, err
+	}
+	transactions, err := updateMissing(ctx, db.Collection(collectionTransactions), "version", int64(0), dryRun)
+	return orders + transactions, err
+}
+
+// migrateFailCount sets a zero fail count on payment methods without one: a
+// missing field sorts before zero and would make such a method preferred.
+func migrateFailCount(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	return updateMissing(ctx, db.Collection(collectionPaymentMethods), "fail_count", 0, dryRun)
+}
+
+// migrateOrderState stores the state of orders saved before states were
+// recorded, as derived from their completion flag and result.
+func migrateOrderState(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	collection := db.Collection(collectionPaymentOrders)
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "state", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "state", Value: ""}},
+	}}}
+	if dryRun {
+		return collection.CountDocuments(ctx, filter)
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var affected int64
+	for cursor.Next(ctx) {
+		var order entity.PaymentOrder
+		if err = cursor.Decode(&order); err != nil {
+			return affected, err
+		}
+		state := order.CurrentState()
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "state", Value: state},
+			{Key: "state_history", Value: []entity.OrderStateChange{{To: state, Note: "migrated", Time: time.Now()}}},
+		}}}
+		result, err := collection.UpdateOne(ctx, append(bson.D{{Key: "order", Value: order.Order}}, filter...), update)
+		if err != nil {
+			return affected, err
+		}
+		affected += result.ModifiedCount
+	}
+	return affected, cursor.Err()
+}
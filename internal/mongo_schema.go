@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+)
+
+// Actions reported for schema steps.
+const (
+	SchemaExists   = "exists"
+	SchemaCreated  = "created"
+	SchemaApplied  = "applied"
+	SchemaPending  = "pending"  // would be applied, in a dry run
+	SchemaSkipped  = "skipped"  // applied by another instance
+	SchemaConflict = "conflict" // an existing index differs; it is left as is
+	SchemaFailed   = "failed"
+)
+
+// SchemaStep reports what was done, or would be done in a dry run, for an
+// index or a migration.
+type SchemaStep struct {
+	Target string
+	Action string
+	Detail string
+}
+
+func (s SchemaStep) String() string {
+	if s.Detail == "" {
+		return fmt.Sprintf("%s: %s", s.Target, s.Action)
+	}
+	return fmt.Sprintf("%s: %s; %s", s.Target, s.Action, s.Detail)
+}
+
+// mongoIndex is an index the queries of MongoDB rely on.
+type mongoIndex struct {
+	collection string
+	name       string
+	keys       bson.D
+	unique     bool
+	// required is set for the unique indexes the writes of electrum rely on:
+	// the service does not start without them
+	required bool
+}
+
+// mongoIndexes lists the indexes electrum needs. Unique indexes enforce the
+// business rules: one order per number, one transaction per id, one tag per id
+// and one payment method per card and user. A new order is numbered after the
+// last one and inserted, so only the unique order number keeps two instances
+// from opening the same order.
+var mongoIndexes = []mongoIndex{
+	{collectionPaymentOrders, "order_unique", bson.D{{Key: "order", Value: 1}}, true, true},
+	{collectionPaymentOrders, "transaction_open", bson.D{{Key: "transaction_id", Value: 1}, {Key: "is_completed", Value: 1}}, false, false},
+	{collectionPaymentOrders, "time_opened", bson.D{{Key: "time_opened", Value: -1}}, false, false},
+	{collectionPaymentOrders, "completed_time_opened", bson.D{{Key: "is_completed", Value: 1}, {Key: "time_opened", Value: 1}}, false, false},
+	{collectionTransactions, "transaction_id_unique", bson.D{{Key: "transaction_id", Value: 1}}, true, false},
+	{collectionPaymentMethods, "user_identifier_unique", bson.D{{Key: "user_id", Value: 1}, {Key: "identifier", Value: 1}}, true, false},
+	{collectionPaymentMethods, "identifier", bson.D{{Key: "identifier", Value: 1}}, false, false},
+	{collectionPaymentMethods, "user_fail_count", bson.D{{Key: "user_id", Value: 1}, {Key: "fail_count", Value: 1}}, false, false},
+	{collectionUserTags, "id_tag_unique", bson.D{{Key: "id_tag", Value: 1}}, true, false},
+	{collectionPayment, "order", bson.D{{Key: "order", Value: 1}}, false, false},
+	{collectionLog, "level_timestamp", bson.D{{Key: "level", Value: 1}, {Key: "timestamp", Value: 1}}, false, false},
+	{collectionLog, "request_id", bson.D{{Key: "request_id", Value: 1}}, false, false},
+	{collectionLog, "order", bson.D{{Key: "order", Value: 1}}, false, false},
+	{collectionLog, "transaction_id", bson.D{{Key: "transaction_id", Value: 1}}, false, false},
+	{collectionLog, "user_id", bson.D{{Key: "user_id", Value: 1}}, false, false},
+	{collectionPaymentOrders, "user_id", bson.D{{Key: "user_id", Value: 1}}, false, false},
+}
+
+// EnsureIndexes checks the indexes electrum needs and creates the missing ones;
+// in a dry run, it only reports them. An existing index on the same keys is
+// accepted as is; if it lacks a required uniqueness, it is reported as a
+// conflict and left for an operator to replace. Creating a unique index fails
+// while the collection holds duplicates; the failure is reported and the other
+// indexes are still checked. The error joins the failures; it matches
+// errRequiredIndex if a required index is missing or not unique.
+func (m *MongoDB) EnsureIndexes(ctx context.Context, dryRun bool) ([]SchemaStep, error) {
+	existing := make(map[string][]*mongo.IndexSpecification)
+	var steps []SchemaStep
+	var failures []error
+	fail := func(index mongoIndex, err error) {
+		if index.required {
+			err = fmt.Errorf("%w: %w", errRequiredIndex, err)
+		}
+		failures = append(failures, err)
+	}
+	for _, index := range mongoIndexes {
+		collection := m.client.Database(m.database).Collection(index.collection)
+		specs, ok := existing[index.collection]
+		if !ok {
+			var err error
+			specs, err = collection.Indexes().ListSpecifications(ctx)
+			if err != nil && !isNamespaceNotFound(err) {
+				return steps, fmt.Errorf("list indexes of %s: %w", index.collection, err)
+			}
+			existing[index.collection] = specs
+		}
+
+		target := fmt.Sprintf("index %s.%s", index.collection, index.name)
+		keys := indexSignature(index.keys)
+		if spec := findIndex(specs, keys); spec != nil {
+			if index.unique && (spec.Unique == nil || !*spec.Unique) {
+				detail := fmt.Sprintf("index %s on %s is not unique", spec.Name, keys)
+				steps = append(steps, SchemaStep{target, SchemaConflict, detail})
+				if index.required {
+					fail(index, fmt.Errorf("%s: %s", target, detail))
+				}
+			} else {
+				steps = append(steps, SchemaStep{Target: target, Action: SchemaExists})
+			}
+			continue
+		}
+		if dryRun {
+			steps = append(steps, SchemaStep{Target: target, Action: SchemaPending, Detail: keys})
+			continue
+		}
+
+		model := mongo.IndexModel{Keys: index.keys, Options: options.Index().SetName(index.name)}
+		if index.unique {
+			model.Options.SetUnique(true)
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			steps = append(steps, SchemaStep{target, SchemaFailed, err.Error()})
+			fail(index, fmt.Errorf("create %s: %w", target, err))
+			continue
+		}
+		steps = append(steps, SchemaStep{Target: target, Action: SchemaCreated, Detail: keys})
+	}
+	return steps, errors.Join(failures...)
+}
+
+// errRequiredIndex is matched by the error of EnsureIndexes when an index the
+// writes rely on could not be created.
+var errRequiredIndex = errors.New("required index missing")
+
+// findIndex returns the index with the key signature, or nil.
+func findIndex(specs []*mongo.IndexSpecification, keys string) *mongo.IndexSpecification {
+	for _, spec := range specs {
+		var document bson.D
+		if err := bson.Unmarshal(spec.KeysDocument, &document); err != nil {
+			continue
+		}
+		if indexSignature(document) == keys {
+			return spec
+		}
+	}
+	return nil
+}
+
+// indexSignature formats index keys as "field:1,field:-1", whatever numeric
+// type the server returned them with.
+func indexSignature(keys bson.D) string {
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		direction := fmt.Sprint(key.Value)
+		switch value := key.Value.(type) {
+		case int32:
+			direction = fmt.Sprint(int64(value))
+		case float64:
+			direction = fmt.Sprint(int64(value))
+		}
+		parts = append(parts, key.Key+":"+direction)
+	}
+	return strings.Join(parts, ",")
+}
+
+// isNamespaceNotFound reports whether an error means that the collection does
+// not exist yet; it has no indexes then.
+func isNamespaceNotFound(err error) bool {
+	var commandError mongo.CommandError
+	return errors.As(err, &commandError) && commandError.Code == 26
+}
+
+// PrepareSchema ensures the indexes and applies the migrations, logging every
+// step. Index failures are logged and do not stop the service, unless a
+// required index is missing; a failed migration does too, since the data may
+// be left between versions.
+func (m *MongoDB) PrepareSchema(ctx context.Context, owner string, dryRun bool, logger services.LogHandler) error {
+	steps, err := m.EnsureIndexes(ctx, dryRun)
+	logSchemaSteps(logger, steps)
+	if errors.Is(err, errRequiredIndex) {
+		return fmt.Errorf("mongo indexes: %w", err)
+	}
+	if err != nil {
+		logger.Error("mongo indexes", err)
+	}
+
+	steps, err = m.Migrate(ctx, owner, dryRun)
+	logSchemaSteps(logger, steps)
+	if err != nil {
+		return fmt.Errorf("mongo migrations: %w", err)
+	}
+	return nil
+}
+
+func logSchemaSteps(logger services.LogHandler, steps []SchemaStep) {
+	for _, step := range steps {
+		switch step.Action {
+		case SchemaExists, SchemaSkipped:
+			logger.Debug(step.String())
+		case SchemaConflict, SchemaFailed:
+			logger.Warn(step.String())
+		default:
+			logger.Info(step.String())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"electrum/config"
+	"encoding/hex"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestMongo connects to the MongoDB server at ELECTRUM_TEST_MONGO, as
+// host:port without authentication, and uses a new database that is dropped
+// after the test. The test is skipped without a server.
+func newTestMongo(t *testing.T) *MongoDB {
+	t.Helper()
+	address := os.Getenv("ELECTRUM_TEST_MONGO")
+	if address == "" {
+		t.Skip("ELECTRUM_TEST_MONGO is not set")
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("ELECTRUM_TEST_MONGO: %v", err)
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	conf := &config.Config{}
+	conf.Mongo.Enabled = true
+	conf.Mongo.Host = host
+	conf.Mongo.Port = port
+	conf.Mongo.Database = "electrum_test_" + hex.EncodeToString(suffix)
+	m, err := NewMongoClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = m.client.Database(m.database).Drop(ctx)
+		_ = m.Disconnect(ctx)
+	})
+	return m
+}
+
+func TestIndexSignature(t *testing.T) {
+	tests := []struct {
+		keys bson.D
+		want string
+	}{
+		{bson.D{{Key: "order", Value: 1}}, "order:1"},
+		{bson.D{{Key: "order", Value: int32(1)}}, "order:1"},
+		{bson.D{{Key: "time_opened", Value: float64(-1)}}, "time_opened:-1"},
+		{bson.D{{Key: "is_completed", Value: int64(1)}, {Key: "time_opened", Value: int32(1)}}, "is_completed:1,time_opened:1"},
+	}
+	for _, tt := range tests {
+		if got := indexSignature(tt.keys); got != tt.want {
+			t.Errorf("indexSignature(%v) = %s, want %s", tt.keys, got, tt.want)
+		}
+	}
+}
+
+// indexNames returns the names of the indexes of a collection.
+func indexNames(t *testing.T, m *MongoDB, collection string) map[string]bool {
+	t.Helper()
+	specs, err := m.client.Database(m.database).Collection(collection).Indexes().ListSpecifications(context.Background())
+	if err != nil && !isNamespaceNotFound(err) {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, spec := range specs {
+		names[spec.Name] = true
+	}
+	return names
+}
+
+// countActions counts the steps by action.
+func countActions(steps []SchemaStep) map[string]int {
+	actions := make(map[string]int)
+	for _, step := range steps {
+		actions[step.Action]++
+	}
+	return actions
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+
+	// a dry run reports every index and creates none
+	steps, err := m.EnsureIndexes(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := countActions(steps); actions[SchemaPending] != len(mongoIndexes) {
+		t.Errorf("dry run actions %v, want %d pending", actions, len(mongoIndexes))
+	}
+	if names := indexNames(t, m, collectionPaymentOrders); names["order_unique"] {
+		t.Error("dry run created an index")
+	}
+
+	steps, err = m.EnsureIndexes(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := countActions(steps); actions[SchemaCreated] != len(mongoIndexes) {
+		t.Errorf("actions %v, want %d created", actions, len(mongoIndexes))
+	}
+	if names := indexNames(t, m, collectionPaymentOrders); !names["order_unique"] || !names["completed_time_opened"] {
+		t.Errorf("order indexes %v", names)
+	}
+
+	steps, err = m.EnsureIndexes(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := countActions(steps); actions[SchemaExists] != len(mongoIndexes) {
+		t.Errorf("second run actions %v, want %d existing", actions, len(mongoIndexes))
+	}
+}
+
+func TestEnsureIndexesRequired(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+	orders := m.client.Database(m.database).Collection(collectionPaymentOrders)
+	// duplicate order numbers keep the unique index from being created
+	for i := 0; i < 2; i++ {
+		if _, err := orders.InsertOne(ctx, bson.D{{Key: "order", Value: 1200}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := m.EnsureIndexes(ctx, false)
+	if !errors.Is(err, errRequiredIndex) {
+		t.Fatalf("error %v, want a required index failure", err)
+	}
+	if err = m.PrepareSchema(ctx, "test", false, NewLogger("schema", false, nil)); !errors.Is(err, errRequiredIndex) {
+		t.Errorf("prepare schema: %v, want a required index failure", err)
+	}
+
+	// an existing index on the order that is not unique is not enough
+	if _, err = orders.DeleteOne(ctx, bson.D{{Key: "order", Value: 1200}}); err != nil {
+		t.Fatal(err)
+	}
+	model := mongo.IndexModel{Keys: bson.D{{Key: "order", Value: 1}}, Options: options.Index().SetName("order")}
+	if _, err = orders.Indexes().CreateOne(ctx, model); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := m.EnsureIndexes(ctx, false)
+	if !errors.Is(err, errRequiredIndex) || steps[0].Action != SchemaConflict {
+		t.Errorf("first step %v, error %v; want a conflict of the required index", steps[0], err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+	db := m.client.Database(m.database)
+	// an order and a payment method saved by an earlier version
+	if _, err := db.Collection(collectionPaymentOrders).InsertOne(ctx, bson.D{{Key: "order", Value: 1200}, {Key: "is_completed", Value: false}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection(collectionPaymentMethods).InsertOne(ctx, bson.D{{Key: "user_id", Value: "user-1"}, {Key: "identifier", Value: "tok-1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := m.Migrate(ctx, "first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != len(mongoMigrations) || countActions(steps)[SchemaPending] != len(mongoMigrations) || steps[0].Detail != "1 documents" {
+		t.Errorf("dry run steps %v", steps)
+	}
+	if n, _ := db.Collection(collectionMigrations).CountDocuments(ctx, bson.D{}); n != 0 {
+		t.Errorf("dry run recorded %d migrations", n)
+	}
+
+	steps, err = m.Migrate(ctx, "first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countActions(steps)[SchemaApplied] != len(mongoMigrations) {
+		t.Errorf("steps %v, want all applied", steps)
+	}
+	var order bson.M
+	if err = db.Collection(collectionPaymentOrders).FindOne(ctx, bson.D{{Key: "order", Value: 1200}}).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order["version"] != int64(0) || order["state"] == nil {
+		t.Errorf("migrated order %v, want version 0 and a state", order)
+	}
+
+	steps, err = m.Migrate(ctx, "second", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countActions(steps)[SchemaExists] != len(mongoMigrations) {
+		t.Errorf("second run steps %v, want all done", steps)
+	}
+}
+
+func TestMigrateClaim(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+	records := m.client.Database(m.database).Collection(collectionMigrations)
+	// another instance runs the first migration, and the second was left
+	// running by an instance that stopped
+	running := []any{
+		migrationRecord{Version: 1, Name: "version_fields", Status: migrationRunning, Owner: "other", Started: time.Now()},
+		migrationRecord{Version: 2, Name: "payment_method_fail_count", Status: migrationRunning, Owner: "gone", Started: time.Now().Add(-migrationTakeover - time.Minute)},
+	}
+	if _, err := records.InsertMany(ctx, running); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := m.Migrate(ctx, "owner", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{SchemaSkipped, SchemaApplied, SchemaApplied}
+	for i, step := range steps {
+		if step.Action != want[i] {
+			t.Errorf("step %v, want %s", step, want[i])
+		}
+	}
+	var record migrationRecord
+	if err = records.FindOne(ctx, bson.D{{Key: "_id", Value: 2}}).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Owner != "owner" || record.Status != migrationDone {
+		t.Errorf("taken over record %+v, want done by owner", record)
+	}
+	if err = records.FindOne(ctx, bson.D{{Key: "_id", Value: 1}}).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Owner != "other" || record.Status != migrationRunning {
+		t.Errorf("claimed record %+v, want left to the other instance", record)
+	}
+}
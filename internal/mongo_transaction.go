@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"sync"
+	"time"
+)
+
+// journalKey is the context key of the compensation journal of a unit of work.
+type journalKey struct{}
+
+// journalEntry restores one document to the state it had before the unit of work.
+type journalEntry struct {
+	collection string
+	filter     bson.D
+	previous   bson.Raw // nil if the document did not exist
+	// written holds the fields that identify the document as written by the
+	// unit of work, such as its new version; nil until the write succeeded
+	written bson.D
+}
+
+// journal records the documents changed by a unit of work on a standalone server.
+type journal struct {
+	mutex   sync.Mutex
+	entries []*journalEntry
+}
+
+// supportsTransactions reports whether the server is a replica set member or a
+// mongos router; standalone servers do not support multi-document transactions.
+func supportsTransactions(ctx context.Context, client *mongo.Client) bool {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	admin := client.Database("admin")
+	err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		// servers before 4.4 only know the legacy command name
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	}
+	if err != nil {
+		return false
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid"
+}
+
+// WithTransaction runs fn as one unit of work; all database calls made by fn
+// must use the context passed to it. Nested calls join the outer unit.
+//
+// On a replica set or sharded cluster the writes run inside one session
+// transaction: they are committed together when fn returns nil and discarded
+// otherwise. The transaction is not retried, so fn does not have to be idempotent.
+//
+// A standalone server has no transactions. There, each write made by fn first
+// records the previous state of its document, and when fn or a write fails the
+// recorded documents are restored in reverse order. This compensation is best
+// effort: other readers may see the intermediate state, and a crash of the
+// process before compensation completes leaves the partial writes in place.
+// Production deployments should run a replica set, even a single-member one.
+func (m *MongoDB) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil || ctx.Value(journalKey{}) != nil {
+		return fn(ctx)
+	}
+	if !m.transactions {
+		return m.withCompensation(ctx, fn)
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+	defer session.EndSession(context.Background())
+
+	return mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		if err := sc.StartTransaction(); err != nil {
+			return fmt.Errorf("start transaction: %w", err)
+		}
+		if err := fn(sc); err != nil {
+			if abortErr := sc.AbortTransaction(context.Background()); abortErr != nil {
+				return fmt.Errorf("%w; abort transaction: %v", err, abortErr)
+			}
+			return transactionConflict(err)
+		}
+		if err := sc.CommitTransaction(sc); err != nil {
+			return transactionConflict(fmt.Errorf("commit transaction: %w", err))
+		}
+		return nil
+	})
+}
+
+// transactionConflict marks a transient transaction error, such as a write
+// conflict with a concurrent transaction, as services.ErrConflict so that the
+// caller reloads and retries like on a version conflict.
+func transactionConflict(err error) error {
+	var labeled interface{ HasErrorLabel(string) bool }
+	if errors.As(err, &labeled) && labeled.HasErrorLabel(driver.TransientTransactionError) && !errors.Is(err, services.ErrConflict) {
+		return fmt.Errorf("%w: %v", services.ErrConflict, err)
+	}
+	return err
+}
+
+func (m *MongoDB) withCompensation(ctx context.Context, fn func(ctx context.Context) error) error {
+	j := &journal{}
+	err := fn(context.WithValue(ctx, journalKey{}, j))
+	if err == nil {
+		return nil
+	}
+	// compensate even if the caller's context is done
+	undoCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if undoErr := m.compensate(undoCtx, j); undoErr != nil {
+		return fmt.Errorf("%w; compensation failed: %w", err, undoErr)
+	}
+	return err
+}
+
+// remember records the current state of the document matching the filter when
+// ctx carries a compensation journal; it must be called before the write. The
+// write then calls the returned function once it succeeded, with the fields
+// that identify the document as written, e.g. its new version; a document
+// whose write failed is not restored.
+func (m *MongoDB) remember(ctx context.Context, collection string, filter bson.D) (func(written bson.D), error) {
+	j, ok := ctx.Value(journalKey{}).(*journal)
+	if !ok {
+		return func(bson.D) {}, nil
+	}
+	previous, err := m.client.Database(m.database).Collection(collection).FindOne(ctx, filter).Raw()
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("read %s before write: %w", collection, err)
+	}
+	entry := &journalEntry{collection: collection, filter: filter, previous: previous}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries = append(j.entries, entry)
+	return func(written bson.D) {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		entry.written = append(bson.D{}, written...)
+	}, nil
+}
+
+// compensate restores the journaled documents, the most recent write first.
+// A document is restored only while it is still as the unit of work wrote it;
+// one changed since by a concurrent write is left as is and reported as a
+// conflict rather than overwritten.
+func (m *MongoDB) compensate(ctx context.Context, j *journal) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	var errs []error
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		entry := j.entries[i]
+		if entry.written == nil {
+			continue
+		}
+		collection := m.client.Database(m.database).Collection(entry.collection)
+		filter := append(append(bson.D{}, entry.filter...), entry.written...)
+		var matched int64
+		var err error
+		if entry.previous == nil {
+			var result *mongo.DeleteResult
+			if result, err = collection.DeleteOne(ctx, filter); err == nil {
+				matched = result.DeletedCount
+			}
+		} else {
+			var result *mongo.UpdateResult
+			if result, err = collection.ReplaceOne(ctx, filter, entry.previous); err == nil {
+				matched = result.MatchedCount
+			}
+		}
+		if err == nil && matched == 0 {
+			err = fmt.Errorf("%w: changed by a concurrent write, left as is", services.ErrConflict)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restore %s %v: %w", entry.collection, entry.filter, err))
+		}
+	}
+	return errors.Join(errs...)
+}
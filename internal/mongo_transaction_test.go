@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+	"time"
+)
+
+// mongoSnapshot returns the documents of the collections a payment unit of
+// work writes, as extended JSON.
+func mongoSnapshot(t *testing.T, m *MongoDB) map[string][]string {
+	t.Helper()
+	ctx := context.Background()
+	snapshot := make(map[string][]string)
+	for _, name := range []string{collectionTransactions, collectionPaymentOrders, collectionPaymentMethods} {
+		cursor, err := m.client.Database(m.database).Collection(name).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var documents []bson.Raw
+		if err = cursor.All(ctx, &documents); err != nil {
+			t.Fatal(err)
+		}
+		for _, document := range documents {
+			snapshot[name] = append(snapshot[name], document.String())
+		}
+	}
+	return snapshot
+}
+
+func TestMongoCompensation(t *testing.T) {
+	failure := errors.New("gateway down")
+	tests := []struct {
+		name     string
+		unit     func(ctx context.Context, m *MongoDB) error
+		conflict bool // the failure is a conflict
+	}{
+		{"failing unit", func(ctx context.Context, m *MongoDB) error {
+			order, err := m.GetPaymentOrder(ctx, 1200)
+			if err != nil {
+				return err
+			}
+			order.Amount = 900
+			if err = m.SavePaymentOrder(ctx, order); err != nil {
+				return err
+			}
+			if err = m.CreatePaymentOrder(ctx, &entity.PaymentOrder{Order: 1201, TransactionId: 10, TimeOpened: time.Now()}); err != nil {
+				return err
+			}
+			transaction, err := m.GetTransaction(ctx, 10)
+			if err != nil {
+				return err
+			}
+			transaction.PaymentOrder = 1200
+			transaction.PaymentBilled = 900
+			if err = m.UpdateTransaction(ctx, transaction); err != nil {
+				return err
+			}
+			if err = m.UpdatePaymentMethodFailCount(ctx, "tok-0000000001", 2); err != nil {
+				return err
+			}
+			return failure
+		}, false},
+		{"failing write halfway", func(ctx context.Context, m *MongoDB) error {
+			order, err := m.GetPaymentOrder(ctx, 1200)
+			if err != nil {
+				return err
+			}
+			stale := *order
+			order.Amount = 900
+			if err = m.SavePaymentOrder(ctx, order); err != nil {
+				return err
+			}
+			if err = m.UpdatePaymentMethodFailCount(ctx, "tok-0000000001", 2); err != nil {
+				return err
+			}
+			// the order was changed since it was read
+			stale.Amount = 700
+			if err = m.SavePaymentOrder(ctx, &stale); err != nil {
+				return err
+			}
+			transaction, err := m.GetTransaction(ctx, 10)
+			if err != nil {
+				return err
+			}
+			transaction.PaymentBilled = 700
+			return m.UpdateTransaction(ctx, transaction)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMongoUnit(t)
+			before := mongoSnapshot(t, m)
+
+			err := m.WithTransaction(context.Background(), func(ctx context.Context) error {
+				return tt.unit(ctx, m)
+			})
+			if err == nil || errors.Is(err, services.ErrConflict) != tt.conflict {
+				t.Fatalf("error %v, want a failure, conflict %v", err, tt.conflict)
+			}
+			after := mongoSnapshot(t, m)
+			for name, documents := range before {
+				if len(after[name]) != len(documents) {
+					t.Errorf("%s: %d documents after the unit, want %d", name, len(after[name]), len(documents))
+					continue
+				}
+				for i := range documents {
+					if after[name][i] != documents[i] {
+						t.Errorf("%s: %s after the unit, want %s", name, after[name][i], documents[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMongoCompensationConcurrentWrite(t *testing.T) {
+	m := newMongoUnit(t)
+	failure := errors.New("gateway down")
+	err := m.WithTransaction(context.Background(), func(ctx context.Context) error {
+		order, err := m.GetPaymentOrder(ctx, 1200)
+		if err != nil {
+			return err
+		}
+		order.Amount = 900
+		if err = m.SavePaymentOrder(ctx, order); err != nil {
+			return err
+		}
+		// another request changes the order outside of the unit
+		order.Amount = 1000
+		if err = m.SavePaymentOrder(context.Background(), order); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) || !errors.Is(err, services.ErrConflict) {
+		t.Fatalf("error %v, want the failure and a conflict of the compensation", err)
+	}
+	order, err := m.GetPaymentOrder(context.Background(), 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Amount != 1000 || order.Version != 3 {
+		t.Errorf("amount %d, version %d; want the concurrent write left as is", order.Amount, order.Version)
+	}
+}
+
+// newMongoUnit returns a test database that compensates units of work, as a
+// standalone server does, with transaction 10, its order 1200 and a card of
+// user-1.
+func newMongoUnit(t *testing.T) *MongoDB {
+	t.Helper()
+	m := newTestMongo(t)
+	m.transactions = false
+	ctx := context.Background()
+	transaction := &entity.Transaction{Id: 10, PaymentAmount: 1500}
+	if _, err := m.client.Database(m.database).Collection(collectionTransactions).InsertOne(ctx, transaction); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-0000000001", FailCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	order := &entity.PaymentOrder{Order: 1200, TransactionId: 10, UserId: "user-1", Amount: 500, TimeOpened: time.Now()}
+	if err := m.CreatePaymentOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxRetryBackoff caps the delay between retries after transport failures.
+const maxRetryBackoff = time.Minute
+
+// scheduleRecovery resolves a request lost in transport after a backoff. The
+// gateway may or may not have processed such a request, so it is never simply
+// sent again: see recoverRequest. After the retry limit, the order is left open
+// for the gateway notification.
+func (p *Payments) scheduleRecovery(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, retries int) {
+	if retries > p.conf.Gateway.RetryLimit {
+		p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d: status unknown after %d retries, waiting for notification", operation, request.Order, retries-1))
+		return
+	}
+	delay := retryBackoff(p.conf.Gateway.RetryBackoff, retries)
+	p.later(ctx, delay, func(ctx context.Context) {
+		p.recoverRequest(ctx, operation, request, retries)
+	})
+}
+
+// recoverRequest queries the gateway for the outcome of a request lost in
+// transport. A result found is processed as the response. Only when the gateway
+// has no record of the operation, the same request is sent again: with the same
+// order number and parameters, it is the same signed message, so the gateway
+// cannot process it twice; if it refuses the order as a duplicate, the query is
+// repeated (see send). When the status cannot be queried, nothing is resent.
+func (p *Payments) recoverRequest(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, retries int) {
+	result, err := p.gateway.Query(ctx, request)
+	if err == nil && !sameOperation(operation, request, result) {
+		// the last result of the order belongs to an earlier operation
+		err = services.ErrGatewayNoRecord
+	}
+	if err == nil && operation == services.OperationRefund && (request.MerchantData == "" || result.MerchantData == "") {
+		err = p.checkRefundResult(ctx, request)
+	}
+
+	switch {
+	case err == nil:
+		p.recordAttempt(ctx, operation, request.Order, entity.GatewayAttempt{Outcome: entity.AttemptFound, Code: result.Code})
+		p.processResponse(ctx, result)
+	case errors.Is(err, services.ErrGatewayNoRecord):
+		p.recordAttempt(ctx, operation, request.Order, entity.GatewayAttempt{Outcome: entity.AttemptNoRecord})
+		p.logger.InfoContext(ctx, fmt.Sprintf("%s order %d not found on gateway, resending (retry %d)", operation, request.Order, retries))
+		p.send(ctx, operation, request, 0, retries)
+	case errors.Is(err, services.ErrGatewayQueryUnsupported):
+		p.recordAttempt(ctx, operation, request.Order, entity.GatewayAttempt{Outcome: entity.AttemptQueryFailed, Error: err.Error()})
+		p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d: status unknown, waiting for notification: %v", operation, request.Order, err))
+	default:
+		p.recordAttempt(ctx, operation, request.Order, entity.GatewayAttempt{Outcome: entity.AttemptQueryFailed, Error: err.Error()})
+		p.logger.WarnContext(ctx, fmt.Sprintf("query %s order %d: %v", operation, request.Order, err))
+		p.scheduleRecovery(ctx, operation, request, retries+1)
+	}
+}
+
+// sameOperation reports whether a queried result is the outcome of the request.
+// The gateway keeps only the last result of an order: a refund is found by its
+// amount and the request ID echoed in the merchant data, other operations by
+// their type; an authorization may come back as held.
+func sameOperation(operation services.GatewayOperation, request *services.GatewayRequest, result *services.GatewayResult) bool {
+	if result.Order != request.Order {
+		return false
+	}
+	if operation == services.OperationRefund {
+		if request.MerchantData != "" && result.MerchantData != "" && request.MerchantData != result.MerchantData {
+			return false
+		}
+		return result.Operation == services.OperationRefund && result.Amount == request.Amount
+	}
+	return result.Operation == operation
+}
+
+// checkRefundResult refuses a refund result found by its amount alone while
+// the order has another refund of the same amount, which the result may
+// belong to. The refund is neither closed nor sent again: the query is
+// repeated and, after the retry limit, the notification decides.
+func (p *Payments) checkRefundResult(ctx context.Context, request *services.GatewayRequest) error {
+	order, err := p.database.GetPaymentOrder(ctx, request.Order)
+	if err != nil {
+		return fmt.Errorf("get payment order: %w", err)
+	}
+	refunds := 0
+	for _, refund := range order.Refunds {
+		if refund.Amount == request.Amount {
+			refunds++
+		}
+	}
+	if refunds > 1 {
+		return fmt.Errorf("result of refund %d cannot be told from another refund of the same amount", request.Amount)
+	}
+	return nil
+}
+
+// retryBackoff returns the delay before a retry, doubled with each one.
+func retryBackoff(base time.Duration, retries int) time.Duration {
+	if base <= 0 {
+		base = 2 * time.Second
+	}
+	delay := base
+	for i := 1; i < retries && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// sendAttempt describes the outcome of a request sent to the gateway.
+func sendAttempt(result *services.GatewayResult, err error) entity.GatewayAttempt {
+	var gatewayError *services.GatewayError
+	switch {
+	case err == nil:
+		return entity.GatewayAttempt{Outcome: entity.AttemptAnswered, Code: result.Code}
+	case errors.Is(err, services.ErrGatewayUnavailable):
+		return entity.GatewayAttempt{Outcome: entity.AttemptUnavailable, Error: err.Error()}
+	case errors.As(err, &gatewayError):
+		return entity.GatewayAttempt{Outcome: entity.AttemptRejected, Code: gatewayError.Code}
+	default:
+		return entity.GatewayAttempt{Outcome: entity.AttemptTransportError, Error: err.Error()}
+	}
+}
+
+// recordAttempt appends a gateway attempt to the order.
+func (p *Payments) recordAttempt(ctx context.Context, operation services.GatewayOperation, orderId int, attempt entity.GatewayAttempt) {
+	ctx, lease, err := p.lockOrder(ctx, orderId)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "record gateway attempt", err)
+		return
+	}
+	defer p.unlock(lease)
+
+	attempt.Operation = string(operation)
+	err = p.update(ctx, func(ctx context.Context) error {
+		order, err := p.database.GetPaymentOrder(ctx, orderId)
+		if err != nil {
+			return fmt.Errorf("get payment order: %w", err)
+		}
+		order.AddAttempt(attempt)
+		return p.database.SavePaymentOrder(ctx, order)
+	})
+	if err != nil {
+		p.logger.ErrorContext(ctx, fmt.Sprintf("record %s attempt of order %d", operation, orderId), err)
+	}
+}
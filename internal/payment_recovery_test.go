@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// lossyGateway loses requests in transport: dropped ones never reach the
+// gateway, lost ones are processed but their answer does not arrive.
+type lossyGateway struct {
+	*MemoryGateway
+	mutex    sync.Mutex
+	drop     map[services.GatewayOperation]int
+	lose     map[services.GatewayOperation]int
+	hide     int  // queries answered with no record, as before the gateway has stored the result
+	blind    bool // queried results come without merchant data
+	sent     map[services.GatewayOperation]int
+	refunded int
+}
+
+func newLossyGateway() *lossyGateway {
+	return &lossyGateway{
+		MemoryGateway: NewMemoryGateway(),
+		drop:          make(map[services.GatewayOperation]int),
+		lose:          make(map[services.GatewayOperation]int),
+		sent:          make(map[services.GatewayOperation]int),
+	}
+}
+
+func (g *lossyGateway) Authorize(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(services.OperationAuthorize, func() (*services.GatewayResult, error) {
+		return g.MemoryGateway.Authorize(ctx, request)
+	})
+}
+
+func (g *lossyGateway) Refund(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return g.call(services.OperationRefund, func() (*services.GatewayResult, error) {
+		return g.MemoryGateway.Refund(ctx, request)
+	})
+}
+
+func (g *lossyGateway) call(operation services.GatewayOperation, send func() (*services.GatewayResult, error)) (*services.GatewayResult, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sent[operation]++
+	if g.drop[operation] > 0 {
+		g.drop[operation]--
+		return nil, errors.New("connection refused")
+	}
+	result, err := send()
+	if err == nil && operation == services.OperationRefund && result.Approved {
+		g.refunded += result.Amount
+	}
+	if g.lose[operation] > 0 {
+		g.lose[operation]--
+		return nil, errors.New("connection reset")
+	}
+	return result, err
+}
+
+func (g *lossyGateway) Query(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.hide > 0 {
+		g.hide--
+		return nil, services.ErrGatewayNoRecord
+	}
+	result, err := g.MemoryGateway.Query(ctx, request)
+	if err == nil && g.blind {
+		result.MerchantData = ""
+	}
+	return result, err
+}
+
+func (g *lossyGateway) counts() (sent map[services.GatewayOperation]int, refunded int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	sent = make(map[services.GatewayOperation]int)
+	for operation, count := range g.sent {
+		sent[operation] = count
+	}
+	return sent, g.refunded
+}
+
+// newRecoveryPayments creates Payments on the lossy gateway with a finished
+// transaction 10 of 1000 to be paid by a user with a payment method.
+func newRecoveryPayments(t *testing.T, gateway services.Gateway) (*Payments, *MemoryDatabase) {
+	t.Helper()
+	var conf config.Config
+	if err := cleanenv.ReadEnv(&conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Gateway.RetryBackoff = 5 * time.Millisecond
+	database, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPayments(&conf)
+	p.SetLogger(NewLogger("payments", false, nil))
+	p.SetDatabase(database)
+	p.SetGateway(gateway)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = p.Drain(ctx)
+	})
+
+	if err = database.SaveUserTag(&entity.UserTag{IdTag: "tag-1", UserId: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.SaveTransaction(&entity.Transaction{Id: 10, IsFinished: true, IdTag: "tag-1", PaymentAmount: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	err = database.SavePaymentMethod(context.Background(), &entity.PaymentMethod{UserId: "user-1", Identifier: "tok-1", CofTid: "cof-1", IsDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, database
+}
+
+// waitFor polls a condition met by background jobs.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// payOrder pays transaction 10 and waits until its order is closed.
+func payOrder(t *testing.T, p *Payments, database *MemoryDatabase) *entity.PaymentOrder {
+	t.Helper()
+	if err := p.PayTransaction(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	var order *entity.PaymentOrder
+	waitFor(t, "payment order", func() bool {
+		transaction, err := database.GetTransaction(context.Background(), 10)
+		if err != nil || transaction.PaymentOrder == 0 {
+			return false
+		}
+		order, err = database.GetPaymentOrder(context.Background(), transaction.PaymentOrder)
+		return err == nil && !order.TimeClosed.IsZero()
+	})
+	return order
+}
+
+func TestDuplicateOrderAfterResendIsQueried(t *testing.T) {
+	gateway := newLossyGateway()
+	// the authorization is charged, its answer is lost and the first query
+	// does not see it yet; the resent request is refused as a duplicate
+	gateway.lose[services.OperationAuthorize] = 1
+	gateway.hide = 1
+	p, database := newRecoveryPayments(t, gateway)
+
+	order := payOrder(t, p, database)
+	if state := order.CurrentState(); state != entity.OrderAuthorized {
+		t.Fatalf("order %s, want authorized", state)
+	}
+	if sent, _ := gateway.counts(); sent[services.OperationAuthorize] != 2 {
+		t.Errorf("%d authorizations sent, want 2", sent[services.OperationAuthorize])
+	}
+	transaction, err := database.GetTransaction(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.PaymentBilled != 1000 {
+		t.Errorf("billed %d, want 1000", transaction.PaymentBilled)
+	}
+	method, err := database.GetPaymentMethod(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method.FailCount != 0 {
+		t.Errorf("fail count %d after a charged order", method.FailCount)
+	}
+}
+
+func TestRefundRecoveryWithEarlierRefundOfSameAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     bool // the second refund never reaches the gateway, otherwise its answer is lost
+		blind    bool
+		sent     int
+		refunded int
+		status   string
+	}{
+		{name: "request lost, told apart by merchant data", drop: true, sent: 3, refunded: 600, status: entity.RefundCompleted},
+		{name: "answer lost, told apart by merchant data", sent: 2, refunded: 600, status: entity.RefundCompleted},
+		{name: "answer lost, no merchant data", blind: true, sent: 2, refunded: 600, status: entity.RefundPending},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gateway := newLossyGateway()
+			p, database := newRecoveryPayments(t, gateway)
+			order := payOrder(t, p, database)
+			orderId := strconv.Itoa(order.Order)
+
+			refund := func(requestId string) {
+				ctx := WithRequestIDValue(context.Background(), requestId)
+				if err := p.ReturnByOrder(ctx, orderId, &entity.RefundRequest{Amount: 300}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			refunds := func() []entity.Refund {
+				order, err := database.GetPaymentOrder(context.Background(), order.Order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return order.Refunds
+			}
+
+			refund("req-a")
+			waitFor(t, "first refund", func() bool {
+				r := refunds()
+				return len(r) == 1 && r[0].Status == entity.RefundCompleted
+			})
+
+			gateway.mutex.Lock()
+			if test.drop {
+				gateway.drop[services.OperationRefund] = 1
+			} else {
+				gateway.lose[services.OperationRefund] = 1
+			}
+			gateway.blind = test.blind
+			gateway.mutex.Unlock()
+			refund("req-b")
+
+			waitFor(t, "second refund", func() bool {
+				if test.status != entity.RefundPending {
+					r := refunds()
+					return len(r) == 2 && r[1].Status != entity.RefundPending
+				}
+				// the recovery gives up after the retry limit
+				order, err := database.GetPaymentOrder(context.Background(), order.Order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				failed := 0
+				for _, attempt := range order.Attempts {
+					if attempt.Outcome == entity.AttemptQueryFailed {
+						failed++
+					}
+				}
+				return failed == p.conf.Gateway.RetryLimit
+			})
+
+			r := refunds()
+			if len(r) != 2 || r[1].Status != test.status {
+				t.Fatalf("refunds %+v, want the second %s", r, test.status)
+			}
+			sent, refunded := gateway.counts()
+			if sent[services.OperationRefund] != test.sent || refunded != test.refunded {
+				t.Errorf("%d refunds sent, %d refunded; want %d, %d", sent[services.OperationRefund], refunded, test.sent, test.refunded)
+			}
+		})
+	}
+}
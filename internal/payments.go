@@ -1,75 +1,226 @@
 package internal
 
 import (
-	"bytes"
 	"context"
 	"electrum/config"
 	"electrum/entity"
 	"electrum/services"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
 	"strconv"
-	"sync"
 	"time"
 )
 
-// Payments handles payment processing with Redsys payment gateway.
+// currencyEUR is the ISO 4217 numeric code used for all orders.
+const (
+	currencyEUR = "978"
+	// maxConflictRetries limits how often a unit of work is applied again
+	// after a version conflict.
+	maxConflictRetries = 3
+)
+
+// Payments handles order and transaction logic on top of a payment gateway.
 // It uses fine-grained locking per transaction/order to allow concurrent operations
 // while preventing race conditions.
 type Payments struct {
-	conf       *config.Config
-	database   services.Database
-	logger     services.LogHandler
-	locks      sync.Map // map[int]*sync.Mutex for per-order locking
-	requestUrl string
-	httpClient *http.Client
+	conf     *config.Config
+	database services.Database
+	gateway  services.Gateway
+	locker   services.Locker
+	logger   services.LogHandler
+	metrics  *Metrics
+	jobs     *jobGroup
 }
 
-// NewPayments creates a new payment processing service with configured HTTP client.
-// The HTTP client includes timeouts and connection pooling for reliable external API calls.
+// NewPayments creates a new payment processing service with a process-local locker.
+// A gateway must be set with SetGateway before processing payments.
 func NewPayments(config *config.Config) *Payments {
 	return &Payments{
-		conf:       config,
-		requestUrl: config.Merchant.RequestUrl,
-		locks:      sync.Map{},
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
-				DisableKeepAlives:   false,
-			},
-		},
-	}
-}
-
-// lockOrder acquires a lock for a specific transaction/order to prevent concurrent modifications.
-// This allows multiple different orders to be processed in parallel while ensuring
-// safety for operations on the same order.
-func (p *Payments) lockOrder(id int) *sync.Mutex {
-	value, _ := p.locks.LoadOrStore(id, &sync.Mutex{})
-	mutex := value.(*sync.Mutex)
-	mutex.Lock()
-	return mutex
-}
-
-// unlockOrder releases the lock for a transaction/order and cleans up the mutex
-// from the map to prevent memory leaks.
-func (p *Payments) unlockOrder(id int, mutex *sync.Mutex) {
-	mutex.Unlock()
-	// Clean up mutex from map to prevent unbounded growth
-	p.locks.Delete(id)
+		conf:   config,
+		locker: NewLockManager(),
+		jobs:   newJobGroup(),
+	}
+}
+
+// lock acquires a lease on a key to prevent concurrent modifications.
+// This allows different transactions and orders to be processed in parallel while
+// ensuring safety for operations on the same one; with a shared locker, also across
+// instances. Waiting is limited by the configured acquire timeout.
+// The work under the lease must use the returned context: it is cancelled with
+// services.ErrLeaseLost when the lease is lost, so that a holder that lost its
+// lease stops writing before another instance takes over.
+func (p *Payments) lock(ctx context.Context, namespace services.LockNamespace, id int) (context.Context, *workLease, error) {
+	acquireCtx := ctx
+	if timeout := p.conf.Lock.AcquireTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		acquireCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	key := services.LockKey{Namespace: namespace, Id: strconv.Itoa(id)}
+	acquireCtx, span := StartSpan(acquireCtx, "lock acquire", trace.SpanKindInternal, attribute.String("lock.key", key.String()))
+	defer span.End()
+	start := time.Now()
+	lease, err := p.locker.Acquire(acquireCtx, key)
+	p.metrics.LockWait(namespace, time.Since(start))
+	if err != nil {
+		spanError(span, err)
+		if acquireCtx.Err() != nil {
+			// the key stayed held by another request, or the caller gave up
+			return nil, nil, fmt.Errorf("lock %s: %w: %w", key, refused(services.ErrorBusy, "%s %d is being processed, try again later", namespace, id), err)
+		}
+		return nil, nil, fmt.Errorf("lock %s: %w", key, err)
+	}
+	p.logger.DebugContext(acquireCtx, fmt.Sprintf("lock %s acquired; token %d", key, lease.Token()))
+
+	workCtx, cancel := context.WithCancelCause(ctx)
+	if lost := lease.Lost(); lost != nil {
+		workCtx = withFence(workCtx, lease)
+		go func() {
+			select {
+			case <-lost:
+				p.logger.WarnContext(workCtx, fmt.Sprintf("lock %s lost, work cancelled", key))
+				cancel(services.ErrLeaseLost)
+			case <-workCtx.Done():
+			}
+		}()
+	}
+	return workCtx, &workLease{Lease: lease, cancel: cancel}, nil
+}
+
+// fencesKey is the context key of the leases a unit of work is fenced with.
+const fencesKey contextKey = "fences"
+
+// withFence returns ctx carrying the lease, in addition to those ctx carries,
+// so that the units of work run with it are fenced by its token.
+func withFence(ctx context.Context, lease services.Lease) context.Context {
+	leases, _ := ctx.Value(fencesKey).([]services.Lease)
+	return context.WithValue(ctx, fencesKey, append(leases[:len(leases):len(leases)], lease))
+}
+
+// fence records the tokens of the leases carried by ctx in its unit of work;
+// it fails with services.ErrLeaseLost if another holder has taken a key over.
+// Leases that cannot be lost are not fenced: the local lock manager counts
+// its tokens from 1 again after a restart.
+func (p *Payments) fence(ctx context.Context) error {
+	leases, _ := ctx.Value(fencesKey).([]services.Lease)
+	for _, lease := range leases {
+		if err := p.database.Fence(ctx, lease.Key(), lease.Token()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workLease is a lease held by Payments with the cancel of the work context.
+type workLease struct {
+	services.Lease
+	cancel context.CancelCauseFunc
+}
+
+// lockTransaction acquires the lease of a transaction.
+func (p *Payments) lockTransaction(ctx context.Context, transactionId int) (context.Context, *workLease, error) {
+	return p.lock(ctx, services.LockTransaction, transactionId)
+}
+
+// lockOrder acquires the lease of a payment order. When both are needed, the
+// transaction is locked first.
+func (p *Payments) lockOrder(ctx context.Context, orderId int) (context.Context, *workLease, error) {
+	return p.lock(ctx, services.LockOrder, orderId)
+}
+
+// update runs fn as a unit of work and, when it fails on a version conflict,
+// runs it again up to maxConflictRetries times. fn must load the entities it
+// changes, so that a retry applies the change to their current state.
+// A unit of work cancelled by the loss of its lease fails with services.ErrLeaseLost.
+func (p *Payments) update(ctx context.Context, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := p.database.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := p.fence(ctx); err != nil {
+				return err
+			}
+			return fn(ctx)
+		})
+		if err != nil && errors.Is(context.Cause(ctx), services.ErrLeaseLost) {
+			return fmt.Errorf("%w: %v", services.ErrLeaseLost, err)
+		}
+		if err == nil || !errors.Is(err, services.ErrConflict) || attempt > maxConflictRetries {
+			return err
+		}
+		p.logger.WarnContext(ctx, fmt.Sprintf("retry %d after conflict: %v", attempt, err))
+	}
+}
+
+// unlock cancels the work context of a lease and releases it.
+func (p *Payments) unlock(lease *workLease) {
+	lease.cancel(nil)
+	if err := lease.Release(context.Background()); err != nil {
+		p.logger.Error(fmt.Sprintf("release lock %s", lease.Key()), err)
+	}
+}
+
+// Drain stops accepting payment operations and waits for the gateway requests
+// and responses in progress. Jobs still running when the context is done are
+// cancelled: their orders stay in the sent state and their refunds pending, as
+// stored before the request was sent, so they can be resolved from the gateway later.
+func (p *Payments) Drain(ctx context.Context) error {
+	return p.jobs.drain(ctx)
+}
+
+// InFlight returns the number of running background jobs.
+func (p *Payments) InFlight() int64 {
+	return p.jobs.running.Load()
+}
+
+// HeldLocks returns the keys held through the locker, if it can list them.
+func (p *Payments) HeldLocks() []services.LockKey {
+	if lister, ok := p.locker.(interface{ HeldKeys() []services.LockKey }); ok {
+		return lister.HeldKeys()
+	}
+	return nil
+}
+
+// LockStats returns the lock counters of the locker, if it keeps them.
+func (p *Payments) LockStats() []LockStats {
+	if counter, ok := p.locker.(interface{ Stats() []LockStats }); ok {
+		return counter.Stats()
+	}
+	return nil
+}
+
+// checkAccepting rejects new operations once shutdown started.
+func (p *Payments) checkAccepting() error {
+	if p.jobs.draining.Load() {
+		return refused(services.ErrorShuttingDown, "service is shutting down")
+	}
+	return nil
+}
+
+// refused returns an error of an operation refused for a reason the caller can act on.
+func refused(code services.ErrorCode, format string, args ...any) error {
+	return &services.PaymentError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// SetLocker replaces the locker, e.g. with a shared one when running several instances.
+func (p *Payments) SetLocker(locker services.Locker) {
+	p.locker = locker
 }
 
 func (p *Payments) SetDatabase(database services.Database) {
 	p.database = database
 }
 
+func (p *Payments) SetGateway(gateway services.Gateway) {
+	p.gateway = gateway
+}
+
+// SetMetrics enables the payment, notification and lock metrics.
+func (p *Payments) SetMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
 func (p *Payments) SetLogger(logger services.LogHandler) {
 	p.logger = logger
 	if p.conf.DisablePayment {
@@ -79,89 +230,146 @@ func (p *Payments) SetLogger(logger services.LogHandler) {
 	}
 }
 
-// Notify processes a payment notification webhook from Redsys.
+// Notify processes a payment notification webhook from the gateway.
 // Note: Notify doesn't lock because it processes asynchronously and doesn't
 // directly modify shared state - the async processResponse handles its own locking.
 func (p *Payments) Notify(ctx context.Context, data []byte) error {
+	if err := p.checkAccepting(); err != nil {
+		return err
+	}
+	if p.gateway == nil {
+		return fmt.Errorf("payment gateway not set")
+	}
 
-	params, err := url.ParseQuery(string(data))
+	response, err := p.gateway.VerifyNotification(ctx, data)
 	if err != nil {
-		p.logger.Info(string(data))
-		return fmt.Errorf("parse query: %v", err)
+		p.metrics.Notification(NotificationInvalid)
+		p.logger.DebugContext(ctx, string(data))
+		return refused(services.ErrorInvalidNotification, "verify notification: %v", err)
 	}
-
-	paymentResult := entity.PaymentRequest{
-		SignatureVersion: params.Get("Ds_SignatureVersion"),
-		Parameters:       params.Get("Ds_MerchantParameters"),
-		Signature:        params.Get("Ds_Signature"),
+	response.Notification = true
+	ctx = WithLogFields(ctx, FieldOrder, response.Order)
+	// the notification is processed under the request that sent the operation
+	if origin := response.MerchantData; origin != GetRequestID(ctx) && ValidRequestID(origin) {
+		p.logger.DebugContext(ctx, "notification of request "+origin)
+		ctx = WithRequestIDValue(ctx, origin)
 	}
 
-	response, err := p.readParameters(paymentResult.Parameters)
-	if response != nil {
-		// Process payment response asynchronously with panic recovery
-		go p.processResponseWithRecovery(ctx, response)
-	}
-	return err
+	// Process payment response asynchronously with panic recovery
+	p.jobs.goJob(func() { p.processResponseWithRecovery(ctx, response) })
+	return nil
 }
 
 // PayTransaction initiates a payment for a finished charging transaction.
 // Uses per-transaction locking to allow concurrent payments for different transactions.
 func (p *Payments) PayTransaction(ctx context.Context, transactionId int) error {
-	mutex := p.lockOrder(transactionId)
-	defer p.unlockOrder(transactionId, mutex)
+	_, err := p.payTransaction(ctx, transactionId, nil)
+	return err
+}
+
+// PayTransactionWait initiates a payment like PayTransaction and waits up to
+// the given time for the gateway request job to finish. A request deferred
+// or retried by the job leaves the order pending.
+func (p *Payments) PayTransactionWait(ctx context.Context, transactionId int, wait time.Duration) (*entity.PaymentStatus, error) {
+	done := make(chan struct{})
+	orderId, err := p.payTransaction(ctx, transactionId, done)
+	if err != nil || orderId == 0 {
+		return nil, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		p.logger.InfoContext(ctx, fmt.Sprintf("order %d: no gateway outcome after %v", orderId, wait))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.OrderStatus(ctx, orderId)
+}
 
-	p.logger.Info(fmt.Sprintf("pay transaction %v", transactionId))
+// OrderStatus returns the outcome of a payment order.
+func (p *Payments) OrderStatus(ctx context.Context, orderId int) (*entity.PaymentStatus, error) {
+	if p.database == nil {
+		return nil, fmt.Errorf("database not set")
+	}
+	order, err := p.database.GetPaymentOrder(ctx, orderId)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil, refused(services.ErrorOrderNotFound, "order %d not found", orderId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order.Status(), nil
+}
 
-	if p.conf.Merchant.Secret == "" || p.conf.Merchant.Code == "" || p.conf.Merchant.Terminal == "" {
-		return fmt.Errorf("merchant not configured")
+// payTransaction opens a payment order for the transaction and starts the
+// gateway request job, which closes done when it finishes. It returns the
+// order number, or zero if no order was opened and no job started.
+func (p *Payments) payTransaction(ctx context.Context, transactionId int, done chan<- struct{}) (int, error) {
+	if err := p.checkAccepting(); err != nil {
+		return 0, err
+	}
+	ctx = WithLogFields(ctx, FieldTransactionId, transactionId)
+	ctx, lease, err := p.lockTransaction(ctx, transactionId)
+	if err != nil {
+		return 0, err
+	}
+	defer p.unlock(lease)
+
+	p.logger.InfoContext(ctx, fmt.Sprintf("pay transaction %v", transactionId))
+
+	if err := p.checkGateway(); err != nil {
+		return 0, err
 	}
 
 	transaction, err := p.getTransaction(ctx, transactionId)
 	if err != nil {
-		p.logger.Error(fmt.Sprintf("pay transaction %v", transactionId), err)
-		return err
+		p.logger.ErrorContext(ctx, fmt.Sprintf("pay transaction %v", transactionId), err)
+		return 0, err
 	}
 	amount := transaction.PaymentAmount - transaction.PaymentBilled
 	if amount <= 0 {
-		p.logger.Warn(fmt.Sprintf("transaction %v amount is zero", transactionId))
-		return nil
+		p.logger.WarnContext(ctx, fmt.Sprintf("transaction %v amount is zero", transactionId))
+		return 0, refused(services.ErrorAmountZero, "transaction %v has nothing to pay", transactionId)
 	}
 
 	// --------------------------------------------- USER TAG
 	tag := transaction.UserTag
 	if tag == nil {
 		tag, err = p.database.GetUserTag(ctx, transaction.IdTag)
+		if errors.Is(err, services.ErrNotFound) {
+			return 0, refused(services.ErrorNoUser, "user tag %v not found", secret(transaction.IdTag))
+		}
 		if err != nil {
-			p.logger.Error("get user tag", err)
-			return err
+			p.logger.ErrorContext(ctx, "get user tag", err)
+			return 0, err
 		}
 	}
 	if tag.UserId == "" {
-		//p.logger.Warn(fmt.Sprintf("empty user id for tag %v", tag.IdTag))
+		//p.logger.WarnContext(ctx, fmt.Sprintf("empty user id for tag %v", tag.IdTag))
 
-		transaction.PaymentBilled = transaction.PaymentAmount
-		err = p.database.UpdateTransaction(ctx, transaction)
-		if err != nil {
-			p.logger.Error("update transaction", err)
+		if err = p.billWithoutPayment(ctx, transactionId); err != nil {
+			p.logger.ErrorContext(ctx, "update transaction", err)
 		}
 
-		return fmt.Errorf("empty user id for tag %v", secret(transaction.IdTag))
+		return 0, refused(services.ErrorNoUser, "empty user id for tag %v", secret(transaction.IdTag))
 	}
+	ctx = WithLogFields(ctx, FieldUserId, tag.UserId)
 
 	// --------------------------------------------- PAYMENT METHOD
 	paymentMethod := transaction.PaymentMethod
 	if paymentMethod == nil {
 		paymentMethod, err = p.database.GetPaymentMethod(ctx, tag.UserId)
 		if err != nil {
-			//p.logger.Error("failed to get payment method", err)
+			//p.logger.ErrorContext(ctx, "failed to get payment method", err)
 
-			transaction.PaymentBilled = transaction.PaymentAmount
-			err = p.database.UpdateTransaction(ctx, transaction)
-			if err != nil {
-				p.logger.Error("update transaction", err)
+			if err = p.billWithoutPayment(ctx, transactionId); err != nil {
+				p.logger.ErrorContext(ctx, "update transaction", err)
 			}
 
-			return fmt.Errorf("id %v has no payment method", secret(transaction.IdTag))
+			return 0, refused(services.ErrorNoPaymentMethod, "id %v has no payment method", secret(transaction.IdTag))
 		}
 	}
 	// try to get another payment method if the current has some problems or the transaction has previous errors
@@ -169,33 +377,22 @@ func (p *Payments) PayTransaction(ctx context.Context, transactionId int) error
 		storedPM, _ := p.database.GetPaymentMethod(ctx, tag.UserId)
 		if storedPM != nil && storedPM.Identifier != paymentMethod.Identifier {
 			paymentMethod = storedPM
-			p.logger.Warn(fmt.Sprintf("payment method loaded from db: %s", secret(storedPM.Identifier)))
+			p.logger.WarnContext(ctx, fmt.Sprintf("payment method loaded from db: %s", secret(storedPM.Identifier)))
 		}
 	}
 
 	consumed := (transaction.MeterStop - transaction.MeterStart) / 1000
 	description := fmt.Sprintf("%s:%d %dkW", transaction.ChargePointId, transaction.ConnectorId, consumed)
 
-	orderToClose, err := p.database.GetPaymentOrderByTransaction(ctx, transaction.Id)
-	if err == nil && orderToClose != nil {
-		orderToClose.IsCompleted = true
-		orderToClose.Result = "closed without response"
-		orderToClose.TimeClosed = time.Now()
-		if err := p.database.SavePaymentOrder(ctx, orderToClose); err != nil {
-			p.logger.Error("failed to close previous payment order", err)
-		}
-		p.updatePaymentMethodFailCounter(ctx, orderToClose.Identifier, 1)
-	}
+	p.closeOpenOrder(ctx, transaction.Id)
 
 	//---------------------------------------------
 	if p.conf.DisablePayment {
-		transaction.PaymentBilled = transaction.PaymentAmount
-		err = p.database.UpdateTransaction(ctx, transaction)
-		if err != nil {
-			p.logger.Error("update transaction", err)
+		if err = p.billWithoutPayment(ctx, transactionId); err != nil {
+			p.logger.ErrorContext(ctx, "update transaction", err)
 		}
-		p.logger.Info(fmt.Sprintf("payment disabled: transaction %v paid without request", transactionId))
-		return nil
+		p.logger.InfoContext(ctx, fmt.Sprintf("payment disabled: transaction %v paid without request", transactionId))
+		return 0, nil
 	}
 	//---------------------------------------------
 
@@ -207,175 +404,350 @@ func (p *Payments) PayTransaction(ctx context.Context, transactionId int) error
 		UserId:        tag.UserId,
 		UserName:      tag.Username,
 		TimeOpened:    time.Now(),
+		RequestId:     GetRequestID(ctx),
+	}
+	paymentOrder.Create(fmt.Sprintf("transaction %v", transaction.Id))
+
+	// another instance may take the same number; the insert then conflicts
+	// and the order is numbered again
+	err = p.update(ctx, func(ctx context.Context) error {
+		lastOrder, err := p.database.GetLastOrder(ctx)
+		switch {
+		case err == nil:
+			paymentOrder.Order = lastOrder.Order + 1
+		case errors.Is(err, services.ErrNotFound):
+			paymentOrder.Order = 1200
+		default:
+			return fmt.Errorf("get last order: %w", err)
+		}
+		return p.database.CreatePaymentOrder(ctx, &paymentOrder)
+	})
+	if err != nil {
+		p.logger.ErrorContext(ctx, "save order", err)
+		return 0, err
 	}
+	ctx = WithLogFields(ctx, FieldOrder, paymentOrder.Order)
 
-	lastOrder, _ := p.database.GetLastOrder(ctx)
-	if lastOrder != nil {
-		paymentOrder.Order = lastOrder.Order + 1
-	} else {
-		paymentOrder.Order = 1200
+	request := &services.GatewayRequest{
+		Order:        paymentOrder.Order,
+		Amount:       amount,
+		Currency:     currencyEUR,
+		Identifier:   paymentMethod.Identifier,
+		CofTid:       paymentMethod.CofTid,
+		Description:  description,
+		MerchantData: paymentOrder.RequestId,
 	}
+	p.logger.InfoContext(ctx, fmt.Sprintf("order: %d; identifier: %s; txnid: %s", request.Order, secret(request.Identifier), secret(request.CofTid)))
+
+	// Process payment request asynchronously with timeout
+	p.jobs.goJob(func() {
+		if done != nil {
+			defer close(done)
+		}
+		p.processRequestWithTimeout(ctx, services.OperationAuthorize, request, 0)
+	})
 
-	err = p.database.SavePaymentOrder(ctx, &paymentOrder)
+	return paymentOrder.Order, nil
+}
+
+// billWithoutPayment marks the whole amount of a transaction as billed without
+// a payment order, e.g. when the user has no payment method. The caller holds
+// the transaction lock.
+func (p *Payments) billWithoutPayment(ctx context.Context, transactionId int) error {
+	return p.update(ctx, func(ctx context.Context) error {
+		transaction, err := p.database.GetTransaction(ctx, transactionId)
+		if err != nil {
+			return fmt.Errorf("get transaction: %w", err)
+		}
+		transaction.PaymentBilled = transaction.PaymentAmount
+		return p.database.UpdateTransaction(ctx, transaction)
+	})
+}
+
+// closeOpenOrder times out an order of the transaction still waiting for a result,
+// before a new order is opened. The caller holds the transaction lock.
+func (p *Payments) closeOpenOrder(ctx context.Context, transactionId int) {
+	openOrder, err := p.database.GetPaymentOrderByTransaction(ctx, transactionId)
+	if err != nil && !errors.Is(err, services.ErrNotFound) {
+		p.logger.ErrorContext(ctx, "get open payment order", err)
+	}
+	if err != nil || openOrder == nil {
+		return
+	}
+	ctx, lease, err := p.lockOrder(ctx, openOrder.Order)
 	if err != nil {
-		p.logger.Error("save order", err)
-		return err
+		p.logger.ErrorContext(ctx, "close previous payment order", err)
+		return
 	}
+	defer p.unlock(lease)
 
-	order := fmt.Sprintf("%d", paymentOrder.Order)
-
-	// Prepare Redsys MIT (Merchant Initiated Transaction) parameters
-	// This is a subsequent recurring payment using stored credentials
-	parameters := entity.MerchantParameters{
-		Amount:          fmt.Sprintf("%d", amount),
-		Order:           order,
-		Identifier:      paymentMethod.Identifier,
-		MerchantCode:    p.conf.Merchant.Code,
-		Currency:        "978", // EUR
-		TransactionType: "0",   // 0 = Authorization/Purchase, 3 = Refund
-		Terminal:        p.conf.Merchant.Terminal,
-		// DirectPayment: "true" for MIT using stored token (no redirect)
-		DirectPayment: "true",
-		// Exception: "MIT" signals PSD2 Merchant Initiated Transaction exemption
-		// Required for merchant-initiated payments without cardholder participation
-		Exception: "MIT",
-		// CofIni: "N" indicates this is NOT the initial credential storage transaction
-		// Initial transactions use "S", subsequent use "N"
-		CofIni: "N",
-		// CofType: "R" for Recurring payments (variable amounts, defined intervals)
-		// "R" = Recurring (EV charging sessions with variable amounts)
-		// "I" = Installments (fixed amounts, fixed intervals)
-		// "C" = Others (one-time misc transactions)
-		CofType: "R",
-		// CofTid: Network transaction ID from the initial authorization
-		// This links the current MIT transaction to the original cardholder-initiated auth
-		CofTid: paymentMethod.CofTid,
-	}
-	p.logger.Info(fmt.Sprintf("order: %s; identifier: %s; txnid: %s", order, secret(parameters.Identifier), secret(parameters.CofTid)))
-
-	request, err := p.newRequest(&parameters)
+	err = p.update(ctx, func(ctx context.Context) error {
+		// reload under the lock, a result may have arrived in the meantime
+		orderToClose, err := p.database.GetPaymentOrder(ctx, openOrder.Order)
+		if err != nil {
+			return fmt.Errorf("get payment order: %w", err)
+		}
+		// a deferred order never reached the gateway, the card is not at fault
+		deferred := orderToClose.CurrentState() == entity.OrderDeferred
+		if err = orderToClose.Transition(entity.OrderTimedOut, "closed by new payment"); err != nil {
+			p.logger.WarnContext(ctx, err.Error())
+			return nil
+		}
+		orderToClose.Result = "closed without response"
+		orderToClose.TimeClosed = time.Now()
+		if err = p.database.SavePaymentOrder(ctx, orderToClose); err != nil {
+			return err
+		}
+		if deferred {
+			return nil
+		}
+		return p.updatePaymentMethodFailCounter(ctx, orderToClose.Identifier, 1)
+	})
 	if err != nil {
-		p.logger.Error("pay: create request", err)
-		return err
+		p.logger.ErrorContext(ctx, "failed to close previous payment order", err)
 	}
-
-	// Process payment request asynchronously with timeout
-	go p.processRequestWithTimeout(ctx, request, paymentOrder.Order)
-
-	return nil
 }
 
-// ReturnPayment processes a refund for a charging transaction.
+// ReturnPayment refunds a charging transaction. The amount is spread across the
+// successful payment orders of the transaction, newest first, never exceeding what
+// is left to refund on each order; an amount of zero refunds everything left.
+// Each part is recorded on the transaction as a refund leg.
 // Uses per-transaction locking to allow concurrent operations.
-func (p *Payments) ReturnPayment(ctx context.Context, transactionId int) error {
-	mutex := p.lockOrder(transactionId)
-	defer p.unlockOrder(transactionId, mutex)
+func (p *Payments) ReturnPayment(ctx context.Context, transactionId int, amount int) error {
+	if err := p.checkAccepting(); err != nil {
+		return err
+	}
+	ctx = WithLogFields(ctx, FieldTransactionId, transactionId)
+	ctx, lease, err := p.lockTransaction(ctx, transactionId)
+	if err != nil {
+		return err
+	}
+	defer p.unlock(lease)
+
+	if err := p.checkGateway(); err != nil {
+		return err
+	}
+	if amount < 0 {
+		return refused(services.ErrorInvalidAmount, "amount to return is negative")
+	}
 
 	transaction, err := p.getTransaction(ctx, transactionId)
 	if err != nil {
-		p.logger.Error(fmt.Sprintf("return transaction %v", transactionId), err)
+		p.logger.ErrorContext(ctx, fmt.Sprintf("return transaction %v", transactionId), err)
 		return err
 	}
-	amount := transaction.PaymentAmount
-	if amount <= 0 {
-		p.logger.Warn(fmt.Sprintf("transaction %v amount is zero", transactionId))
+
+	orders, err := p.refundableOrders(ctx, transaction)
+	if err != nil {
+		return err
+	}
+	if len(orders) == 0 {
+		p.logger.WarnContext(ctx, fmt.Sprintf("transaction %v has nothing to refund", transactionId))
 		return nil
 	}
-	order := fmt.Sprintf("%d", transaction.PaymentOrder)
-
-	parameters := entity.MerchantParameters{
-		Amount: fmt.Sprintf("%d", amount),
-		Order:  order,
-		//Identifier:      paymentOrder.Identifier,
-		MerchantCode:    p.conf.Merchant.Code,
-		Currency:        "978",
-		TransactionType: "3",
-		Terminal:        p.conf.Merchant.Terminal,
-		//DirectPayment:   "true",
-		//Exception:       "MIT",
-		//Cof:             "N",
+	// orders are locked before the unit of work, lease writes must not join it
+	for _, order := range orders {
+		var orderLease *workLease
+		ctx, orderLease, err = p.lockOrder(ctx, order.Order)
+		if err != nil {
+			return err
+		}
+		defer p.unlock(orderLease)
 	}
 
-	request, err := p.newRequest(&parameters)
+	var legs []entity.RefundLeg
+	err = p.update(ctx, func(ctx context.Context) error {
+		legs = nil
+		// reload under the order locks, results may have arrived in the meantime
+		transaction, err := p.database.GetTransaction(ctx, transactionId)
+		if err != nil {
+			return fmt.Errorf("get transaction: %w", err)
+		}
+		orders, err := p.refundableOrders(ctx, transaction)
+		if err != nil {
+			return err
+		}
+		refundable := 0
+		for _, order := range orders {
+			refundable += order.Refundable()
+		}
+		rest := amount
+		if rest == 0 {
+			rest = refundable
+		}
+		if rest > refundable {
+			return refused(services.ErrorInvalidAmount, "return amount %v exceeds refundable amount %v", rest, refundable)
+		}
+
+		for _, order := range orders {
+			if rest == 0 {
+				break
+			}
+			legAmount := min(rest, order.Refundable())
+			if legAmount <= 0 {
+				continue
+			}
+			order.AddRefund(entity.Refund{
+				Amount:    legAmount,
+				Reason:    fmt.Sprintf("transaction %v refund", transactionId),
+				RequestId: GetRequestID(ctx),
+				Time:      time.Now(),
+			})
+			if err = p.database.SavePaymentOrder(ctx, order); err != nil {
+				return fmt.Errorf("save refund of order %v: %v", order.Order, err)
+			}
+			legs = append(legs, entity.RefundLeg{
+				Order:      order.Order,
+				Amount:     legAmount,
+				Status:     entity.RefundPending,
+				TimeOpened: time.Now(),
+			})
+			rest -= legAmount
+		}
+
+		transaction.RefundLegs = append(transaction.RefundLegs, legs...)
+		if err = p.database.UpdateTransaction(ctx, transaction); err != nil {
+			return fmt.Errorf("save refund legs: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		p.logger.Error("return: create request", err)
 		return err
 	}
+	if len(legs) == 0 {
+		p.logger.WarnContext(ctx, fmt.Sprintf("transaction %v has nothing to refund", transactionId))
+		return nil
+	}
 
-	// Process refund request asynchronously with timeout
-	go p.processRequestWithTimeout(ctx, request, transaction.PaymentOrder)
+	for _, leg := range legs {
+		legCtx := WithLogFields(ctx, FieldOrder, leg.Order)
+		p.logger.InfoContext(legCtx, fmt.Sprintf("return transaction %v: order %v, amount %v", transactionId, leg.Order, leg.Amount))
+		request := &services.GatewayRequest{
+			Order:        leg.Order,
+			Amount:       leg.Amount,
+			Currency:     currencyEUR,
+			MerchantData: GetRequestID(ctx),
+		}
+		// Process refund request asynchronously with timeout
+		p.jobs.goJob(func() { p.processRequestWithTimeout(legCtx, services.OperationRefund, request, 0) })
+	}
 
 	return nil
 }
 
+// refundableOrders loads the successful payment orders of a transaction, newest first.
+func (p *Payments) refundableOrders(ctx context.Context, transaction *entity.Transaction) ([]*entity.PaymentOrder, error) {
+	numbers := make([]int, 0, len(transaction.PaymentOrders)+1)
+	for _, order := range transaction.PaymentOrders {
+		numbers = append(numbers, order.Order)
+	}
+	// transactions billed before orders were listed only keep the last order
+	if len(numbers) == 0 && transaction.PaymentOrder > 0 {
+		numbers = append(numbers, transaction.PaymentOrder)
+	}
+
+	var orders []*entity.PaymentOrder
+	for _, number := range numbers {
+		order, err := p.database.GetPaymentOrder(ctx, number)
+		if err != nil {
+			return nil, fmt.Errorf("get payment order: %w", err)
+		}
+		if order.CapturedAmount() > 0 {
+			orders = append(orders, order)
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].TimeOpened.Equal(orders[j].TimeOpened) {
+			return orders[i].Order > orders[j].Order
+		}
+		return orders[i].TimeOpened.After(orders[j].TimeOpened)
+	})
+	return orders, nil
+}
+
 // ReturnByOrder processes a refund for a specific payment order.
+// The refund is rejected if it exceeds the captured amount minus the refunds
+// that are completed or still in flight; it is recorded on the order as pending.
 // Uses per-order locking to allow concurrent refund operations.
-func (p *Payments) ReturnByOrder(ctx context.Context, orderId string, amount int) error {
-	if amount == 0 {
-		return fmt.Errorf("amount to return is zero")
+func (p *Payments) ReturnByOrder(ctx context.Context, orderId string, refund *entity.RefundRequest) error {
+	if err := p.checkAccepting(); err != nil {
+		return err
+	}
+	if refund == nil || refund.Amount <= 0 {
+		return refused(services.ErrorAmountZero, "amount to return is zero")
 	}
 	if p.database == nil {
 		return fmt.Errorf("database not set")
 	}
+	if err := p.checkGateway(); err != nil {
+		return err
+	}
 	id, err := strconv.Atoi(orderId)
 	if err != nil {
-		return fmt.Errorf("invalid order id: %s; %v", orderId, err)
+		return refused(services.ErrorInvalidRequest, "invalid order id: %s", orderId)
 	}
+	ctx = WithLogFields(ctx, FieldOrder, id)
 
-	mutex := p.lockOrder(id)
-	defer p.unlockOrder(id, mutex)
-	order, err := p.database.GetPaymentOrder(ctx, id)
+	ctx, lease, err := p.lockOrder(ctx, id)
 	if err != nil {
-		return fmt.Errorf("get payment order: %v", err)
+		return err
 	}
-	if order.Amount < amount {
-		return fmt.Errorf("order amount %v is less than return amount %v", order.Amount, amount)
+	defer p.unlock(lease)
+	order, err := p.database.GetPaymentOrder(ctx, id)
+	if errors.Is(err, services.ErrNotFound) {
+		return refused(services.ErrorOrderNotFound, "order %d not found", id)
 	}
-
-	parameters := entity.MerchantParameters{
-		Amount:          fmt.Sprintf("%d", amount),
-		Order:           orderId,
-		MerchantCode:    p.conf.Merchant.Code,
-		Currency:        "978",
-		TransactionType: "3",
-		Terminal:        p.conf.Merchant.Terminal,
+	if err != nil {
+		return fmt.Errorf("get payment order: %w", err)
 	}
-
-	request, err := p.newRequest(&parameters)
+	ctx = WithLogFields(ctx, FieldTransactionId, order.TransactionId, FieldUserId, order.UserId)
+	request, err := p.recordRefund(ctx, order, refund)
 	if err != nil {
-		p.logger.Error("return by order: create request", err)
 		return err
 	}
 
 	// Process refund request asynchronously with timeout
-	go p.processRequestWithTimeout(ctx, request, id)
+	p.jobs.goJob(func() { p.processRequestWithTimeout(ctx, services.OperationRefund, request, 0) })
 
 	return nil
 }
 
-func (p *Payments) newRequest(parameters *entity.MerchantParameters) (*entity.PaymentRequest, error) {
-	// encode parameters to Base64
-	parametersBase64, err := p.createParameters(parameters)
-	if err != nil {
-		return nil, fmt.Errorf("parameters encode base64: %v", err)
-	}
-
-	order := parameters.Order
-	merchantSecret := p.conf.Merchant.Secret
+// recordRefund records a pending refund on a locked order and returns the
+// request to send to the gateway once the record is stored.
+func (p *Payments) recordRefund(ctx context.Context, order *entity.PaymentOrder, refund *entity.RefundRequest) (*services.GatewayRequest, error) {
+	if refundable := order.Refundable(); refundable < refund.Amount {
+		return nil, refused(services.ErrorInvalidAmount, "order refundable amount %v is less than return amount %v", refundable, refund.Amount)
+	}
+
+	order.AddRefund(entity.Refund{
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		Operator:  refund.Operator,
+		RequestId: GetRequestID(ctx),
+		Time:      time.Now(),
+	})
+	if err := p.database.SavePaymentOrder(ctx, order); err != nil {
+		return nil, fmt.Errorf("save payment order: %w", err)
+	}
+
+	return &services.GatewayRequest{
+		Order:        order.Order,
+		Amount:       refund.Amount,
+		Currency:     currencyEUR,
+		MerchantData: GetRequestID(ctx),
+	}, nil
+}
 
-	encryptor := NewEncryptor(merchantSecret, parametersBase64, order)
-	signature, err := encryptor.CreateSignature()
-	if err != nil {
-		return nil, fmt.Errorf("create signature: %v", err)
+// checkGateway verifies that a gateway is set and ready to accept requests.
+func (p *Payments) checkGateway() error {
+	if p.gateway == nil {
+		return fmt.Errorf("payment gateway not set")
 	}
-
-	request := &entity.PaymentRequest{
-		Parameters:       parametersBase64,
-		Signature:        signature,
-		SignatureVersion: "HMAC_SHA256_V1",
+	if err := p.gateway.Validate(); err != nil {
+		return refused(services.ErrorMerchantNotConfigured, "%s: %v", p.gateway.Name(), err)
 	}
-
-	return request, nil
+	return nil
 }
 
 func (p *Payments) getTransaction(ctx context.Context, transactionId int) (*entity.Transaction, error) {
@@ -383,179 +755,307 @@ func (p *Payments) getTransaction(ctx context.Context, transactionId int) (*enti
 		return nil, fmt.Errorf("database not set")
 	}
 	transaction, err := p.database.GetTransaction(ctx, transactionId)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil, refused(services.ErrorTransactionNotFound, "transaction %v not found", transactionId)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get transaction %v", transactionId)
+		return nil, fmt.Errorf("get transaction %v: %w", transactionId, err)
 	}
 	if !transaction.IsFinished {
-		return nil, fmt.Errorf("transaction %v is not finished", transactionId)
+		return nil, refused(services.ErrorTransactionNotFinished, "transaction %v is not finished", transactionId)
 	}
 	return transaction, nil
 }
 
-func (p *Payments) createParameters(parameters *entity.MerchantParameters) (string, error) {
-	// convert parameters to JSON string
-	parametersJson, err := json.Marshal(parameters)
-	if err != nil {
-		return "", err
-	}
-	p.logger.Debug(fmt.Sprintf("request parameters: %s", string(parametersJson)))
-	// encode parameters to Base64
-	return base64.StdEncoding.EncodeToString(parametersJson), nil
-}
-
 // processRequestWithTimeout wraps processRequest with timeout and panic recovery.
 // This ensures goroutines don't hang indefinitely and panics are logged.
 // Creates a detached context to prevent cancellation when HTTP request completes.
-func (p *Payments) processRequestWithTimeout(parentCtx context.Context, request *entity.PaymentRequest, orderId int) {
+// deferrals counts the previous attempts refused while the gateway was unavailable.
+func (p *Payments) processRequestWithTimeout(parentCtx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, deferrals int) {
 	// Recover from panics in goroutine
 	defer func() {
 		if r := recover(); r != nil {
-			p.logger.Error("panic in processRequest", fmt.Errorf("panic: %v", r))
+			p.logger.ErrorContext(parentCtx, "panic in processRequest", fmt.Errorf("panic: %v", r))
 		}
 	}()
 
-	// Extract request ID from parent context before it gets canceled
-	reqID := GetRequestID(parentCtx)
+	ctx, cancel := p.jobContext(parentCtx)
+	defer cancel()
+	ctx, span := StartSpan(ctx, "job "+string(operation), trace.SpanKindInternal, attribute.Int(FieldOrder, request.Order))
+	defer span.End()
 
-	// Create a detached background context to prevent cancellation when HTTP request completes
-	// The async payment processing must continue even after the HTTP handler returns
-	backgroundCtx := context.Background()
+	p.processRequest(ctx, operation, request, deferrals)
+}
+
+// jobContext creates the context of a gateway job, detached from the parent so
+// that the job continues after the HTTP handler returns, until the job times out
+// or is cancelled at the shutdown deadline. The request ID and the log fields
+// are kept for tracing.
+func (p *Payments) jobContext(parentCtx context.Context) (context.Context, context.CancelFunc) {
+	backgroundCtx := detachContext(p.jobs.ctx, parentCtx)
 
-	// Add request ID to the detached context for tracing
-	if reqID != "" {
-		backgroundCtx = context.WithValue(backgroundCtx, contextKey("requestID"), reqID)
+	// the timeout covers the gateway call and the database updates
+	timeout := p.conf.Gateway.JobTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
 	}
+	return context.WithTimeout(backgroundCtx, timeout)
+}
 
-	// Create context with timeout for external API call (30s)
-	ctx, cancel := context.WithTimeout(backgroundCtx, 30*time.Second)
-	defer cancel()
+// later runs fn as a gateway job after the delay. Waiting jobs give up on
+// shutdown; what they were about to do is left for the gateway notification.
+func (p *Payments) later(parentCtx context.Context, delay time.Duration, fn func(ctx context.Context)) {
+	p.jobs.goJob(func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.jobs.stopping:
+			return
+		}
 
-	p.processRequest(ctx, request, orderId)
+		defer func() {
+			if r := recover(); r != nil {
+				p.logger.ErrorContext(parentCtx, "panic in delayed request", fmt.Errorf("panic: %v", r))
+			}
+		}()
+		ctx, cancel := p.jobContext(parentCtx)
+		defer cancel()
+		ctx, span := StartSpan(ctx, "job delayed", trace.SpanKindInternal)
+		defer span.End()
+		fn(ctx)
+	})
 }
 
 // processResponseWithRecovery wraps processResponse with panic recovery.
 // Creates a detached context to prevent cancellation when HTTP request completes.
-func (p *Payments) processResponseWithRecovery(parentCtx context.Context, response *entity.PaymentParameters) {
+func (p *Payments) processResponseWithRecovery(parentCtx context.Context, response *services.GatewayResult) {
 	// Recover from panics in goroutine
 	defer func() {
 		if r := recover(); r != nil {
-			p.logger.Error("panic in processResponse", fmt.Errorf("panic: %v", r))
+			p.logger.ErrorContext(parentCtx, "panic in processResponse", fmt.Errorf("panic: %v", r))
 		}
 	}()
 
-	// Extract request ID from parent context before it gets canceled
-	reqID := GetRequestID(parentCtx)
-
-	// Create a detached background context to prevent cancellation when HTTP request completes
-	// The async response processing must continue even after the webhook handler returns
-	backgroundCtx := context.Background()
-
-	// Add request ID to the detached context for tracing
-	if reqID != "" {
-		backgroundCtx = context.WithValue(backgroundCtx, contextKey("requestID"), reqID)
-	}
+	// Create a detached context to prevent cancellation when HTTP request completes
+	// The async response processing must continue even after the webhook handler returns,
+	// until the job is cancelled at the shutdown deadline. The request ID and the
+	// log fields are kept for tracing.
+	backgroundCtx := detachContext(p.jobs.ctx, parentCtx)
+	backgroundCtx, span := StartSpan(backgroundCtx, "job "+string(response.Operation)+" result", trace.SpanKindInternal, attribute.Int(FieldOrder, response.Order))
+	defer span.End()
 
 	// processResponse will add its own timeout if needed
 	p.processResponse(backgroundCtx, response)
 }
 
-// processRequest sends a payment request to Redsys and processes the response.
+// processRequest sends a request to the payment gateway and processes the result.
 // This runs in a goroutine to avoid blocking the HTTP handler.
 // The context should have a timeout to prevent hanging.
-func (p *Payments) processRequest(ctx context.Context, request *entity.PaymentRequest, orderId int) {
-	requestData, err := json.Marshal(request)
-	if err != nil {
-		p.logger.Error("create request", err)
+func (p *Payments) processRequest(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, deferrals int) {
+	ctx = WithLogFields(ctx, FieldOrder, request.Order)
+	if operation == services.OperationAuthorize {
+		p.markSent(ctx, request.Order)
+	}
+	p.send(ctx, operation, request, deferrals, 0)
+}
+
+// send executes a request, records the attempt on the order and handles the
+// outcome. retries counts the previous attempts lost in transport.
+func (p *Payments) send(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, deferrals, retries int) {
+	result, err := p.execute(ctx, operation, request)
+	p.recordAttempt(ctx, operation, request.Order, sendAttempt(result, err))
+
+	if err == nil {
+		p.processResponse(ctx, result)
 		return
 	}
+	if errors.Is(err, services.ErrGatewayUnavailable) {
+		p.deferRequest(ctx, operation, request, deferrals, err)
+		return
+	}
+	// a resent request is refused as a duplicate when the first one reached the
+	// gateway after all: the card may be charged, so the result is queried again
+	if retries > 0 && errors.Is(err, services.ErrGatewayDuplicateOrder) {
+		p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d already on gateway, querying again (retry %d)", operation, request.Order, retries))
+		p.scheduleRecovery(ctx, operation, request, retries+1)
+		return
+	}
+	// close the order if the gateway rejected the request
+	var gatewayError *services.GatewayError
+	if errors.As(err, &gatewayError) {
+		p.logger.WarnContext(ctx, fmt.Sprintf("response error code: %s", gatewayError.Code))
+		p.metrics.Result(operation, OutcomeRejected, gatewayError.Code)
+		p.closeOnGatewayError(ctx, operation, request, gatewayError.Code)
+		return
+	}
+	// the job was cancelled on shutdown; the order is left open for the notification
+	if p.jobs.ctx.Err() != nil {
+		p.logger.ErrorContext(ctx, "request cancelled", p.jobs.ctx.Err())
+		return
+	}
+	p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d: %v", operation, request.Order, err))
+	p.scheduleRecovery(ctx, operation, request, retries+1)
+}
 
-	// Create HTTP request with context for timeout/cancellation support
-	req, err := http.NewRequestWithContext(ctx, "POST", p.requestUrl, bytes.NewBuffer(requestData))
-	if err != nil {
-		p.logger.Error("create http request", err)
+// deferRequest schedules a request refused while the gateway is unavailable to
+// be sent again after the delay the gateway asks for. The card is not at fault,
+// so the fail counter is not changed. After the configured number of attempts
+// an authorization is closed as errored without billing the transaction, which
+// can then be paid again later, and a refund is closed as failed.
+// A deferred request is left as is on shutdown; its order stays deferred.
+func (p *Payments) deferRequest(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, deferrals int, reason error) {
+	if deferrals >= p.conf.Gateway.RetryLimit {
+		p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d abandoned after %d attempts: %v", operation, request.Order, deferrals+1, reason))
+		p.metrics.Result(operation, OutcomeUnavailable, "")
+		p.closeUnavailable(ctx, operation, request)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if operation == services.OperationAuthorize {
+		p.markDeferred(ctx, request.Order, reason)
+	}
+
+	delay := time.Second
+	var unavailable *services.UnavailableError
+	if errors.As(reason, &unavailable) && unavailable.RetryAfter > delay {
+		delay = unavailable.RetryAfter
+	}
+	p.logger.WarnContext(ctx, fmt.Sprintf("%s order %d deferred for %v: %v", operation, request.Order, delay.Round(time.Second), reason))
+
+	p.later(ctx, delay, func(ctx context.Context) {
+		p.processRequest(ctx, operation, request, deferrals+1)
+	})
+}
 
-	response, err := p.httpClient.Do(req)
+// markDeferred moves an order that could not be sent to the deferred state.
+func (p *Payments) markDeferred(ctx context.Context, orderId int, reason error) {
+	ctx, lease, err := p.lockOrder(ctx, orderId)
 	if err != nil {
-		// Check if error was due to timeout/cancellation
-		if ctx.Err() != nil {
-			p.logger.Error("request timeout or cancelled", ctx.Err())
-		} else {
-			p.logger.Error("post request", err)
-		}
+		p.logger.ErrorContext(ctx, "mark order deferred", err)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
+	defer p.unlock(lease)
+
+	err = p.update(ctx, func(ctx context.Context) error {
+		order, err := p.database.GetPaymentOrder(ctx, orderId)
 		if err != nil {
-			p.logger.Error("close response body", err)
+			return fmt.Errorf("get payment order: %w", err)
 		}
-	}(response.Body)
-
-	body, err := io.ReadAll(response.Body)
+		if err = order.Transition(entity.OrderDeferred, reason.Error()); err != nil {
+			p.logger.WarnContext(ctx, err.Error())
+			return nil
+		}
+		return p.database.SavePaymentOrder(ctx, order)
+	})
 	if err != nil {
-		p.logger.Error("read response body", err)
+		p.logger.ErrorContext(ctx, "save payment order", err)
+	}
+}
+
+// closeUnavailable closes an order or a refund that could not be sent to the
+// gateway; the card is not at fault and the transaction is not billed.
+func (p *Payments) closeUnavailable(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest) {
+	const result = "gateway unavailable"
+	if operation != services.OperationAuthorize && operation != services.OperationRefund {
+		// a held order stays held and can be captured or voided again
 		return
 	}
 
-	paymentResult, err := p.readResponse(body)
+	ctx, lease, err := p.lockOrder(ctx, request.Order)
 	if err != nil {
-		// check if we have an error response from Redsys and close the order
-		code, e := p.checkErrorResponse(body)
-		if e != nil {
-			p.logger.Warn(fmt.Sprintf("unrecognized response: %s", string(body)))
-		} else {
-			p.logger.Warn(fmt.Sprintf("response error code: %s", code))
-			order, _ := p.database.GetPaymentOrder(ctx, orderId)
-			if order != nil {
-				p.closeOrderOnError(ctx, order, code)
-			}
-		}
+		p.logger.ErrorContext(ctx, "close unavailable order", err)
 		return
 	}
+	defer p.unlock(lease)
 
-	p.processResponse(ctx, paymentResult)
+	err = p.update(ctx, func(ctx context.Context) error {
+		order, err := p.database.GetPaymentOrder(ctx, request.Order)
+		if err != nil {
+			return fmt.Errorf("get payment order: %w", err)
+		}
+		if operation == services.OperationRefund {
+			return p.closeRefund(ctx, order, request.Amount, false, result, "")
+		}
+		if err = order.Transition(entity.OrderErrored, result); err != nil {
+			p.logger.WarnContext(ctx, err.Error())
+			return nil
+		}
+		order.Result = result
+		order.TimeClosed = time.Now()
+		return p.database.SavePaymentOrder(ctx, order)
+	})
+	if err != nil {
+		p.logger.ErrorContext(ctx, fmt.Sprintf("close %s of order %d", operation, request.Order), err)
+	}
 }
 
-func (p *Payments) readResponse(body []byte) (*entity.PaymentParameters, error) {
-	var paymentResponse entity.PaymentRequest
-	err := json.Unmarshal(body, &paymentResponse)
+// closeOnGatewayError closes the order or the refund rejected by the gateway.
+func (p *Payments) closeOnGatewayError(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest, code string) {
+	ctx, lease, err := p.lockOrder(ctx, request.Order)
 	if err != nil {
-		return nil, fmt.Errorf("parse response: %v", err)
+		p.logger.ErrorContext(ctx, "close order on error", err)
+		return
 	}
-	return p.readParameters(paymentResponse.Parameters)
-}
+	defer p.unlock(lease)
 
-func (p *Payments) checkErrorResponse(responseBody []byte) (string, error) {
-	var errorCode entity.ErrorCodeResponse
-	err := json.Unmarshal(responseBody, &errorCode)
+	err = p.update(ctx, func(ctx context.Context) error {
+		order, err := p.database.GetPaymentOrder(ctx, request.Order)
+		if err != nil {
+			return fmt.Errorf("get payment order: %w", err)
+		}
+		if operation == services.OperationRefund {
+			return p.closeRefund(ctx, order, request.Amount, false, code, "")
+		}
+		return p.closeOrderOnError(ctx, order, entity.OrderErrored, code)
+	})
 	if err != nil {
-		return "", err
+		p.logger.ErrorContext(ctx, fmt.Sprintf("close %s of order %d on error", operation, request.Order), err)
 	}
-	return errorCode.Code, nil
 }
 
-func (p *Payments) readParameters(parameters string) (*entity.PaymentParameters, error) {
-	if parameters == "" {
-		return nil, fmt.Errorf("empty parameters")
-	}
-	parametersBytes, err := base64.StdEncoding.DecodeString(parameters)
+// markSent moves a created order to the sent state before it goes to the gateway.
+func (p *Payments) markSent(ctx context.Context, orderId int) {
+	ctx, lease, err := p.lockOrder(ctx, orderId)
 	if err != nil {
-		return nil, fmt.Errorf("decode parameters: %v", err)
+		p.logger.ErrorContext(ctx, "mark order sent", err)
+		return
 	}
-	var paymentResult entity.PaymentParameters
-	err = json.Unmarshal(parametersBytes, &paymentResult)
+	defer p.unlock(lease)
+
+	err = p.update(ctx, func(ctx context.Context) error {
+		order, err := p.database.GetPaymentOrder(ctx, orderId)
+		if err != nil {
+			return fmt.Errorf("get payment order: %w", err)
+		}
+		if err = order.Transition(entity.OrderSent, p.gateway.Name()); err != nil {
+			p.logger.WarnContext(ctx, err.Error())
+			return nil
+		}
+		return p.database.SavePaymentOrder(ctx, order)
+	})
 	if err != nil {
-		p.logger.Warn(fmt.Sprintf("parameters: %s", string(parametersBytes)))
-		return nil, fmt.Errorf("parse parameters: %v", err)
+		p.logger.ErrorContext(ctx, "save payment order", err)
 	}
-	p.logger.Debug(fmt.Sprintf("received parameters: %s", string(parametersBytes)))
-	return &paymentResult, nil
 }
 
-func (p *Payments) processResponse(ctx context.Context, paymentResult *entity.PaymentParameters) {
+// execute dispatches the operation to the gateway.
+func (p *Payments) execute(ctx context.Context, operation services.GatewayOperation, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	switch operation {
+	case services.OperationAuthorize:
+		return p.gateway.Authorize(ctx, request)
+	case services.OperationCapture:
+		return p.gateway.Capture(ctx, request)
+	case services.OperationRefund:
+		return p.gateway.Refund(ctx, request)
+	case services.OperationVoid:
+		return p.gateway.Void(ctx, request)
+	case services.OperationQuery:
+		return p.gateway.Query(ctx, request)
+	}
+	return nil, fmt.Errorf("unsupported operation %s", operation)
+}
+
+func (p *Payments) processResponse(ctx context.Context, paymentResult *services.GatewayResult) {
 	// Add timeout for database operations if not already set
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		var cancel context.CancelFunc
@@ -563,65 +1063,107 @@ func (p *Payments) processResponse(ctx context.Context, paymentResult *entity.Pa
 		defer cancel()
 	}
 
-	p.logger.Info(fmt.Sprintf("response: type: %s; result: %s; order: %s; amount: %s", paymentResult.TransactionType, paymentResult.Response, paymentResult.Order, paymentResult.Amount))
-	err := p.database.SavePaymentResult(ctx, paymentResult)
-	if err != nil {
-		p.logger.Error("save payment result", err)
+	p.logger.InfoContext(ctx, fmt.Sprintf("response: %s; result: %s; order: %d; amount: %d", paymentResult.Operation, paymentResult.Code, paymentResult.Order, paymentResult.Amount))
+	if paymentResult.Raw != nil {
+		err := p.database.SavePaymentResult(ctx, paymentResult.Raw)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "save payment result", err)
+		}
 	}
 
-	number, err := strconv.Atoi(paymentResult.Order)
+	ctx, lease, err := p.lockOrder(ctx, paymentResult.Order)
 	if err != nil {
-		p.logger.Error("read order number", err)
+		p.countResult(paymentResult, false, err)
+		p.logger.ErrorContext(ctx, "process response", err)
 		return
 	}
-	amount, err := strconv.Atoi(paymentResult.Amount)
+	defer p.unlock(lease)
+
+	var refund *services.GatewayRequest
+	var applied bool
+	err = p.update(ctx, func(ctx context.Context) error {
+		var e error
+		refund, applied, e = p.applyResult(ctx, paymentResult)
+		return e
+	})
+	p.countResult(paymentResult, applied, err)
 	if err != nil {
-		p.logger.Error("read amount", err)
+		p.logger.ErrorContext(ctx, fmt.Sprintf("process %s result of order %d", paymentResult.Operation, paymentResult.Order), err)
 		return
 	}
-	order, err := p.database.GetPaymentOrder(ctx, number)
-	if err != nil {
-		p.logger.Error("get payment order", err)
-		return
+
+	// the refund is sent only when the unit of work that recorded it is committed
+	if refund != nil {
+		p.jobs.goJob(func() { p.processRequestWithTimeout(ctx, services.OperationRefund, refund, 0) })
 	}
-	if !order.IsCompleted {
-		order.Amount = amount
-		order.IsCompleted = true
-		order.Result = fmt.Sprintf("%s by electrum", paymentResult.Response)
-		order.TimeClosed = time.Now()
-		order.Currency = paymentResult.Currency
-		order.Date = fmt.Sprintf("%s %s", paymentResult.Date, paymentResult.Hour)
+}
 
-		err = p.database.SavePaymentOrder(ctx, order)
-		if err != nil {
-			p.logger.Error("save payment order", err)
+// countResult counts a processed gateway result if it was applied, and a
+// notification as valid, or as duplicate if it was ignored.
+func (p *Payments) countResult(result *services.GatewayResult, applied bool, err error) {
+	if applied {
+		p.metrics.Result(result.Operation, resultOutcome(result), result.Code)
+	}
+	if result.Notification {
+		if err == nil && !applied {
+			p.metrics.Notification(NotificationDuplicate)
+		} else {
+			p.metrics.Notification(NotificationValid)
 		}
 	}
+}
 
-	err = p.checkPaymentResult(paymentResult)
+// applyResult updates the order, the transaction and the payment method with a
+// gateway result inside a unit of work. It returns a refund to send when the
+// result verified a new payment method, and whether the result was applied
+// rather than ignored as a repeat of one already applied.
+func (p *Payments) applyResult(ctx context.Context, paymentResult *services.GatewayResult) (*services.GatewayRequest, bool, error) {
+	amount := paymentResult.Amount
+	order, err := p.database.GetPaymentOrder(ctx, paymentResult.Order)
 	if err != nil {
-		p.closeOrderOnError(ctx, order, paymentResult.Response)
-		return
+		return nil, false, fmt.Errorf("get payment order: %w", err)
+	}
+	if paymentResult.Operation == services.OperationRefund {
+		applied := order.HasPendingRefund(amount) ||
+			paymentResult.Approved && !order.HasCompletedRefund(amount, paymentResult.AuthorisationCode)
+		return nil, applied, p.closeRefund(ctx, order, amount, paymentResult.Approved, paymentResult.Code, paymentResult.AuthorisationCode)
 	}
-	p.updatePaymentMethodFailCounter(ctx, order.Identifier, 0)
 
-	// if transaction type is 3, then it is a refund
-	if paymentResult.TransactionType == "3" {
-		order.RefundAmount = amount
-		order.RefundTime = time.Now()
-		err = p.database.SavePaymentOrder(ctx, order)
-		if err != nil {
-			p.logger.Error("save payment order", err)
-		}
-		return
+	result := fmt.Sprintf("%s by electrum", paymentResult.Code)
+	if err = order.Transition(resultState(paymentResult), result); err != nil {
+		// the order already has a final result, e.g. a notification after the response
+		p.logger.WarnContext(ctx, fmt.Sprintf("ignored %s result: %v", paymentResult.Operation, err))
+		return nil, false, nil
+	}
+	order.Amount = amount
+	if paymentResult.Approved && !paymentResult.Held && paymentResult.Operation != services.OperationVoid {
+		order.Captured = amount
 	}
+	order.Result = result
+	order.TimeClosed = time.Now()
+	order.Currency = paymentResult.Currency
+	order.Date = paymentResult.Date
 
-	if order.TransactionId > 0 {
+	if err = p.database.SavePaymentOrder(ctx, order); err != nil {
+		return nil, true, err
+	}
 
+	if !paymentResult.Approved {
+		return nil, true, p.chargeFailed(ctx, order, paymentResult.Code)
+	}
+	if err = p.updatePaymentMethodFailCounter(ctx, order.Identifier, 0); err != nil {
+		return nil, true, err
+	}
+
+	// nothing is charged until a held order is captured
+	if paymentResult.Held || paymentResult.Operation == services.OperationVoid {
+		return nil, true, nil
+	}
+
+	if order.TransactionId > 0 {
 		transaction, e := p.database.GetTransaction(ctx, order.TransactionId)
 		if e != nil {
-			p.logger.Error("get transaction", e)
-			return
+			return nil, true, fmt.Errorf("get transaction: %w", e)
 		}
 
 		transaction.PaymentOrder = order.Order
@@ -629,76 +1171,156 @@ func (p *Payments) processResponse(ctx context.Context, paymentResult *entity.Pa
 		transaction.PaymentError = ""
 		transaction.AddOrder(*order)
 
-		e = p.database.UpdateTransaction(ctx, transaction)
-		if e != nil {
-			p.logger.Error("update transaction", e)
-			return
-		}
+		return nil, true, p.database.UpdateTransaction(ctx, transaction)
+	}
 
+	paymentMethod := entity.PaymentMethod{
+		Description: "**** **** **** ****",
+		Identifier:  paymentResult.Identifier,
+		CofTid:      paymentResult.CofTid,
+		CardBrand:   paymentResult.CardBrand,
+		CardCountry: paymentResult.CardCountry,
+		ExpiryDate:  paymentResult.ExpiryDate,
+		UserId:      order.UserId,
+		UserName:    order.UserName,
+	}
+	err = p.savePaymentMethod(ctx, &paymentMethod)
+	if err != nil {
+		// a card verified again is already stored; the verification is still refunded
+		p.logger.ErrorContext(ctx, "save payment method", err)
 	} else {
+		p.logger.InfoContext(ctx, fmt.Sprintf("payment method %s saved for %s", secret(paymentMethod.Identifier), order.UserName))
+	}
 
-		paymentMethod := entity.PaymentMethod{
-			Description: "**** **** **** ****",
-			Identifier:  paymentResult.MerchantIdentifier,
-			CofTid:      paymentResult.MerchantCofTxnid,
-			CardBrand:   paymentResult.CardBrand,
-			CardCountry: paymentResult.CardCountry,
-			ExpiryDate:  paymentResult.ExpiryDate,
-			UserId:      order.UserId,
-			UserName:    order.UserName,
-		}
-		err = p.savePaymentMethod(ctx, &paymentMethod)
-		if err != nil {
-			p.logger.Error("save payment method", err)
-		} else {
-			p.logger.Info(fmt.Sprintf("payment method %s saved for %s", secret(paymentMethod.Identifier), order.UserName))
+	//after saving payment method, need to refund the amount
+	if order.Amount <= 0 {
+		return nil, true, nil
+	}
+	refund, err := p.recordRefund(ctx, order, &entity.RefundRequest{
+		Amount: order.Amount,
+		Reason: "payment method verification",
+	})
+	return refund, true, err
+}
+
+// closeRefund stores the result of a refund on the order and closes the matching
+// refund leg of the transaction. A failed refund does not count against the card.
+// It runs inside the caller's unit of work.
+func (p *Payments) closeRefund(ctx context.Context, order *entity.PaymentOrder, amount int, approved bool, result, authorisationCode string) error {
+	status := entity.RefundFailed
+	if approved {
+		status = entity.RefundCompleted
+		if err := p.updatePaymentMethodFailCounter(ctx, order.Identifier, 0); err != nil {
+			return err
 		}
+	} else {
+		p.logger.WarnContext(ctx, fmt.Sprintf("refund of %v on order %v failed: %s", amount, order.Order, result))
+	}
 
-		//after saving payment method, need to refund the amount
-		if order.Amount > 0 {
-			id := fmt.Sprintf("%d", order.Order)
-			err = p.ReturnByOrder(ctx, id, order.Amount)
-			if err != nil {
-				p.logger.Error("refund payment", err)
-				return
-			}
+	if !order.CloseRefund(amount, status, result, authorisationCode) {
+		// a second message about a refund already closed, e.g. response and notification
+		if !approved || order.HasCompletedRefund(amount, authorisationCode) {
+			return nil
+		}
+		// refund made outside electrum or its record was lost
+		order.AddRefund(entity.Refund{
+			Amount: amount,
+			Reason: "refund notification",
+			Time:   time.Now(),
+		})
+		order.CloseRefund(amount, status, result, authorisationCode)
+	}
+	if status == entity.RefundCompleted {
+		state := entity.OrderPartiallyRefunded
+		if order.RefundAmount >= order.CapturedAmount() {
+			state = entity.OrderRefunded
 		}
+		if err := order.Transition(state, fmt.Sprintf("refund %v: %s", amount, result)); err != nil {
+			p.logger.WarnContext(ctx, err.Error())
+		}
+	}
+	if err := p.database.SavePaymentOrder(ctx, order); err != nil {
+		return err
+	}
+
+	if order.TransactionId == 0 {
+		return nil
+	}
+	transaction, err := p.database.GetTransaction(ctx, order.TransactionId)
+	if err != nil {
+		return fmt.Errorf("get transaction: %w", err)
+	}
+	if !transaction.CloseRefundLeg(order.Order, amount, status, result) {
+		return nil
+	}
+	return p.database.UpdateTransaction(ctx, transaction)
+}
 
+// resultOutcome maps a gateway result to its outcome in the metrics.
+func resultOutcome(result *services.GatewayResult) string {
+	switch {
+	case !result.Approved:
+		return OutcomeDeclined
+	case result.Held:
+		return OutcomeHeld
 	}
+	return OutcomeApproved
+}
 
+// resultState maps a gateway result to the order state it leads to.
+func resultState(result *services.GatewayResult) entity.OrderState {
+	if !result.Approved {
+		return entity.OrderDeclined
+	}
+	switch {
+	case result.Held:
+		return entity.OrderHeld
+	case result.Operation == services.OperationCapture:
+		return entity.OrderCaptured
+	case result.Operation == services.OperationVoid:
+		return entity.OrderVoided
+	}
+	return entity.OrderAuthorized
 }
 
-// closeOrderOnError marks a payment order as failed and closes it.
-// This is called when payment processing encounters an error.
-func (p *Payments) closeOrderOnError(ctx context.Context, order *entity.PaymentOrder, result string) {
-	p.updatePaymentMethodFailCounter(ctx, order.Identifier, 1)
+// closeOrderOnError moves a payment order to a failed state and closes it.
+// This is called when payment processing encounters an error, inside the
+// caller's unit of work.
+func (p *Payments) closeOrderOnError(ctx context.Context, order *entity.PaymentOrder, state entity.OrderState, result string) error {
+	if err := order.Transition(state, result); err != nil {
+		p.logger.WarnContext(ctx, fmt.Sprintf("close order on error: %v", err))
+		return nil
+	}
+	order.Result = result
+	order.TimeClosed = time.Now()
+	if err := p.database.SavePaymentOrder(ctx, order); err != nil {
+		return err
+	}
 
-	if !order.IsCompleted {
-		order.IsCompleted = true
-		order.Result = result
-		order.TimeClosed = time.Now()
-		if err := p.database.SavePaymentOrder(ctx, order); err != nil {
-			p.logger.Error("failed to save payment order on error", err)
-		}
+	return p.chargeFailed(ctx, order, result)
+}
+
+// chargeFailed counts the failure against the payment method and closes the
+// transaction of a failed order.
+func (p *Payments) chargeFailed(ctx context.Context, order *entity.PaymentOrder, result string) error {
+	if err := p.updatePaymentMethodFailCounter(ctx, order.Identifier, 1); err != nil {
+		return err
 	}
 
 	// close transaction on payment error; temporary solution
-	if order.TransactionId > 0 {
-		p.logger.Info(fmt.Sprintf("close transaction %v on payment error", order.TransactionId))
-		transaction, e := p.database.GetTransaction(ctx, order.TransactionId)
-		if e != nil {
-			p.logger.Error("get transaction", e)
-			return
-		}
-		transaction.PaymentBilled = transaction.PaymentAmount
-		transaction.PaymentOrder = order.Order
-		transaction.PaymentError = result
-		transaction.AddOrder(*order)
-		e = p.database.UpdateTransaction(ctx, transaction)
-		if e != nil {
-			p.logger.Error("update transaction", e)
-		}
+	if order.TransactionId == 0 {
+		return nil
+	}
+	p.logger.InfoContext(ctx, fmt.Sprintf("close transaction %v on payment error", order.TransactionId))
+	transaction, err := p.database.GetTransaction(ctx, order.TransactionId)
+	if err != nil {
+		return fmt.Errorf("get transaction: %w", err)
 	}
+	transaction.PaymentBilled = transaction.PaymentAmount
+	transaction.PaymentOrder = order.Order
+	transaction.PaymentError = result
+	transaction.AddOrder(*order)
+	return p.database.UpdateTransaction(ctx, transaction)
 }
 
 func (p *Payments) savePaymentMethod(ctx context.Context, pm *entity.PaymentMethod) error {
@@ -711,46 +1333,29 @@ func (p *Payments) savePaymentMethod(ctx context.Context, pm *entity.PaymentMeth
 	return p.database.SavePaymentMethod(ctx, pm)
 }
 
-func (p *Payments) checkPaymentResult(result *entity.PaymentParameters) error {
-	if result.TransactionType == "0" {
-		if result.Response != "0000" {
-			return fmt.Errorf("code %s", result.Response)
-		}
-		return nil
-	}
-	if result.TransactionType == "3" {
-		if result.Response != "0900" {
-			return fmt.Errorf("code %s", result.Response)
-		}
-		return nil
-	}
-	return fmt.Errorf("code %s; transaction type %s", result.Response, result.TransactionType)
-}
-
-func (p *Payments) updatePaymentMethodFailCounter(ctx context.Context, identifier string, count int) {
+// updatePaymentMethodFailCounter resets the fail counter when count is zero and
+// increments it otherwise. A missing payment method is not an error: it may have
+// been deleted by the user while the order was open.
+func (p *Payments) updatePaymentMethodFailCounter(ctx context.Context, identifier string, count int) error {
 	if p.database == nil || identifier == "" {
-		return
+		return nil
 	}
 
 	paymentMethod, err := p.database.GetPaymentMethodByIdentifier(ctx, identifier)
-	if err != nil {
-		p.logger.Error("get payment method", err)
-		return
-	}
-	if paymentMethod == nil {
-		p.logger.Warn(fmt.Sprintf("payment method %s not found", secret(identifier)))
-		return
+	if err != nil || paymentMethod == nil {
+		p.logger.WarnContext(ctx, fmt.Sprintf("payment method %s not found", secret(identifier)))
+		return nil
 	}
 
 	if count == 0 {
+		if paymentMethod.FailCount == 0 {
+			return nil
+		}
 		paymentMethod.FailCount = 0
 	} else {
 		paymentMethod.FailCount++
 	}
-	err = p.database.UpdatePaymentMethodFailCount(ctx, identifier, paymentMethod.FailCount)
-	if err != nil {
-		p.logger.Error("update payment method", err)
-	}
+	return p.database.UpdatePaymentMethodFailCount(ctx, identifier, paymentMethod.FailCount)
 }
 
 func secret(some string) string {
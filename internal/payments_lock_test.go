@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"testing"
+	"time"
+)
+
+// losableLocker grants leases that the test can report as lost.
+// Every grant has a greater token, also for a key still held.
+type losableLocker struct {
+	lease  *losableLease
+	tokens int64
+}
+
+func (l *losableLocker) Acquire(_ context.Context, key services.LockKey) (services.Lease, error) {
+	l.tokens++
+	l.lease = &losableLease{key: key, token: l.tokens, lost: make(chan struct{})}
+	return l.lease, nil
+}
+
+type losableLease struct {
+	key   services.LockKey
+	token int64
+	lost  chan struct{}
+}
+
+func (l *losableLease) Key() services.LockKey           { return l.key }
+func (l *losableLease) Token() int64                    { return l.token }
+func (l *losableLease) Renew(_ context.Context) error   { return nil }
+func (l *losableLease) Release(_ context.Context) error { return nil }
+func (l *losableLease) Lost() <-chan struct{}           { return l.lost }
+
+func TestLeaseLossCancelsWork(t *testing.T) {
+	database, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker := &losableLocker{}
+	p := NewPayments(&config.Config{})
+	p.SetLogger(NewLogger("payments", false, nil))
+	p.SetDatabase(database)
+	p.SetLocker(locker)
+
+	ctx, lease, err := p.lockOrder(context.Background(), 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.unlock(lease)
+	if ctx.Err() != nil {
+		t.Fatal("work context done while the lease is held")
+	}
+
+	close(locker.lease.lost)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work context not cancelled after the lease was lost")
+	}
+	if !errors.Is(context.Cause(ctx), services.ErrLeaseLost) {
+		t.Errorf("cause = %v, want lease lost", context.Cause(ctx))
+	}
+
+	err = p.update(ctx, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	if !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("update after the lease was lost: %v, want lease lost", err)
+	}
+}
+
+func TestUnlockEndsWork(t *testing.T) {
+	p := NewPayments(&config.Config{})
+	p.SetLogger(NewLogger("payments", false, nil))
+
+	ctx, lease, err := p.lockTransaction(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.unlock(lease)
+	if ctx.Err() == nil || context.Cause(ctx) == services.ErrLeaseLost {
+		t.Errorf("after unlock: err %v, cause %v", ctx.Err(), context.Cause(ctx))
+	}
+}
+
+func TestFenceRejectsStaleHolder(t *testing.T) {
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{}
+	conf.Database.Type = dialectSQLite
+	conf.Database.DSN = ":memory:"
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	for name, database := range map[string]services.Database{"memory": memory, "sqlite": store} {
+		t.Run(name, func(t *testing.T) {
+			p := NewPayments(&config.Config{})
+			p.SetLogger(NewLogger("payments", false, nil))
+			p.SetDatabase(database)
+			p.SetLocker(&losableLocker{})
+
+			order := &entity.PaymentOrder{Order: 1200, Amount: 500, TimeOpened: time.Now()}
+			if err := database.CreatePaymentOrder(context.Background(), order); err != nil {
+				t.Fatal(err)
+			}
+			setAmount := func(amount int) func(ctx context.Context) error {
+				return func(ctx context.Context) error {
+					order, err := database.GetPaymentOrder(ctx, 1200)
+					if err != nil {
+						return err
+					}
+					order.Amount = amount
+					return database.SavePaymentOrder(ctx, order)
+				}
+			}
+
+			// the lease expired without its holder noticing, and was granted again
+			staleCtx, stale, err := p.lockOrder(context.Background(), 1200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.unlock(stale)
+			ctx, lease, err := p.lockOrder(context.Background(), 1200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.unlock(lease)
+
+			if err = p.update(ctx, setAmount(600)); err != nil {
+				t.Fatalf("update of the new holder: %v", err)
+			}
+			err = p.update(staleCtx, setAmount(700))
+			var fenced *services.FencedError
+			if !errors.As(err, &fenced) || !errors.Is(err, services.ErrLeaseLost) || fenced.Token != 1 {
+				t.Fatalf("update of the stale holder: %v, want fenced token 1", err)
+			}
+			if err = p.update(ctx, setAmount(650)); err != nil {
+				t.Fatalf("update of the new holder after the stale one: %v", err)
+			}
+
+			stored, err := database.GetPaymentOrder(context.Background(), 1200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Amount != 650 || stored.Version != 3 {
+				t.Errorf("stored amount %d, version %d; want 650, 3", stored.Amount, stored.Version)
+			}
+		})
+	}
+}
+
+func TestFenceUndoneWithUnit(t *testing.T) {
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{}
+	conf.Database.Type = dialectSQLite
+	conf.Database.DSN = ":memory:"
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	key := services.LockKey{Namespace: services.LockTransaction, Id: "10"}
+	failed := errors.New("failed")
+	for name, database := range map[string]services.Database{"memory": memory, "sqlite": store} {
+		ctx := context.Background()
+		if err = database.Fence(ctx, key, 5); err != nil {
+			t.Fatalf("%s: fence 5: %v", name, err)
+		}
+		if err = database.Fence(ctx, key, 5); err != nil {
+			t.Errorf("%s: fence 5 again: %v", name, err)
+		}
+		// a unit of work that fails does not record its token
+		err = database.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := database.Fence(ctx, key, 7); err != nil {
+				return err
+			}
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			t.Fatalf("%s: failed unit: %v", name, err)
+		}
+		if err = database.Fence(ctx, key, 6); err != nil {
+			t.Errorf("%s: fence 6 after the failed unit: %v", name, err)
+		}
+		if err = database.Fence(ctx, key, 4); !errors.Is(err, services.ErrLeaseLost) {
+			t.Errorf("%s: fence 4: %v, want lease lost", name, err)
+		}
+	}
+}
+
+func TestLockTimeoutIsBusy(t *testing.T) {
+	conf := &config.Config{}
+	conf.Lock.AcquireTimeout = 20 * time.Millisecond
+	p := NewPayments(conf)
+	p.SetLogger(NewLogger("payments", false, nil))
+
+	_, lease, err := p.lockTransaction(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.unlock(lease)
+
+	_, _, err = p.lockTransaction(context.Background(), 10)
+	var refusal *services.PaymentError
+	if !errors.As(err, &refusal) || refusal.Code != services.ErrorBusy || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lock of a held key: %v, want busy after the deadline", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = p.lockTransaction(ctx, 10); !errors.As(err, &refusal) || refusal.Code != services.ErrorBusy {
+		t.Errorf("lock with a cancelled context: %v, want busy", err)
+	}
+}
@@ -0,0 +1,435 @@
+package internal_test
+
+import (
+	"context"
+	"database/sql"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/internal"
+	"electrum/internal/sandbox"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// testSecret is the public secret of the Redsys test terminal.
+const testSecret = "sq7HjrUOBfKmC576ILgskD5srU870gJ7"
+
+const (
+	testIdTag      = "tag-1"
+	testUserId     = "user-1"
+	testIdentifier = "tok-1"
+)
+
+// databases are the kinds of database the payment scenarios run on.
+var databases = []string{"memory", "sqlite"}
+
+// harness runs Payments on a database against the Redsys sandbox.
+type harness struct {
+	payments *internal.Payments
+	database services.Database
+	sandbox  *sandbox.Server
+	// seed stores a user tag and a transaction, written by the central system
+	seed func(t *testing.T, tag *entity.UserTag, transaction *entity.Transaction)
+	// setAmount changes the payment amount of a transaction, as when more
+	// energy is billed to it
+	setAmount func(t *testing.T, transactionId, amount int)
+}
+
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	var conf config.Config
+	if err := cleanenv.ReadEnv(&conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Merchant.Secret = testSecret
+	conf.Merchant.Code = "999008881"
+	conf.Merchant.Terminal = "1"
+	conf.Gateway.TimeoutMax = 2 * time.Second
+	conf.Gateway.RetryBackoff = 10 * time.Millisecond
+	return &conf
+}
+
+// newHarness creates Payments on the named database kind, with a user that
+// has a payment method.
+func newHarness(t *testing.T, kind string) *harness {
+	t.Helper()
+	conf := testConfig(t)
+	h := &harness{sandbox: sandbox.NewServer(testSecret)}
+	conf.Merchant.RequestUrl = h.sandbox.Start()
+	conf.Merchant.QueryUrl = h.sandbox.QueryUrl()
+	t.Cleanup(h.sandbox.Close)
+
+	switch kind {
+	case "memory":
+		memory, err := internal.NewMemoryDatabase("", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.database = memory
+		h.seed = func(t *testing.T, tag *entity.UserTag, transaction *entity.Transaction) {
+			if err := memory.SaveUserTag(tag); err != nil {
+				t.Fatal(err)
+			}
+			if err := memory.SaveTransaction(transaction); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.setAmount = func(t *testing.T, transactionId, amount int) {
+			transaction, err := memory.GetTransaction(context.Background(), transactionId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transaction.PaymentAmount = amount
+			if err = memory.SaveTransaction(transaction); err != nil {
+				t.Fatal(err)
+			}
+		}
+	case "sqlite":
+		conf.Database.Type = "sqlite"
+		conf.Database.DSN = filepath.Join(t.TempDir(), "electrum.db")
+		database, err := internal.NewSQLDatabase(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = database.Close(context.Background()) })
+		h.database = database
+		// user tags and transactions are written by the central system
+		central, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)", conf.Database.DSN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = central.Close() })
+		h.seed = func(t *testing.T, tag *entity.UserTag, transaction *entity.Transaction) {
+			_, err := central.Exec("INSERT OR REPLACE INTO user_tags (id_tag, user_id, username) VALUES (?, ?, ?)",
+				tag.IdTag, tag.UserId, tag.Username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = central.Exec("INSERT INTO transactions (transaction_id, is_finished, id_tag, charge_point_id, payment_amount) "+
+				"VALUES (?, ?, ?, ?, ?)",
+				transaction.Id, transaction.IsFinished, transaction.IdTag, transaction.ChargePointId, transaction.PaymentAmount)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.setAmount = func(t *testing.T, transactionId, amount int) {
+			if _, err := central.Exec("UPDATE transactions SET payment_amount = ? WHERE transaction_id = ?", amount, transactionId); err != nil {
+				t.Fatal(err)
+			}
+		}
+	default:
+		t.Fatalf("unknown database %s", kind)
+	}
+
+	redsys := internal.NewRedsys(conf)
+	h.payments = internal.NewPayments(conf)
+	h.payments.SetLogger(internal.NewLogger("payments", false, nil))
+	h.payments.SetDatabase(h.database)
+	h.payments.SetGateway(redsys)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = h.payments.Drain(ctx)
+	})
+
+	err := h.database.SavePaymentMethod(context.Background(), &entity.PaymentMethod{
+		UserId:     testUserId,
+		Identifier: testIdentifier,
+		CofTid:     "cof-1",
+		IsDefault:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// addTransaction stores a finished transaction of the test user.
+func (h *harness) addTransaction(t *testing.T, id, amount int) {
+	t.Helper()
+	h.seed(t, &entity.UserTag{IdTag: testIdTag, UserId: testUserId, Username: "user"}, &entity.Transaction{
+		Id:            id,
+		IsFinished:    true,
+		IdTag:         testIdTag,
+		ChargePointId: "cp-1",
+		PaymentAmount: amount,
+	})
+}
+
+// pay pays what is left of a transaction and waits for the gateway outcome.
+func (h *harness) pay(t *testing.T, transactionId int) *entity.PaymentStatus {
+	t.Helper()
+	status, err := h.payments.PayTransactionWait(context.Background(), transactionId, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == nil {
+		t.Fatal("no payment order opened")
+	}
+	return status
+}
+
+// transaction loads a transaction.
+func (h *harness) transaction(t *testing.T, id int) *entity.Transaction {
+	t.Helper()
+	transaction, err := h.database.GetTransaction(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transaction
+}
+
+// order loads a payment order.
+func (h *harness) order(t *testing.T, id int) *entity.PaymentOrder {
+	t.Helper()
+	order, err := h.database.GetPaymentOrder(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// eventually waits for a condition met by background jobs.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// settledLegs waits until no refund leg of the transaction is pending and returns them.
+func (h *harness) settledLegs(t *testing.T, transactionId int) []entity.RefundLeg {
+	t.Helper()
+	var legs []entity.RefundLeg
+	eventually(t, "refund legs", func() bool {
+		legs = h.transaction(t, transactionId).RefundLegs
+		for _, leg := range legs {
+			if leg.Status == entity.RefundPending {
+				return false
+			}
+		}
+		return true
+	})
+	return legs
+}
+
+func TestReturnPaymentSpreadsRefunds(t *testing.T) {
+	type leg struct {
+		order  int
+		amount int
+	}
+	tests := []struct {
+		name    string
+		refunds []int
+		legs    []leg
+		refused bool
+	}{
+		{
+			name:    "part of the newest order",
+			refunds: []int{400},
+			legs:    []leg{{1201, 400}},
+		},
+		{
+			name:    "across orders, newest first",
+			refunds: []int{900},
+			legs:    []leg{{1201, 600}, {1200, 300}},
+		},
+		{
+			name:    "everything left",
+			refunds: []int{0},
+			legs:    []leg{{1201, 600}, {1200, 1000}},
+		},
+		{
+			name:    "after an earlier refund",
+			refunds: []int{400, 900},
+			legs:    []leg{{1201, 400}, {1201, 200}, {1200, 700}},
+		},
+		{
+			name:    "everything left after an earlier refund",
+			refunds: []int{1000, 0},
+			legs:    []leg{{1201, 600}, {1200, 400}, {1200, 600}},
+		},
+		{
+			name:    "more than captured",
+			refunds: []int{1601},
+			refused: true,
+		},
+		{
+			name:    "more than left",
+			refunds: []int{1000, 601},
+			legs:    []leg{{1201, 600}, {1200, 400}},
+			refused: true,
+		},
+	}
+
+	for _, kind := range databases {
+		for _, test := range tests {
+			t.Run(kind+"/"+test.name, func(t *testing.T) {
+				h := newHarness(t, kind)
+				// two orders billed to the transaction: 1000, then 600 more
+				h.addTransaction(t, 10, 1000)
+				if status := h.pay(t, 10); status.State != entity.OrderAuthorized {
+					t.Fatalf("first order %s", status.State)
+				}
+				h.setAmount(t, 10, 1600)
+				if status := h.pay(t, 10); status.State != entity.OrderAuthorized {
+					t.Fatalf("second order %s", status.State)
+				}
+
+				var err error
+				for _, amount := range test.refunds {
+					if err = h.payments.ReturnPayment(context.Background(), 10, amount); err != nil {
+						break
+					}
+					h.settledLegs(t, 10)
+				}
+				var refusal *services.PaymentError
+				if test.refused != (errors.As(err, &refusal) && refusal.Code == services.ErrorInvalidAmount) {
+					t.Fatalf("error = %v, refused %v", err, test.refused)
+				}
+				if !test.refused && err != nil {
+					t.Fatal(err)
+				}
+
+				legs := h.settledLegs(t, 10)
+				if len(legs) != len(test.legs) {
+					t.Fatalf("legs %+v, want %+v", legs, test.legs)
+				}
+				refunded := map[int]int{}
+				for i, want := range test.legs {
+					if legs[i].Order != want.order || legs[i].Amount != want.amount || legs[i].Status != entity.RefundCompleted {
+						t.Errorf("leg %d: %+v, want %+v completed", i, legs[i], want)
+					}
+					refunded[want.order] += want.amount
+				}
+				for _, number := range []int{1200, 1201} {
+					order := h.order(t, number)
+					if order.RefundAmount != refunded[number] {
+						t.Errorf("order %d refunded %d, want %d", number, order.RefundAmount, refunded[number])
+					}
+					if order.RefundAmount == order.CapturedAmount() && order.CurrentState() != entity.OrderRefunded {
+						t.Errorf("fully refunded order %d in state %s", number, order.CurrentState())
+					}
+				}
+			})
+		}
+	}
+}
+
+// paymentState is what a scenario leaves in the database, without the times
+// and the references generated by the gateway.
+type paymentState struct {
+	Billed    int
+	Orders    []orderState
+	Legs      []legState
+	FailCount int
+}
+
+type orderState struct {
+	Order    int
+	State    entity.OrderState
+	Amount   int
+	Refunded int
+	Result   string
+	Refunds  []legState
+	Attempts []string
+}
+
+type legState struct {
+	Order  int
+	Amount int
+	Status string
+}
+
+// state loads the payment state of a transaction of the test user.
+func (h *harness) state(t *testing.T, transactionId int) paymentState {
+	t.Helper()
+	transaction := h.transaction(t, transactionId)
+	state := paymentState{Billed: transaction.PaymentBilled}
+	for _, billed := range transaction.PaymentOrders {
+		order := h.order(t, billed.Order)
+		o := orderState{
+			Order:    order.Order,
+			State:    order.CurrentState(),
+			Amount:   order.Amount,
+			Refunded: order.RefundAmount,
+			Result:   order.Result,
+		}
+		for _, refund := range order.Refunds {
+			o.Refunds = append(o.Refunds, legState{Order: order.Order, Amount: refund.Amount, Status: refund.Status})
+		}
+		for _, attempt := range order.Attempts {
+			o.Attempts = append(o.Attempts, attempt.Operation+" "+attempt.Outcome+" "+attempt.Code)
+		}
+		state.Orders = append(state.Orders, o)
+	}
+	for _, leg := range transaction.RefundLegs {
+		state.Legs = append(state.Legs, legState{Order: leg.Order, Amount: leg.Amount, Status: leg.Status})
+	}
+	method, err := h.database.GetPaymentMethod(context.Background(), testUserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.FailCount = method.FailCount
+	return state
+}
+
+func TestDatabaseParity(t *testing.T) {
+	scenario := func(t *testing.T, h *harness) paymentState {
+		h.addTransaction(t, 10, 1000)
+		if status := h.pay(t, 10); status.State != entity.OrderAuthorized {
+			t.Fatalf("first order %s", status.State)
+		}
+		// 600 more is billed and declined by the card
+		h.setAmount(t, 10, 1600)
+		if err := h.sandbox.OnAmount(600, sandbox.Declined("0190")); err != nil {
+			t.Fatal(err)
+		}
+		if status := h.pay(t, 10); status.State != entity.OrderDeclined {
+			t.Fatalf("declined order %s", status.State)
+		}
+		// a refund of the paid order, then one declined by the gateway
+		if err := h.payments.ReturnPayment(context.Background(), 10, 900); err != nil {
+			t.Fatal(err)
+		}
+		h.settledLegs(t, 10)
+		if err := h.sandbox.OnAmount(100, sandbox.Declined("0950")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.payments.ReturnPayment(context.Background(), 10, 100); err != nil {
+			t.Fatal(err)
+		}
+		h.settledLegs(t, 10)
+		return h.state(t, 10)
+	}
+
+	states := make(map[string]paymentState)
+	for _, kind := range databases {
+		t.Run(kind, func(t *testing.T) {
+			states[kind] = scenario(t, newHarness(t, kind))
+		})
+	}
+	if t.Failed() {
+		return
+	}
+	memory := states[databases[0]]
+	if len(memory.Orders) == 0 || len(memory.Legs) != 2 {
+		t.Fatalf("memory state %+v", memory)
+	}
+	for _, kind := range databases[1:] {
+		if !reflect.DeepEqual(states[kind], memory) {
+			t.Errorf("%s state differs from memory:\n%+v\n%+v", kind, states[kind], memory)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// racingDatabase lets a concurrent writer update the transaction right before
+// each of the first updates, so that they fail on a version conflict.
+type racingDatabase struct {
+	*MemoryDatabase
+	races   int
+	updates int
+}
+
+func (d *racingDatabase) UpdateTransaction(ctx context.Context, transaction *entity.Transaction) error {
+	d.updates++
+	if d.races > 0 {
+		d.races--
+		stored, err := d.GetTransaction(ctx, transaction.Id)
+		if err != nil {
+			return err
+		}
+		stored.Version++
+		if err = d.SaveTransaction(stored); err != nil {
+			return err
+		}
+	}
+	return d.MemoryDatabase.UpdateTransaction(ctx, transaction)
+}
+
+func newRacingPayments(t *testing.T, races int) (*Payments, *racingDatabase) {
+	t.Helper()
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &racingDatabase{MemoryDatabase: memory, races: races}
+	p := NewPayments(&config.Config{})
+	p.SetLogger(NewLogger("payments", false, nil))
+	p.SetDatabase(database)
+	p.SetGateway(NewMemoryGateway())
+	return p, database
+}
+
+func TestUpdateRetriesConflicts(t *testing.T) {
+	tests := []struct {
+		races    int
+		updates  int
+		conflict bool
+	}{
+		{races: 0, updates: 1},
+		{races: 1, updates: 2},
+		{races: maxConflictRetries, updates: maxConflictRetries + 1},
+		{races: maxConflictRetries + 1, updates: maxConflictRetries + 1, conflict: true},
+	}
+
+	for _, test := range tests {
+		p, database := newRacingPayments(t, test.races)
+		if err := database.SaveTransaction(&entity.Transaction{Id: 10, PaymentAmount: 500}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := p.update(context.Background(), func(ctx context.Context) error {
+			transaction, err := database.GetTransaction(ctx, 10)
+			if err != nil {
+				return err
+			}
+			transaction.PaymentBilled += 100
+			return database.UpdateTransaction(ctx, transaction)
+		})
+		if test.conflict != errors.Is(err, services.ErrConflict) || !test.conflict && err != nil {
+			t.Errorf("%d races: error %v", test.races, err)
+		}
+		if database.updates != test.updates {
+			t.Errorf("%d races: %d updates, want %d", test.races, database.updates, test.updates)
+		}
+		transaction, _ := database.GetTransaction(context.Background(), 10)
+		if billed := transaction.PaymentBilled; test.conflict && billed != 0 || !test.conflict && billed != 100 {
+			t.Errorf("%d races: billed %d", test.races, billed)
+		}
+	}
+}
+
+func TestPayTransactionWithoutUserRetriesConflicts(t *testing.T) {
+	p, database := newRacingPayments(t, 2)
+	if err := database.SaveUserTag(&entity.UserTag{IdTag: "tag-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SaveTransaction(&entity.Transaction{Id: 10, IsFinished: true, IdTag: "tag-1", PaymentAmount: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := p.PayTransaction(context.Background(), 10)
+	var refusal *services.PaymentError
+	if !errors.As(err, &refusal) || refusal.Code != services.ErrorNoUser {
+		t.Fatalf("error = %v, want no user", err)
+	}
+	transaction, err := database.GetTransaction(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.PaymentBilled != 500 {
+		t.Errorf("billed %d after conflicts, want 500", transaction.PaymentBilled)
+	}
+}
+
+// lastOrderDatabase answers the last order lookups as a lagging or failing
+// database would.
+type lastOrderDatabase struct {
+	*MemoryDatabase
+	stale int // lookups answered as if there were no order yet
+	fail  error
+}
+
+func (d *lastOrderDatabase) GetLastOrder(ctx context.Context) (*entity.PaymentOrder, error) {
+	if d.fail != nil {
+		return nil, d.fail
+	}
+	if d.stale > 0 {
+		d.stale--
+		return nil, fmt.Errorf("get last order: %w", services.ErrNotFound)
+	}
+	return d.MemoryDatabase.GetLastOrder(ctx)
+}
+
+func TestPayTransactionOrderNumber(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale int
+		fail  error
+		order int // the number of the new order; none if 0
+	}{
+		{name: "after the last order", order: 1201},
+		{name: "number taken", stale: 1, order: 1201},
+		{name: "last order unknown", fail: errors.New("connection reset")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, memory := newRecoveryPayments(t, NewMemoryGateway())
+			// an order stored before versioning
+			legacy := &entity.PaymentOrder{Order: 1200, TransactionId: 9, Amount: 700, IsCompleted: true, TimeOpened: time.Now().Add(-time.Hour)}
+			if err := memory.CreatePaymentOrder(context.Background(), legacy); err != nil {
+				t.Fatal(err)
+			}
+			p.SetDatabase(&lastOrderDatabase{MemoryDatabase: memory, stale: test.stale, fail: test.fail})
+
+			err := p.PayTransaction(context.Background(), 10)
+			if (err != nil) != (test.fail != nil) {
+				t.Fatalf("error %v", err)
+			}
+			if test.order != 0 {
+				waitFor(t, "payment order", func() bool {
+					order, err := memory.GetPaymentOrder(context.Background(), test.order)
+					return err == nil && order.TransactionId == 10 && !order.TimeClosed.IsZero()
+				})
+			} else if orders := len(memory.state.PaymentOrders); orders != 1 {
+				t.Errorf("%d orders stored, want the legacy order only", orders)
+			}
+
+			stored, err := memory.GetPaymentOrder(context.Background(), 1200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.TransactionId != 9 || stored.Amount != 700 || stored.Version != 1 {
+				t.Errorf("legacy order overwritten: %+v", stored)
+			}
+		})
+	}
+}
+
+func TestPaymentOrderCreateAndSave(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			var database services.Database
+			if kind == "memory" {
+				memory, err := NewMemoryDatabase("", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				database = memory
+			} else {
+				conf := &config.Config{}
+				conf.Database.Type = dialectSQLite
+				conf.Database.DSN = ":memory:"
+				store, err := NewSQLDatabase(conf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = store.Close(context.Background()) })
+				database = store
+			}
+			ctx := context.Background()
+
+			// an order that was never created cannot be saved
+			order := &entity.PaymentOrder{Order: 1200, Amount: 500, TimeOpened: time.Now()}
+			if err := database.SavePaymentOrder(ctx, order); !errors.Is(err, services.ErrConflict) || order.Version != 0 {
+				t.Fatalf("save of a new order: %v, version %d", err, order.Version)
+			}
+			if err := database.CreatePaymentOrder(ctx, order); err != nil || order.Version != 1 {
+				t.Fatalf("create: %v, version %d", err, order.Version)
+			}
+
+			// a second order with the number conflicts and leaves the first as is
+			taken := &entity.PaymentOrder{Order: 1200, Amount: 900, TimeOpened: time.Now()}
+			if err := database.CreatePaymentOrder(ctx, taken); !errors.Is(err, services.ErrConflict) || taken.Version != 0 {
+				t.Fatalf("create of a taken number: %v, version %d", err, taken.Version)
+			}
+
+			order.Amount = 600
+			if err := database.SavePaymentOrder(ctx, order); err != nil || order.Version != 2 {
+				t.Fatalf("save: %v, version %d", err, order.Version)
+			}
+			stale := *order
+			stale.Version = 1
+			if err := database.SavePaymentOrder(ctx, &stale); !errors.Is(err, services.ErrConflict) {
+				t.Fatalf("save at an old version: %v", err)
+			}
+
+			stored, err := database.GetPaymentOrder(ctx, 1200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Amount != 600 || stored.Version != 2 {
+				t.Errorf("stored amount %d, version %d; want 600, 2", stored.Amount, stored.Version)
+			}
+			last, err := database.GetLastOrder(ctx)
+			if err != nil || last.Order != 1200 {
+				t.Errorf("last order %v, %v", last, err)
+			}
+		})
+	}
+}
+
+func TestGetLastOrderNotFound(t *testing.T) {
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{}
+	conf.Database.Type = dialectSQLite
+	conf.Database.DSN = ":memory:"
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	for name, database := range map[string]services.Database{"memory": memory, "sqlite": store} {
+		if _, err = database.GetLastOrder(context.Background()); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("%s: error %v, want not found", name, err)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	redsysName = "redsys"
+
+	// Redsys DS_MERCHANT_TRANSACTIONTYPE values
+	redsysAuthorization    = "0"
+	redsysPreauthorization = "1"
+	redsysConfirmation     = "2"
+	redsysRefund           = "3"
+	redsysCancellation     = "9"
+
+	// redsysCodeNoRecord is the error code answered by the query endpoint
+	// when Redsys does not know the requested order.
+	redsysCodeNoRecord = "SIS0059"
+	// redsysCodeDuplicateOrder rejects a request with an order number that
+	// Redsys has already processed.
+	redsysCodeDuplicateOrder = "SIS0051"
+)
+
+// Redsys implements services.Gateway for the Redsys REST API.
+// Requests are signed with the merchant secret (see Encryptor) and posted to
+// trataPeticionREST; notifications are verified with the same algorithm.
+type Redsys struct {
+	conf       *config.Config
+	requestUrl string
+	queryUrl   string
+	httpClient *http.Client
+	logger     services.LogHandler
+}
+
+// NewRedsys creates a Redsys gateway with configured HTTP client.
+// The HTTP client includes timeouts and connection pooling for reliable external API calls.
+// The client timeout is the upper bound; shorter deadlines come with the request context.
+func NewRedsys(conf *config.Config) *Redsys {
+	return &Redsys{
+		conf:       conf,
+		requestUrl: conf.Merchant.RequestUrl,
+		queryUrl:   conf.Merchant.QueryUrl,
+		httpClient: &http.Client{
+			Timeout: conf.Gateway.TimeoutMax,
+			Transport: &http.Transport{
+				MaxIdleConns:        conf.Gateway.MaxIdleConns,
+				MaxIdleConnsPerHost: conf.Gateway.MaxIdleConnsPerHost,
+				MaxConnsPerHost:     conf.Gateway.MaxConnsPerHost,
+				IdleConnTimeout:     conf.Gateway.IdleConnTimeout,
+				DisableKeepAlives:   false,
+			},
+		},
+	}
+}
+
+func (r *Redsys) SetLogger(logger services.LogHandler) {
+	r.logger = logger
+}
+
+func (r *Redsys) Name() string {
+	return redsysName
+}
+
+// Validate checks that merchant credentials are present.
+func (r *Redsys) Validate() error {
+	if r.conf.Merchant.Secret == "" || r.conf.Merchant.Code == "" || r.conf.Merchant.Terminal == "" {
+		return fmt.Errorf("merchant not configured")
+	}
+	return nil
+}
+
+// Authorize sends a MIT (Merchant Initiated Transaction) payment using stored credentials.
+func (r *Redsys) Authorize(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	transactionType := redsysAuthorization
+	if request.Hold {
+		transactionType = redsysPreauthorization
+	}
+
+	// Prepare Redsys MIT (Merchant Initiated Transaction) parameters
+	// This is a subsequent recurring payment using stored credentials
+	parameters := r.parameters(request, transactionType)
+	parameters.Identifier = request.Identifier
+	// DirectPayment: "true" for MIT using stored token (no redirect)
+	parameters.DirectPayment = "true"
+	// Exception: "MIT" signals PSD2 Merchant Initiated Transaction exemption
+	// Required for merchant-initiated payments without cardholder participation
+	parameters.Exception = "MIT"
+	// CofIni: "N" indicates this is NOT the initial credential storage transaction
+	// Initial transactions use "S", subsequent use "N"
+	parameters.CofIni = "N"
+	// CofType: "R" for Recurring payments (variable amounts, defined intervals)
+	// "R" = Recurring (EV charging sessions with variable amounts)
+	// "I" = Installments (fixed amounts, fixed intervals)
+	// "C" = Others (one-time misc transactions)
+	parameters.CofType = "R"
+	// CofTid: Network transaction ID from the initial authorization
+	// This links the current MIT transaction to the original cardholder-initiated auth
+	parameters.CofTid = request.CofTid
+
+	return r.post(ctx, r.requestUrl, parameters)
+}
+
+// Capture confirms a previous preauthorization.
+func (r *Redsys) Capture(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return r.post(ctx, r.requestUrl, r.parameters(request, redsysConfirmation))
+}
+
+// Refund returns an amount of a completed payment.
+func (r *Redsys) Refund(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return r.post(ctx, r.requestUrl, r.parameters(request, redsysRefund))
+}
+
+// Void cancels a preauthorization that was not captured.
+func (r *Redsys) Void(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	return r.post(ctx, r.requestUrl, r.parameters(request, redsysCancellation))
+}
+
+// Query asks Redsys for the state of an order through the configured query URL.
+func (r *Redsys) Query(ctx context.Context, request *services.GatewayRequest) (*services.GatewayResult, error) {
+	if r.queryUrl == "" {
+		return nil, services.ErrGatewayQueryUnsupported
+	}
+	parameters := &entity.MerchantParameters{
+		Order:        fmt.Sprintf("%d", request.Order),
+		MerchantCode: r.conf.Merchant.Code,
+		Terminal:     r.conf.Merchant.Terminal,
+	}
+	result, err := r.post(ctx, r.queryUrl, parameters)
+	var gatewayError *services.GatewayError
+	if errors.As(err, &gatewayError) && gatewayError.Code == redsysCodeNoRecord {
+		return nil, services.ErrGatewayNoRecord
+	}
+	return result, err
+}
+
+// VerifyNotification checks the signature of a Redsys notification
+// (form-encoded Ds_SignatureVersion, Ds_MerchantParameters, Ds_Signature) and decodes it.
+func (r *Redsys) VerifyNotification(ctx context.Context, data []byte) (*services.GatewayResult, error) {
+	params, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse query: %v", err)
+	}
+
+	notification := entity.PaymentRequest{
+		SignatureVersion: params.Get("Ds_SignatureVersion"),
+		Parameters:       params.Get("Ds_MerchantParameters"),
+		Signature:        params.Get("Ds_Signature"),
+	}
+	return r.readMessage(ctx, &notification)
+}
+
+func (r *Redsys) parameters(request *services.GatewayRequest, transactionType string) *entity.MerchantParameters {
+	return &entity.MerchantParameters{
+		Amount:          fmt.Sprintf("%d", request.Amount),
+		Order:           fmt.Sprintf("%d", request.Order),
+		MerchantCode:    r.conf.Merchant.Code,
+		Currency:        request.Currency,
+		TransactionType: transactionType,
+		Terminal:        r.conf.Merchant.Terminal,
+		MerchantData:    request.MerchantData,
+	}
+}
+
+// post sends signed parameters to Redsys in a client span and decodes the signed response.
+func (r *Redsys) post(ctx context.Context, requestUrl string, parameters *entity.MerchantParameters) (*services.GatewayResult, error) {
+	ctx, span := StartSpan(ctx, "redsys POST", trace.SpanKindClient,
+		attribute.String("http.request.method", http.MethodPost),
+		attribute.String("url.full", requestUrl),
+		attribute.String("redsys.transaction_type", parameters.TransactionType),
+		attribute.String(FieldOrder, parameters.Order))
+	defer span.End()
+	result, err := r.send(ctx, span, requestUrl, parameters)
+	var gatewayError *services.GatewayError
+	if errors.As(err, &gatewayError) {
+		span.SetAttributes(attribute.String("redsys.code", gatewayError.Code))
+	} else {
+		spanError(span, err)
+	}
+	if result != nil {
+		span.SetAttributes(attribute.String("redsys.code", result.Code))
+	}
+	return result, err
+}
+
+func (r *Redsys) send(ctx context.Context, span trace.Span, requestUrl string, parameters *entity.MerchantParameters) (*services.GatewayResult, error) {
+	request, err := r.newRequest(ctx, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	requestData, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+
+	// Create HTTP request with context for timeout/cancellation support
+	req, err := http.NewRequestWithContext(ctx, "POST", requestUrl, bytes.NewBuffer(requestData))
+	if err != nil {
+		return nil, fmt.Errorf("create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	response, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post request: %w", err)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+
+	var message entity.PaymentRequest
+	if err = json.Unmarshal(body, &message); err == nil && message.Parameters != "" {
+		return r.readMessage(ctx, &message)
+	}
+
+	// check if we have an error response from Redsys
+	var errorCode entity.ErrorCodeResponse
+	if err = json.Unmarshal(body, &errorCode); err == nil && errorCode.Code != "" {
+		return nil, &services.GatewayError{
+			Gateway:   redsysName,
+			Code:      errorCode.Code,
+			Duplicate: errorCode.Code == redsysCodeDuplicateOrder,
+		}
+	}
+	return nil, fmt.Errorf("unrecognized response: %s", string(body))
+}
+
+func (r *Redsys) newRequest(ctx context.Context, parameters *entity.MerchantParameters) (*entity.PaymentRequest, error) {
+	// encode parameters to Base64
+	parametersBase64, err := r.createParameters(ctx, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("parameters encode base64: %v", err)
+	}
+
+	order := parameters.Order
+	merchantSecret := r.conf.Merchant.Secret
+
+	encryptor := NewEncryptor(merchantSecret, parametersBase64, order)
+	signature, err := encryptor.CreateSignature()
+	if err != nil {
+		return nil, fmt.Errorf("create signature: %v", err)
+	}
+
+	request := &entity.PaymentRequest{
+		Parameters:       parametersBase64,
+		Signature:        signature,
+		SignatureVersion: "HMAC_SHA256_V1",
+	}
+
+	return request, nil
+}
+
+func (r *Redsys) createParameters(ctx context.Context, parameters *entity.MerchantParameters) (string, error) {
+	// convert parameters to JSON string
+	parametersJson, err := json.Marshal(parameters)
+	if err != nil {
+		return "", err
+	}
+	r.debug(ctx, fmt.Sprintf("request parameters: %s", string(parametersJson)))
+	// encode parameters to Base64
+	return base64.StdEncoding.EncodeToString(parametersJson), nil
+}
+
+// readMessage decodes signed parameters and verifies the signature against the order.
+func (r *Redsys) readMessage(ctx context.Context, message *entity.PaymentRequest) (*services.GatewayResult, error) {
+	parameters, err := r.readParameters(ctx, message.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := NewEncryptor(r.conf.Merchant.Secret, message.Parameters, parameters.Order).CreateSignature()
+	if err != nil {
+		return nil, fmt.Errorf("create signature: %v", err)
+	}
+	if normalizeSignature(expected) != normalizeSignature(message.Signature) {
+		return nil, fmt.Errorf("invalid signature for order %s", parameters.Order)
+	}
+
+	return r.result(parameters)
+}
+
+func (r *Redsys) readParameters(ctx context.Context, parameters string) (*entity.PaymentParameters, error) {
+	if parameters == "" {
+		return nil, fmt.Errorf("empty parameters")
+	}
+	parametersBytes, err := base64.StdEncoding.DecodeString(parameters)
+	if err != nil {
+		// notifications may use the URL-safe alphabet
+		parametersBytes, err = base64.URLEncoding.DecodeString(parameters)
+		if err != nil {
+			return nil, fmt.Errorf("decode parameters: %v", err)
+		}
+	}
+	var paymentResult entity.PaymentParameters
+	err = json.Unmarshal(parametersBytes, &paymentResult)
+	if err != nil {
+		r.warn(ctx, fmt.Sprintf("parameters: %s", string(parametersBytes)))
+		return nil, fmt.Errorf("parse parameters: %v", err)
+	}
+	r.debug(ctx, fmt.Sprintf("received parameters: %s", string(parametersBytes)))
+	return &paymentResult, nil
+}
+
+// result converts Redsys response parameters to a gateway-neutral result.
+func (r *Redsys) result(parameters *entity.PaymentParameters) (*services.GatewayResult, error) {
+	order, err := strconv.Atoi(parameters.Order)
+	if err != nil {
+		return nil, fmt.Errorf("read order number: %v", err)
+	}
+	amount, err := strconv.Atoi(parameters.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("read amount: %v", err)
+	}
+
+	operation := services.OperationAuthorize
+	switch parameters.TransactionType {
+	case redsysConfirmation:
+		operation = services.OperationCapture
+	case redsysRefund:
+		operation = services.OperationRefund
+	case redsysCancellation:
+		operation = services.OperationVoid
+	}
+
+	return &services.GatewayResult{
+		Operation:         operation,
+		Order:             order,
+		Amount:            amount,
+		Currency:          parameters.Currency,
+		Approved:          redsysApproved(parameters.TransactionType, parameters.Response),
+		Held:              parameters.TransactionType == redsysPreauthorization,
+		Code:              parameters.Response,
+		AuthorisationCode: parameters.AuthorisationCode,
+		Identifier:        parameters.MerchantIdentifier,
+		CofTid:            parameters.MerchantCofTxnid,
+		CardBrand:         parameters.CardBrand,
+		CardCountry:       parameters.CardCountry,
+		ExpiryDate:        parameters.ExpiryDate,
+		Date:              fmt.Sprintf("%s %s", parameters.Date, parameters.Hour),
+		MerchantData:      parameters.MerchantData,
+		Raw:               parameters,
+	}, nil
+}
+
+// redsysApproved reports whether Ds_Response means success for the transaction type.
+// Payments and preauthorizations are approved with 0000-0099, refunds and
+// confirmations with 0900, cancellations with 0400.
+func redsysApproved(transactionType, response string) bool {
+	switch transactionType {
+	case redsysAuthorization, redsysPreauthorization:
+		code, err := strconv.Atoi(response)
+		return err == nil && len(response) == 4 && code >= 0 && code <= 99
+	case redsysConfirmation, redsysRefund:
+		return response == "0900"
+	case redsysCancellation:
+		return response == "0400"
+	}
+	return false
+}
+
+// normalizeSignature maps the URL-safe Base64 alphabet used in notifications to the standard one.
+func normalizeSignature(signature string) string {
+	return strings.NewReplacer("-", "+", "_", "/").Replace(signature)
+}
+
+func (r *Redsys) debug(ctx context.Context, text string) {
+	if r.logger != nil {
+		r.logger.DebugContext(ctx, text)
+	}
+}
+
+func (r *Redsys) warn(ctx context.Context, text string) {
+	if r.logger != nil {
+		r.logger.WarnContext(ctx, text)
+	}
+}
@@ -12,6 +12,9 @@ type contextKey string
 
 const requestIDKey contextKey = "requestID"
 
+// maxRequestIDLength bounds the request IDs accepted from callers.
+const maxRequestIDLength = 128
+
 // GenerateRequestID creates a unique request identifier.
 func GenerateRequestID() string {
 	bytes := make([]byte, 16)
@@ -32,6 +35,29 @@ func WithRequestID(ctx context.Context) context.Context {
 	return context.WithValue(ctx, requestIDKey, GenerateRequestID())
 }
 
+// WithRequestIDValue sets the request ID of the context, replacing any other.
+func WithRequestIDValue(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// ValidRequestID reports whether a request ID from a caller can be used: up
+// to 128 letters, digits and the characters - _ . : so that it is safe to log,
+// echo in a header and send to the gateway.
+func ValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // GetRequestID retrieves the request ID from the context.
 // Returns an empty string if no request ID is present.
 func GetRequestID(ctx context.Context) string {
@@ -0,0 +1,107 @@
+package internal_test
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/internal"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const requestIdHeader = "X-Correlation-ID"
+
+// payWithRequestId asks the server to pay a transaction with a request ID
+// header and returns the ID echoed by the server.
+func payWithRequestId(t *testing.T, url, requestId string) string {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(requestIdHeader, requestId)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", response.StatusCode)
+	}
+	return response.Header.Get(requestIdHeader)
+}
+
+func TestRequestIdFromCaller(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestId string
+		kept      bool
+	}{
+		{"valid", "csms-42.call:7_a", true},
+		{"longest", strings.Repeat("a", 128), true},
+		{"invalid characters", "csms 42;drop", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	h := newHarness(t, "memory")
+	conf := &config.Config{}
+	conf.Listen.RequestIdHeader = requestIdHeader
+	url := h.serveWith(t, conf, nil)
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transactionId := 10 + i
+			h.addTransaction(t, transactionId, 1500)
+
+			echoed := payWithRequestId(t, url+"/pay/"+strconv.Itoa(transactionId), tt.requestId)
+			if tt.kept && echoed != tt.requestId {
+				t.Errorf("echoed %q, want the caller's %q", echoed, tt.requestId)
+			}
+			if !tt.kept && (echoed == tt.requestId || !internal.ValidRequestID(echoed)) {
+				t.Errorf("echoed %q, want a new valid ID", echoed)
+			}
+			// the payment is completed by a background job
+			eventually(t, "completed payment", func() bool { return h.transaction(t, transactionId).PaymentOrder != 0 })
+			order := h.order(t, h.transaction(t, transactionId).PaymentOrder)
+			if order.RequestId != echoed {
+				t.Errorf("order request id %q, want the echoed %q", order.RequestId, echoed)
+			}
+		})
+	}
+}
+
+func TestRequestIdInNotification(t *testing.T) {
+	h := newHarness(t, "memory")
+	notifications := make(chan []byte, 1)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		notifications <- body
+	}))
+	defer notify.Close()
+	h.sandbox.SetNotifyUrl(notify.URL)
+	conf := &config.Config{}
+	conf.Listen.RequestIdHeader = requestIdHeader
+	url := h.serveWith(t, conf, nil)
+	h.addTransaction(t, 10, 1500)
+
+	payWithRequestId(t, url+"/pay/10", "csms-42")
+
+	// the payment is sent by a background job
+	var body []byte
+	select {
+	case body = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	redsys := internal.NewRedsys(testConfig(t))
+	notification, err := redsys.VerifyNotification(context.Background(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.MerchantData != "csms-42" {
+		t.Errorf("notification merchant data %q, want csms-42", notification.MerchantData)
+	}
+}
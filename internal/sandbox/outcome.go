@@ -0,0 +1,74 @@
+package sandbox
+
+import (
+	"fmt"
+	"time"
+)
+
+// OutcomeKind selects how the sandbox answers a matching request.
+type OutcomeKind string
+
+const (
+	// Approve answers with a successful Ds_Response ("0000" for payments, "0900" for refunds).
+	Approve OutcomeKind = "approve"
+	// Decline answers with a signed response carrying the scripted Ds_Response code.
+	Decline OutcomeKind = "decline"
+	// SisError answers with an {"errorCode": "SISxxxx"} body, as Redsys does for rejected requests.
+	SisError OutcomeKind = "sis_error"
+	// Timeout holds the connection open until the client gives up or Delay elapses.
+	Timeout OutcomeKind = "timeout"
+	// Malformed answers with a body that is not valid Redsys JSON.
+	Malformed OutcomeKind = "malformed"
+)
+
+// Outcome describes a scripted answer for a request.
+type Outcome struct {
+	Kind OutcomeKind
+	// Code is the Ds_Response code for Decline or the SIS code for SisError.
+	Code string
+	// Delay is applied before answering; for Timeout it caps how long the connection is held.
+	Delay time.Duration
+	// Notify sends the asynchronous notification to the configured notify URL.
+	// It is honored for Approve, Decline and Timeout outcomes.
+	Notify bool
+}
+
+// Approved returns an outcome that approves the operation and sends a notification.
+func Approved() Outcome {
+	return Outcome{Kind: Approve, Notify: true}
+}
+
+// Declined returns an outcome that declines the operation with the given Ds_Response code.
+func Declined(code string) Outcome {
+	return Outcome{Kind: Decline, Code: code, Notify: true}
+}
+
+// Rejected returns an outcome that answers with a SIS error code.
+func Rejected(code string) Outcome {
+	return Outcome{Kind: SisError, Code: code}
+}
+
+// TimedOut returns an outcome that never answers within the client deadline,
+// but still notifies, like a Redsys that processed the payment and lost the response.
+func TimedOut(hold time.Duration) Outcome {
+	return Outcome{Kind: Timeout, Delay: hold, Notify: true}
+}
+
+// Garbled returns an outcome that answers with a malformed body.
+func Garbled() Outcome {
+	return Outcome{Kind: Malformed}
+}
+
+func (o Outcome) validate() error {
+	switch o.Kind {
+	case Approve, Timeout, Malformed:
+		return nil
+	case Decline, SisError:
+		if o.Code == "" {
+			return fmt.Errorf("outcome %s requires a code", o.Kind)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown outcome %q", o.Kind)
+	}
+}
@@ -0,0 +1,96 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Script is the file form of sandbox outcomes, used by cmd/redsys-sandbox.
+//
+//	{
+//	  "default": {"outcome": "approve"},
+//	  "identifiers": {"tok-declined": {"outcome": "decline", "code": "0190"}},
+//	  "amounts": {"999": {"outcome": "timeout", "delay": "45s"}}
+//	}
+type Script struct {
+	Default     *ScriptOutcome           `json:"default"`
+	Identifiers map[string]ScriptOutcome `json:"identifiers"`
+	Amounts     map[string]ScriptOutcome `json:"amounts"`
+}
+
+// ScriptOutcome is an Outcome with a human-readable delay.
+type ScriptOutcome struct {
+	Outcome OutcomeKind `json:"outcome"`
+	Code    string      `json:"code"`
+	Delay   string      `json:"delay"`
+	Notify  *bool       `json:"notify"`
+}
+
+func (so ScriptOutcome) outcome() (Outcome, error) {
+	outcome := Outcome{Kind: so.Outcome, Code: so.Code}
+	if so.Delay != "" {
+		delay, err := time.ParseDuration(so.Delay)
+		if err != nil {
+			return outcome, fmt.Errorf("delay %q: %w", so.Delay, err)
+		}
+		outcome.Delay = delay
+	}
+	if so.Notify != nil {
+		outcome.Notify = *so.Notify
+	} else {
+		outcome.Notify = so.Outcome == Approve || so.Outcome == Decline || so.Outcome == Timeout
+	}
+	return outcome, outcome.validate()
+}
+
+// LoadScript reads a JSON script file and applies it to the server.
+func (s *Server) LoadScript(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read script: %w", err)
+	}
+	var script Script
+	if err = json.Unmarshal(data, &script); err != nil {
+		return fmt.Errorf("parse script: %w", err)
+	}
+	return s.ApplyScript(&script)
+}
+
+// ApplyScript adds the outcomes of the script to the server.
+func (s *Server) ApplyScript(script *Script) error {
+	if script.Default != nil {
+		outcome, err := script.Default.outcome()
+		if err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+		if err = s.SetDefault(outcome); err != nil {
+			return err
+		}
+	}
+	for identifier, so := range script.Identifiers {
+		outcome, err := so.outcome()
+		if err != nil {
+			return fmt.Errorf("identifier %s: %w", identifier, err)
+		}
+		if err = s.OnIdentifier(identifier, outcome); err != nil {
+			return err
+		}
+	}
+	for key, so := range script.Amounts {
+		amount, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("amount %q: %w", key, err)
+		}
+		outcome, err := so.outcome()
+		if err != nil {
+			return fmt.Errorf("amount %s: %w", key, err)
+		}
+		if err = s.OnAmount(amount, outcome); err != nil {
+			return err
+		}
+	}
+	return nil
+}
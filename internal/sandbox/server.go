@@ -0,0 +1,504 @@
+// Package sandbox implements a local fake of the Redsys REST endpoint
+// (trataPeticionREST) for integration tests and developer machines that cannot
+// reach sis-t.redsys.es. Requests are verified and responses are signed with the
+// same Encryptor used by electrum, and answers are scripted per card token or amount.
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"electrum/entity"
+	"electrum/internal"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RequestPath is the path electrum posts payment requests to.
+	RequestPath = "/sis/rest/trataPeticionREST"
+	// QueryPath is the path the sandbox answers order queries on, to be used
+	// as merchant.query_url.
+	QueryPath = "/sis/rest/consultaOperacionREST"
+
+	// codeSignatureError is returned when Ds_Signature does not match the parameters.
+	codeSignatureError = "SIS0042"
+	// codeBadRequest is returned when the request cannot be decoded.
+	codeBadRequest = "SIS0431"
+	// codeRefundNotAllowed is the Ds_Response for refunds of unknown or exhausted orders.
+	codeRefundNotAllowed = "0950"
+	// codeNoRecord is returned by the query endpoint for unknown orders.
+	codeNoRecord = "SIS0059"
+	// codeDuplicateOrder is returned for an authorization of an order number
+	// that was already settled.
+	codeDuplicateOrder = "SIS0051"
+)
+
+// Request is a decoded request received by the sandbox.
+type Request struct {
+	Parameters entity.MerchantParameters
+	Outcome    Outcome
+	Received   time.Time
+}
+
+// order keeps the amounts the sandbox has authorized and refunded per order number.
+type order struct {
+	authorized int
+	refunded   int
+}
+
+// Server is a fake Redsys endpoint. It implements http.Handler, so it can be
+// mounted on any listener, wrapped in httptest, or run by cmd/redsys-sandbox.
+type Server struct {
+	secret     string
+	notifyUrl  string
+	httpClient *http.Client
+	logger     *log.Logger
+
+	mutex          sync.Mutex
+	byIdentifier   map[string]Outcome
+	byAmount       map[int]Outcome
+	defaultOutcome Outcome
+	orders         map[string]*order
+	results        map[string]*entity.PaymentParameters // last result per order, for queries
+	requests       []Request
+	notifications  sync.WaitGroup
+	testServer     *httptest.Server
+}
+
+// NewServer creates a sandbox that verifies signatures with the given Base64
+// merchant secret and approves every request until scripted otherwise.
+func NewServer(secret string) *Server {
+	return &Server{
+		secret:         secret,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		logger:         log.New(io.Discard, "", 0),
+		byIdentifier:   make(map[string]Outcome),
+		byAmount:       make(map[int]Outcome),
+		defaultOutcome: Approved(),
+		orders:         make(map[string]*order),
+		results:        make(map[string]*entity.PaymentParameters),
+	}
+}
+
+// SetNotifyUrl sets the URL that receives asynchronous notifications,
+// normally electrum's /notify endpoint. Notifications are not sent when empty.
+func (s *Server) SetNotifyUrl(notifyUrl string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.notifyUrl = notifyUrl
+}
+
+// SetLogger enables logging of received requests and sent answers.
+func (s *Server) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// OnIdentifier scripts the outcome for requests using the given card token.
+// Identifier scripts take precedence over amount scripts.
+func (s *Server) OnIdentifier(identifier string, outcome Outcome) error {
+	if err := outcome.validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.byIdentifier[identifier] = outcome
+	return nil
+}
+
+// OnAmount scripts the outcome for requests with the given amount in cents.
+func (s *Server) OnAmount(amount int, outcome Outcome) error {
+	if err := outcome.validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.byAmount[amount] = outcome
+	return nil
+}
+
+// SetDefault sets the outcome for requests matching no script.
+func (s *Server) SetDefault(outcome Outcome) error {
+	if err := outcome.validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultOutcome = outcome
+	return nil
+}
+
+// Reset removes all scripts, recorded requests and known orders.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.byIdentifier = make(map[string]Outcome)
+	s.byAmount = make(map[int]Outcome)
+	s.defaultOutcome = Approved()
+	s.orders = make(map[string]*order)
+	s.results = make(map[string]*entity.PaymentParameters)
+	s.requests = nil
+}
+
+// Requests returns a copy of the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// Start serves the sandbox on a random local port and returns the request URL
+// to be used as merchant.request_url. Call Close to stop it.
+func (s *Server) Start() string {
+	s.testServer = httptest.NewServer(s.mux())
+	return s.testServer.URL + RequestPath
+}
+
+// QueryUrl returns the query URL of a server created by Start.
+func (s *Server) QueryUrl() string {
+	if s.testServer == nil {
+		return ""
+	}
+	return s.testServer.URL + QueryPath
+}
+
+// Listen serves the sandbox on the given address until the listener fails.
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, s.mux())
+}
+
+func (s *Server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(RequestPath, s)
+	mux.HandleFunc(QueryPath, s.serveQuery)
+	return mux
+}
+
+// Close stops a server created by Start and waits for pending notifications.
+func (s *Server) Close() {
+	if s.testServer != nil {
+		s.testServer.Close()
+	}
+	s.notifications.Wait()
+}
+
+// WaitNotifications blocks until all scheduled notifications have been sent.
+func (s *Server) WaitNotifications() {
+	s.notifications.Wait()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parameters, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	outcome := s.match(parameters)
+	s.logger.Printf("order %s: type %s; amount %s; outcome %s %s", parameters.Order, parameters.TransactionType, parameters.Amount, outcome.Kind, outcome.Code)
+	if s.duplicate(parameters) {
+		s.writeError(w, codeDuplicateOrder)
+		return
+	}
+
+	if outcome.Kind != Timeout && outcome.Delay > 0 {
+		select {
+		case <-time.After(outcome.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch outcome.Kind {
+	case SisError:
+		s.writeError(w, outcome.Code)
+	case Malformed:
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"Ds_MerchantParameters": `))
+	case Timeout:
+		result := s.settle(parameters, outcome)
+		s.scheduleNotification(result, outcome)
+		hold := outcome.Delay
+		if hold == 0 {
+			hold = time.Hour
+		}
+		select {
+		case <-time.After(hold):
+		case <-r.Context().Done():
+		}
+	default:
+		result := s.settle(parameters, outcome)
+		s.writeResult(w, result)
+		s.scheduleNotification(result, outcome)
+	}
+}
+
+// serveQuery answers the last result of an order, or SIS0059 if the sandbox
+// never settled a request for it. Queries are not scripted.
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request) {
+	parameters, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	result, found := s.results[parameters.Order]
+	s.mutex.Unlock()
+
+	s.logger.Printf("order %s: query; found %v", parameters.Order, found)
+	if !found {
+		s.writeError(w, codeNoRecord)
+		return
+	}
+	s.writeResult(w, result)
+}
+
+// readRequest decodes a signed request and verifies its signature; on failure
+// it writes the error answer and returns false.
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request) (*entity.MerchantParameters, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var request entity.PaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.writeError(w, codeBadRequest)
+		return nil, false
+	}
+
+	parameters, err := s.decodeParameters(request.Parameters)
+	if err != nil {
+		s.logger.Printf("decode parameters: %v", err)
+		s.writeError(w, codeBadRequest)
+		return nil, false
+	}
+
+	expected, err := internal.NewEncryptor(s.secret, request.Parameters, parameters.Order).CreateSignature()
+	if err != nil || expected != request.Signature {
+		s.logger.Printf("order %s: signature mismatch", parameters.Order)
+		s.writeError(w, codeSignatureError)
+		return nil, false
+	}
+	return parameters, true
+}
+
+// match records the request and returns the scripted outcome for it.
+func (s *Server) match(parameters *entity.MerchantParameters) Outcome {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	outcome, ok := s.byIdentifier[parameters.Identifier]
+	if !ok {
+		amount, _ := strconv.Atoi(parameters.Amount)
+		outcome, ok = s.byAmount[amount]
+	}
+	if !ok {
+		outcome = s.defaultOutcome
+	}
+
+	s.requests = append(s.requests, Request{
+		Parameters: *parameters,
+		Outcome:    outcome,
+		Received:   time.Now(),
+	})
+	return outcome
+}
+
+// duplicate reports whether the request authorizes an order number that was
+// already settled.
+func (s *Server) duplicate(parameters *entity.MerchantParameters) bool {
+	if parameters.TransactionType != "0" && parameters.TransactionType != "1" {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.results[parameters.Order]
+	return ok
+}
+
+// settle applies the operation to the sandbox ledger and builds the response parameters.
+func (s *Server) settle(parameters *entity.MerchantParameters, outcome Outcome) *entity.PaymentParameters {
+	now := time.Now()
+	result := &entity.PaymentParameters{
+		MerchantCode:     parameters.MerchantCode,
+		Terminal:         parameters.Terminal,
+		Order:            parameters.Order,
+		Amount:           parameters.Amount,
+		Currency:         parameters.Currency,
+		Date:             now.Format("02/01/2006"),
+		Hour:             now.Format("15:04"),
+		SecurePayment:    "0",
+		TransactionType:  parameters.TransactionType,
+		ConsumerLanguage: "1",
+		MerchantData:     parameters.MerchantData,
+	}
+
+	amount, _ := strconv.Atoi(parameters.Amount)
+	approved := outcome.Kind == Approve || outcome.Kind == Timeout
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch parameters.TransactionType {
+	case "3":
+		o, ok := s.orders[parameters.Order]
+		switch {
+		case !approved:
+			result.Response = outcome.Code
+		case !ok || o.authorized-o.refunded < amount:
+			result.Response = codeRefundNotAllowed
+		default:
+			o.refunded += amount
+			result.Response = "0900"
+			result.AuthorisationCode = authorisationCode()
+		}
+	default:
+		if !approved {
+			result.Response = outcome.Code
+			break
+		}
+		result.Response = "0000"
+		result.AuthorisationCode = authorisationCode()
+		result.CardBrand = "1"
+		result.CardCountry = "724"
+		result.ExpiryDate = now.AddDate(3, 0, 0).Format("0601")
+		result.MerchantIdentifier = parameters.Identifier
+		result.MerchantCofTxnid = parameters.CofTid
+		if parameters.Identifier == "" || parameters.Identifier == "REQUIRED" {
+			result.MerchantIdentifier = randomHex(20)
+			result.MerchantCofTxnid = randomHex(8)
+		}
+		s.orders[parameters.Order] = &order{authorized: amount}
+	}
+	s.results[parameters.Order] = result
+	return result
+}
+
+func (s *Server) decodeParameters(encoded string) (*entity.MerchantParameters, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("empty parameters")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode base64: %w", err)
+	}
+	var parameters entity.MerchantParameters
+	if err = json.Unmarshal(data, &parameters); err != nil {
+		return nil, fmt.Errorf("parse json: %w", err)
+	}
+	if parameters.Order == "" {
+		return nil, fmt.Errorf("empty order")
+	}
+	return &parameters, nil
+}
+
+// sign encodes the response parameters and signs them with the order key.
+func (s *Server) sign(result *entity.PaymentParameters) (*entity.PaymentRequest, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	parameters := base64.StdEncoding.EncodeToString(data)
+	signature, err := internal.NewEncryptor(s.secret, parameters, result.Order).CreateSignature()
+	if err != nil {
+		return nil, err
+	}
+	return &entity.PaymentRequest{
+		Parameters:       parameters,
+		Signature:        signature,
+		SignatureVersion: "HMAC_SHA256_V1",
+	}, nil
+}
+
+func (s *Server) writeResult(w http.ResponseWriter, result *entity.PaymentParameters) {
+	response, err := s.sign(result)
+	if err != nil {
+		s.logger.Printf("order %s: sign response: %v", result.Order, err)
+		s.writeError(w, codeSignatureError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entity.ErrorCodeResponse{Code: code})
+}
+
+// scheduleNotification posts the signed result to the notify URL in the background.
+func (s *Server) scheduleNotification(result *entity.PaymentParameters, outcome Outcome) {
+	s.mutex.Lock()
+	notifyUrl := s.notifyUrl
+	s.mutex.Unlock()
+
+	if !outcome.Notify || notifyUrl == "" {
+		return
+	}
+
+	s.notifications.Add(1)
+	go func() {
+		defer s.notifications.Done()
+		if err := s.notify(notifyUrl, result); err != nil {
+			s.logger.Printf("order %s: notify: %v", result.Order, err)
+		}
+	}()
+}
+
+func (s *Server) notify(notifyUrl string, result *entity.PaymentParameters) error {
+	signed, err := s.sign(result)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	form := url.Values{}
+	form.Set("Ds_SignatureVersion", signed.SignatureVersion)
+	form.Set("Ds_MerchantParameters", signed.Parameters)
+	form.Set("Ds_Signature", signed.Signature)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifyUrl, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func authorisationCode() string {
+	return randomHex(3)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,230 @@
+package sandbox_test
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/internal"
+	"electrum/internal/sandbox"
+	"electrum/services"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// testSecret is the public secret of the Redsys test terminal.
+const testSecret = "sq7HjrUOBfKmC576ILgskD5srU870gJ7"
+
+// newGateway starts a sandbox and returns a Redsys gateway that talks to it.
+func newGateway(t *testing.T) (*sandbox.Server, *internal.Redsys) {
+	t.Helper()
+	var conf config.Config
+	if err := cleanenv.ReadEnv(&conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Merchant.Secret = testSecret
+	conf.Merchant.Code = "999008881"
+	conf.Merchant.Terminal = "1"
+	conf.Gateway.TimeoutMax = 2 * time.Second
+
+	server := sandbox.NewServer(testSecret)
+	conf.Merchant.RequestUrl = server.Start()
+	conf.Merchant.QueryUrl = server.QueryUrl()
+	t.Cleanup(server.Close)
+	return server, internal.NewRedsys(&conf)
+}
+
+func TestSandboxAnswers(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   func(server *sandbox.Server) error
+		call     func(ctx context.Context, redsys *internal.Redsys) (*services.GatewayResult, error)
+		approved bool
+		code     string
+		sisError string
+	}{
+		{
+			name: "authorization approved",
+			call: func(ctx context.Context, redsys *internal.Redsys) (*services.GatewayResult, error) {
+				return redsys.Authorize(ctx, &services.GatewayRequest{Order: 1201, Amount: 1500, Currency: "978", Identifier: "tok-1"})
+			},
+			approved: true,
+			code:     "0000",
+		},
+		{
+			name: "authorization declined by card",
+			script: func(server *sandbox.Server) error {
+				return server.OnIdentifier("tok-declined", sandbox.Declined("0190"))
+			},
+			call: func(ctx context.Context, redsys *internal.Redsys) (*services.GatewayResult, error) {
+				return redsys.Authorize(ctx, &services.GatewayRequest{Order: 1202, Amount: 1500, Currency: "978", Identifier: "tok-declined"})
+			},
+			code: "0190",
+		},
+		{
+			name: "request rejected by amount",
+			script: func(server *sandbox.Server) error {
+				return server.OnAmount(999, sandbox.Rejected("SIS0054"))
+			},
+			call: func(ctx context.Context, redsys *internal.Redsys) (*services.GatewayResult, error) {
+				return redsys.Authorize(ctx, &services.GatewayRequest{Order: 1203, Amount: 999, Currency: "978", Identifier: "tok-1"})
+			},
+			sisError: "SIS0054",
+		},
+		{
+			name: "refund of an unknown order",
+			call: func(ctx context.Context, redsys *internal.Redsys) (*services.GatewayResult, error) {
+				return redsys.Refund(ctx, &services.GatewayRequest{Order: 1204, Amount: 100, Currency: "978"})
+			},
+			code: "0950",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, redsys := newGateway(t)
+			if test.script != nil {
+				if err := test.script(server); err != nil {
+					t.Fatal(err)
+				}
+			}
+			result, err := test.call(context.Background(), redsys)
+			if test.sisError != "" {
+				var gatewayError *services.GatewayError
+				if !errors.As(err, &gatewayError) || gatewayError.Code != test.sisError {
+					t.Fatalf("error = %v, want gateway error %s", err, test.sisError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Approved != test.approved || result.Code != test.code {
+				t.Errorf("result approved %v code %s, want approved %v code %s", result.Approved, result.Code, test.approved, test.code)
+			}
+		})
+	}
+}
+
+func TestSandboxRefundLedger(t *testing.T) {
+	_, redsys := newGateway(t)
+	ctx := context.Background()
+
+	if _, err := redsys.Authorize(ctx, &services.GatewayRequest{Order: 1300, Amount: 1000, Currency: "978", Identifier: "tok-1"}); err != nil {
+		t.Fatal(err)
+	}
+	refunds := []struct {
+		amount   int
+		approved bool
+	}{
+		{600, true},
+		{400, true},
+		{1, false}, // the order is fully refunded
+	}
+	for _, refund := range refunds {
+		result, err := redsys.Refund(ctx, &services.GatewayRequest{Order: 1300, Amount: refund.amount, Currency: "978"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Approved != refund.approved {
+			t.Errorf("refund of %d approved %v, want %v", refund.amount, result.Approved, refund.approved)
+		}
+	}
+}
+
+func TestSandboxDuplicateOrder(t *testing.T) {
+	_, redsys := newGateway(t)
+	ctx := context.Background()
+	request := &services.GatewayRequest{Order: 1400, Amount: 1000, Currency: "978", Identifier: "tok-1"}
+
+	if _, err := redsys.Authorize(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	_, err := redsys.Authorize(ctx, request)
+	if !errors.Is(err, services.ErrGatewayDuplicateOrder) {
+		t.Fatalf("repeated authorization: %v, want duplicate order", err)
+	}
+	// the first result is kept for queries
+	result, err := redsys.Query(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Approved || result.Amount != 1000 {
+		t.Errorf("queried result %+v", result)
+	}
+}
+
+func TestSandboxQuery(t *testing.T) {
+	_, redsys := newGateway(t)
+	ctx := context.Background()
+
+	if _, err := redsys.Query(ctx, &services.GatewayRequest{Order: 1400}); !errors.Is(err, services.ErrGatewayNoRecord) {
+		t.Fatalf("query of unknown order: %v, want no record", err)
+	}
+	if _, err := redsys.Authorize(ctx, &services.GatewayRequest{Order: 1400, Amount: 700, Currency: "978", Identifier: "tok-1", MerchantData: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := redsys.Query(ctx, &services.GatewayRequest{Order: 1400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Operation != services.OperationAuthorize || result.Amount != 700 || !result.Approved || result.MerchantData != "req-1" {
+		t.Errorf("query result %+v", result)
+	}
+}
+
+// TestSandboxMerchantData checks that the request ID sent as merchant data
+// comes back in the response and in the signed notification.
+func TestSandboxMerchantData(t *testing.T) {
+	server, redsys := newGateway(t)
+	notifications := make(chan []byte, 1)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		notifications <- body
+	}))
+	defer notify.Close()
+	server.SetNotifyUrl(notify.URL)
+
+	ctx := context.Background()
+	result, err := redsys.Authorize(ctx, &services.GatewayRequest{Order: 1500, Amount: 1200, Currency: "978", Identifier: "tok-1", MerchantData: "csms-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MerchantData != "csms-42" {
+		t.Errorf("response merchant data %q, want csms-42", result.MerchantData)
+	}
+
+	server.WaitNotifications()
+	notification, err := redsys.VerifyNotification(ctx, <-notifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Order != 1500 || notification.MerchantData != "csms-42" {
+		t.Errorf("notification order %d merchant data %q", notification.Order, notification.MerchantData)
+	}
+}
+
+func TestSandboxSignature(t *testing.T) {
+	server := sandbox.NewServer(testSecret)
+	requestUrl := server.Start()
+	defer server.Close()
+
+	var conf config.Config
+	if err := cleanenv.ReadEnv(&conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Merchant.Secret = "Mk9m98IfEblmPfrpsawt7BmxObt98Jev" // not the sandbox secret
+	conf.Merchant.Code = "999008881"
+	conf.Merchant.Terminal = "1"
+	conf.Merchant.RequestUrl = requestUrl
+
+	_, err := internal.NewRedsys(&conf).Authorize(context.Background(), &services.GatewayRequest{Order: 1600, Amount: 100, Currency: "978"})
+	var gatewayError *services.GatewayError
+	if !errors.As(err, &gatewayError) || gatewayError.Code != "SIS0042" {
+		t.Fatalf("error = %v, want SIS0042", err)
+	}
+}
@@ -1,29 +1,47 @@
 package internal
 
 import (
+	"context"
+	"crypto/subtle"
 	"electrum/config"
 	"electrum/entity"
 	"electrum/services"
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	payTransaction = "/pay/:transaction_id"
 	returnPayment  = "/return/:transaction_id"
 	returnByOrder  = "/return/order/:order_id"
+	orderStatus    = "/order/:order_id"
 	paymentNotify  = "/notify"
+	timeline       = "/timeline"
+	metrics        = "/metrics"
+	healthz        = "/healthz"
+	readyz         = "/readyz"
+	debugStatus    = "/debug/status"
 )
 
 type Server struct {
 	conf       *config.Config
 	httpServer *http.Server
 	payments   services.Payments
+	timeline   *Timeline
+	metrics    *Metrics
+	health     *Health
+	clients    []netip.Prefix
 	logger     services.LogHandler
 }
 
@@ -44,16 +62,123 @@ func NewServer(conf *config.Config) *Server {
 }
 
 func (s *Server) Register(router *httprouter.Router) {
-	router.GET(payTransaction, s.payTransaction)
-	router.GET(returnPayment, s.returnTransaction)
-	router.POST(returnByOrder, s.returnOrder)
-	router.POST(paymentNotify, s.paymentNotify)
+	router.GET(payTransaction, s.traced(http.MethodGet, payTransaction, s.payTransaction))
+	router.GET(returnPayment, s.traced(http.MethodGet, returnPayment, s.returnTransaction))
+	router.POST(returnByOrder, s.traced(http.MethodPost, returnByOrder, s.returnOrder))
+	router.GET(orderStatus, s.traced(http.MethodGet, orderStatus, s.getOrderStatus))
+	router.POST(paymentNotify, s.traced(http.MethodPost, paymentNotify, s.paymentNotify))
+	router.GET(timeline, s.traced(http.MethodGet, timeline, s.getTimeline))
+	router.GET(metrics, s.getMetrics)
+	router.GET(healthz, s.getHealth)
+	router.GET(readyz, s.getReadiness)
+	router.GET(debugStatus, s.traced(http.MethodGet, debugStatus, s.getDebugStatus))
+}
+
+// traced runs a handler in a server span that continues the trace of the
+// W3C traceparent header of the request, if any. The request ID the handler
+// logs with is taken from the request ID header, or generated, and echoed in
+// the response; the span carries it too.
+func (s *Server) traced(method, route string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := s.requestContext(r)
+		if header := s.conf.Listen.RequestIdHeader; header != "" {
+			w.Header().Set(header, GetRequestID(ctx))
+		}
+		ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+		ctx, span := StartSpan(ctx, method+" "+route, trace.SpanKindServer,
+			attribute.String("http.request.method", method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String(FieldRequestId, GetRequestID(ctx)))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handle(recorder, r.WithContext(ctx), ps)
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			spanError(span, fmt.Errorf("status %d", recorder.status))
+		}
+	}
+}
+
+// requestContext returns the request context with the caller's request ID,
+// or a new one if the caller sent none or an invalid one.
+func (s *Server) requestContext(r *http.Request) context.Context {
+	requestID := r.Header.Get(s.conf.Listen.RequestIdHeader)
+	if requestID == "" {
+		return WithRequestID(r.Context())
+	}
+	if !ValidRequestID(requestID) {
+		ctx := WithRequestID(r.Context())
+		s.logger.DebugContext(ctx, fmt.Sprintf("invalid request id replaced: %q", requestID))
+		return ctx
+	}
+	return WithRequestIDValue(r.Context(), requestID)
+}
+
+// statusRecorder keeps the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
 
 func (s *Server) SetPaymentsService(payments services.Payments) {
 	s.payments = payments
 }
 
+// SetTimeline enables the timeline endpoint.
+func (s *Server) SetTimeline(timeline *Timeline) {
+	s.timeline = timeline
+}
+
+// SetMetrics enables the metrics endpoint.
+func (s *Server) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+// SetSyncClients sets the networks of the callers whose payments are
+// synchronous by default.
+func (s *Server) SetSyncClients(clients []netip.Prefix) {
+	s.clients = clients
+}
+
+// ParseClients reads client addresses and CIDR networks; an address is a
+// network of that one address.
+func ParseClients(values []string) ([]netip.Prefix, error) {
+	clients := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client network %s: %w", value, err)
+			}
+			clients = append(clients, prefix.Masked())
+			continue
+		}
+		address, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client address %s: %w", value, err)
+		}
+		address = address.Unmap()
+		clients = append(clients, netip.PrefixFrom(address, address.BitLen()))
+	}
+	return clients, nil
+}
+
+// SetHealth enables the readiness and debug status endpoints.
+func (s *Server) SetHealth(health *Health) {
+	s.health = health
+}
+
 func (s *Server) SetLogger(logger services.LogHandler) {
 	s.logger = logger
 }
@@ -80,114 +205,316 @@ func (s *Server) Start() error {
 	return err
 }
 
+// Shutdown stops accepting connections and waits for the active requests to
+// complete or the context to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func (s *Server) payTransaction(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Add request ID for tracing
 	ctx := WithRequestID(r.Context())
-	reqID := GetRequestID(ctx)
 
 	transactionId := ps.ByName("transaction_id")
-	if transactionId == "" {
-		s.logger.Warn(fmt.Sprintf("[%s] empty transaction id", reqID))
-		w.WriteHeader(http.StatusBadRequest)
+	id, err := strconv.Atoi(transactionId)
+	if err != nil {
+		s.fail(ctx, w, "pay transaction", refused(services.ErrorInvalidRequest, "invalid transaction id: %s", transactionId))
 		return
 	}
-	id, err := strconv.Atoi(transactionId)
+
+	wait, err := s.synchronous(r)
 	if err != nil {
-		s.logger.Warn(fmt.Sprintf("[%s] invalid transaction id: %s; %v", reqID, transactionId, err))
-		w.WriteHeader(http.StatusBadRequest)
+		s.fail(ctx, w, "pay transaction", err)
+		return
+	}
+	if !wait {
+		err = s.payments.PayTransaction(ctx, id)
+		if err != nil {
+			s.fail(ctx, w, fmt.Sprintf("pay transaction %v", id), err, FieldTransactionId, id)
+			return
+		}
+		s.respond(ctx, w, http.StatusOK, nil)
 		return
 	}
 
-	err = s.payments.PayTransaction(ctx, id)
+	status, err := s.payments.PayTransactionWait(ctx, id, s.conf.Sync.Wait)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] pay transaction %v", reqID, id), err)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.fail(ctx, w, fmt.Sprintf("pay transaction %v", id), err, FieldTransactionId, id)
+		return
+	}
+	if status == nil {
+		// payments are disabled
+		s.respond(ctx, w, http.StatusOK, nil)
 		return
 	}
+	response := paymentResponse{PaymentStatus: status}
+	code := http.StatusOK
+	if status.Category == entity.PaymentPending {
+		response.StatusUrl = strings.Replace(orderStatus, ":order_id", strconv.Itoa(status.Order), 1)
+		w.Header().Set("Location", response.StatusUrl)
+		code = http.StatusAccepted
+	}
+	s.respond(ctx, w, code, response)
+}
+
+// paymentResponse is the answer of a synchronous payment; a payment still
+// pending at the deadline carries the URL to poll for its outcome.
+type paymentResponse struct {
+	*entity.PaymentStatus
+	StatusUrl string `json:"status_url,omitempty"`
+}
+
+// synchronous reports whether a payment request waits for the gateway
+// outcome: as asked with the wait parameter, or else if the caller is one of
+// the synchronous clients.
+func (s *Server) synchronous(r *http.Request) (bool, error) {
+	if value := r.URL.Query().Get("wait"); value != "" {
+		wait, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, refused(services.ErrorInvalidRequest, "invalid wait parameter: %s", value)
+		}
+		return wait, nil
+	}
+	if len(s.clients) == 0 {
+		return false, nil
+	}
+	address, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false, nil
+	}
+	for _, client := range s.clients {
+		if client.Contains(address.Addr().Unmap()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Server) getOrderStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
 
-	w.WriteHeader(http.StatusOK)
+	orderId, err := strconv.Atoi(ps.ByName("order_id"))
+	if err != nil {
+		s.fail(ctx, w, "order status", refused(services.ErrorInvalidRequest, "invalid order id: %s", ps.ByName("order_id")))
+		return
+	}
+	status, err := s.payments.OrderStatus(ctx, orderId)
+	if err != nil {
+		s.fail(ctx, w, fmt.Sprintf("order status %d", orderId), err, FieldOrder, orderId)
+		return
+	}
+	s.respond(ctx, w, http.StatusOK, status)
 }
 
 func (s *Server) returnOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Add request ID for tracing
 	ctx := WithRequestID(r.Context())
-	reqID := GetRequestID(ctx)
 
 	orderId := ps.ByName("order_id")
-	if orderId == "" {
-		s.logger.Warn(fmt.Sprintf("[%s] return order: empty order id", reqID))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] return order: read request body", reqID), err)
-		w.WriteHeader(http.StatusBadRequest)
+		s.fail(ctx, w, "return order: read request body", refused(services.ErrorInvalidRequest, "read request body: %v", err))
 		return
 	}
 
-	var order entity.PaymentOrder
-	err = json.Unmarshal(body, &order)
+	var refund entity.RefundRequest
+	err = json.Unmarshal(body, &refund)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] return order: decode request body", reqID), err)
-		w.WriteHeader(http.StatusBadRequest)
+		s.fail(ctx, w, "return order: decode request body", refused(services.ErrorInvalidRequest, "decode request body: %v", err))
 		return
 	}
 
-	s.logger.Info(fmt.Sprintf("[%s] processing request: return order %s, amount %d", reqID, orderId, order.Amount))
-	err = s.payments.ReturnByOrder(ctx, orderId, order.Amount)
+	s.logger.InfoContext(ctx, fmt.Sprintf("processing request: return order %s, amount %d", orderId, refund.Amount), FieldOrder, orderId)
+	err = s.payments.ReturnByOrder(ctx, orderId, &refund)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] return order %s", reqID, orderId), err)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.fail(ctx, w, fmt.Sprintf("return order %s", orderId), err, FieldOrder, orderId)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	s.respond(ctx, w, http.StatusOK, nil)
 }
 
 func (s *Server) returnTransaction(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Add request ID for tracing
 	ctx := WithRequestID(r.Context())
-	reqID := GetRequestID(ctx)
 
 	transactionId := ps.ByName("transaction_id")
-	if transactionId == "" {
-		s.logger.Warn(fmt.Sprintf("[%s] empty transaction id", reqID))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
 	id, err := strconv.Atoi(transactionId)
 	if err != nil {
-		s.logger.Warn(fmt.Sprintf("[%s] invalid transaction id: %s; %v", reqID, transactionId, err))
-		w.WriteHeader(http.StatusBadRequest)
+		s.fail(ctx, w, "return transaction", refused(services.ErrorInvalidRequest, "invalid transaction id: %s", transactionId))
 		return
 	}
 
-	err = s.payments.ReturnPayment(ctx, id)
+	// optional amount in cents; zero refunds everything left on the transaction
+	amount := 0
+	if value := r.URL.Query().Get("amount"); value != "" {
+		amount, err = strconv.Atoi(value)
+		if err != nil || amount < 0 {
+			s.fail(ctx, w, "return transaction", refused(services.ErrorInvalidAmount, "invalid return amount: %s", value))
+			return
+		}
+	}
+
+	err = s.payments.ReturnPayment(ctx, id, amount)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] return transaction %v", reqID, id), err)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.fail(ctx, w, fmt.Sprintf("return transaction %v", id), err, FieldTransactionId, id)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	s.respond(ctx, w, http.StatusOK, nil)
 }
 
 func (s *Server) paymentNotify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Add request ID for tracing
 	ctx := WithRequestID(r.Context())
-	reqID := GetRequestID(ctx)
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] payment notify: get body", reqID), err)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.fail(ctx, w, "payment notify: get body", err)
 		return
 	}
 
 	err = s.payments.Notify(ctx, body)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("[%s] payment notify: process body", reqID), err)
+		s.fail(ctx, w, "payment notify: process body", err)
+		return
+	}
+	s.respond(ctx, w, http.StatusOK, nil)
+}
+
+// authorized reports whether the request carries the admin token; without a
+// configured token the admin endpoints are disabled.
+func (s *Server) authorized(r *http.Request) bool {
+	token := s.conf.Admin.Token
+	if token == "" {
+		return false
+	}
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+// getTimeline answers with a page of the timeline in data.
+func (s *Server) getTimeline(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := WithRequestID(r.Context())
+
+	if s.timeline == nil || s.conf.Admin.Token == "" {
+		s.failWith(ctx, w, errorNotFound, "timeline is not enabled")
+		return
+	}
+	if !s.authorized(r) {
+		s.logger.WarnContext(ctx, "timeline: unauthorized request from "+r.RemoteAddr)
+		s.failWith(ctx, w, errorUnauthorized, "admin token required")
+		return
+	}
+
+	query, err := timelineQuery(r)
+	if err == nil {
+		err = query.Validate()
+	}
+	if err != nil {
+		s.fail(ctx, w, "timeline", refused(services.ErrorInvalidRequest, "%v", err))
+		return
+	}
+
+	page, err := s.timeline.Build(ctx, query)
+	if err != nil {
+		s.fail(ctx, w, "timeline", err)
+		return
+	}
+	s.respond(ctx, w, http.StatusOK, page)
+}
+
+// timelineQuery reads a timeline query from the request parameters.
+func timelineQuery(r *http.Request) (TimelineQuery, error) {
+	values := r.URL.Query()
+	query := TimelineQuery{
+		RequestId: values.Get("request_id"),
+		UserId:    values.Get("user"),
+		Level:     values.Get("level"),
+	}
+	numbers := []struct {
+		name  string
+		value *int
+	}{
+		{"order", &query.Order},
+		{"transaction", &query.TransactionId},
+		{"offset", &query.Offset},
+		{"limit", &query.Limit},
+	}
+	for _, number := range numbers {
+		value := values.Get(number.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid %s: %s", number.name, value)
+		}
+		*number.value = n
+	}
+	times := []struct {
+		name  string
+		value *time.Time
+	}{
+		{"from", &query.From},
+		{"to", &query.To},
+	}
+	for _, t := range times {
+		value := values.Get(t.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("invalid %s: %s", t.name, value)
+		}
+		*t.value = parsed
+	}
+	return query, nil
+}
+
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.metrics == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.metrics.Handler().ServeHTTP(w, r)
+}
+
+// getHealth reports that the process is up and serving requests. Like the
+// readiness, it answers without the API envelope: probes read the status
+// code, and the body is the check report itself.
+func (s *Server) getHealth(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": CheckOk})
+}
+
+// getReadiness answers 503 when any readiness check fails; warnings keep the
+// instance ready.
+func (s *Server) getReadiness(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.health == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	readiness := s.health.Ready(r.Context())
+	status := http.StatusOK
+	if readiness.Status == CheckFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
+
+// getDebugStatus answers with the status of the instance in data.
+func (s *Server) getDebugStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	if s.health == nil || s.conf.Admin.Token == "" {
+		s.failWith(ctx, w, errorNotFound, "debug status is not enabled")
+		return
+	}
+	if !s.authorized(r) {
+		s.logger.WarnContext(ctx, "debug status: unauthorized request from "+r.RemoteAddr)
+		s.failWith(ctx, w, errorUnauthorized, "admin token required")
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+	s.respond(ctx, w, http.StatusOK, s.health.Status())
 }
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes of the server itself; the codes of refused payment operations
+// come from services.PaymentError.
+const (
+	errorNotFound           services.ErrorCode = "not_found"
+	errorUnauthorized       services.ErrorCode = "unauthorized"
+	errorConflict           services.ErrorCode = "conflict"
+	errorStorageUnavailable services.ErrorCode = "storage_unavailable"
+	errorInternal           services.ErrorCode = "internal_error"
+)
+
+// errorStatus maps the codes of refused operations to HTTP statuses.
+var errorStatus = map[services.ErrorCode]int{
+	services.ErrorInvalidRequest:         http.StatusBadRequest,
+	services.ErrorInvalidNotification:    http.StatusBadRequest,
+	services.ErrorTransactionNotFound:    http.StatusNotFound,
+	services.ErrorOrderNotFound:          http.StatusNotFound,
+	services.ErrorTransactionNotFinished: http.StatusConflict,
+	services.ErrorNoUser:                 http.StatusUnprocessableEntity,
+	services.ErrorNoPaymentMethod:        http.StatusUnprocessableEntity,
+	services.ErrorAmountZero:             http.StatusUnprocessableEntity,
+	services.ErrorInvalidAmount:          http.StatusUnprocessableEntity,
+	services.ErrorMerchantNotConfigured:  http.StatusServiceUnavailable,
+	services.ErrorShuttingDown:           http.StatusServiceUnavailable,
+	services.ErrorBusy:                   http.StatusServiceUnavailable,
+	errorNotFound:                        http.StatusNotFound,
+	errorUnauthorized:                    http.StatusUnauthorized,
+	errorConflict:                        http.StatusConflict,
+	errorStorageUnavailable:              http.StatusServiceUnavailable,
+}
+
+// retryAfter is the Retry-After header, in seconds, of transient errors.
+var retryAfter = map[services.ErrorCode]string{
+	services.ErrorBusy:      "1",
+	errorStorageUnavailable: "5",
+}
+
+// apiResponse is the envelope of the answers of the payment API, and of the
+// errors of all endpoints.
+type apiResponse struct {
+	Ok        bool      `json:"ok"`
+	RequestId string    `json:"request_id,omitempty"`
+	Data      any       `json:"data,omitempty"`
+	Error     *apiError `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Code    services.ErrorCode `json:"code"`
+	Message string             `json:"message"`
+}
+
+// respond writes a successful answer; data may be nil.
+func (s *Server) respond(ctx context.Context, w http.ResponseWriter, status int, data any) {
+	writeJSON(w, status, apiResponse{Ok: true, RequestId: GetRequestID(ctx), Data: data})
+}
+
+// fail logs an error and writes it with the status of its code. Refused
+// operations are logged as warnings with their message; other errors are
+// logged in full and answered without details: an unreachable database as
+// storage_unavailable, a lease taken over as busy, and the rest as internal
+// errors. Transient errors carry a Retry-After header.
+func (s *Server) fail(ctx context.Context, w http.ResponseWriter, event string, err error, fields ...any) {
+	response := apiError{Code: errorInternal, Message: "internal error"}
+	status := http.StatusInternalServerError
+	var refusal *services.PaymentError
+	switch {
+	case errors.As(err, &refusal):
+		response = apiError{Code: refusal.Code, Message: refusal.Message}
+	case mongoUnavailable(err) || sqlUnavailable(err):
+		response = apiError{Code: errorStorageUnavailable, Message: "database unavailable, try again later"}
+	case errors.Is(err, services.ErrLeaseLost):
+		response = apiError{Code: services.ErrorBusy, Message: "taken over by another request, try again later"}
+	case errors.Is(err, services.ErrConflict):
+		response = apiError{Code: errorConflict, Message: "concurrent update, try again"}
+	}
+	if code, ok := errorStatus[response.Code]; ok {
+		status = code
+	}
+	if seconds, ok := retryAfter[response.Code]; ok {
+		w.Header().Set("Retry-After", seconds)
+	}
+
+	if status >= http.StatusInternalServerError {
+		s.logger.ErrorContext(ctx, event, err, fields...)
+	} else {
+		s.logger.WarnContext(ctx, fmt.Sprintf("%s: %v", event, err), fields...)
+	}
+	writeJSON(w, status, apiResponse{RequestId: GetRequestID(ctx), Error: &response})
+}
+
+// failWith answers with a server error code, such as a disabled endpoint.
+func (s *Server) failWith(ctx context.Context, w http.ResponseWriter, code services.ErrorCode, message string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, apiResponse{RequestId: GetRequestID(ctx), Error: &apiError{Code: code, Message: message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,155 @@
+package internal_test
+
+import (
+	"electrum/config"
+	"electrum/entity"
+	"electrum/internal"
+	"electrum/internal/sandbox"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// syncAnswer is the envelope of a payment request answered by the server.
+type syncAnswer struct {
+	Ok        bool   `json:"ok"`
+	RequestId string `json:"request_id"`
+	Data      *struct {
+		entity.PaymentStatus
+		StatusUrl string `json:"status_url"`
+	} `json:"data"`
+	Error *struct {
+		Code string `json:"code"`
+	} `json:"error"`
+}
+
+// serve serves the payment API of the harness, waiting up to wait for
+// synchronous payments, and synchronously for the client networks.
+func (h *harness) serve(t *testing.T, wait time.Duration, clients ...string) string {
+	t.Helper()
+	conf := &config.Config{}
+	conf.Sync.Wait = wait
+	prefixes, err := internal.ParseClients(clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.serveWith(t, conf, prefixes)
+}
+
+// serveWith serves the payment API of the harness with the configuration.
+func (h *harness) serveWith(t *testing.T, conf *config.Config, clients []netip.Prefix) string {
+	t.Helper()
+	server := internal.NewServer(conf)
+	server.SetLogger(internal.NewLogger("server", false, nil))
+	server.SetPaymentsService(h.payments)
+	server.SetSyncClients(clients)
+	router := httprouter.New()
+	server.Register(router)
+	httpServer := httptest.NewServer(router)
+	t.Cleanup(httpServer.Close)
+	return httpServer.URL
+}
+
+// requestPayment asks the server to pay a transaction.
+func requestPayment(t *testing.T, url string) (*http.Response, syncAnswer) {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var answer syncAnswer
+	if err = json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		t.Fatalf("decode answer: %v", err)
+	}
+	return response, answer
+}
+
+func TestSynchronousPayment(t *testing.T) {
+	for _, kind := range databases {
+		t.Run(kind, func(t *testing.T) {
+			h := newHarness(t, kind)
+			url := h.serve(t, 5*time.Second)
+			h.addTransaction(t, 10, 1500)
+
+			response, answer := requestPayment(t, url+"/pay/10?wait=true")
+			if response.StatusCode != http.StatusOK || !answer.Ok || answer.Data == nil {
+				t.Fatalf("status %d, answer %+v; want 200 with the outcome", response.StatusCode, answer)
+			}
+			status := answer.Data
+			order := h.order(t, status.Order)
+			if status.TransactionId != 10 || status.State != order.CurrentState() || status.Category != entity.PaymentApproved {
+				t.Errorf("status %+v, want the approved order of transaction 10 in state %s", status.PaymentStatus, order.CurrentState())
+			}
+			if status.Amount != 1500 || status.Billed != 1500 || status.StatusUrl != "" {
+				t.Errorf("amount %d, billed %d, status url %q; want 1500 billed", status.Amount, status.Billed, status.StatusUrl)
+			}
+			if billed := h.transaction(t, 10).PaymentBilled; billed != 1500 {
+				t.Errorf("transaction billed %d, want 1500", billed)
+			}
+		})
+	}
+}
+
+func TestSynchronousPaymentDeadline(t *testing.T) {
+	h := newHarness(t, "memory")
+	url := h.serve(t, 50*time.Millisecond)
+	h.addTransaction(t, 10, 1500)
+	// the gateway answers after the deadline of the caller
+	if err := h.sandbox.OnAmount(1500, sandbox.Outcome{Kind: sandbox.Approve, Delay: 500 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, answer := requestPayment(t, url+"/pay/10?wait=true")
+	if response.StatusCode != http.StatusAccepted || answer.Data == nil {
+		t.Fatalf("status %d, answer %+v; want 202 with the pending order", response.StatusCode, answer)
+	}
+	statusUrl := "/order/" + strconv.Itoa(answer.Data.Order)
+	if answer.Data.Category != entity.PaymentPending || answer.Data.StatusUrl != statusUrl || response.Header.Get("Location") != statusUrl {
+		t.Errorf("category %s, status url %q, location %q; want pending at %s",
+			answer.Data.Category, answer.Data.StatusUrl, response.Header.Get("Location"), statusUrl)
+	}
+
+	// the outcome comes in later at the status URL
+	eventually(t, "approved order", func() bool {
+		_, answer := requestPayment(t, url+statusUrl)
+		return answer.Data != nil && answer.Data.Category == entity.PaymentApproved
+	})
+}
+
+func TestSynchronousClients(t *testing.T) {
+	h := newHarness(t, "memory")
+	h.addTransaction(t, 10, 1500)
+	h.addTransaction(t, 11, 700)
+
+	// the test client connects from the loopback network
+	response, answer := requestPayment(t, h.serve(t, 5*time.Second, "127.0.0.0/8")+"/pay/10")
+	if response.StatusCode != http.StatusOK || answer.Data == nil || answer.Data.Category != entity.PaymentApproved {
+		t.Errorf("client in the network: status %d, answer %+v; want the outcome", response.StatusCode, answer)
+	}
+
+	response, answer = requestPayment(t, h.serve(t, 5*time.Second, "10.0.0.0/8")+"/pay/11")
+	if response.StatusCode != http.StatusOK || !answer.Ok || answer.Data != nil {
+		t.Errorf("client outside the network: status %d, answer %+v; want an answer without waiting", response.StatusCode, answer)
+	}
+}
+
+func TestSynchronousInvalidWait(t *testing.T) {
+	h := newHarness(t, "memory")
+	url := h.serve(t, 5*time.Second)
+	h.addTransaction(t, 10, 1500)
+
+	response, answer := requestPayment(t, url+"/pay/10?wait=soon")
+	if response.StatusCode != http.StatusBadRequest || answer.Error == nil || answer.Error.Code != "invalid_request" {
+		t.Errorf("status %d, answer %+v; want 400 invalid_request", response.StatusCode, answer)
+	}
+	if len(h.sandbox.Requests()) != 0 {
+		t.Error("a request with an invalid wait was sent to the gateway")
+	}
+}
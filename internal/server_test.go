@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingPayments answers every payment operation with its error.
+type failingPayments struct {
+	err error
+}
+
+func (p *failingPayments) Notify(context.Context, []byte) error          { return p.err }
+func (p *failingPayments) PayTransaction(context.Context, int) error     { return p.err }
+func (p *failingPayments) ReturnPayment(context.Context, int, int) error { return p.err }
+func (p *failingPayments) ReturnByOrder(context.Context, string, *entity.RefundRequest) error {
+	return p.err
+}
+func (p *failingPayments) PayTransactionWait(context.Context, int, time.Duration) (*entity.PaymentStatus, error) {
+	return nil, p.err
+}
+func (p *failingPayments) OrderStatus(context.Context, int) (*entity.PaymentStatus, error) {
+	return nil, p.err
+}
+
+// newTestServer serves the API of a server whose payments fail with err.
+func newTestServer(t *testing.T, conf *config.Config, err error) *httptest.Server {
+	t.Helper()
+	conf.Listen.RequestIdHeader = "X-Request-ID"
+	server := NewServer(conf)
+	server.SetLogger(NewLogger("server", false, nil))
+	server.SetPaymentsService(&failingPayments{err: err})
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	t.Cleanup(httpServer.Close)
+	return httpServer
+}
+
+// getEnvelope sends a GET with a request ID and decodes the answer.
+func getEnvelope(t *testing.T, url, token string) (*http.Response, apiResponse) {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Request-ID", "caller-1")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var envelope apiResponse
+	if err = json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		t.Fatalf("decode answer: %v", err)
+	}
+	return response, envelope
+}
+
+// errorCase is an error of the payments and the answer expected for it.
+type errorCase struct {
+	name       string
+	err        error
+	code       services.ErrorCode
+	status     int
+	retryAfter string
+}
+
+func TestServerErrorEnvelope(t *testing.T) {
+	tests := []errorCase{
+		{"conflict", fmt.Errorf("save: %w", &services.ConflictError{Entity: "payment order", Id: 1200}), errorConflict, http.StatusConflict, ""},
+		{"lease lost", fmt.Errorf("update: %w", services.ErrLeaseLost), services.ErrorBusy, http.StatusServiceUnavailable, "1"},
+		{"fenced", &services.FencedError{Key: services.LockKey{Namespace: services.LockOrder, Id: "1200"}, Token: 1}, services.ErrorBusy, http.StatusServiceUnavailable, "1"},
+		{"sql connection", fmt.Errorf("get transaction: %w", driver.ErrBadConn), errorStorageUnavailable, http.StatusServiceUnavailable, "5"},
+		{"mongo server selection", fmt.Errorf("get transaction: %w", topology.ServerSelectionError{Wrapped: errors.New("no primary")}), errorStorageUnavailable, http.StatusServiceUnavailable, "5"},
+		{"other", errors.New("broken"), errorInternal, http.StatusInternalServerError, ""},
+	}
+	// every refusal code answers with its status
+	for code, status := range errorStatus {
+		if code == errorNotFound || code == errorUnauthorized || code == errorConflict || code == errorStorageUnavailable {
+			continue
+		}
+		retry := ""
+		if code == services.ErrorBusy {
+			retry = "1"
+		}
+		tests = append(tests, errorCase{string(code), refused(code, "refused"), code, status, retry})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, &config.Config{}, tt.err)
+			response, envelope := getEnvelope(t, server.URL+"/pay/10", "")
+			if response.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", response.StatusCode, tt.status)
+			}
+			if envelope.Ok || envelope.Error == nil || envelope.Error.Code != tt.code {
+				t.Fatalf("envelope %+v, want error %s", envelope, tt.code)
+			}
+			if envelope.RequestId != "caller-1" || response.Header.Get("X-Request-ID") != "caller-1" {
+				t.Errorf("request id %q, header %q; want caller-1", envelope.RequestId, response.Header.Get("X-Request-ID"))
+			}
+			if got := response.Header.Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+			if tt.code == errorInternal && envelope.Error.Message != "internal error" {
+				t.Errorf("internal error message %q leaks details", envelope.Error.Message)
+			}
+		})
+	}
+}
+
+func TestServerInvalidRequest(t *testing.T) {
+	server := newTestServer(t, &config.Config{}, nil)
+	response, envelope := getEnvelope(t, server.URL+"/pay/abc", "")
+	if response.StatusCode != http.StatusBadRequest || envelope.Error == nil || envelope.Error.Code != services.ErrorInvalidRequest {
+		t.Errorf("status %d, envelope %+v; want 400 invalid_request", response.StatusCode, envelope)
+	}
+	response, envelope = getEnvelope(t, server.URL+"/pay/10", "")
+	if response.StatusCode != http.StatusOK || !envelope.Ok || envelope.RequestId != "caller-1" {
+		t.Errorf("status %d, envelope %+v; want 200 ok", response.StatusCode, envelope)
+	}
+}
+
+func TestServerAdminAccess(t *testing.T) {
+	disabled := newTestServer(t, &config.Config{}, nil)
+	conf := &config.Config{}
+	conf.Admin.Token = "secret"
+	enabled := NewServer(conf)
+	conf.Listen.RequestIdHeader = "X-Request-ID"
+	enabled.SetLogger(NewLogger("server", false, nil))
+	enabled.SetTimeline(&Timeline{})
+	enabled.SetHealth(&Health{})
+	server := httptest.NewServer(enabled.httpServer.Handler)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		token  string
+		code   services.ErrorCode
+		status int
+	}{
+		{"timeline disabled", disabled.URL + "/timeline?order=1200", "secret", errorNotFound, http.StatusNotFound},
+		{"debug status disabled", disabled.URL + "/debug/status", "secret", errorNotFound, http.StatusNotFound},
+		{"timeline without token", server.URL + "/timeline?order=1200", "", errorUnauthorized, http.StatusUnauthorized},
+		{"timeline with a wrong token", server.URL + "/timeline?order=1200", "guess", errorUnauthorized, http.StatusUnauthorized},
+		{"debug status without token", server.URL + "/debug/status", "", errorUnauthorized, http.StatusUnauthorized},
+		{"debug status with a wrong token", server.URL + "/debug/status", "guess", errorUnauthorized, http.StatusUnauthorized},
+		{"timeline with an invalid query", server.URL + "/timeline?order=x", "secret", services.ErrorInvalidRequest, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, envelope := getEnvelope(t, tt.url, tt.token)
+			if response.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", response.StatusCode, tt.status)
+			}
+			if envelope.Ok || envelope.Error == nil || envelope.Error.Code != tt.code {
+				t.Fatalf("envelope %+v, want error %s", envelope, tt.code)
+			}
+			if envelope.RequestId != "caller-1" {
+				t.Errorf("request id %q, want caller-1", envelope.RequestId)
+			}
+		})
+	}
+}
+
+func TestServerTimeline(t *testing.T) {
+	conf := &config.Config{}
+	conf.Admin.Token = "secret"
+	conf.Listen.RequestIdHeader = "X-Request-ID"
+	server := NewServer(conf)
+	server.SetLogger(NewLogger("server", false, nil))
+	server.SetTimeline(NewTimeline(newTimelineStore(t)))
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	defer httpServer.Close()
+
+	response, envelope := getEnvelope(t, httpServer.URL+"/timeline?order=1200&level=warning&offset=1&limit=1", "secret")
+	if response.StatusCode != http.StatusOK || !envelope.Ok {
+		t.Fatalf("status %d, envelope %+v; want 200 ok", response.StatusCode, envelope)
+	}
+	var page TimelinePage
+	data, _ := json.Marshal(envelope.Data)
+	if err := json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Query.Order != 1200 || page.Query.Level != "warning" || page.Total != 3 || len(page.Events) != 1 {
+		t.Fatalf("page %+v, want the second of 3 warnings of order 1200", page)
+	}
+	if event := page.Events[0]; event.Source != EventLog || event.Level != "warning" || event.Text != "authorize order 1200: connection reset" {
+		t.Errorf("event %+v, want the warning log record", event)
+	}
+}
@@ -0,0 +1,794 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+const (
+	orderColumns = "order_number, transaction_id, user_id, user_name, amount, captured, currency, description, identifier, " +
+		"is_completed, state, state_history, attempts, result, date, time_opened, time_closed, refund_amount, refund_time, version, request_id"
+	transactionColumns = "transaction_id, session_id, is_finished, connector_id, charge_point_id, id_tag, reservation_id, " +
+		"meter_start, meter_stop, time_start, time_stop, reason, id_tag_note, username, payment_amount, payment_billed, " +
+		"payment_order, payment_error, payment_plan, meter_values, payment_method_id, version"
+	paymentMethodColumns = "id, user_id, identifier, description, card_number, card_type, card_brand, card_country, " +
+		"expiry_date, is_default, user_name, fail_count, cof_tid"
+)
+
+// sqlTxKey carries the *sql.Tx of a unit of work in a context.
+type sqlTxKey struct{}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// SQLDatabase is a services.Database on SQLite or PostgreSQL. The schema is
+// created and upgraded at startup by the migrations embedded for the dialect.
+// Payment orders, their refunds, transactions and payment methods are related
+// by foreign keys; an order number and a card identifier per user are unique.
+//
+// Units of work are database transactions; on SQLite they take the write lock
+// when they begin, so that concurrent units wait instead of failing.
+type SQLDatabase struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewSQLDatabase opens the database of conf.Database.Type, sqlite or postgres,
+// at conf.Database.DSN and applies pending migrations. For SQLite, the DSN is
+// the path of the database file.
+func NewSQLDatabase(conf *config.Config) (*SQLDatabase, error) {
+	s := &SQLDatabase{dialect: conf.Database.Type}
+	var driver, dsn string
+	switch s.dialect {
+	case dialectSQLite:
+		driver, dsn = "sqlite", sqliteDSN(conf.Database.DSN)
+	case dialectPostgres:
+		driver, dsn = "pgx", conf.Database.DSN
+	default:
+		return nil, fmt.Errorf("unsupported sql dialect: %s", s.dialect)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s database: %w", s.dialect, err)
+	}
+	if s.dialect == dialectSQLite && isSQLiteMemory(conf.Database.DSN) {
+		// every connection to an in-memory database opens a new one
+		db.SetMaxOpenConns(1)
+	}
+	s.db = db
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("ping %s database: %w", s.dialect, err)
+	}
+	if err = s.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sqliteDSN turns a file path into a DSN that enables foreign keys, waits for
+// locks and begins transactions with the write lock. A DSN with its own
+// pragmas is used as is.
+func sqliteDSN(path string) string {
+	if strings.Contains(path, "_pragma") {
+		return path
+	}
+	if path == "" {
+		path = ":memory:"
+	}
+	pragmas := "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate"
+	if !isSQLiteMemory(path) {
+		pragmas += "&_pragma=journal_mode(WAL)"
+	}
+	return fmt.Sprintf("file:%s?%s", path, pragmas)
+}
+
+func isSQLiteMemory(path string) bool {
+	return path == "" || strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory")
+}
+
+// Close closes the connection pool.
+func (s *SQLDatabase) Close(_ context.Context) error {
+	return s.db.Close()
+}
+
+// Ping checks the database connection, for readiness checks.
+func (s *SQLDatabase) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// WithTransaction runs fn in a database transaction. Nested calls join the outer one.
+func (s *SQLDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlConflict(fmt.Errorf("begin transaction: %w", err))
+	}
+	if err = fn(context.WithValue(ctx, sqlTxKey{}, tx)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			return fmt.Errorf("%w; rollback: %v", err, rollbackErr)
+		}
+		return sqlConflict(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return sqlConflict(fmt.Errorf("commit transaction: %w", err))
+	}
+	return nil
+}
+
+// sqlConflict marks a serialization failure or deadlock on PostgreSQL, and a
+// busy database on SQLite, as services.ErrConflict so that the caller reloads
+// and retries like on a version conflict.
+func sqlConflict(err error) error {
+	if errors.Is(err, services.ErrConflict) {
+		return err
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01") {
+		return fmt.Errorf("%w: %v", services.ErrConflict, err)
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		if code := liteErr.Code() & 0xff; code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED {
+			return fmt.Errorf("%w: %v", services.ErrConflict, err)
+		}
+	}
+	return err
+}
+
+// isUniqueViolation reports whether an insert failed on a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// sqlUnavailable reports whether a statement failed because the database
+// could not be reached or opened, rather than on the statement itself.
+func sqlUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection exceptions, and a server shutting down or starting up
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		code := liteErr.Code() & 0xff
+		return code == sqlite3.SQLITE_CANTOPEN || code == sqlite3.SQLITE_IOERR
+	}
+	return false
+}
+
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction of the unit of work in the context, or the pool.
+func (s *SQLDatabase) conn(ctx context.Context) sqlQuerier {
+	if tx, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+func (s *SQLDatabase) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.conn(ctx).ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLDatabase) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return s.conn(ctx).QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLDatabase) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return s.conn(ctx).QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+// rebind replaces the ? placeholders of a query with $1, $2... for PostgreSQL.
+func (s *SQLDatabase) rebind(query string) string {
+	if s.dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// WriteLogMessage writes a log message to the database.
+// Fence records the fencing token of a lock key. The upsert leaves a greater
+// recorded token in place and then affects no row; inside a unit of work the
+// row stays locked until it ends, so a concurrent holder waits for it.
+func (s *SQLDatabase) Fence(ctx context.Context, key services.LockKey, token int64) error {
+	result, err := s.exec(ctx, `INSERT INTO lock_fences (lock_key, token) VALUES (?, ?)
+		ON CONFLICT (lock_key) DO UPDATE SET token = excluded.token WHERE lock_fences.token <= excluded.token`,
+		key.String(), token)
+	if err != nil {
+		return fmt.Errorf("fence %s: %w", key, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("fence %s: %w", key, err)
+	}
+	if affected == 0 {
+		return &services.FencedError{Key: key, Token: token}
+	}
+	return nil
+}
+
+func (s *SQLDatabase) WriteLogMessage(ctx context.Context, data services.Data) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("write log message: %w", err)
+	}
+	var level, requestId, userId sql.NullString
+	var order, transactionId sql.NullInt64
+	if message, ok := data.(*services.LogMessage); ok {
+		level = sql.NullString{String: message.Level, Valid: true}
+		requestId = sql.NullString{String: message.RequestId, Valid: message.RequestId != ""}
+		userId = sql.NullString{String: message.UserId, Valid: message.UserId != ""}
+		order = sql.NullInt64{Int64: int64(message.Order), Valid: message.Order != 0}
+		transactionId = sql.NullInt64{Int64: int64(message.TransactionId), Valid: message.TransactionId != 0}
+	}
+	_, err = s.exec(ctx, "INSERT INTO payment_log (data_type, level, timestamp, data, request_id, order_number, "+
+		"transaction_id, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		data.DataType(), level, time.Now(), string(encoded), requestId, order, transactionId, userId)
+	if err != nil {
+		return fmt.Errorf("write log message: %w", err)
+	}
+	return nil
+}
+
+// WriteLogMessages writes log messages in one transaction.
+func (s *SQLDatabase) WriteLogMessages(ctx context.Context, data []services.Data) error {
+	return s.WithTransaction(ctx, func(ctx context.Context) error {
+		for _, message := range data {
+			if err := s.WriteLogMessage(ctx, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUserTag retrieves a user tag (RFID card) by its identifier.
+func (s *SQLDatabase) GetUserTag(ctx context.Context, idTag string) (*entity.UserTag, error) {
+	var tag entity.UserTag
+	var registered, lastSeen sql.NullTime
+	err := s.queryRow(ctx, "SELECT id_tag, user_id, username, source, is_enabled, local, note, date_registered, last_seen "+
+		"FROM user_tags WHERE id_tag = ?", idTag).
+		Scan(&tag.IdTag, &tag.UserId, &tag.Username, &tag.Source, &tag.IsEnabled, &tag.Local, &tag.Note, &registered, &lastSeen)
+	if err != nil {
+		return nil, fmt.Errorf("get user tag %s: %w", idTag, sqlNotFound(err))
+	}
+	tag.DateRegistered = registered.Time
+	tag.LastSeen = lastSeen.Time
+	return &tag, nil
+}
+
+// GetTransaction retrieves a transaction by ID with its payment method, the
+// orders billed to it and its refund legs.
+func (s *SQLDatabase) GetTransaction(ctx context.Context, id int) (*entity.Transaction, error) {
+	var transaction entity.Transaction
+	var reservation, paymentMethodId sql.NullInt64
+	var timeStart, timeStop sql.NullTime
+	var plan, meterValues []byte
+	err := s.queryRow(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE transaction_id = ?", id).Scan(
+		&transaction.Id, &transaction.SessionId, &transaction.IsFinished, &transaction.ConnectorId,
+		&transaction.ChargePointId, &transaction.IdTag, &reservation, &transaction.MeterStart, &transaction.MeterStop,
+		&timeStart, &timeStop, &transaction.Reason, &transaction.IdTagNote, &transaction.Username,
+		&transaction.PaymentAmount, &transaction.PaymentBilled, &transaction.PaymentOrder, &transaction.PaymentError,
+		&plan, &meterValues, &paymentMethodId, &transaction.Version)
+	if err != nil {
+		return nil, fmt.Errorf("get transaction %d: %w", id, sqlNotFound(err))
+	}
+	if reservation.Valid {
+		value := int(reservation.Int64)
+		transaction.ReservationId = &value
+	}
+	transaction.TimeStart = timeStart.Time
+	transaction.TimeStop = timeStop.Time
+	if err = unmarshalColumn(plan, &transaction.Plan); err != nil {
+		return nil, fmt.Errorf("get transaction %d: payment plan: %w", id, err)
+	}
+	if err = unmarshalColumn(meterValues, &transaction.MeterValues); err != nil {
+		return nil, fmt.Errorf("get transaction %d: meter values: %w", id, err)
+	}
+
+	if paymentMethodId.Valid {
+		row := s.queryRow(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE id = ?", paymentMethodId.Int64)
+		if transaction.PaymentMethod, err = scanPaymentMethod(row); err != nil {
+			return nil, fmt.Errorf("get transaction %d: payment method: %w", id, err)
+		}
+	}
+	if transaction.PaymentOrders, err = s.transactionOrders(ctx, id); err != nil {
+		return nil, fmt.Errorf("get transaction %d: %w", id, err)
+	}
+	if transaction.RefundLegs, err = s.refundLegs(ctx, id); err != nil {
+		return nil, fmt.Errorf("get transaction %d: %w", id, err)
+	}
+	return &transaction, nil
+}
+
+// transactionOrders loads the orders billed to a transaction.
+func (s *SQLDatabase) transactionOrders(ctx context.Context, transactionId int) ([]entity.PaymentOrder, error) {
+	rows, err := s.query(ctx, "SELECT "+prefixColumns("o", orderColumns)+" FROM payment_orders o "+
+		"JOIN transaction_orders t ON t.order_number = o.order_number "+
+		"WHERE t.transaction_id = ? ORDER BY t.position", transactionId)
+	if err != nil {
+		return nil, fmt.Errorf("payment orders: %w", err)
+	}
+	var orders []*entity.PaymentOrder
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("payment orders: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("payment orders: %w", err)
+	}
+
+	result := make([]entity.PaymentOrder, 0, len(orders))
+	for _, order := range orders {
+		if order.Refunds, err = s.refunds(ctx, order.Order); err != nil {
+			return nil, err
+		}
+		result = append(result, *order)
+	}
+	return result, nil
+}
+
+func (s *SQLDatabase) refundLegs(ctx context.Context, transactionId int) ([]entity.RefundLeg, error) {
+	rows, err := s.query(ctx, "SELECT order_number, amount, status, result, time_opened, time_closed "+
+		"FROM refund_legs WHERE transaction_id = ? ORDER BY position", transactionId)
+	if err != nil {
+		return nil, fmt.Errorf("refund legs: %w", err)
+	}
+	defer rows.Close()
+	var legs []entity.RefundLeg
+	for rows.Next() {
+		var leg entity.RefundLeg
+		var opened, closed sql.NullTime
+		if err = rows.Scan(&leg.Order, &leg.Amount, &leg.Status, &leg.Result, &opened, &closed); err != nil {
+			return nil, fmt.Errorf("refund legs: %w", err)
+		}
+		leg.TimeOpened = opened.Time
+		leg.TimeClosed = closed.Time
+		legs = append(legs, leg)
+	}
+	return legs, rows.Err()
+}
+
+// UpdateTransaction updates transaction payment billing data at the expected
+// version, with the orders billed to it and its refund legs.
+func (s *SQLDatabase) UpdateTransaction(ctx context.Context, transaction *entity.Transaction) error {
+	expected := transaction.Version
+	err := s.WithTransaction(ctx, func(ctx context.Context) error {
+		result, err := s.exec(ctx, "UPDATE transactions SET payment_order = ?, payment_error = ?, payment_billed = ?, version = ? "+
+			"WHERE transaction_id = ? AND version = ?",
+			transaction.PaymentOrder, transaction.PaymentError, transaction.PaymentBilled, expected+1, transaction.Id, expected)
+		if err != nil {
+			return fmt.Errorf("update transaction %d: %w", transaction.Id, err)
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return &services.ConflictError{Entity: "transaction", Id: transaction.Id, Version: expected}
+		}
+
+		if _, err = s.exec(ctx, "DELETE FROM transaction_orders WHERE transaction_id = ?", transaction.Id); err != nil {
+			return fmt.Errorf("update transaction %d orders: %w", transaction.Id, err)
+		}
+		for i, order := range transaction.PaymentOrders {
+			_, err = s.exec(ctx, "INSERT INTO transaction_orders (transaction_id, order_number, position) VALUES (?, ?, ?)",
+				transaction.Id, order.Order, i)
+			if err != nil {
+				return fmt.Errorf("update transaction %d orders: %w", transaction.Id, err)
+			}
+		}
+
+		if _, err = s.exec(ctx, "DELETE FROM refund_legs WHERE transaction_id = ?", transaction.Id); err != nil {
+			return fmt.Errorf("update transaction %d refund legs: %w", transaction.Id, err)
+		}
+		for i, leg := range transaction.RefundLegs {
+			_, err = s.exec(ctx, "INSERT INTO refund_legs (transaction_id, order_number, position, amount, status, result, time_opened, time_closed) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				transaction.Id, leg.Order, i, leg.Amount, leg.Status, leg.Result, leg.TimeOpened, leg.TimeClosed)
+			if err != nil {
+				return fmt.Errorf("update transaction %d refund legs: %w", transaction.Id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	transaction.Version = expected + 1
+	return nil
+}
+
+// GetPaymentMethod retrieves the best available payment method for a user.
+// It first tries to get the default payment method, then falls back to the
+// method with the lowest fail count if no default exists or the default has failures.
+func (s *SQLDatabase) GetPaymentMethod(ctx context.Context, userId string) (*entity.PaymentMethod, error) {
+	row := s.queryRow(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE user_id = ? AND is_default = ? "+
+		"ORDER BY id LIMIT 1", userId, true)
+	pm, err := scanPaymentMethod(row)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get payment method for user %s: %w", userId, err)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) || pm.FailCount > 0 {
+		row = s.queryRow(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE user_id = ? "+
+			"ORDER BY fail_count, id LIMIT 1", userId)
+		if pm, err = scanPaymentMethod(row); err != nil {
+			return nil, fmt.Errorf("get payment method fallback for user %s: %w", userId, err)
+		}
+	}
+	return pm, nil
+}
+
+// GetPaymentMethodByIdentifier retrieves a payment method by its unique identifier.
+func (s *SQLDatabase) GetPaymentMethodByIdentifier(ctx context.Context, identifier string) (*entity.PaymentMethod, error) {
+	row := s.queryRow(ctx, "SELECT "+paymentMethodColumns+" FROM payment_methods WHERE identifier = ? ORDER BY id LIMIT 1", identifier)
+	pm, err := scanPaymentMethod(row)
+	if err != nil {
+		return nil, fmt.Errorf("get payment method by identifier: %w", sqlNotFound(err))
+	}
+	return pm, nil
+}
+
+// SavePaymentMethod saves a new payment method to the database.
+// Returns an error if a payment method with the same identifier already exists for the user.
+func (s *SQLDatabase) SavePaymentMethod(ctx context.Context, paymentMethod *entity.PaymentMethod) error {
+	duplicate := fmt.Errorf("payment method with identifier %s already exists", secret(paymentMethod.Identifier))
+	var id int64
+	err := s.queryRow(ctx, "SELECT id FROM payment_methods WHERE user_id = ? AND identifier = ?",
+		paymentMethod.UserId, paymentMethod.Identifier).Scan(&id)
+	if err == nil {
+		return duplicate
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("save payment method: %w", err)
+	}
+
+	_, err = s.exec(ctx, "INSERT INTO payment_methods (user_id, identifier, description, card_number, card_type, card_brand, "+
+		"card_country, expiry_date, is_default, user_name, fail_count, cof_tid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		paymentMethod.UserId, paymentMethod.Identifier, paymentMethod.Description, paymentMethod.CardNumber,
+		paymentMethod.CardType, paymentMethod.CardBrand, paymentMethod.CardCountry, paymentMethod.ExpiryDate,
+		paymentMethod.IsDefault, paymentMethod.UserName, paymentMethod.FailCount, paymentMethod.CofTid)
+	if isUniqueViolation(err) {
+		return duplicate
+	}
+	if err != nil {
+		return fmt.Errorf("save payment method: %w", err)
+	}
+	return nil
+}
+
+// UpdatePaymentMethodFailCount updates the fail counter of the payment method
+// GetPaymentMethodByIdentifier returns; the methods of other users with the
+// same card keep theirs.
+func (s *SQLDatabase) UpdatePaymentMethodFailCount(ctx context.Context, identifier string, count int) error {
+	_, err := s.exec(ctx, "UPDATE payment_methods SET fail_count = ? WHERE id = "+
+		"(SELECT id FROM payment_methods WHERE identifier = ? ORDER BY id LIMIT 1)", count, identifier)
+	if err != nil {
+		return fmt.Errorf("update payment method fail count: %w", err)
+	}
+	return nil
+}
+
+// GetPaymentOrderByTransaction retrieves an incomplete payment order for a transaction.
+func (s *SQLDatabase) GetPaymentOrderByTransaction(ctx context.Context, transactionId int) (*entity.PaymentOrder, error) {
+	order, err := s.getOrder(ctx, "WHERE transaction_id = ? AND is_completed = ? ORDER BY time_opened, order_number LIMIT 1",
+		transactionId, false)
+	if err != nil {
+		return nil, fmt.Errorf("get payment order by transaction %d: %w", transactionId, sqlNotFound(err))
+	}
+	return order, nil
+}
+
+// GetPaymentOrder retrieves a payment order by its order number.
+func (s *SQLDatabase) GetPaymentOrder(ctx context.Context, id int) (*entity.PaymentOrder, error) {
+	order, err := s.getOrder(ctx, "WHERE order_number = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("get payment order %d: %w", id, sqlNotFound(err))
+	}
+	return order, nil
+}
+
+// sqlNotFound converts the error of a lookup that found no row to
+// services.ErrNotFound.
+func sqlNotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return services.ErrNotFound
+	}
+	return err
+}
+
+// GetLastOrder retrieves the most recently opened payment order.
+func (s *SQLDatabase) GetLastOrder(ctx context.Context) (*entity.PaymentOrder, error) {
+	order, err := s.getOrder(ctx, "ORDER BY time_opened DESC, order_number DESC LIMIT 1")
+	if err != nil {
+		return nil, fmt.Errorf("get last order: %w", sqlNotFound(err))
+	}
+	return order, nil
+}
+
+// OpenOrderTimes returns the opening times of the orders not completed.
+func (s *SQLDatabase) OpenOrderTimes(ctx context.Context) ([]time.Time, error) {
+	rows, err := s.query(ctx, "SELECT time_opened FROM payment_orders WHERE is_completed = ?", false)
+	if err != nil {
+		return nil, fmt.Errorf("find open orders: %w", err)
+	}
+	defer rows.Close()
+	var times []time.Time
+	for rows.Next() {
+		var opened sql.NullTime
+		if err = rows.Scan(&opened); err != nil {
+			return nil, fmt.Errorf("find open orders: %w", err)
+		}
+		times = append(times, opened.Time)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("find open orders: %w", err)
+	}
+	return times, nil
+}
+
+// getOrder loads the first payment order matched by the clause, with its refunds.
+func (s *SQLDatabase) getOrder(ctx context.Context, clause string, args ...any) (*entity.PaymentOrder, error) {
+	order, err := scanOrder(s.queryRow(ctx, "SELECT "+orderColumns+" FROM payment_orders "+clause, args...))
+	if err != nil {
+		return nil, err
+	}
+	if order.Refunds, err = s.refunds(ctx, order.Order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *SQLDatabase) refunds(ctx context.Context, orderNumber int) ([]entity.Refund, error) {
+	rows, err := s.query(ctx, "SELECT amount, status, reason, operator, authorisation_code, request_id, result, time, time_closed "+
+		"FROM refunds WHERE order_number = ? ORDER BY position", orderNumber)
+	if err != nil {
+		return nil, fmt.Errorf("refunds of order %d: %w", orderNumber, err)
+	}
+	defer rows.Close()
+	var refunds []entity.Refund
+	for rows.Next() {
+		var refund entity.Refund
+		var opened, closed sql.NullTime
+		err = rows.Scan(&refund.Amount, &refund.Status, &refund.Reason, &refund.Operator, &refund.AuthorisationCode,
+			&refund.RequestId, &refund.Result, &opened, &closed)
+		if err != nil {
+			return nil, fmt.Errorf("refunds of order %d: %w", orderNumber, err)
+		}
+		refund.Time = opened.Time
+		refund.TimeClosed = closed.Time
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
+
+// CreatePaymentOrder inserts a new payment order with its refunds; the unique
+// order number turns a taken number into a conflict.
+func (s *SQLDatabase) CreatePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
+	return s.writeOrder(ctx, order, true)
+}
+
+// SavePaymentOrder updates a payment order at its expected version, together
+// with its refunds.
+func (s *SQLDatabase) SavePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error {
+	return s.writeOrder(ctx, order, false)
+}
+
+// writeOrder inserts a new order or updates a stored one. The order refers to
+// the stored payment method of its user and card, if there is one.
+func (s *SQLDatabase) writeOrder(ctx context.Context, order *entity.PaymentOrder, create bool) error {
+	history, err := json.Marshal(nonNil(order.StateHistory))
+	if err != nil {
+		return fmt.Errorf("save payment order %d: %w", order.Order, err)
+	}
+	attempts, err := json.Marshal(nonNil(order.Attempts))
+	if err != nil {
+		return fmt.Errorf("save payment order %d: %w", order.Order, err)
+	}
+	var transactionId sql.NullInt64
+	if order.TransactionId != 0 {
+		transactionId = sql.NullInt64{Int64: int64(order.TransactionId), Valid: true}
+	}
+
+	expected := order.Version
+	conflict := &services.ConflictError{Entity: "payment order", Id: order.Order, Version: expected}
+	err = s.WithTransaction(ctx, func(ctx context.Context) error {
+		var paymentMethodId sql.NullInt64
+		err := s.queryRow(ctx, "SELECT id FROM payment_methods WHERE user_id = ? AND identifier = ?",
+			order.UserId, order.Identifier).Scan(&paymentMethodId)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("save payment order %d: %w", order.Order, err)
+		}
+
+		values := []any{transactionId, paymentMethodId, order.UserId, order.UserName, order.Amount, order.Captured,
+			order.Currency, order.Description, order.Identifier, order.IsCompleted, string(order.State), string(history),
+			string(attempts), order.Result, order.Date, order.TimeOpened, order.TimeClosed, order.RefundAmount,
+			order.RefundTime, expected + 1, order.RequestId}
+		if create {
+			_, err = s.exec(ctx, "INSERT INTO payment_orders (transaction_id, payment_method_id, user_id, user_name, amount, "+
+				"captured, currency, description, identifier, is_completed, state, state_history, attempts, result, date, "+
+				"time_opened, time_closed, refund_amount, refund_time, version, request_id, order_number) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				append(values, order.Order)...)
+			if isUniqueViolation(err) {
+				return conflict
+			}
+			if err != nil {
+				return fmt.Errorf("create payment order %d: %w", order.Order, err)
+			}
+		} else {
+			result, err := s.exec(ctx, "UPDATE payment_orders SET transaction_id = ?, payment_method_id = ?, user_id = ?, "+
+				"user_name = ?, amount = ?, captured = ?, currency = ?, description = ?, identifier = ?, is_completed = ?, "+
+				"state = ?, state_history = ?, attempts = ?, result = ?, date = ?, time_opened = ?, time_closed = ?, "+
+				"refund_amount = ?, refund_time = ?, version = ?, request_id = ? WHERE order_number = ? AND version = ?",
+				append(values, order.Order, expected)...)
+			if err != nil {
+				return fmt.Errorf("save payment order %d: %w", order.Order, err)
+			}
+			affected, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("save payment order %d: %w", order.Order, err)
+			}
+			if affected == 0 {
+				return conflict
+			}
+		}
+
+		if _, err = s.exec(ctx, "DELETE FROM refunds WHERE order_number = ?", order.Order); err != nil {
+			return fmt.Errorf("save refunds of order %d: %w", order.Order, err)
+		}
+		for i, refund := range order.Refunds {
+			_, err = s.exec(ctx, "INSERT INTO refunds (order_number, position, amount, status, reason, operator, "+
+				"authorisation_code, request_id, result, time, time_closed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				order.Order, i, refund.Amount, refund.Status, refund.Reason, refund.Operator, refund.AuthorisationCode,
+				refund.RequestId, refund.Result, refund.Time, refund.TimeClosed)
+			if err != nil {
+				return fmt.Errorf("save refunds of order %d: %w", order.Order, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	order.Version = expected + 1
+	return nil
+}
+
+// SavePaymentResult stores a payment response from Redsys for audit purposes.
+func (s *SQLDatabase) SavePaymentResult(ctx context.Context, p *entity.PaymentParameters) error {
+	_, err := s.exec(ctx, "INSERT INTO payment_results (order_number, merchant_code, terminal, amount, currency, date, hour, "+
+		"secure_payment, expiry_date, merchant_identifier, card_country, response, merchant_data, transaction_type, "+
+		"consumer_language, authorisation_code, card_brand, merchant_cof_txnid, processed_pay_method, time_received) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p.Order, p.MerchantCode, p.Terminal, p.Amount, p.Currency, p.Date, p.Hour, p.SecurePayment, p.ExpiryDate,
+		p.MerchantIdentifier, p.CardCountry, p.Response, p.MerchantData, p.TransactionType, p.ConsumerLanguage,
+		p.AuthorisationCode, p.CardBrand, p.MerchantCofTxnid, p.ProcessedPayMethod, time.Now())
+	if err != nil {
+		return fmt.Errorf("save payment result: %w", err)
+	}
+	return nil
+}
+
+func scanOrder(row rowScanner) (*entity.PaymentOrder, error) {
+	var order entity.PaymentOrder
+	var transactionId sql.NullInt64
+	var state string
+	var history, attempts []byte
+	var opened, closed, refunded sql.NullTime
+	err := row.Scan(&order.Order, &transactionId, &order.UserId, &order.UserName, &order.Amount, &order.Captured,
+		&order.Currency, &order.Description, &order.Identifier, &order.IsCompleted, &state, &history, &attempts,
+		&order.Result, &order.Date, &opened, &closed, &order.RefundAmount, &refunded, &order.Version, &order.RequestId)
+	if err != nil {
+		return nil, err
+	}
+	order.TransactionId = int(transactionId.Int64)
+	order.State = entity.OrderState(state)
+	order.TimeOpened = opened.Time
+	order.TimeClosed = closed.Time
+	order.RefundTime = refunded.Time
+	if err = unmarshalColumn(history, &order.StateHistory); err != nil {
+		return nil, fmt.Errorf("order %d state history: %w", order.Order, err)
+	}
+	if err = unmarshalColumn(attempts, &order.Attempts); err != nil {
+		return nil, fmt.Errorf("order %d attempts: %w", order.Order, err)
+	}
+	return &order, nil
+}
+
+func scanPaymentMethod(row rowScanner) (*entity.PaymentMethod, error) {
+	var pm entity.PaymentMethod
+	var id int64
+	err := row.Scan(&id, &pm.UserId, &pm.Identifier, &pm.Description, &pm.CardNumber, &pm.CardType, &pm.CardBrand,
+		&pm.CardCountry, &pm.ExpiryDate, &pm.IsDefault, &pm.UserName, &pm.FailCount, &pm.CofTid)
+	if err != nil {
+		return nil, err
+	}
+	return &pm, nil
+}
+
+// unmarshalColumn decodes a JSON column; an empty column leaves v unchanged.
+func unmarshalColumn(data []byte, v any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// nonNil returns an empty slice for nil, so that a JSON column holds [] rather than null.
+func nonNil[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+	return values
+}
+
+// prefixColumns qualifies a list of columns with a table alias.
+func prefixColumns(alias, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = alias + "." + name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"electrum/config"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestSQLite opens a SQLite database in memory.
+func newTestSQLite(t *testing.T) *SQLDatabase {
+	t.Helper()
+	conf := &config.Config{}
+	conf.Database.Type = dialectSQLite
+	conf.Database.DSN = ":memory:"
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close(context.Background()) })
+	return store
+}
+
+// newTestPostgres opens the PostgreSQL database at ELECTRUM_TEST_POSTGRES in
+// a new schema that is dropped after the test. The test is skipped without a
+// server.
+func newTestPostgres(t *testing.T) *SQLDatabase {
+	t.Helper()
+	dsn := os.Getenv("ELECTRUM_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("ELECTRUM_TEST_POSTGRES is not set")
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	schema := "electrum_test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	schemaDSN, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("ELECTRUM_TEST_POSTGRES: %v", err)
+	}
+	query := schemaDSN.Query()
+	query.Set("search_path", schema)
+	schemaDSN.RawQuery = query.Encode()
+
+	conf := &config.Config{}
+	conf.Database.Type = dialectPostgres
+	conf.Database.DSN = schemaDSN.String()
+	store, err := NewSQLDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close(context.Background()) })
+	return store
+}
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE payment_orders SET amount = ? WHERE order_number = ? AND version = ?"
+	postgres := &SQLDatabase{dialect: dialectPostgres}
+	if got := postgres.rebind(query); got != "UPDATE payment_orders SET amount = $1 WHERE order_number = $2 AND version = $3" {
+		t.Errorf("postgres: %s", got)
+	}
+	sqlite := &SQLDatabase{dialect: dialectSQLite}
+	if got := sqlite.rebind(query); got != query {
+		t.Errorf("sqlite: %s", got)
+	}
+}
+
+func TestSQLErrorMapping(t *testing.T) {
+	tests := []struct {
+		code        string
+		conflict    bool
+		unique      bool
+		unavailable bool
+	}{
+		{"40001", true, false, false}, // serialization failure
+		{"40P01", true, false, false}, // deadlock
+		{"23505", false, true, false}, // unique violation
+		{"08006", false, false, true}, // connection failure
+		{"57P01", false, false, true}, // admin shutdown
+		{"23503", false, false, false},
+	}
+	for _, tt := range tests {
+		err := fmt.Errorf("save: %w", &pgconn.PgError{Code: tt.code})
+		if got := errors.Is(sqlConflict(err), services.ErrConflict); got != tt.conflict {
+			t.Errorf("%s: conflict %v, want %v", tt.code, got, tt.conflict)
+		}
+		if got := isUniqueViolation(err); got != tt.unique {
+			t.Errorf("%s: unique violation %v, want %v", tt.code, got, tt.unique)
+		}
+		if got := sqlUnavailable(err); got != tt.unavailable {
+			t.Errorf("%s: unavailable %v, want %v", tt.code, got, tt.unavailable)
+		}
+	}
+}
+
+func TestSQLLookupsNotFound(t *testing.T) {
+	store := newTestSQLite(t)
+	ctx := context.Background()
+	lookups := map[string]func() error{
+		"user tag":    func() error { _, err := store.GetUserTag(ctx, "tag-1"); return err },
+		"transaction": func() error { _, err := store.GetTransaction(ctx, 10); return err },
+		"payment method by identifier": func() error {
+			_, err := store.GetPaymentMethodByIdentifier(ctx, "tok-1")
+			return err
+		},
+		"payment order by transaction": func() error {
+			_, err := store.GetPaymentOrderByTransaction(ctx, 10)
+			return err
+		},
+		"payment order": func() error { _, err := store.GetPaymentOrder(ctx, 1200); return err },
+		"last order":    func() error { _, err := store.GetLastOrder(ctx); return err },
+	}
+	for name, lookup := range lookups {
+		if err := lookup(); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("%s: %v, want not found", name, err)
+		}
+	}
+}
+
+func TestSQLFailCountOfSharedCard(t *testing.T) {
+	store := newTestSQLite(t)
+	ctx := context.Background()
+	// two users registered the same card
+	for _, user := range []string{"user-1", "user-2"} {
+		if err := store.SavePaymentMethod(ctx, &entity.PaymentMethod{UserId: user, Identifier: "tok-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.UpdatePaymentMethodFailCount(ctx, "tok-1", 2); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, user := range []string{"user-1", "user-2"} {
+		pm, err := store.GetPaymentMethod(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[user] = pm.FailCount
+	}
+	if counts["user-1"] != 2 || counts["user-2"] != 0 {
+		t.Errorf("fail counts %v, want 2 for the method read by identifier only", counts)
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	store := newTestPostgres(t)
+	ctx := context.Background()
+
+	// state history and attempts are stored as JSONB
+	order := &entity.PaymentOrder{Order: 1200, Amount: 500, TimeOpened: time.Now()}
+	order.Create("transaction 10")
+	order.Attempts = []entity.GatewayAttempt{{Attempt: 1, Outcome: "sent"}}
+	if err := store.CreatePaymentOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetPaymentOrder(ctx, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.StateHistory) != 1 || stored.StateHistory[0].To != entity.OrderCreated || len(stored.Attempts) != 1 {
+		t.Errorf("stored history %v, attempts %v", stored.StateHistory, stored.Attempts)
+	}
+
+	// a taken order number is a unique violation, reported as a conflict
+	taken := &entity.PaymentOrder{Order: 1200, Amount: 900, TimeOpened: time.Now()}
+	if err = store.CreatePaymentOrder(ctx, taken); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("create of a taken number: %v, want conflict", err)
+	}
+
+	stored.Amount = 600
+	if err = store.SavePaymentOrder(ctx, stored); err != nil || stored.Version != 2 {
+		t.Fatalf("save: %v, version %d", err, stored.Version)
+	}
+
+	// a serialization failure of a unit of work is reported as a conflict
+	err = store.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := store.exec(ctx, "DO $$ BEGIN RAISE EXCEPTION 'concurrent update' USING ERRCODE = '40001'; END $$")
+		return err
+	})
+	if !errors.Is(err, services.ErrConflict) {
+		t.Errorf("serialization failure: %v, want conflict", err)
+	}
+
+	if err = store.Fence(ctx, services.LockKey{Namespace: services.LockOrder, Id: "1200"}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Fence(ctx, services.LockKey{Namespace: services.LockOrder, Id: "1200"}, 4); !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("fence with an older token: %v, want lease lost", err)
+	}
+}
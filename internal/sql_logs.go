@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"electrum/entity"
+	"electrum/services"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CountLogs returns the number of log records.
+func (s *SQLDatabase) CountLogs(ctx context.Context) (int64, error) {
+	var count int64
+	if err := s.queryRow(ctx, "SELECT COUNT(*) FROM payment_log").Scan(&count); err != nil {
+		return 0, fmt.Errorf("count logs: %w", err)
+	}
+	return count, nil
+}
+
+// ReadLogs returns up to limit log records matching the filter, oldest first.
+func (s *SQLDatabase) ReadLogs(ctx context.Context, filter LogFilter, limit int) ([]StoredLog, error) {
+	where, args := sqlLogFilter(filter)
+	rows, err := s.query(ctx, "SELECT id, data FROM payment_log"+where+" ORDER BY id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("read logs: %w", err)
+	}
+	defer rows.Close()
+	var records []StoredLog
+	for rows.Next() {
+		var id int64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, fmt.Errorf("read logs: %w", err)
+		}
+		records = append(records, StoredLog{Id: strconv.FormatInt(id, 10), Data: []byte(data)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read logs: %w", err)
+	}
+	return records, nil
+}
+
+// sqlLogFilter builds the WHERE clause of a log filter and its arguments;
+// records without a level match info.
+func sqlLogFilter(filter LogFilter) (string, []any) {
+	var conditions []string
+	var args []any
+	switch filter.Level {
+	case "":
+	case string(Info):
+		conditions = append(conditions, "(level = ? OR level IS NULL)")
+		args = append(args, filter.Level)
+	default:
+		conditions = append(conditions, "level = ?")
+		args = append(args, filter.Level)
+	}
+	if len(filter.Levels) > 0 {
+		condition := "level IN (" + placeholders(len(filter.Levels)) + ")"
+		if slices.Contains(filter.Levels, string(Info)) {
+			condition = "(" + condition + " OR level IS NULL)"
+		}
+		conditions = append(conditions, condition)
+		for _, level := range filter.Levels {
+			args = append(args, level)
+		}
+	}
+	if !filter.Before.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, filter.Before)
+	}
+	if !filter.After.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.After)
+	}
+
+	var correlation []string
+	if filter.RequestId != "" {
+		correlation = append(correlation, "request_id = ?")
+		args = append(args, filter.RequestId)
+	}
+	if len(filter.Orders) > 0 {
+		correlation = append(correlation, "order_number IN ("+placeholders(len(filter.Orders))+")")
+		for _, order := range filter.Orders {
+			args = append(args, order)
+		}
+	}
+	if filter.TransactionId != 0 {
+		correlation = append(correlation, "transaction_id = ?")
+		args = append(args, filter.TransactionId)
+	}
+	if filter.UserId != "" {
+		correlation = append(correlation, "user_id = ?")
+		args = append(args, filter.UserId)
+	}
+	if len(correlation) > 0 {
+		conditions = append(conditions, "("+strings.Join(correlation, " OR ")+")")
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// placeholders returns n comma separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// FindLogMessages returns the latest limit log messages matching the filter,
+// newest first.
+func (s *SQLDatabase) FindLogMessages(ctx context.Context, filter LogFilter, limit int) ([]*services.LogMessage, error) {
+	where, args := sqlLogFilter(filter)
+	rows, err := s.query(ctx, "SELECT data FROM payment_log"+where+" ORDER BY timestamp DESC, id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("find logs: %w", err)
+	}
+	defer rows.Close()
+	var messages []*services.LogMessage
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("find logs: %w", err)
+		}
+		var message services.LogMessage
+		if err = json.Unmarshal([]byte(data), &message); err != nil {
+			return nil, fmt.Errorf("find logs: %w", err)
+		}
+		messages = append(messages, &message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("find logs: %w", err)
+	}
+	return messages, nil
+}
+
+// FindPaymentOrders returns up to limit orders matching any of the query
+// fields, newest first.
+func (s *SQLDatabase) FindPaymentOrders(ctx context.Context, query OrderQuery, limit int) ([]*entity.PaymentOrder, error) {
+	var conditions []string
+	var args []any
+	if len(query.Orders) > 0 {
+		conditions = append(conditions, "order_number IN ("+placeholders(len(query.Orders))+")")
+		for _, order := range query.Orders {
+			args = append(args, order)
+		}
+	}
+	if query.TransactionId != 0 {
+		conditions = append(conditions, "transaction_id = ?")
+		args = append(args, query.TransactionId)
+	}
+	if query.UserId != "" {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, query.UserId)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	rows, err := s.query(ctx, "SELECT "+orderColumns+" FROM payment_orders WHERE "+strings.Join(conditions, " OR ")+
+		" ORDER BY time_opened DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("find payment orders: %w", err)
+	}
+	var orders []*entity.PaymentOrder
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("find payment orders: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("find payment orders: %w", err)
+	}
+	for _, order := range orders {
+		if order.Refunds, err = s.refunds(ctx, order.Order); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+// FindPaymentResults returns the raw gateway results of the orders.
+func (s *SQLDatabase) FindPaymentResults(ctx context.Context, orders []int) ([]ReceivedResult, error) {
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(orders))
+	for i, order := range orders {
+		args[i] = strconv.Itoa(order)
+	}
+	rows, err := s.query(ctx, "SELECT order_number, merchant_code, terminal, amount, currency, date, hour, "+
+		"secure_payment, expiry_date, merchant_identifier, card_country, response, merchant_data, transaction_type, "+
+		"consumer_language, authorisation_code, card_brand, merchant_cof_txnid, processed_pay_method, time_received "+
+		"FROM payment_results WHERE order_number IN ("+placeholders(len(orders))+") ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("find payment results: %w", err)
+	}
+	defer rows.Close()
+	var results []ReceivedResult
+	for rows.Next() {
+		var p entity.PaymentParameters
+		var received sql.NullTime
+		err = rows.Scan(&p.Order, &p.MerchantCode, &p.Terminal, &p.Amount, &p.Currency, &p.Date, &p.Hour,
+			&p.SecurePayment, &p.ExpiryDate, &p.MerchantIdentifier, &p.CardCountry, &p.Response, &p.MerchantData,
+			&p.TransactionType, &p.ConsumerLanguage, &p.AuthorisationCode, &p.CardBrand, &p.MerchantCofTxnid,
+			&p.ProcessedPayMethod, &received)
+		if err != nil {
+			return nil, fmt.Errorf("find payment results: %w", err)
+		}
+		results = append(results, ReceivedResult{Time: received.Time, Parameters: &p})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("find payment results: %w", err)
+	}
+	return results, nil
+}
+
+// DeleteLogs deletes log records by id.
+func (s *SQLDatabase) DeleteLogs(ctx context.Context, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		value, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("delete logs: %w", err)
+		}
+		args[i] = value
+	}
+	result, err := s.exec(ctx, "DELETE FROM payment_log WHERE id IN ("+placeholders(len(ids))+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("delete logs: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlMigrations holds the schema of each dialect as numbered scripts,
+// migrations/<dialect>/<version>_<name>.sql. Applied scripts must not change;
+// schema changes are added as new scripts.
+//
+//go:embed migrations
+var sqlMigrations embed.FS
+
+type sqlMigration struct {
+	version int
+	name    string
+	script  string
+}
+
+// migrate applies the migrations of the dialect that are not recorded in
+// schema_migrations yet, in order of version, each in its own transaction.
+func (s *SQLDatabase) migrate(ctx context.Context) error {
+	_, err := s.exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations "+
+		"(version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := s.query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("read schema_migrations: %w", err)
+	}
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("read schema_migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("read schema_migrations: %w", err)
+	}
+
+	migrations, err := loadSQLMigrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if applied[migration.version] {
+			continue
+		}
+		err = s.WithTransaction(ctx, func(ctx context.Context) error {
+			if _, err := s.exec(ctx, migration.script); err != nil {
+				return err
+			}
+			_, err := s.exec(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.version, migration.name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("apply migration %d_%s: %w", migration.version, migration.name, err)
+		}
+	}
+	return nil
+}
+
+// loadSQLMigrations reads the embedded migrations of a dialect, ordered by version.
+func loadSQLMigrations(dialect string) ([]sqlMigration, error) {
+	dir := "migrations/" + dialect
+	entries, err := fs.ReadDir(sqlMigrations, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	var migrations []sqlMigration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		file := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(file, ".sql") {
+			continue
+		}
+		prefix, name, _ := strings.Cut(strings.TrimSuffix(file, ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: version prefix expected", file)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, file)
+		}
+		seen[version] = file
+		script, err := fs.ReadFile(sqlMigrations, dir+"/"+file)
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", file, err)
+		}
+		migrations = append(migrations, sqlMigration{version: version, name: name, script: string(script)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
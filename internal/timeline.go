@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Sources of timeline events.
+const (
+	EventLog     = "log"     // a log record
+	EventResult  = "result"  // a raw gateway result, as received
+	EventState   = "state"   // a change of the order state
+	EventRequest = "request" // a request sent to the gateway, or a query
+)
+
+const (
+	// maxTimelineLogs limits the log records read for one timeline
+	maxTimelineLogs = 10000
+	// maxTimelineOrders limits the orders of a user read for one timeline
+	maxTimelineOrders = 500
+	// defaultTimelineLimit and maxTimelineLimit bound a timeline page
+	defaultTimelineLimit = 100
+	maxTimelineLimit     = 1000
+)
+
+// TimelineStore is implemented by the databases a timeline is read from.
+type TimelineStore interface {
+	// FindLogMessages returns the latest limit log messages matching the
+	// filter, newest first.
+	FindLogMessages(ctx context.Context, filter LogFilter, limit int) ([]*services.LogMessage, error)
+	// FindPaymentOrders returns up to limit orders matching any of the query
+	// fields, newest first.
+	FindPaymentOrders(ctx context.Context, query OrderQuery, limit int) ([]*entity.PaymentOrder, error)
+	// FindPaymentResults returns the raw gateway results of the orders.
+	FindPaymentResults(ctx context.Context, orders []int) ([]ReceivedResult, error)
+}
+
+// OrderQuery selects the orders with one of the numbers, of the transaction,
+// or of the user.
+type OrderQuery struct {
+	Orders        []int
+	TransactionId int
+	UserId        string
+}
+
+// ReceivedResult is a raw gateway result with the time it was stored.
+type ReceivedResult struct {
+	Time       time.Time
+	Parameters *entity.PaymentParameters
+}
+
+// TimelineQuery selects the events of one request, order, transaction or user.
+// Level is the lowest level of the events returned.
+type TimelineQuery struct {
+	RequestId     string    `json:"request_id,omitempty"`
+	Order         int       `json:"order,omitempty"`
+	TransactionId int       `json:"transaction_id,omitempty"`
+	UserId        string    `json:"user_id,omitempty"`
+	Level         string    `json:"level,omitempty"`
+	From          time.Time `json:"from,omitempty"`
+	To            time.Time `json:"to,omitempty"`
+	Offset        int       `json:"offset"`
+	Limit         int       `json:"limit"`
+}
+
+// TimelineEvent is an event of a timeline, with the record it comes from.
+type TimelineEvent struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Level    string    `json:"level"`
+	Category string    `json:"category,omitempty"`
+	Order    int       `json:"order,omitempty"`
+	Text     string    `json:"text"`
+	Data     any       `json:"data,omitempty"`
+}
+
+// TimelinePage is a page of a timeline. Truncated is set when the timeline
+// had more log records or orders than are read for one timeline; the latest
+// are kept, and the events before the oldest log record read are left out.
+type TimelinePage struct {
+	Query     TimelineQuery   `json:"query"`
+	Total     int             `json:"total"`
+	Truncated bool            `json:"truncated,omitempty"`
+	Events    []TimelineEvent `json:"events"`
+}
+
+// levelRanks orders the event levels.
+var levelRanks = map[string]int{"debug": 0, "info": 1, "warning": 2, "error": 3}
+
+// Timeline merges, for one request ID, order, transaction or user, the log
+// records, the raw gateway results, the order state changes and the gateway
+// requests into one list ordered by time.
+type Timeline struct {
+	store TimelineStore
+}
+
+func NewTimeline(store TimelineStore) *Timeline {
+	return &Timeline{store: store}
+}
+
+// Validate checks that the query selects exactly one key and has valid
+// filters, and sets the default page size.
+func (q *TimelineQuery) Validate() error {
+	keys := 0
+	for _, set := range []bool{q.RequestId != "", q.Order != 0, q.TransactionId != 0, q.UserId != ""} {
+		if set {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return fmt.Errorf("one of request id, order, transaction or user is required")
+	}
+	if _, ok := levelRanks[q.Level]; q.Level != "" && !ok {
+		return fmt.Errorf("unknown level: %s", q.Level)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("offset and limit must not be negative")
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultTimelineLimit
+	}
+	q.Limit = min(q.Limit, maxTimelineLimit)
+	return nil
+}
+
+// Build returns a page of the timeline of the query.
+func (t *Timeline) Build(ctx context.Context, query TimelineQuery) (*TimelinePage, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	page := &TimelinePage{Query: query, Events: []TimelineEvent{}}
+
+	// the orders of the key; for a request, those its log records refer to
+	orderQuery := OrderQuery{TransactionId: query.TransactionId, UserId: query.UserId}
+	if query.Order != 0 {
+		orderQuery.Orders = []int{query.Order}
+	}
+	var orders []*entity.PaymentOrder
+	if query.RequestId == "" {
+		var err error
+		orders, err = t.store.FindPaymentOrders(ctx, orderQuery, maxTimelineOrders)
+		if err != nil {
+			return nil, fmt.Errorf("find orders: %w", err)
+		}
+		page.Truncated = len(orders) == maxTimelineOrders
+	}
+
+	// log records of the key and of its orders
+	logFilter := LogFilter{
+		RequestId:     query.RequestId,
+		TransactionId: query.TransactionId,
+		UserId:        query.UserId,
+		After:         query.From,
+		Levels:        logLevels(query.Level),
+	}
+	if !query.To.IsZero() {
+		logFilter.Before = query.To.Add(time.Nanosecond)
+	}
+	for _, order := range orders {
+		logFilter.Orders = append(logFilter.Orders, order.Order)
+	}
+	if query.Order != 0 && len(orders) == 0 {
+		logFilter.Orders = []int{query.Order}
+	}
+	messages, err := t.store.FindLogMessages(ctx, logFilter, maxTimelineLogs)
+	if err != nil {
+		return nil, fmt.Errorf("find logs: %w", err)
+	}
+	var cutoff time.Time
+	if len(messages) == maxTimelineLogs {
+		page.Truncated = true
+		cutoff = messages[len(messages)-1].Timestamp
+	}
+
+	if query.RequestId != "" {
+		seen := make(map[int]bool)
+		for _, message := range messages {
+			if message.Order != 0 && !seen[message.Order] {
+				seen[message.Order] = true
+				orderQuery.Orders = append(orderQuery.Orders, message.Order)
+			}
+		}
+		if len(orderQuery.Orders) > 0 {
+			if orders, err = t.store.FindPaymentOrders(ctx, orderQuery, maxTimelineOrders); err != nil {
+				return nil, fmt.Errorf("find orders: %w", err)
+			}
+		}
+	}
+
+	numbers := make([]int, 0, len(orders))
+	for _, order := range orders {
+		numbers = append(numbers, order.Order)
+	}
+	var results []ReceivedResult
+	if len(numbers) > 0 {
+		if results, err = t.store.FindPaymentResults(ctx, numbers); err != nil {
+			return nil, fmt.Errorf("find results: %w", err)
+		}
+	}
+
+	events := timelineEvents(messages, orders, results)
+	minRank := levelRanks[query.Level]
+	filtered := events[:0]
+	for _, event := range events {
+		if levelRanks[event.Level] < minRank {
+			continue
+		}
+		if !query.From.IsZero() && event.Time.Before(query.From) || event.Time.Before(cutoff) {
+			continue
+		}
+		if !query.To.IsZero() && event.Time.After(query.To) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool { return filtered[i].Time.Before(filtered[j].Time) })
+
+	page.Total = len(filtered)
+	if query.Offset < len(filtered) {
+		end := min(query.Offset+query.Limit, len(filtered))
+		page.Events = append(page.Events, filtered[query.Offset:end]...)
+	}
+	return page, nil
+}
+
+// logLevels returns the importances of the log records at or above the level,
+// or nil for any level.
+func logLevels(level string) []string {
+	if level == "" {
+		return nil
+	}
+	var levels []string
+	for importance, name := range levelNames {
+		if levelRanks[name] >= levelRanks[level] {
+			levels = append(levels, importance)
+		}
+	}
+	slices.Sort(levels)
+	return levels
+}
+
+// timelineEvents converts the records to events.
+func timelineEvents(messages []*services.LogMessage, orders []*entity.PaymentOrder, results []ReceivedResult) []TimelineEvent {
+	var events []TimelineEvent
+	for _, message := range messages {
+		level := levelNames[message.Level]
+		if level == "" {
+			level = "info"
+		}
+		events = append(events, TimelineEvent{
+			Time:     message.Timestamp,
+			Source:   EventLog,
+			Level:    level,
+			Category: message.Category,
+			Order:    message.Order,
+			Text:     message.Text,
+			Data:     message,
+		})
+	}
+	for _, order := range orders {
+		for _, change := range order.StateHistory {
+			level := "info"
+			if change.To == entity.OrderErrored || change.To == entity.OrderTimedOut {
+				level = "warning"
+			}
+			events = append(events, TimelineEvent{
+				Time:   change.Time,
+				Source: EventState,
+				Level:  level,
+				Order:  order.Order,
+				Text:   fmt.Sprintf("%s -> %s: %s", change.From, change.To, change.Note),
+				Data:   change,
+			})
+		}
+		for _, attempt := range order.Attempts {
+			level := "info"
+			if attempt.Error != "" {
+				level = "warning"
+			}
+			text := fmt.Sprintf("%s attempt %d: %s", attempt.Operation, attempt.Attempt, attempt.Outcome)
+			if attempt.Code != "" {
+				text += " " + attempt.Code
+			}
+			if attempt.Error != "" {
+				text += "; " + attempt.Error
+			}
+			events = append(events, TimelineEvent{
+				Time:   attempt.Time,
+				Source: EventRequest,
+				Level:  level,
+				Order:  order.Order,
+				Text:   text,
+				Data:   attempt,
+			})
+		}
+	}
+	for _, result := range results {
+		order, _ := strconv.Atoi(result.Parameters.Order)
+		events = append(events, TimelineEvent{
+			Time:   result.Time,
+			Source: EventResult,
+			Level:  "info",
+			Order:  order,
+			Text: fmt.Sprintf("type %s; response %s; amount %s",
+				result.Parameters.TransactionType, result.Parameters.Response, result.Parameters.Amount),
+			Data: result.Parameters,
+		})
+	}
+	return events
+}
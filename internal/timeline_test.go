@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"electrum/entity"
+	"electrum/services"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// timelineStart is the time the orders of the test timelines are opened.
+var timelineStart = time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local)
+
+// newTimelineStore returns a memory database with order 1200 of transaction
+// 10 and user-1, its records, and a log record of another order.
+func newTimelineStore(t *testing.T) *MemoryDatabase {
+	t.Helper()
+	ctx := context.Background()
+	store, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(seconds int) time.Time { return timelineStart.Add(time.Duration(seconds) * time.Second) }
+
+	order := &entity.PaymentOrder{Order: 1200, TransactionId: 10, UserId: "user-1", Amount: 500, TimeOpened: at(0)}
+	order.StateHistory = []entity.OrderStateChange{
+		{To: entity.OrderCreated, Note: "transaction 10", Time: at(0)},
+		{From: entity.OrderCreated, To: entity.OrderSent, Time: at(1)},
+		{From: entity.OrderSent, To: entity.OrderErrored, Note: "connection reset", Time: at(5)},
+	}
+	order.Attempts = []entity.GatewayAttempt{
+		{Operation: "authorize", Attempt: 1, Outcome: "failed", Error: "connection reset", Time: at(2)},
+	}
+	if err = store.CreatePaymentOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	result := &entity.PaymentParameters{Order: "1200", Date: "01/10/2026", Hour: "12:03", Response: "0000", Amount: "500"}
+	if err = store.SavePaymentResult(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []*services.LogMessage{
+		{Text: "pay transaction 10", Level: string(Info), TransactionId: 10, RequestId: "req-1", Timestamp: at(0)},
+		{Text: "order 1200", Level: string(Info), Order: 1200, RequestId: "req-1", Timestamp: at(1)},
+		{Text: "authorize order 1200: connection reset", Level: string(Warning), Order: 1200, Timestamp: at(3)},
+		{Text: "card saved", UserId: "user-1", Timestamp: at(4)},
+		{Text: "order 1300", Level: string(Error), Order: 1300, Timestamp: at(4)},
+	}
+	for _, message := range messages {
+		if err = store.WriteLogMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// eventTexts returns the texts of the events.
+func eventTexts(events []TimelineEvent) []string {
+	texts := make([]string, len(events))
+	for i, event := range events {
+		texts[i] = event.Text
+	}
+	return texts
+}
+
+func TestTimelineQueryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query TimelineQuery
+		valid bool
+		limit int
+	}{
+		{"no key", TimelineQuery{}, false, 0},
+		{"two keys", TimelineQuery{Order: 1200, UserId: "user-1"}, false, 0},
+		{"unknown level", TimelineQuery{Order: 1200, Level: "fatal"}, false, 0},
+		{"negative offset", TimelineQuery{Order: 1200, Offset: -1}, false, 0},
+		{"negative limit", TimelineQuery{Order: 1200, Limit: -1}, false, 0},
+		{"default limit", TimelineQuery{RequestId: "req-1"}, true, defaultTimelineLimit},
+		{"limit", TimelineQuery{TransactionId: 10, Level: "warning", Limit: 20}, true, 20},
+		{"limit too large", TimelineQuery{UserId: "user-1", Limit: 5000}, true, maxTimelineLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.query.Validate()
+			if (err == nil) != tt.valid {
+				t.Fatalf("error %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && tt.query.Limit != tt.limit {
+				t.Errorf("limit %d, want %d", tt.query.Limit, tt.limit)
+			}
+		})
+	}
+}
+
+func TestTimelineBuild(t *testing.T) {
+	timeline := NewTimeline(newTimelineStore(t))
+	all := []string{
+		"pay transaction 10",
+		" -> created: transaction 10",
+		"order 1200",
+		"created -> sent: ",
+		"authorize attempt 1: failed; connection reset",
+		"authorize order 1200: connection reset",
+		"card saved",
+		"sent -> errored: connection reset",
+		"type ; response 0000; amount 500",
+	}
+	tests := []struct {
+		name  string
+		query TimelineQuery
+		total int
+		texts []string
+	}{
+		{"order", TimelineQuery{Order: 1200}, 7, []string{
+			" -> created: transaction 10", "order 1200", "created -> sent: ", "authorize attempt 1: failed; connection reset",
+			"authorize order 1200: connection reset", "sent -> errored: connection reset", "type ; response 0000; amount 500",
+		}},
+		{"transaction", TimelineQuery{TransactionId: 10}, 8, slices.Delete(slices.Clone(all), 6, 7)},
+		{"user", TimelineQuery{UserId: "user-1"}, 8, slices.Delete(slices.Clone(all), 0, 1)},
+		{"request", TimelineQuery{RequestId: "req-1"}, 7, slices.Delete(slices.Clone(all), 5, 7)},
+		{"level", TimelineQuery{UserId: "user-1", Level: "warning"}, 3, []string{
+			"authorize attempt 1: failed; connection reset", "authorize order 1200: connection reset", "sent -> errored: connection reset",
+		}},
+		{"time range", TimelineQuery{Order: 1200, From: timelineStart.Add(time.Second), To: timelineStart.Add(3 * time.Second)}, 4, []string{
+			"order 1200", "created -> sent: ", "authorize attempt 1: failed; connection reset", "authorize order 1200: connection reset",
+		}},
+		{"page", TimelineQuery{Order: 1200, Offset: 2, Limit: 2}, 7, []string{
+			"created -> sent: ", "authorize attempt 1: failed; connection reset",
+		}},
+		{"past the end", TimelineQuery{Order: 1200, Offset: 7}, 7, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := timeline.Build(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != tt.total || page.Truncated {
+				t.Errorf("total %d, truncated %v; want %d", page.Total, page.Truncated, tt.total)
+			}
+			if texts := eventTexts(page.Events); !slices.Equal(texts, tt.texts) {
+				t.Errorf("events %q, want %q", texts, tt.texts)
+			}
+		})
+	}
+
+	if _, err := timeline.Build(context.Background(), TimelineQuery{}); err == nil {
+		t.Error("a query without a key was built")
+	}
+}
+
+func TestTimelineTruncated(t *testing.T) {
+	store := newTimelineStore(t)
+	store.logRecords = maxTimelineLogs + 100
+	// more log records of the order than are read for one timeline
+	for i := 0; i < maxTimelineLogs+10; i++ {
+		message := &services.LogMessage{Text: "query " + strconv.Itoa(i), Level: string(Info), Order: 1200,
+			Timestamp: timelineStart.Add(10*time.Second + time.Duration(i)*time.Millisecond)}
+		if err := store.WriteLogMessage(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := NewTimeline(store).Build(context.Background(), TimelineQuery{Order: 1200, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the latest records are kept, and the events before them left out
+	if !page.Truncated || page.Total != maxTimelineLogs+1 {
+		t.Errorf("truncated %v, total %d; want the latest %d logs and the result", page.Truncated, page.Total, maxTimelineLogs)
+	}
+	if texts := eventTexts(page.Events); !slices.Equal(texts, []string{"query 10", "query 11"}) {
+		t.Errorf("first events %q, want the oldest records read", texts)
+	}
+}
+
+func TestFindLogMessagesLevels(t *testing.T) {
+	ctx := context.Background()
+	memory, err := NewMemoryDatabase("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]interface {
+		services.Database
+		TimelineStore
+	}{"memory": memory, "sqlite": newTestSQLite(t)}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, level := range []Importance{Raw, Info, Warning, Error} {
+				message := &services.LogMessage{Text: "level " + string(level), Level: string(level), Order: 1200}
+				if err := store.WriteLogMessage(ctx, message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tests := []struct {
+				level string
+				texts []string
+			}{
+				{"", []string{"level !", "level ?", "level  ", "level -"}},
+				{"debug", []string{"level !", "level ?", "level  ", "level -"}},
+				{"info", []string{"level !", "level ?", "level  "}},
+				{"warning", []string{"level !", "level ?"}},
+				{"error", []string{"level !"}},
+			}
+			for _, tt := range tests {
+				messages, err := store.FindLogMessages(ctx, LogFilter{Orders: []int{1200}, Levels: logLevels(tt.level)}, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				texts := make([]string, len(messages))
+				for i, message := range messages {
+					texts[i] = message.Text
+				}
+				if !slices.Equal(texts, tt.texts) {
+					t.Errorf("level %q: %q, want %q newest first", tt.level, texts, tt.texts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"electrum/services"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporters of finished spans.
+const (
+	TraceExporterOTLP   = "otlp"   // OTLP over HTTP with protobuf encoding
+	TraceExporterStdout = "stdout" // JSON, one span per line
+	TraceExporterFile   = "file"   // as stdout, appended to a file
+)
+
+const (
+	spanLinksKey contextKey = "spanLinks"
+
+	// tracerName is the instrumentation scope of the spans.
+	tracerName = "electrum"
+)
+
+// propagator reads and writes the W3C traceparent header. It is used even
+// while tracing is disabled, so that the records logged for a request carry
+// the trace of the caller.
+var propagator = propagation.TraceContext{}
+
+// StartSpan starts a span as a child of the current span of ctx. Without one,
+// the span starts a trace, linked to the spans of the request the work was
+// detached from, if any. The span records nothing while tracing is disabled.
+func StartSpan(ctx context.Context, name string, kind trace.SpanKind, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{trace.WithSpanKind(kind), trace.WithAttributes(attributes...)}
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if links, ok := ctx.Value(spanLinksKey).([]trace.Link); ok {
+			options = append(options, trace.WithLinks(links...))
+		}
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// spanError marks the span as failed with the error; a nil error is ignored.
+func spanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// linkSpans returns ctx carrying the current span of parent as a link for the
+// spans started from it.
+func linkSpans(ctx, parent context.Context) context.Context {
+	if c := trace.SpanContextFromContext(parent); c.IsValid() {
+		return context.WithValue(ctx, spanLinksKey, []trace.Link{{SpanContext: c}})
+	}
+	return ctx
+}
+
+// linkedSampler decides whether a new trace is exported: as its links are,
+// or by the sample ratio.
+type linkedSampler struct {
+	ratio sdktrace.Sampler
+}
+
+func (s linkedSampler) ShouldSample(parameters sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if len(parameters.Links) == 0 {
+		return s.ratio.ShouldSample(parameters)
+	}
+	result := sdktrace.SamplingResult{
+		Decision:   sdktrace.Drop,
+		Tracestate: trace.SpanContextFromContext(parameters.ParentContext).TraceState(),
+	}
+	for _, link := range parameters.Links {
+		if link.SpanContext.IsSampled() {
+			result.Decision = sdktrace.RecordAndSample
+			break
+		}
+	}
+	return result
+}
+
+func (s linkedSampler) Description() string {
+	return fmt.Sprintf("LinkedSampler{%s}", s.ratio.Description())
+}
+
+// Tracer exports the spans with the OpenTelemetry SDK: they are batched and
+// sent by a background worker, and dropped when the buffer is full.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	closer   io.Closer
+	logger   services.LogHandler
+	once     sync.Once
+	err      error
+}
+
+func NewTracer(conf *config.Config) (*Tracer, error) {
+	tracing := conf.Tracing
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch tracing.Exporter {
+	case TraceExporterOTLP:
+		if tracing.Endpoint == "" {
+			return nil, fmt.Errorf("otlp trace endpoint is not set")
+		}
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(tracing.Endpoint))
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		if tracing.File == "" {
+			return nil, fmt.Errorf("trace file is not set")
+		}
+		file, openErr := os.OpenFile(tracing.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if openErr != nil {
+			return nil, fmt.Errorf("open trace file: %w", openErr)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		closer = file
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", tracing.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s trace exporter: %w", tracing.Exporter, err)
+	}
+	t := newTracer(conf, sdktrace.WithBatcher(exporter))
+	t.closer = closer
+	return t, nil
+}
+
+// newTracer creates a tracer whose spans go to the span processor.
+func newTracer(conf *config.Config, processor sdktrace.TracerProviderOption) *Tracer {
+	service := conf.Tracing.ServiceName
+	if service == "" {
+		service = "electrum"
+	}
+	sampler := linkedSampler{ratio: sdktrace.TraceIDRatioBased(conf.Tracing.SampleRatio)}
+	return &Tracer{
+		provider: sdktrace.NewTracerProvider(
+			processor,
+			sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+			// traces started by callers follow their sampling decision
+			sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		),
+	}
+}
+
+func (t *Tracer) SetLogger(logger services.LogHandler) {
+	t.logger = logger
+}
+
+// Start makes the tracer the one spans are started with; export errors go
+// to the logger.
+func (t *Tracer) Start() {
+	if t.logger != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			t.logger.Error("export spans", err)
+		}))
+	}
+	otel.SetTracerProvider(t.provider)
+}
+
+// Shutdown exports the buffered spans, stops the worker and closes the
+// exporter, waiting until the context is done. Later calls return the
+// result of the first one.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() {
+		err := t.provider.Shutdown(ctx)
+		if t.closer != nil {
+			err = errors.Join(err, t.closer.Close())
+		}
+		if err != nil {
+			t.err = fmt.Errorf("shutdown tracing: %w", err)
+		}
+	})
+	return t.err
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"electrum/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTracer starts a tracer that records the spans in memory.
+func newTestTracer(t *testing.T, ratio float64) *tracetest.SpanRecorder {
+	t.Helper()
+	conf := &config.Config{}
+	conf.Tracing.SampleRatio = ratio
+	recorder := tracetest.NewSpanRecorder()
+	tracer := newTracer(conf, sdktrace.WithSpanProcessor(recorder))
+	tracer.Start()
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return recorder
+}
+
+// remoteContext returns a context continuing the trace of a caller.
+func remoteContext(sampled bool) context.Context {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if sampled {
+		header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	}
+	return propagator.Extract(context.Background(), propagation.HeaderCarrier(header))
+}
+
+func TestTracerSampling(t *testing.T) {
+	// new traces are not sampled by the ratio
+	recorder := newTestTracer(t, 0)
+
+	_, root := StartSpan(context.Background(), "root", trace.SpanKindInternal)
+	root.End()
+
+	ctx, request := StartSpan(remoteContext(true), "request", trace.SpanKindServer)
+	request.End()
+	_, job := StartSpan(detachContext(context.Background(), ctx), "job", trace.SpanKindInternal)
+	job.End()
+
+	unsampled, _ := StartSpan(remoteContext(false), "unsampled request", trace.SpanKindServer)
+	_, unsampledJob := StartSpan(detachContext(context.Background(), unsampled), "unsampled job", trace.SpanKindInternal)
+	unsampledJob.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "request" || spans[1].Name() != "job" {
+		var names []string
+		for _, span := range spans {
+			names = append(names, span.Name())
+		}
+		t.Fatalf("exported %v, want the sampled request and its job", names)
+	}
+	if spans[0].Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("request parent %s, want the caller's span", spans[0].Parent().SpanID())
+	}
+	// the job starts a trace linked to the request
+	jobSpan := spans[1]
+	if jobSpan.Parent().IsValid() || jobSpan.SpanContext().TraceID() == spans[0].SpanContext().TraceID() {
+		t.Error("job continues the trace of the request")
+	}
+	if links := jobSpan.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != spans[0].SpanContext().SpanID() {
+		t.Errorf("job links %v, want the request", links)
+	}
+}
+
+func TestTracerShutdownOnce(t *testing.T) {
+	conf := &config.Config{}
+	conf.Tracing.Exporter = TraceExporterFile
+	conf.Tracing.File = filepath.Join(t.TempDir(), "spans.json")
+	tracer, err := NewTracer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the trace file is closed once
+	for i := 0; i < 2; i++ {
+		if err := tracer.Shutdown(context.Background()); err != nil {
+			t.Fatalf("shutdown %d: %v", i+1, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"electrum/config"
 	"electrum/internal"
 	"electrum/services"
@@ -9,12 +10,17 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+// schemaTimeout bounds the index checks and data migrations at startup
+const schemaTimeout = 5 * time.Minute
+
 func main() {
 	logger := internal.NewLogger("internal", false, nil)
 
 	configPath := flag.String("conf", "config.yml", "path to config file")
+	dryRun := flag.Bool("dry-run", false, "report the mongo indexes and migrations to apply, then exit")
 	flag.Parse()
 
 	logger.Info("using config file: " + *configPath)
@@ -23,50 +29,218 @@ func main() {
 		logger.Error("boot", err)
 		return
 	}
+	if err = internal.SetLogFormat(conf.Log.Format); err != nil {
+		logger.Error("boot", err)
+		return
+	}
 
 	logger.Info(fmt.Sprintf("merchant: %s; terminal: %s; request url: %s", conf.Merchant.Code, conf.Merchant.Terminal, conf.Merchant.RequestUrl))
 
+	// components register their shutdown as they start, and stop in reverse order:
+	// server, payment jobs, log writes, then the database
+	lifecycle := internal.NewLifecycle(conf.ShutdownTimeout)
+	lifecycle.SetLogger(logger)
+	defer lifecycle.Stop()
+
 	var mongo *internal.MongoDB
 	var database services.Database // Use interface type to properly handle nil
-	if conf.Mongo.Enabled {
+	switch conf.Database.Type {
+	case "mongo":
+		if !conf.Mongo.Enabled {
+			break
+		}
 		mongo, err = internal.NewMongoClient(conf)
 		if err != nil {
 			logger.Error("mongo client", err)
 			return
 		}
 		logger.Info("mongo client initialized")
+		if !mongo.SupportsTransactions() {
+			logger.Warn("mongo server is standalone: payment updates use compensation instead of transactions")
+		}
 		database = mongo // Only assign to interface if not nil
+		lifecycle.OnStop("mongo", mongo.Disconnect)
+	case "sqlite", "postgres":
+		sqlDatabase, err := internal.NewSQLDatabase(conf)
+		if err != nil {
+			logger.Error("sql database", err)
+			return
+		}
+		logger.Info(fmt.Sprintf("%s database initialized", conf.Database.Type))
+		database = sqlDatabase
+		lifecycle.OnStop("sql database", sqlDatabase.Close)
+	case "memory":
+		memory, err := internal.NewMemoryDatabase(conf.Database.Snapshot, conf.LogRecords)
+		if err != nil {
+			logger.Error("memory database", err)
+			return
+		}
+		memory.SetLogger(logger)
+		memory.StartSnapshots(conf.Database.SnapshotInterval)
+		logger.Warn("using memory database: data is lost on exit unless a snapshot file is set")
+		database = memory
+		lifecycle.OnStop("memory database", memory.Close)
+	default:
+		logger.Error("boot", fmt.Errorf("unknown database type: %s", conf.Database.Type))
+		return
+	}
 
-		// Ensure MongoDB connection is closed on shutdown
-		defer func() {
-			if err := mongo.Disconnect(); err != nil {
-				logger.Error("mongo disconnect", err)
-			} else {
-				logger.Info("mongo connection closed")
-			}
-		}()
+	if policy := conf.Log.Buffer.Policy; policy != internal.LogPolicyDrop && policy != internal.LogPolicyBlock {
+		logger.Error("boot", fmt.Errorf("unknown log buffer policy: %s", policy))
+		return
 	}
+	logs := internal.NewLogPipeline(conf, database)
+	logs.Start()
+	lifecycle.OnStop("logger", logs.Flush)
 
-	// Setup signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		logger.Info(fmt.Sprintf("received signal %s, shutting down gracefully", sig))
-		os.Exit(0)
-	}()
+	// the retention creates the capped log collection, so it starts before the
+	// mongo indexes are created
+	var retention *internal.LogRetention
+	if conf.Log.Retention.Enabled && !*dryRun {
+		if store, ok := database.(internal.LogStore); ok {
+			retention = internal.NewLogRetention(conf, store)
+			retention.SetLogger(internal.NewLogger("retention", conf.IsDebug, logs))
+			retention.Start(context.Background())
+			lifecycle.OnStop("log retention", retention.Stop)
+		} else {
+			logger.Warn(fmt.Sprintf("log retention is not supported by the %s database", conf.Database.Type))
+		}
+	}
+
+	if mongo != nil && (conf.Mongo.ManageSchema || *dryRun) {
+		if err = prepareSchema(mongo, conf, *dryRun, logger); err != nil {
+			logger.Error("mongo schema", err)
+			return
+		}
+	}
+	if *dryRun {
+		logger.Info("dry run finished")
+		return
+	}
+
+	if conf.Tracing.Enabled {
+		tracer, err := internal.NewTracer(conf)
+		if err != nil {
+			logger.Error("tracing", err)
+			return
+		}
+		tracer.SetLogger(internal.NewLogger("tracing", conf.IsDebug, logs))
+		tracer.Start()
+		lifecycle.OnStop("tracing", tracer.Shutdown)
+		logger.Info(fmt.Sprintf("tracing enabled, exporter %s", conf.Tracing.Exporter))
+	}
+
+	var gateway services.Gateway
+	switch conf.Gateway.Type {
+	case "memory":
+		gateway = internal.NewMemoryGateway()
+	case "redsys":
+		redsys := internal.NewRedsys(conf)
+		redsys.SetLogger(internal.NewLogger("redsys", conf.IsDebug, logs))
+		gateway = redsys
+	default:
+		logger.Error("boot", fmt.Errorf("unknown gateway type: %s", conf.Gateway.Type))
+		return
+	}
+	logger.Info("payment gateway: " + gateway.Name())
+
+	guarded := internal.NewGuardedGateway(gateway, conf)
+	guarded.SetLogger(internal.NewLogger("gateway", conf.IsDebug, logs))
 
 	payments := internal.NewPayments(conf)
-	payments.SetLogger(internal.NewLogger("payments", conf.IsDebug, database))
+	payments.SetLogger(internal.NewLogger("payments", conf.IsDebug, logs))
 	payments.SetDatabase(database)
+	payments.SetGateway(guarded)
+	lifecycle.OnStop("payments", payments.Drain)
+
+	switch conf.Lock.Type {
+	case "memory":
+	case "mongo":
+		if mongo == nil {
+			logger.Error("boot", fmt.Errorf("mongo lock requires mongo to be enabled"))
+			return
+		}
+		locker, err := internal.NewMongoLocker(mongo, conf.Lock.Owner, conf.Lock.TTL)
+		if err != nil {
+			logger.Error("mongo locker", err)
+			return
+		}
+		locker.SetLogger(internal.NewLogger("locker", conf.IsDebug, logs))
+		payments.SetLocker(locker)
+		logger.Info("using shared mongo locks")
+	default:
+		logger.Error("boot", fmt.Errorf("unknown lock type: %s", conf.Lock.Type))
+		return
+	}
 
 	server := internal.NewServer(conf)
-	server.SetLogger(internal.NewLogger("server", conf.IsDebug, database))
+	server.SetLogger(internal.NewLogger("server", conf.IsDebug, logs))
 	server.SetPaymentsService(payments)
-
-	err = server.Start()
+	clients, err := internal.ParseClients(conf.Sync.Clients)
 	if err != nil {
-		logger.Error("server start", err)
+		logger.Error("boot", err)
 		return
 	}
+	server.SetSyncClients(clients)
+	if conf.Metrics.Enabled {
+		metrics := internal.NewMetrics(conf)
+		metrics.SetLogger(internal.NewLogger("metrics", conf.IsDebug, logs))
+		metrics.SetPayments(payments)
+		metrics.SetGateway(guarded)
+		metrics.SetLogPipeline(logs)
+		if store, ok := database.(internal.OpenOrderStore); ok {
+			metrics.SetOrderStore(store)
+		}
+		payments.SetMetrics(metrics)
+		guarded.SetMetrics(metrics)
+		if mongo != nil {
+			mongo.SetMetrics(metrics)
+		}
+		server.SetMetrics(metrics)
+	}
+	if store, ok := database.(internal.TimelineStore); ok {
+		server.SetTimeline(internal.NewTimeline(store))
+	}
+
+	health := internal.NewHealth(conf)
+	if pinger, ok := database.(internal.Pinger); ok {
+		health.SetDatabase(pinger)
+	}
+	health.SetGateway(guarded)
+	health.SetLogPipeline(logs)
+	health.SetPayments(payments)
+	if retention != nil {
+		health.SetRetention(retention)
+	}
+	server.SetHealth(health)
+
+	// Setup signal handling for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+	lifecycle.OnStop("server", server.Shutdown)
+
+	select {
+	case sig := <-sigChan:
+		logger.Info(fmt.Sprintf("received signal %s, shutting down gracefully", sig))
+	case err = <-serverErr:
+		logger.Error("server start", err)
+	}
+}
+
+// prepareSchema ensures the mongo indexes and migrations; the migrations are
+// claimed under the lock owner name, or the host name and process id.
+func prepareSchema(mongo *internal.MongoDB, conf *config.Config, dryRun bool, logger services.LogHandler) error {
+	owner := conf.Lock.Owner
+	if owner == "" {
+		host, _ := os.Hostname()
+		owner = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), schemaTimeout)
+	defer cancel()
+	return mongo.PrepareSchema(ctx, owner, dryRun, logger)
 }
@@ -3,31 +3,85 @@ package services
 import (
 	"context"
 	"electrum/entity"
+	"errors"
+	"fmt"
 )
 
 // Database provides database operations for the payment service.
 // All methods accept context.Context as the first parameter for proper
 // timeout, cancellation, and request tracing support.
 type Database interface {
+	// WithTransaction runs fn as a unit of work: the writes fn makes through the
+	// context it receives are applied together or not at all. fn must not
+	// start asynchronous work that uses that context.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+
+	// Fence records token as the fencing token of key, unless a greater one is
+	// recorded: then another holder has taken the key over since, and Fence
+	// returns a *FencedError. Inside WithTransaction the record is part of the
+	// unit of work, so a stale holder cannot commit writes to the entities of
+	// key once a newer holder has committed a unit of work on them.
+	Fence(ctx context.Context, key LockKey, token int64) error
+
 	WriteLogMessage(ctx context.Context, data Data) error
+	// WriteLogMessages writes a batch of log messages in one round trip.
+	WriteLogMessages(ctx context.Context, data []Data) error
 
 	GetUserTag(ctx context.Context, idTag string) (*entity.UserTag, error)
 
 	GetTransaction(ctx context.Context, id int) (*entity.Transaction, error)
+	// UpdateTransaction stores the payment fields of a transaction if it is still
+	// at transaction.Version, and increments the version. Otherwise it returns a
+	// *ConflictError and leaves the version unchanged.
 	UpdateTransaction(ctx context.Context, transaction *entity.Transaction) error
 
 	GetPaymentMethod(ctx context.Context, userId string) (*entity.PaymentMethod, error)
 	SavePaymentMethod(ctx context.Context, paymentMethod *entity.PaymentMethod) error
 	GetPaymentMethodByIdentifier(ctx context.Context, identifier string) (*entity.PaymentMethod, error)
+	// UpdatePaymentMethodFailCount sets the fail count of the payment method
+	// GetPaymentMethodByIdentifier returns for the identifier.
 	UpdatePaymentMethodFailCount(ctx context.Context, identifier string, count int) error
 
 	GetPaymentOrderByTransaction(ctx context.Context, transactionId int) (*entity.PaymentOrder, error)
+	// CreatePaymentOrder inserts a new order at version 1. If an order with the
+	// same number exists, it returns a *ConflictError and leaves the version
+	// unchanged; an existing order is never overwritten.
+	CreatePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error
+	// SavePaymentOrder updates an order still at order.Version, and increments
+	// the version. Otherwise, also when the order does not exist, it returns a
+	// *ConflictError and leaves the version unchanged.
 	SavePaymentOrder(ctx context.Context, order *entity.PaymentOrder) error
 	GetPaymentOrder(ctx context.Context, id int) (*entity.PaymentOrder, error)
+	// GetLastOrder returns the most recently opened order; its error matches
+	// ErrNotFound when there is no order yet.
 	GetLastOrder(ctx context.Context) (*entity.PaymentOrder, error)
 	SavePaymentResult(ctx context.Context, paymentParameters *entity.PaymentParameters) error
 }
 
+// ErrNotFound is matched by errors of lookups of a single record, such as a
+// transaction, payment order, payment method or user tag, that does not exist.
+var ErrNotFound = errors.New("no record found")
+
+// ErrConflict is matched by errors of updates rejected because the stored
+// document changed since it was read.
+var ErrConflict = errors.New("version conflict")
+
+// ConflictError reports an update made with an outdated version. The caller
+// should reload the entity and apply its change again.
+type ConflictError struct {
+	Entity  string
+	Id      int
+	Version int64 // version the update expected
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %d changed since version %d", e.Entity, e.Id, e.Version)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
 type Data interface {
 	DataType() string
 }
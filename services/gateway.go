@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"electrum/entity"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GatewayOperation identifies the kind of operation sent to a payment gateway.
+type GatewayOperation string
+
+const (
+	OperationAuthorize GatewayOperation = "authorize"
+	OperationCapture   GatewayOperation = "capture"
+	OperationRefund    GatewayOperation = "refund"
+	OperationVoid      GatewayOperation = "void"
+	OperationQuery     GatewayOperation = "query"
+)
+
+// ErrGatewayNoRecord is returned by Gateway.Query when the gateway has no
+// record of the requested order.
+var ErrGatewayNoRecord = errors.New("gateway has no record of the order")
+
+// ErrGatewayQueryUnsupported is returned by Gateway.Query when the gateway is
+// not configured to answer status queries.
+var ErrGatewayQueryUnsupported = errors.New("gateway does not support status queries")
+
+// ErrGatewayDuplicateOrder is matched by a GatewayError rejecting a request
+// because the gateway already has an order with the same number.
+var ErrGatewayDuplicateOrder = errors.New("gateway already has the order")
+
+// ErrGatewayUnavailable is matched by errors of requests that were not sent
+// because the gateway is considered down, see UnavailableError.
+var ErrGatewayUnavailable = errors.New("gateway unavailable")
+
+// Gateway is a payment acquirer. Implementations translate gateway-neutral
+// requests to their wire protocol and report results as GatewayResult, so that
+// the order and transaction logic in Payments does not depend on the acquirer.
+//
+// Operations return a *GatewayError when the gateway rejected the request
+// without processing it, and a plain error on transport or protocol failures.
+// A declined card is not an error: it is a result with Approved set to false.
+type Gateway interface {
+	Name() string
+	// Validate reports whether the gateway is configured to accept requests.
+	Validate() error
+
+	// Authorize charges a stored payment method; with Hold set, the funds are
+	// only reserved until Capture or Void.
+	Authorize(ctx context.Context, request *GatewayRequest) (*GatewayResult, error)
+	Capture(ctx context.Context, request *GatewayRequest) (*GatewayResult, error)
+	Refund(ctx context.Context, request *GatewayRequest) (*GatewayResult, error)
+	Void(ctx context.Context, request *GatewayRequest) (*GatewayResult, error)
+	// Query returns the last known result for an order, or ErrGatewayNoRecord.
+	Query(ctx context.Context, request *GatewayRequest) (*GatewayResult, error)
+
+	// VerifyNotification checks the authenticity of an asynchronous
+	// notification body and decodes it.
+	VerifyNotification(ctx context.Context, data []byte) (*GatewayResult, error)
+}
+
+// GatewayRequest describes an operation on an order. Amounts are in cents.
+type GatewayRequest struct {
+	Order        int
+	Amount       int
+	Currency     string // ISO 4217 numeric code, "978" for EUR
+	Identifier   string // stored payment method token
+	CofTid       string // network transaction id of the initial authorization
+	Description  string
+	Hold         bool   // reserve funds instead of charging
+	MerchantData string // opaque data echoed back by the gateway
+}
+
+// GatewayResult is the outcome of a gateway operation or notification.
+type GatewayResult struct {
+	Operation         GatewayOperation
+	Order             int
+	Amount            int
+	Currency          string
+	Approved          bool
+	Held              bool   // funds are reserved, not charged
+	Code              string // gateway response code
+	AuthorisationCode string
+	Identifier        string
+	CofTid            string
+	CardBrand         string
+	CardCountry       string
+	ExpiryDate        string
+	Date              string
+	MerchantData      string
+	Notification      bool // the result came in a gateway notification
+	// Raw is the record stored for audit in the payment results collection.
+	Raw *entity.PaymentParameters
+}
+
+// GatewayError is a request rejected by the gateway before processing,
+// such as a Redsys SIS error code.
+type GatewayError struct {
+	Gateway string
+	Code    string
+	// Duplicate is set when the code means that the order number is already
+	// used on the gateway; the error then matches ErrGatewayDuplicateOrder.
+	Duplicate bool
+}
+
+func (e *GatewayError) Error() string {
+	return fmt.Sprintf("%s rejected request: %s", e.Gateway, e.Code)
+}
+
+func (e *GatewayError) Is(target error) bool {
+	return e.Duplicate && target == ErrGatewayDuplicateOrder
+}
+
+// UnavailableError is a request refused locally, without reaching the gateway,
+// e.g. by an open circuit breaker. It says nothing about the card; the request
+// may be sent again after RetryAfter.
+type UnavailableError struct {
+	Gateway    string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s unavailable, retry after %v", e.Gateway, e.RetryAfter)
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrGatewayUnavailable
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrLeaseLost is returned when a lease expired or was taken over by another owner.
+var ErrLeaseLost = errors.New("lease lost")
+
+// LockNamespace separates key spaces, so that equal ids of different
+// entities do not block each other.
+type LockNamespace string
+
+const (
+	LockTransaction LockNamespace = "transaction"
+	LockOrder       LockNamespace = "order"
+)
+
+// LockKey identifies a lock by namespace and entity id.
+type LockKey struct {
+	Namespace LockNamespace
+	Id        string
+}
+
+func (k LockKey) String() string {
+	return fmt.Sprintf("%s:%s", k.Namespace, k.Id)
+}
+
+// Locker grants exclusive leases on keys. Implementations may be local to the
+// process or shared between electrum instances through the database.
+type Locker interface {
+	// Acquire blocks until the key is free or the context is done.
+	Acquire(ctx context.Context, key LockKey) (Lease, error)
+}
+
+// Lease is an exclusive hold of a key.
+type Lease interface {
+	Key() LockKey
+	// Token is a fencing token: it increases with every grant, so a write
+	// carrying an older token can be recognized as coming from a stale holder.
+	// Payments records it with Database.Fence in each unit of work under a
+	// lease that can be lost.
+	Token() int64
+	// Renew extends the lease; it returns ErrLeaseLost if the lease is no longer held.
+	Renew(ctx context.Context) error
+	Release(ctx context.Context) error
+	// Lost is closed when the lease is lost while held, e.g. when it could not
+	// be renewed before it expired; the holder must stop writing then. It is nil
+	// for leases that cannot be lost.
+	Lost() <-chan struct{}
+}
+
+// FencedError reports a unit of work under a lease whose key has since been
+// granted to another holder with a greater token. It matches ErrLeaseLost.
+type FencedError struct {
+	Key   LockKey
+	Token int64 // token of the stale holder
+}
+
+func (e *FencedError) Error() string {
+	return fmt.Sprintf("lock %s: token %d fenced by a newer holder", e.Key, e.Token)
+}
+
+func (e *FencedError) Is(target error) bool {
+	return target == ErrLeaseLost
+}
@@ -1,6 +1,9 @@
 package services
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 const LogMessageType = "logMessage"
 const FeatureMessageType = "featureMessage"
@@ -10,14 +13,27 @@ type LogHandler interface {
 	Info(text string)
 	Warn(text string)
 	Error(event string, err error)
+	// The context variants add the fields carried by the context, such as the
+	// request ID, order, transaction and user, and the given key/value pairs.
+	DebugContext(ctx context.Context, text string, fields ...any)
+	InfoContext(ctx context.Context, text string, fields ...any)
+	WarnContext(ctx context.Context, text string, fields ...any)
+	ErrorContext(ctx context.Context, event string, err error, fields ...any)
 }
 
 type LogMessage struct {
-	Time      string    `json:"time" bson:"time"`
-	Level     string    `json:"level" bson:"level"`
-	Category  string    `json:"category" bson:"category"`
-	Text      string    `json:"text" bson:"text"`
-	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+	Time          string         `json:"time" bson:"time"`
+	Level         string         `json:"level" bson:"level"`
+	Category      string         `json:"category" bson:"category"`
+	Text          string         `json:"text" bson:"text"`
+	Timestamp     time.Time      `json:"timestamp" bson:"timestamp"`
+	RequestId     string         `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Order         int            `json:"order,omitempty" bson:"order,omitempty"`
+	TransactionId int            `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"`
+	UserId        string         `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Fields        map[string]any `json:"fields,omitempty" bson:"fields,omitempty"`
+	TraceId       string         `json:"trace_id,omitempty" bson:"trace_id,omitempty"`
+	SpanId        string         `json:"span_id,omitempty" bson:"span_id,omitempty"`
 }
 
 func (lm *LogMessage) MessageType() string {
@@ -1,12 +1,50 @@
 package services
 
-import "context"
+import (
+	"context"
+	"electrum/entity"
+	"time"
+)
 
 // Payments provides payment processing operations.
 // All methods accept context.Context for proper timeout and cancellation support.
 type Payments interface {
 	Notify(ctx context.Context, data []byte) error
 	PayTransaction(ctx context.Context, transactionId int) error
-	ReturnPayment(ctx context.Context, transactionId int) error
-	ReturnByOrder(ctx context.Context, orderId string, amount int) error
+	// PayTransactionWait pays a transaction and waits up to the given time for
+	// the gateway outcome; the status is pending if it did not come in time,
+	// and nil if no order was opened.
+	PayTransactionWait(ctx context.Context, transactionId int, wait time.Duration) (*entity.PaymentStatus, error)
+	OrderStatus(ctx context.Context, orderId int) (*entity.PaymentStatus, error)
+	ReturnPayment(ctx context.Context, transactionId int, amount int) error
+	ReturnByOrder(ctx context.Context, orderId string, refund *entity.RefundRequest) error
+}
+
+// ErrorCode identifies why a payment operation was refused, for API callers.
+type ErrorCode string
+
+const (
+	ErrorInvalidRequest         ErrorCode = "invalid_request"
+	ErrorTransactionNotFound    ErrorCode = "transaction_not_found"
+	ErrorTransactionNotFinished ErrorCode = "transaction_not_finished"
+	ErrorNoUser                 ErrorCode = "no_user"
+	ErrorNoPaymentMethod        ErrorCode = "no_payment_method"
+	ErrorAmountZero             ErrorCode = "amount_zero"
+	ErrorInvalidAmount          ErrorCode = "invalid_amount"
+	ErrorOrderNotFound          ErrorCode = "order_not_found"
+	ErrorMerchantNotConfigured  ErrorCode = "merchant_not_configured"
+	ErrorInvalidNotification    ErrorCode = "invalid_notification"
+	ErrorShuttingDown           ErrorCode = "shutting_down"
+	ErrorBusy                   ErrorCode = "busy"
+)
+
+// PaymentError is a payment operation refused for a reason the caller can act
+// on. Other errors of Payments are failures of electrum or its dependencies.
+type PaymentError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *PaymentError) Error() string {
+	return e.Message
 }